@@ -22,6 +22,7 @@ import (
 type daemonConfiguration struct {
 	Reporting reporter.Configuration
 	Gateways  gateways.Configuration
+	Install   gateways.InstallConfiguration
 	Netlink   netlink.Configuration
 }
 
@@ -34,6 +35,7 @@ func (configuration *daemonConfiguration) UnmarshalYAML(unmarshal func(interface
 	var raw rawDaemonConfiguration
 	err := yaml.Unmarshal([]byte(`
 reporting: {}
+install: {}
 netlink: {}
 `), &raw)
 	if err != nil {
@@ -45,6 +47,7 @@ netlink: {}
 	if len(raw.Gateways) == 0 {
 		return errors.New("at least one gateway is needed")
 	}
+	raw.Gateways.SetDefaultInstall(raw.Install)
 	*configuration = daemonConfiguration(raw)
 	return nil
 }
@@ -61,6 +64,15 @@ A configuration file must be provided.`,
 			Name:  "check",
 			Usage: "check configuration syntax and exit",
 		},
+		cli.StringFlag{
+			Name:  "replay",
+			Usage: "replay netlink notifications from `FILE` instead of using the kernel",
+		},
+		cli.Float64Flag{
+			Name:  "replay-speed",
+			Usage: "speed factor for replay (0 for no delay)",
+			Value: 1,
+		},
 	},
 	Action: func(c *cli.Context) error {
 		if c.NArg() != 1 {
@@ -106,7 +118,14 @@ A configuration file must be provided.`,
 		}
 
 		// netlink
-		netlinkComponent, err := netlink.New(r, config.Netlink)
+		var netlinkComponent netlink.Component
+		if replay := c.String("replay"); replay != "" {
+			netlinkComponent, err = netlink.NewReplay(r, replay, c.Float64("replay-speed"))
+		} else {
+			netlinkComponent, err = netlink.New(r, config.Netlink, netlink.Dependencies{
+				Daemon: daemonComponent,
+			})
+		}
 		if err != nil {
 			return errors.Wrap(err, "unable to initialize netlink component")
 		}
@@ -114,6 +133,7 @@ A configuration file must be provided.`,
 		// gateways
 		gatewayComponent, err := gateways.New(r, config.Gateways, gateways.Dependencies{
 			Netlink: netlinkComponent,
+			Daemon:  daemonComponent,
 		})
 		if err != nil {
 			return errors.Wrap(err, "unable to initialize gateway component")
@@ -154,11 +174,20 @@ A configuration file must be provided.`,
 			"version", Version,
 			"build-date", BuildDate)
 
-		select {
-		case <-daemonComponent.Terminated():
-			r.Info("stopping all components...")
+	L:
+		for {
+			select {
+			case <-daemonComponent.Watchdog():
+				daemonComponent.TickWatchdog()
+			case <-daemonComponent.Terminated():
+				r.Info("stopping all components...")
+				break L
+			}
 		}
 
+		if err := daemonComponent.Failure(); err != nil {
+			return FatalError{errors.Wrap(err, "daemon terminated")}
+		}
 		return nil
 	},
 }
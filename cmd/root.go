@@ -16,6 +16,17 @@ func (e UsageError) Error() string {
 	return string(e)
 }
 
+// FatalErrorStatus is the exit status when the daemon terminates
+// because of a persistent failure (EX_TEMPFAIL).
+const FatalErrorStatus = 75
+
+// FatalError is the kind of error that should be returned if the
+// daemon terminated because of a persistent failure. The process
+// should exit with FatalErrorStatus to be restarted.
+type FatalError struct {
+	error
+}
+
 // wrapUsageError will transform any command to return a "UsageError"
 // in case of usage error.
 func wrapUsageError(c cli.Command) cli.Command {
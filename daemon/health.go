@@ -0,0 +1,35 @@
+package daemon
+
+import (
+	"sync"
+)
+
+// healthComponent is the health part of a component. The daemon is
+// healthy until a component reports otherwise.
+type healthComponent struct {
+	healthLock sync.Mutex
+	unhealthy  error
+}
+
+// MarkUnhealthy should be called when the daemon is unable to work
+// correctly because of the provided error.
+func (c *healthComponent) MarkUnhealthy(err error) {
+	c.healthLock.Lock()
+	defer c.healthLock.Unlock()
+	c.unhealthy = err
+}
+
+// MarkHealthy should be called when the daemon works correctly again.
+func (c *healthComponent) MarkHealthy() {
+	c.healthLock.Lock()
+	defer c.healthLock.Unlock()
+	c.unhealthy = nil
+}
+
+// Health returns the error that made the daemon unhealthy or nil if
+// the daemon is healthy.
+func (c *healthComponent) Health() error {
+	c.healthLock.Lock()
+	defer c.healthLock.Unlock()
+	return c.unhealthy
+}
@@ -8,6 +8,7 @@ import (
 type lifecycleComponent struct {
 	terminateChannel chan struct{}
 	terminateOnce    sync.Once
+	failure          error
 }
 
 // Terminated will return a channel that will be closed when the daemon
@@ -20,3 +21,23 @@ func (c *lifecycleComponent) Terminated() <-chan struct{} {
 func (c *lifecycleComponent) Terminate() {
 	c.terminateOnce.Do(func() { close(c.terminateChannel) })
 }
+
+// Fail should be called to request termination of a daemon because
+// of the provided error. Only the first call has an effect.
+func (c *lifecycleComponent) Fail(err error) {
+	c.terminateOnce.Do(func() {
+		c.failure = err
+		close(c.terminateChannel)
+	})
+}
+
+// Failure returns the error provided to Fail once the daemon has been
+// terminated because of it. Otherwise, it returns nil.
+func (c *lifecycleComponent) Failure() error {
+	select {
+	case <-c.terminateChannel:
+		return c.failure
+	default:
+		return nil
+	}
+}
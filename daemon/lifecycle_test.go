@@ -3,6 +3,8 @@ package daemon
 import (
 	"testing"
 
+	"github.com/pkg/errors"
+
 	"lrg/reporter"
 )
 
@@ -61,3 +63,60 @@ func TestStop(t *testing.T) {
 		t.Fatalf("Terminated() wasn't closed while we requested it to be")
 	}
 }
+
+func TestFail(t *testing.T) {
+	r := reporter.NewMock()
+	c, err := New(r)
+	if err != nil {
+		t.Fatalf("New() error:\n%+v", err)
+	}
+	c.Start()
+	defer c.Stop()
+
+	if err := c.Failure(); err != nil {
+		t.Fatalf("Failure() == %v, expected nil", err)
+	}
+	failure := errors.New("persistent failure")
+	c.Fail(failure)
+	select {
+	case <-c.Terminated():
+	default:
+		t.Fatalf("Terminated() wasn't closed after Fail()")
+	}
+	c.Fail(errors.New("another failure"))
+	if err := c.Failure(); err != failure {
+		t.Fatalf("Failure() == %v, expected %v", err, failure)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	r := reporter.NewMock()
+	c, err := New(r)
+	if err != nil {
+		t.Fatalf("New() error:\n%+v", err)
+	}
+	c.Start()
+	defer c.Stop()
+
+	if err := c.Health(); err != nil {
+		t.Fatalf("Health() == %v, expected nil", err)
+	}
+	if gauge := r.Gauge("healthy").Snapshot().Value(); gauge != 1 {
+		t.Fatalf("healthy == %d, expected 1", gauge)
+	}
+	failure := errors.New("persistent failure")
+	c.MarkUnhealthy(failure)
+	if err := c.Health(); err != failure {
+		t.Fatalf("Health() == %v, expected %v", err, failure)
+	}
+	if gauge := r.Gauge("healthy").Snapshot().Value(); gauge != 0 {
+		t.Fatalf("healthy == %d, expected 0", gauge)
+	}
+	c.MarkHealthy()
+	if err := c.Health(); err != nil {
+		t.Fatalf("Health() == %v, expected nil", err)
+	}
+	if gauge := r.Gauge("healthy").Snapshot().Value(); gauge != 1 {
+		t.Fatalf("healthy == %d, expected 1", gauge)
+	}
+}
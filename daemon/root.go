@@ -20,6 +20,13 @@ type Component interface {
 	// Lifecycle
 	Terminated() <-chan struct{}
 	Terminate()
+	Fail(error)
+	Failure() error
+
+	// Health
+	MarkUnhealthy(error)
+	MarkHealthy()
+	Health() error
 
 	// Watchdog
 	Ready()
@@ -33,6 +40,7 @@ type realComponent struct {
 	r *reporter.Reporter
 
 	lifecycleComponent
+	healthComponent
 
 	watchdogTicker *time.Ticker
 	watchdogLock   sync.Mutex
@@ -70,6 +78,11 @@ func (c *realComponent) Start() error {
 		}
 	}()
 
+	// Health
+	if c.Health() == nil {
+		c.r.Gauge("healthy").Update(1)
+	}
+
 	// Watchdog
 	c.initializeWatchdog()
 	return nil
@@ -10,6 +10,7 @@ import (
 // need to be started to work.
 type MockComponent struct {
 	lifecycleComponent
+	healthComponent
 }
 
 // NewMock will create a daemon component that does nothing.
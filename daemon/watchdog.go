@@ -1,6 +1,7 @@
 package daemon
 
 import (
+	"fmt"
 	"os"
 	"syscall"
 	"time"
@@ -47,11 +48,39 @@ func (c *realComponent) stopWatchdog() {
 	}
 }
 
-// TickWatchdog will make the watchdog tick.
+// TickWatchdog will make the watchdog tick. While the daemon is
+// unhealthy, the watchdog is not ticked and systemd will restart the
+// daemon.
 func (c *realComponent) TickWatchdog() {
+	if c.Health() != nil {
+		return
+	}
 	systemdDaemon.SdNotify(false, "WATCHDOG=1")
 }
 
+// MarkUnhealthy should be called when the daemon is unable to work
+// correctly because of the provided error. The watchdog is not ticked
+// anymore.
+func (c *realComponent) MarkUnhealthy(err error) {
+	if c.Health() == nil {
+		c.r.Error(err, "daemon is unhealthy")
+	}
+	c.healthComponent.MarkUnhealthy(err)
+	c.r.Gauge("healthy").Update(0)
+	systemdDaemon.SdNotify(false, fmt.Sprintf("STATUS=unhealthy: %s", err))
+}
+
+// MarkHealthy should be called when the daemon works correctly
+// again.
+func (c *realComponent) MarkHealthy() {
+	if c.Health() != nil {
+		c.r.Info("daemon is healthy again")
+		systemdDaemon.SdNotify(false, "STATUS=healthy")
+	}
+	c.healthComponent.MarkHealthy()
+	c.r.Gauge("healthy").Update(1)
+}
+
 // Watchdog provides a channel for which the watchdog should be ticked
 // each time we get a value.
 func (c *realComponent) Watchdog() <-chan time.Time {
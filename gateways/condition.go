@@ -0,0 +1,93 @@
+package gateways
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/pkg/errors"
+	knetlink "github.com/vishvananda/netlink"
+)
+
+// watchCondition periodically evaluates the condition of the provided
+// gateway and sends the result to the gateway loop. It should be run
+// in a goroutine.
+func (c *Component) watchCondition(gateway gateway) error {
+	when := gateway.config.When
+	ticker := time.NewTicker(time.Duration(when.Interval))
+	defer ticker.Stop()
+	for {
+		met, err := checkCondition(when)
+		if err != nil {
+			c.r.Warn("unable to evaluate gateway condition",
+				"condition", when,
+				"err", err,
+				"gateway", gateway)
+			c.r.Counter(fmt.Sprintf("gw%d.condition.errors", gateway.index)).Inc(1)
+		}
+		select {
+		case <-c.t.Dying():
+			return nil
+		case gateway.state.condition <- met:
+		}
+		select {
+		case <-c.t.Dying():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// linkUp tells if a link is up. Virtual interfaces without carrier
+// report an unknown operational state.
+func linkUp(attrs *knetlink.LinkAttrs) bool {
+	return attrs.Flags&net.FlagUp != 0 &&
+		(attrs.OperState == knetlink.OperUp ||
+			attrs.OperState == knetlink.OperUnknown)
+}
+
+// checkCondition tells if the provided condition is met. When the
+// condition cannot be evaluated, it is not met and an error is
+// returned. A missing file or interface, or a command exiting with a
+// non-zero status, is not an error. A command should complete before
+// the next evaluation.
+func checkCondition(when *LRGWhenConfiguration) (bool, error) {
+	switch {
+	case when.File != "":
+		_, err := os.Stat(when.File)
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, errors.Wrapf(err, "cannot check file %s", when.File)
+		}
+		return true, nil
+	case when.Interface != "":
+		link, err := knetlink.LinkByName(when.Interface)
+		if _, ok := err.(knetlink.LinkNotFoundError); ok {
+			return false, nil
+		}
+		if err != nil {
+			return false, errors.Wrapf(err, "cannot check interface %s", when.Interface)
+		}
+		return linkUp(link.Attrs()), nil
+	default:
+		ctx, cancel := context.WithTimeout(context.Background(),
+			time.Duration(when.Interval))
+		defer cancel()
+		err := exec.CommandContext(ctx, "/bin/sh", "-c", when.Command).Run()
+		if ctx.Err() != nil {
+			return false, errors.Errorf("command %q timed out", when.Command)
+		}
+		if _, ok := err.(*exec.ExitError); ok {
+			return false, nil
+		}
+		if err != nil {
+			return false, errors.Wrapf(err, "cannot run command %q", when.Command)
+		}
+		return true, nil
+	}
+}
@@ -0,0 +1,68 @@
+package gateways
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"lrg/config"
+)
+
+func TestCheckCondition(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lrg-")
+	if err != nil {
+		t.Fatalf("TempDir() error:\n%+v", err)
+	}
+	defer os.RemoveAll(dir)
+	existing := filepath.Join(dir, "master")
+	if err := ioutil.WriteFile(existing, []byte("MASTER\n"), 0644); err != nil {
+		t.Fatalf("WriteFile() error:\n%+v", err)
+	}
+
+	interval := config.Duration(time.Second)
+	cases := []struct {
+		when     LRGWhenConfiguration
+		expected bool
+		err      bool
+	}{
+		{
+			when:     LRGWhenConfiguration{File: existing},
+			expected: true,
+		}, {
+			when:     LRGWhenConfiguration{File: filepath.Join(dir, "backup")},
+			expected: false,
+		}, {
+			when:     LRGWhenConfiguration{Interface: "lo"},
+			expected: true,
+		}, {
+			when:     LRGWhenConfiguration{Interface: "nonexistent0"},
+			expected: false,
+		}, {
+			when:     LRGWhenConfiguration{Command: "true", Interval: interval},
+			expected: true,
+		}, {
+			when:     LRGWhenConfiguration{Command: "exit 3", Interval: interval},
+			expected: false,
+		}, {
+			when: LRGWhenConfiguration{
+				Command:  "sleep 1",
+				Interval: config.Duration(50 * time.Millisecond),
+			},
+			expected: false,
+			err:      true,
+		},
+	}
+	for _, tc := range cases {
+		got, err := checkCondition(&tc.when)
+		switch {
+		case err != nil && !tc.err:
+			t.Errorf("checkCondition(%s) error:\n%+v", tc.when, err)
+		case err == nil && tc.err:
+			t.Errorf("checkCondition(%s) == %v but expected error", tc.when, got)
+		case got != tc.expected:
+			t.Errorf("checkCondition(%s) == %v but expected %v", tc.when, got, tc.expected)
+		}
+	}
+}
@@ -1,13 +1,17 @@
 package gateways
 
 import (
+	"fmt"
 	"net"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
-	"github.com/vishvananda/netlink"
+	knetlink "github.com/vishvananda/netlink"
 
 	"lrg/config"
 	"lrg/helpers"
+	"lrg/netlink"
 )
 
 // Configuration contains the configuration for the last resort
@@ -17,8 +21,127 @@ type Configuration []LRGConfiguration
 // LRGConfiguration represents the configuration for one last resort
 // gateway.
 type LRGConfiguration struct {
-	From LRGFromConfiguration
-	To   LRGToConfiguration
+	Name      string
+	From      LRGFromConfiguration
+	To        LRGToConfiguration
+	When      *LRGWhenConfiguration
+	Depends   []LRGDependencyConfiguration
+	Aggregate *LRGAggregateConfiguration
+	Install   *InstallConfiguration
+}
+
+// InstallConfiguration tells how installation of routes and rules is
+// retried on failure and how failures are reported. It can be set
+// globally and for each gateway.
+type InstallConfiguration struct {
+	BackoffInterval    config.Duration
+	BackoffMaxInterval config.Duration
+	BackoffMultiplier  float64
+	// Failures are reported with an increasing level once
+	// installation has been failing for these delays.
+	InfoDelay    config.Duration
+	WarningDelay config.Duration
+	ErrorDelay   config.Duration
+	// When not 0, installation is abandoned once it has been
+	// failing for this delay.
+	GiveUpAfter config.Duration
+	// How the kernel is checked to reflect an installed route.
+	// Until then, installation is retried.
+	Confirm LRGConfirmMode
+	// When not 0, installation is abandoned once it has not been
+	// confirmed for this delay.
+	ConfirmTimeout config.Duration
+}
+
+// LRGConfirmMode tells how the installation of a route is confirmed.
+type LRGConfirmMode string
+
+const (
+	// LRGConfirmModeNone considers a route installed once the
+	// kernel accepted it.
+	LRGConfirmModeNone LRGConfirmMode = ""
+	// LRGConfirmModeEcho waits for the notification of the
+	// route by the kernel.
+	LRGConfirmModeEcho LRGConfirmMode = "echo"
+	// LRGConfirmModeReadBack reads the route back from the
+	// kernel.
+	LRGConfirmModeReadBack LRGConfirmMode = "readback"
+)
+
+// UnmarshalText parses a confirmation mode.
+func (m *LRGConfirmMode) UnmarshalText(text []byte) error {
+	switch mode := LRGConfirmMode(text); mode {
+	case LRGConfirmModeEcho, LRGConfirmModeReadBack:
+		*m = mode
+	case "none":
+		*m = LRGConfirmModeNone
+	default:
+		return errors.Errorf("unknown confirmation mode %q", mode)
+	}
+	return nil
+}
+
+// DefaultInstallConfiguration is the default configuration for the
+// installation of routes and rules.
+var DefaultInstallConfiguration = InstallConfiguration{
+	BackoffInterval:    config.Duration(100 * time.Millisecond),
+	BackoffMaxInterval: config.Duration(1 * time.Minute),
+	BackoffMultiplier:  2,
+	InfoDelay:          config.Duration(5 * time.Second),
+	WarningDelay:       config.Duration(30 * time.Second),
+	ErrorDelay:         config.Duration(1 * time.Minute),
+	GiveUpAfter:        0,
+	ConfirmTimeout:     config.Duration(10 * time.Second),
+}
+
+// UnmarshalYAML parses the configuration for the installation of
+// routes and rules from YAML. Missing keys get their default value.
+func (c *InstallConfiguration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawConfiguration InstallConfiguration
+	raw := rawConfiguration(DefaultInstallConfiguration)
+	if err := unmarshal(&raw); err != nil {
+		return errors.Wrap(err, "unable to decode install configuration")
+	}
+	switch {
+	case raw.BackoffInterval <= 0:
+		return errors.Errorf("backoff interval should be positive (%s)",
+			raw.BackoffInterval)
+	case raw.BackoffMaxInterval < raw.BackoffInterval:
+		return errors.Errorf("backoff maximum interval should be greater than the interval (%s)",
+			raw.BackoffMaxInterval)
+	case raw.BackoffMultiplier < 1:
+		return errors.Errorf("backoff multiplier should be at least 1 (%v)",
+			raw.BackoffMultiplier)
+	case raw.InfoDelay > raw.WarningDelay || raw.WarningDelay > raw.ErrorDelay:
+		return errors.New("alert delays should be increasing (info, warning, error)")
+	case raw.GiveUpAfter < 0:
+		return errors.Errorf("give up delay should not be negative (%s)",
+			raw.GiveUpAfter)
+	case raw.ConfirmTimeout < 0:
+		return errors.Errorf("confirmation timeout should not be negative (%s)",
+			raw.ConfirmTimeout)
+	}
+	*c = InstallConfiguration(raw)
+	return nil
+}
+
+// SetDefaultInstall sets the install configuration of the gateways
+// without their own install configuration.
+func (c Configuration) SetDefaultInstall(install InstallConfiguration) {
+	for idx := range c {
+		if c[idx].Install == nil {
+			install := install
+			c[idx].Install = &install
+		}
+	}
+}
+
+// install returns the install configuration of a gateway.
+func (c *LRGConfiguration) install() *InstallConfiguration {
+	if c.Install == nil {
+		return &DefaultInstallConfiguration
+	}
+	return c.Install
 }
 
 // LRGFromConfiguration is the first half of a last-resort gateway.
@@ -27,6 +150,35 @@ type LRGFromConfiguration struct {
 	Protocol *config.Protocol
 	Metric   *config.Metric
 	Table    config.Table
+	Mode     LRGFromMode
+	Source   *config.Prefix
+	Tos      *uint8
+}
+
+// LRGFromMode tells how routes are selected by a "from"
+// configuration.
+type LRGFromMode string
+
+const (
+	// LRGFromModeDefault selects routes from their prefix,
+	// protocol, metric and table.
+	LRGFromModeDefault LRGFromMode = ""
+	// LRGFromModeRA selects routes learnt from IPv6 router
+	// advertisements. Each router is a separate candidate.
+	LRGFromModeRA LRGFromMode = "ra"
+)
+
+// UnmarshalText parses a mode for a "from" configuration.
+func (m *LRGFromMode) UnmarshalText(text []byte) error {
+	switch mode := LRGFromMode(text); mode {
+	case LRGFromModeRA:
+		*m = mode
+	case "default":
+		*m = LRGFromModeDefault
+	default:
+		return errors.Errorf("unknown mode %q", mode)
+	}
+	return nil
 }
 
 // LRGToConfiguration is the second half of a last-resort gateway.
@@ -36,6 +188,115 @@ type LRGToConfiguration struct {
 	Metric    config.Metric
 	Table     config.Table
 	Blackhole bool
+	Rule      *LRGRuleConfiguration
+	Expires   config.Duration
+	Source    *config.Prefix
+	Tos       *uint8
+	Stale     *LRGStaleConfiguration
+}
+
+// LRGStaleConfiguration tells how a last-resort gateway is modified
+// once all the candidates are lost. Unset fields are not modified.
+type LRGStaleConfiguration struct {
+	Protocol *config.Protocol
+	Metric   *config.Metric
+	Realm    *uint32
+}
+
+// LRGRuleConfiguration is the policy rule directing lookups to the
+// dedicated table of a last-resort gateway. Rules looking up the
+// dedicated table with one of the previous priorities are removed.
+type LRGRuleConfiguration struct {
+	Priority           uint
+	PreviousPriorities []uint
+}
+
+// LRGWhenConfiguration is the condition for a last-resort gateway to
+// be installed. Exactly one of the file, the interface or the command
+// should be set. The condition is evaluated at the provided interval.
+type LRGWhenConfiguration struct {
+	File      string
+	Interface string
+	Command   string
+	Interval  config.Duration
+}
+
+func (c LRGWhenConfiguration) String() string {
+	switch {
+	case c.File != "":
+		return fmt.Sprintf("file %s exists", c.File)
+	case c.Interface != "":
+		return fmt.Sprintf("interface %s is up", c.Interface)
+	default:
+		return fmt.Sprintf("command %q succeeds", c.Command)
+	}
+}
+
+// LRGDependencyConfiguration is a dependency of a last-resort gateway
+// on the state of another gateway, referenced by its name.
+type LRGDependencyConfiguration struct {
+	Gateway string
+	State   LRGDependencyState
+}
+
+// LRGDependencyState is the state of another gateway a last-resort
+// gateway depends on.
+type LRGDependencyState string
+
+const (
+	// LRGDependencyInstalled requires the other gateway to be
+	// installed.
+	LRGDependencyInstalled LRGDependencyState = "installed"
+	// LRGDependencyMissing requires the other gateway to be
+	// missing.
+	LRGDependencyMissing LRGDependencyState = "missing"
+)
+
+// UnmarshalText parses the state of a dependency.
+func (s *LRGDependencyState) UnmarshalText(text []byte) error {
+	switch state := LRGDependencyState(text); state {
+	case LRGDependencyInstalled, LRGDependencyMissing:
+		*s = state
+	default:
+		return errors.Errorf("unknown dependency state %q", state)
+	}
+	return nil
+}
+
+// gatewayState returns the state of a gateway satisfying the
+// dependency.
+func (s LRGDependencyState) gatewayState() int64 {
+	if s == LRGDependencyInstalled {
+		return LRGStateInstalled
+	}
+	return LRGStateMissing
+}
+
+// LRGAggregateConfiguration turns a last-resort gateway into a
+// covering aggregate for other gateways, referenced by their
+// names. The aggregate is installed once more than Lost of them have
+// lost their candidates.
+type LRGAggregateConfiguration struct {
+	Gateways []string
+	Lost     uint
+}
+
+// UnmarshalYAML parses the aggregate block of a gateway from YAML.
+func (c *LRGAggregateConfiguration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawConfiguration LRGAggregateConfiguration
+	raw := rawConfiguration{}
+	if err := unmarshal(&raw); err != nil {
+		return errors.Wrap(err, "unable to decode aggregate configuration")
+	}
+	switch {
+	case len(raw.Gateways) == 0:
+		return errors.New("aggregate without gateways")
+	case raw.Lost >= uint(len(raw.Gateways)):
+		return errors.Errorf("aggregate cannot lose more than %d gateways out of %d",
+			raw.Lost, len(raw.Gateways))
+	}
+	*c = LRGAggregateConfiguration(raw)
+	return nil
 }
 
 // UnmarshalYAML parses the configuration of the gateway component
@@ -49,6 +310,81 @@ func (c *Configuration) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if len(raw) == 0 {
 		return errors.New("at least one gateway is needed")
 	}
+	// Gateways can only depend on or aggregate named gateways
+	// defined before them. This way, there is no dependency
+	// cycle.
+	names := map[string]int{}
+	for i, gw := range raw {
+		for _, dependency := range gw.Depends {
+			_, ok := names[dependency.Gateway]
+			switch {
+			case dependency.Gateway == "":
+				return errors.New("dependency without a gateway name")
+			case dependency.State == "":
+				return errors.Errorf("dependency on %q without a state",
+					dependency.Gateway)
+			case !ok:
+				return errors.Errorf("dependency on %q which is not a previous gateway",
+					dependency.Gateway)
+			}
+		}
+		if gw.Aggregate != nil {
+			aggregated := map[string]bool{}
+			for _, name := range gw.Aggregate.Gateways {
+				j, ok := names[name]
+				switch {
+				case !ok:
+					return errors.Errorf("aggregate of %q which is not a previous gateway",
+						name)
+				case aggregated[name]:
+					return errors.Errorf("duplicate aggregated gateway %q", name)
+				case !gw.To.covers(&raw[j].To):
+					return errors.Errorf("aggregate %s does not cover gateway %q (%s)",
+						gw.To.Prefix, name, raw[j].To.Prefix)
+				}
+				aggregated[name] = true
+			}
+		}
+		if gw.Name == "" {
+			continue
+		}
+		if _, ok := names[gw.Name]; ok {
+			return errors.Errorf("duplicate gateway name %q", gw.Name)
+		}
+		names[gw.Name] = i
+	}
+	// Gateways sharing a dedicated table should agree on the rule
+	// priority. Otherwise, they would install several rules and
+	// one of them could be removed as a previous one by another
+	// gateway.
+	for i, gw1 := range raw {
+		for _, gw2 := range raw[i+1:] {
+			if gw1.To.Rule != nil && gw2.To.Rule != nil &&
+				gw1.To.Table.ID == gw2.To.Table.ID &&
+				gw1.To.family() == gw2.To.family() &&
+				gw1.To.Rule.Priority != gw2.To.Rule.Priority {
+				return errors.Errorf("conflicting rule priorities for table %s",
+					gw1.To.Table)
+			}
+		}
+	}
+	// Gateways should not install the same route. A gateway
+	// should not use a route installed by itself or by another
+	// gateway as a candidate.
+	for i := range raw {
+		for j := range raw {
+			for _, route := range raw[i].To.routes() {
+				switch {
+				case i < j && raw[j].To.Match(route):
+					return errors.Errorf("gateways %d and %d install the same route %s",
+						i+1, j+1, route)
+				case raw[j].candidate(route):
+					return errors.Errorf("gateway %d would use route %s from gateway %d",
+						j+1, route, i+1)
+				}
+			}
+		}
+	}
 	*c = Configuration(raw)
 	return nil
 }
@@ -60,8 +396,62 @@ var (
 	DefaultToProtocol = config.Protocol{ID: 254, Name: "lrg"}
 	// DefaultTable is the default table
 	DefaultTable = config.Table{ID: 254, Name: "main"}
+	// DefaultRulePriority is the default priority for the policy
+	// rule. It is after the rules for the main and default
+	// tables.
+	DefaultRulePriority uint = 40000
+	// MinToExpires is the minimal expiry for copied route
+	MinToExpires = config.Duration(3 * time.Second)
+	// DefaultWhenInterval is the default interval to evaluate a
+	// gateway condition
+	DefaultWhenInterval = config.Duration(5 * time.Second)
 )
 
+// UnmarshalYAML parses the configuration of a policy rule from YAML.
+func (c *LRGRuleConfiguration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawConfiguration LRGRuleConfiguration
+	raw := rawConfiguration{
+		Priority: DefaultRulePriority,
+	}
+	if err := unmarshal(&raw); err != nil {
+		return errors.Wrap(err, "unable to decode rule configuration")
+	}
+	for _, priority := range raw.PreviousPriorities {
+		if priority == raw.Priority {
+			return errors.Errorf("previous rule priority %d is the current one",
+				priority)
+		}
+	}
+	*c = LRGRuleConfiguration(raw)
+	return nil
+}
+
+// UnmarshalYAML parses the condition of a gateway from YAML.
+func (c *LRGWhenConfiguration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawConfiguration LRGWhenConfiguration
+	raw := rawConfiguration{
+		Interval: DefaultWhenInterval,
+	}
+	if err := unmarshal(&raw); err != nil {
+		return errors.Wrap(err, "unable to decode condition configuration")
+	}
+	conditions := 0
+	for _, condition := range []string{raw.File, raw.Interface, raw.Command} {
+		if condition != "" {
+			conditions++
+		}
+	}
+	switch {
+	case conditions != 1:
+		return errors.New("exactly one of file, interface or command is needed for a condition")
+	case raw.Interval <= 0:
+		return errors.Errorf("condition interval should be positive (%s)",
+			raw.Interval)
+	}
+	*c = LRGWhenConfiguration(raw)
+	return nil
+}
+
 // UnmarshalYAML parses the configuration of one gateway
 // from YAML.
 func (c *LRGConfiguration) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -90,6 +480,14 @@ func (c *LRGConfiguration) UnmarshalYAML(unmarshal func(interface{}) error) erro
 	// Copy values from From to To and decode again
 	raw.To.Prefix = raw.From.Prefix
 	raw.To.Table = raw.From.Table
+	if raw.From.Source != nil {
+		source := *raw.From.Source
+		raw.To.Source = &source
+	}
+	if raw.From.Tos != nil {
+		tos := *raw.From.Tos
+		raw.To.Tos = &tos
+	}
 	if err := unmarshal(&raw); err != nil {
 		return errors.Wrap(err, "unable to decode gateway configuration")
 	}
@@ -98,12 +496,55 @@ func (c *LRGConfiguration) UnmarshalYAML(unmarshal func(interface{}) error) erro
 	switch {
 	case raw.From.Prefix.IP.Equal(ipPlaceholder.IP):
 		return errors.New("source prefix missing from configuration")
-	case raw.From.Prefix.IP.To4() == nil && raw.To.Prefix.IP.To4() != nil:
-		return errors.Errorf("incompatible families for from/to prefixes (%s/%s)",
-			raw.From.Prefix, raw.To.Prefix)
 	case raw.From.Prefix.IP.To4() != nil && raw.To.Prefix.IP.To4() == nil:
+		// IPv4 routes can use IPv6 gateways (RFC 5549), but
+		// IPv6 routes cannot use IPv4 gateways.
 		return errors.Errorf("incompatible families for from/to prefixes (%s/%s)",
 			raw.From.Prefix, raw.To.Prefix)
+	case raw.From.Source != nil && raw.From.Prefix.IP.To4() != nil:
+		return errors.Errorf("source prefix is only supported for IPv6 (%s)",
+			raw.From.Source)
+	case raw.To.Source != nil && raw.To.Prefix.IP.To4() != nil:
+		return errors.Errorf("source prefix is only supported for IPv6 (%s)",
+			raw.To.Source)
+	case raw.From.Source != nil && raw.From.Source.IP.To4() != nil:
+		return errors.Errorf("incompatible families for from prefix/source (%s/%s)",
+			raw.From.Prefix, raw.From.Source)
+	case raw.To.Source != nil && raw.To.Source.IP.To4() != nil:
+		return errors.Errorf("incompatible families for to prefix/source (%s/%s)",
+			raw.To.Prefix, raw.To.Source)
+	case raw.From.Tos != nil && raw.From.Prefix.IP.To4() == nil:
+		return errors.Errorf("TOS is only supported for IPv4 (%s)",
+			raw.From.Prefix)
+	case raw.To.Tos != nil && raw.To.Prefix.IP.To4() == nil:
+		return errors.Errorf("TOS is only supported for IPv4 (%s)",
+			raw.To.Prefix)
+	case raw.From.Mode == LRGFromModeRA && raw.From.Prefix.IP.To4() != nil:
+		return errors.Errorf("router advertisement mode is only supported for IPv6 (%s)",
+			raw.From.Prefix)
+	case raw.From.Mode == LRGFromModeRA && raw.From.Protocol != nil &&
+		raw.From.Protocol.ID != syscall.RTPROT_RA:
+		return errors.Errorf("router advertisement mode is incompatible with protocol %s",
+			raw.From.Protocol)
+	case raw.To.Expires != 0 && raw.To.Prefix.IP.To4() != nil:
+		return errors.Errorf("route expiry is only supported for IPv6 (%s)",
+			raw.To.Prefix)
+	case raw.To.Expires != 0 && raw.To.Expires < MinToExpires:
+		return errors.Errorf("route expiry should be at least %s (%s)",
+			MinToExpires, raw.To.Expires)
+	case raw.To.Stale != nil && raw.To.Stale.Protocol == nil &&
+		raw.To.Stale.Metric == nil && raw.To.Stale.Realm == nil:
+		return errors.New("stale gateway should change the protocol, the metric or the realm")
+	case raw.To.Stale != nil && raw.To.Stale.Realm != nil && raw.To.Prefix.IP.To4() == nil:
+		return errors.Errorf("realm is only supported for IPv4 (%s)",
+			raw.To.Prefix)
+	case raw.To.Rule != nil && raw.To.Table.ID == raw.From.Table.ID:
+		return errors.Errorf("policy rule requires a dedicated table (%s)",
+			raw.To.Table)
+	case raw.To.Rule != nil && (raw.To.Table.ID == syscall.RT_TABLE_UNSPEC ||
+		raw.To.Table.ID >= syscall.RT_TABLE_DEFAULT):
+		return errors.Errorf("policy rule cannot use a reserved table (%s)",
+			raw.To.Table)
 	}
 	*c = LRGConfiguration(raw)
 	return nil
@@ -115,14 +556,190 @@ func (c *LRGFromConfiguration) Match(route *netlink.Route) bool {
 		helpers.IPNetEqual(net.IPNet(c.Prefix), *route.Dst) &&
 		(c.Protocol == nil || c.Protocol.ID == uint(route.Protocol)) &&
 		(c.Metric == nil || uint(*c.Metric) == uint(route.Priority)) &&
+		(c.Mode != LRGFromModeRA || route.Protocol == syscall.RTPROT_RA) &&
+		sourceMatch(c.Source, route.SrcPrefix) &&
+		(c.Tos == nil || int(*c.Tos) == route.Tos) &&
 		c.Table.ID == uint(route.Table)
 }
 
-// Match will tel if a "to" configuration matches the given route.
+// candidate will tell if the given route would be a candidate for a
+// gateway. A route carrying the protocol of the gateway is ignored,
+// unless this protocol is explicitly selected. An aggregate gets its
+// candidates from the gateways it covers, not from the kernel.
+func (c *LRGConfiguration) candidate(route *netlink.Route) bool {
+	return c.Aggregate == nil && c.From.Match(route) &&
+		(c.From.Protocol != nil || !c.To.ownProtocol(route.Protocol))
+}
+
+// MatchRule will tell if a "to" configuration matches the given
+// rule. Only a rule for any source and destination, looking up the
+// dedicated table with the configured priority matches.
+func (c *LRGToConfiguration) MatchRule(rule *knetlink.Rule) bool {
+	return c.matchRuleLookup(rule) && rule.Priority == int(c.Rule.Priority)
+}
+
+// MatchStaleRule will tell if the given rule is a rule for the
+// dedicated table of a "to" configuration but with one of the
+// previous priorities. Such a rule has been installed with a previous
+// configuration. Rules with other priorities are left alone: they may
+// have been added by an operator.
+func (c *LRGToConfiguration) MatchStaleRule(rule *knetlink.Rule) bool {
+	if !c.matchRuleLookup(rule) {
+		return false
+	}
+	for _, priority := range c.Rule.PreviousPriorities {
+		if rule.Priority == int(priority) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRuleLookup will tell if the given rule is looking up the
+// dedicated table for any source and destination.
+func (c *LRGToConfiguration) matchRuleLookup(rule *knetlink.Rule) bool {
+	return c.Rule != nil &&
+		rule.Family == c.family() &&
+		rule.Table == int(c.Table.ID) &&
+		rule.Src == nil && rule.Dst == nil &&
+		rule.IifName == "" && rule.OifName == "" &&
+		rule.Mark <= 0 && rule.Goto < 0
+}
+
+// TargetRule returns the rule to install for a "to"
+// configuration. It returns nil if no rule is configured.
+func (c *LRGToConfiguration) TargetRule() *knetlink.Rule {
+	if c.Rule == nil {
+		return nil
+	}
+	rule := knetlink.NewRule()
+	rule.Family = c.family()
+	rule.Priority = int(c.Rule.Priority)
+	rule.Table = int(c.Table.ID)
+	return rule
+}
+
+// expiresSeconds returns the expiry of a copied route in seconds, as
+// expected by the kernel. 0 means the route doesn't expire.
+func (c *LRGToConfiguration) expiresSeconds() int {
+	return int(time.Duration(c.Expires) / time.Second)
+}
+
+// family returns the family of the prefix of a "to" configuration.
+func (c *LRGToConfiguration) family() int {
+	if c.Prefix.IP.To4() != nil {
+		return knetlink.FAMILY_V4
+	}
+	return knetlink.FAMILY_V6
+}
+
+// covers will tell if the prefix of a "to" configuration strictly
+// covers the prefix of another one of the same family.
+func (c *LRGToConfiguration) covers(other *LRGToConfiguration) bool {
+	ones, _ := c.Prefix.Mask.Size()
+	otherOnes, _ := other.Prefix.Mask.Size()
+	prefix := net.IPNet(c.Prefix)
+	return c.family() == other.family() &&
+		ones < otherOnes &&
+		prefix.Contains(other.Prefix.IP)
+}
+
+// Match will tel if a "to" configuration matches the given route. A
+// route marked as stale also matches.
 func (c *LRGToConfiguration) Match(route *netlink.Route) bool {
+	protocol, metric := c.staleProtocolMetric()
 	return route.Dst != nil &&
 		helpers.IPNetEqual(net.IPNet(c.Prefix), *route.Dst) &&
-		c.Protocol.ID == uint(route.Protocol) &&
-		uint(c.Metric) == uint(route.Priority) &&
+		((c.Protocol.ID == uint(route.Protocol) && uint(c.Metric) == uint(route.Priority)) ||
+			(c.Stale != nil && protocol.ID == uint(route.Protocol) && uint(metric) == uint(route.Priority))) &&
+		sourceMatch(c.Source, route.SrcPrefix) &&
+		(c.Tos == nil || int(*c.Tos) == route.Tos) &&
 		c.Table.ID == uint(route.Table)
 }
+
+// ownProtocol will tell if the given protocol is used by a "to"
+// configuration, including for stale routes.
+func (c *LRGToConfiguration) ownProtocol(protocol int) bool {
+	stale, _ := c.staleProtocolMetric()
+	return c.Protocol.ID == uint(protocol) ||
+		(c.Stale != nil && stale.ID == uint(protocol))
+}
+
+// routes returns the routes a "to" configuration may install: the
+// last-resort route and, if configured, the stale one. Only the keys
+// of the routes are set.
+func (c *LRGToConfiguration) routes() []*netlink.Route {
+	route := &netlink.Route{
+		Dst:      &net.IPNet{IP: c.Prefix.IP, Mask: c.Prefix.Mask},
+		Table:    int(c.Table.ID),
+		Protocol: int(c.Protocol.ID),
+		Priority: int(c.Metric),
+	}
+	if c.Source != nil {
+		route.SrcPrefix = &net.IPNet{IP: c.Source.IP, Mask: c.Source.Mask}
+	}
+	if c.Tos != nil {
+		route.Tos = int(*c.Tos)
+	}
+	if c.Stale == nil {
+		return []*netlink.Route{route}
+	}
+	protocol, metric := c.staleProtocolMetric()
+	stale := *route
+	stale.Protocol = int(protocol.ID)
+	stale.Priority = int(metric)
+	return []*netlink.Route{route, &stale}
+}
+
+// staleProtocolMetric returns the protocol and the metric of a stale
+// last-resort gateway.
+func (c *LRGToConfiguration) staleProtocolMetric() (config.Protocol, config.Metric) {
+	protocol, metric := c.Protocol, c.Metric
+	if c.Stale != nil && c.Stale.Protocol != nil {
+		protocol = *c.Stale.Protocol
+	}
+	if c.Stale != nil && c.Stale.Metric != nil {
+		metric = *c.Stale.Metric
+	}
+	return protocol, metric
+}
+
+// StaleRoute returns a copy of the provided route marked as stale. It
+// returns nil if no stale gateway is configured.
+func (c *LRGToConfiguration) StaleRoute(route *netlink.Route) *netlink.Route {
+	if c.Stale == nil {
+		return nil
+	}
+	protocol, metric := c.staleProtocolMetric()
+	stale := *route
+	stale.Protocol = int(protocol.ID)
+	stale.Priority = int(metric)
+	if c.Stale.Realm != nil {
+		stale.Realm = int(*c.Stale.Realm)
+	}
+	return &stale
+}
+
+// sourceMatch will tell if a source prefix from a configuration
+// matches the source prefix of a route. A missing source prefix only
+// matches a route without a source prefix. A source prefix of length
+// 0 is the same as no source prefix.
+func sourceMatch(source *config.Prefix, route *net.IPNet) bool {
+	if source != nil {
+		if ones, _ := source.Mask.Size(); ones == 0 {
+			source = nil
+		}
+	}
+	if route != nil {
+		if ones, _ := route.Mask.Size(); ones == 0 {
+			route = nil
+		}
+	}
+	switch {
+	case source == nil && route == nil:
+		return true
+	case source == nil || route == nil:
+		return false
+	}
+	return helpers.IPNetEqual(net.IPNet(*source), *route)
+}
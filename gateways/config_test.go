@@ -3,13 +3,16 @@ package gateways
 import (
 	"net"
 	"strconv"
+	"syscall"
 	"testing"
+	"time"
 
-	"github.com/vishvananda/netlink"
+	knetlink "github.com/vishvananda/netlink"
 	"gopkg.in/yaml.v2"
 
 	"lrg/config"
 	"lrg/helpers"
+	"lrg/netlink"
 )
 
 func TestUnmarshalGateways(t *testing.T) {
@@ -18,6 +21,12 @@ func TestUnmarshalGateways(t *testing.T) {
 	randomPrefix := config.MustParsePrefix("10.16.0.0/16")
 	metric0 := config.Metric(0)
 	metric1000 := config.Metric(1000)
+	source1 := config.MustParsePrefix("2001:db8:1::/48")
+	source2 := config.MustParsePrefix("2001:db8:2::/48")
+	tos16 := uint8(16)
+	tos4 := uint8(4)
+	metricStale := config.Metric(4294967294)
+	realm10 := uint32(10)
 	cases := []struct {
 		input string
 		want  Configuration
@@ -134,34 +143,890 @@ func TestUnmarshalGateways(t *testing.T) {
 			want: Configuration{},
 			err:  true,
 		}, {
+			// IPv4 routes with IPv6 gateways
+			input: `
+- from:
+    prefix: ::/0
+  to:
+    prefix: 0.0.0.0/0`,
+			want: Configuration{
+				LRGConfiguration{
+					From: LRGFromConfiguration{
+						Prefix: defaultIPv6,
+						Table:  DefaultTable,
+					},
+					To: LRGToConfiguration{
+						Prefix:    defaultIPv4,
+						Protocol:  DefaultToProtocol,
+						Metric:    DefaultToMetric,
+						Table:     DefaultTable,
+						Blackhole: false,
+					},
+				},
+			},
+		}, {
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+    protocol: kernel
+    metric: 0
+    table: 254
+  to:
+    protocol: 254
+    metric: 1000
+    table: public
+    blackhole: true`,
+			want: Configuration{
+				LRGConfiguration{
+					From: LRGFromConfiguration{
+						Prefix:   defaultIPv4,
+						Protocol: &config.Protocol{ID: 2, Name: "kernel"},
+						Metric:   &metric0,
+						Table:    config.Table{ID: 254},
+					},
+					To: LRGToConfiguration{
+						Prefix:    defaultIPv4,
+						Protocol:  config.Protocol{ID: 254},
+						Metric:    metric1000,
+						Table:     config.Table{ID: 90, Name: "public"},
+						Blackhole: true,
+					},
+				},
+			},
+		}, {
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+  to:
+    table: public
+    rule: {}`,
+			want: Configuration{
+				LRGConfiguration{
+					From: LRGFromConfiguration{
+						Prefix: defaultIPv4,
+						Table:  DefaultTable,
+					},
+					To: LRGToConfiguration{
+						Prefix:   defaultIPv4,
+						Protocol: DefaultToProtocol,
+						Metric:   DefaultToMetric,
+						Table:    config.Table{ID: 90, Name: "public"},
+						Rule:     &LRGRuleConfiguration{Priority: DefaultRulePriority},
+					},
+				},
+			},
+		}, {
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+  to:
+    table: public
+    rule:
+      priority: 33000
+      previouspriorities: [32000, 32500]
+- from:
+    prefix: ::/0
+  to:
+    table: public
+    rule:
+      priority: 34000`,
+			want: Configuration{
+				LRGConfiguration{
+					From: LRGFromConfiguration{
+						Prefix: defaultIPv4,
+						Table:  DefaultTable,
+					},
+					To: LRGToConfiguration{
+						Prefix:   defaultIPv4,
+						Protocol: DefaultToProtocol,
+						Metric:   DefaultToMetric,
+						Table:    config.Table{ID: 90, Name: "public"},
+						Rule: &LRGRuleConfiguration{
+							Priority:           33000,
+							PreviousPriorities: []uint{32000, 32500},
+						},
+					},
+				},
+				LRGConfiguration{
+					From: LRGFromConfiguration{
+						Prefix: defaultIPv6,
+						Table:  DefaultTable,
+					},
+					To: LRGToConfiguration{
+						Prefix:   defaultIPv6,
+						Protocol: DefaultToProtocol,
+						Metric:   DefaultToMetric,
+						Table:    config.Table{ID: 90, Name: "public"},
+						Rule:     &LRGRuleConfiguration{Priority: 34000},
+					},
+				},
+			},
+		}, {
+			input: `
+- from:
+    prefix: ::/0
+  to:
+    expires: 5m`,
+			want: Configuration{
+				LRGConfiguration{
+					From: LRGFromConfiguration{
+						Prefix: defaultIPv6,
+						Table:  DefaultTable,
+					},
+					To: LRGToConfiguration{
+						Prefix:   defaultIPv6,
+						Protocol: DefaultToProtocol,
+						Metric:   DefaultToMetric,
+						Table:    DefaultTable,
+						Expires:  config.Duration(5 * time.Minute),
+					},
+				},
+			},
+		}, {
+			input: `
+- from:
+    prefix: ::/0
+    mode: ra`,
+			want: Configuration{
+				LRGConfiguration{
+					From: LRGFromConfiguration{
+						Prefix: defaultIPv6,
+						Table:  DefaultTable,
+						Mode:   LRGFromModeRA,
+					},
+					To: LRGToConfiguration{
+						Prefix:   defaultIPv6,
+						Protocol: DefaultToProtocol,
+						Metric:   DefaultToMetric,
+						Table:    DefaultTable,
+					},
+				},
+			},
+		}, {
+			input: `
+- from:
+    prefix: ::/0
+    source: 2001:db8:1::/48`,
+			want: Configuration{
+				LRGConfiguration{
+					From: LRGFromConfiguration{
+						Prefix: defaultIPv6,
+						Table:  DefaultTable,
+						Source: &source1,
+					},
+					To: LRGToConfiguration{
+						Prefix:   defaultIPv6,
+						Protocol: DefaultToProtocol,
+						Metric:   DefaultToMetric,
+						Table:    DefaultTable,
+						Source:   &source1,
+					},
+				},
+			},
+		}, {
+			input: `
+- from:
+    prefix: ::/0
+    source: 2001:db8:1::/48
+  to:
+    source: 2001:db8:2::/48`,
+			want: Configuration{
+				LRGConfiguration{
+					From: LRGFromConfiguration{
+						Prefix: defaultIPv6,
+						Table:  DefaultTable,
+						Source: &source1,
+					},
+					To: LRGToConfiguration{
+						Prefix:   defaultIPv6,
+						Protocol: DefaultToProtocol,
+						Metric:   DefaultToMetric,
+						Table:    DefaultTable,
+						Source:   &source2,
+					},
+				},
+			},
+		}, {
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+    tos: 16`,
+			want: Configuration{
+				LRGConfiguration{
+					From: LRGFromConfiguration{
+						Prefix: defaultIPv4,
+						Table:  DefaultTable,
+						Tos:    &tos16,
+					},
+					To: LRGToConfiguration{
+						Prefix:   defaultIPv4,
+						Protocol: DefaultToProtocol,
+						Metric:   DefaultToMetric,
+						Table:    DefaultTable,
+						Tos:      &tos16,
+					},
+				},
+			},
+		}, {
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+    tos: 16
+  to:
+    tos: 4`,
+			want: Configuration{
+				LRGConfiguration{
+					From: LRGFromConfiguration{
+						Prefix: defaultIPv4,
+						Table:  DefaultTable,
+						Tos:    &tos16,
+					},
+					To: LRGToConfiguration{
+						Prefix:   defaultIPv4,
+						Protocol: DefaultToProtocol,
+						Metric:   DefaultToMetric,
+						Table:    DefaultTable,
+						Tos:      &tos4,
+					},
+				},
+			},
+		}, {
+			// TOS out of range
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+    tos: 256`,
+			err: true,
+		}, {
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+  when:
+    file: /run/keepalived/master`,
+			want: Configuration{
+				LRGConfiguration{
+					From: LRGFromConfiguration{
+						Prefix: defaultIPv4,
+						Table:  DefaultTable,
+					},
+					To: LRGToConfiguration{
+						Prefix:   defaultIPv4,
+						Protocol: DefaultToProtocol,
+						Metric:   DefaultToMetric,
+						Table:    DefaultTable,
+					},
+					When: &LRGWhenConfiguration{
+						File:     "/run/keepalived/master",
+						Interval: DefaultWhenInterval,
+					},
+				},
+			},
+		}, {
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+  when:
+    command: systemctl is-active bird
+    interval: 30s`,
+			want: Configuration{
+				LRGConfiguration{
+					From: LRGFromConfiguration{
+						Prefix: defaultIPv4,
+						Table:  DefaultTable,
+					},
+					To: LRGToConfiguration{
+						Prefix:   defaultIPv4,
+						Protocol: DefaultToProtocol,
+						Metric:   DefaultToMetric,
+						Table:    DefaultTable,
+					},
+					When: &LRGWhenConfiguration{
+						Command:  "systemctl is-active bird",
+						Interval: config.Duration(30 * time.Second),
+					},
+				},
+			},
+		}, {
+			input: `
+- name: main
+  from:
+    prefix: 0.0.0.0/0
+- name: lte
+  from:
+    prefix: 0.0.0.0/0
+    table: 100
+  to:
+    table: main
+    metric: 4294967294
+  depends:
+    - gateway: main
+      state: missing`,
+			want: Configuration{
+				LRGConfiguration{
+					Name: "main",
+					From: LRGFromConfiguration{
+						Prefix: defaultIPv4,
+						Table:  DefaultTable,
+					},
+					To: LRGToConfiguration{
+						Prefix:   defaultIPv4,
+						Protocol: DefaultToProtocol,
+						Metric:   DefaultToMetric,
+						Table:    DefaultTable,
+					},
+				},
+				LRGConfiguration{
+					Name: "lte",
+					From: LRGFromConfiguration{
+						Prefix: defaultIPv4,
+						Table:  config.Table{ID: 100},
+					},
+					To: LRGToConfiguration{
+						Prefix:   defaultIPv4,
+						Protocol: DefaultToProtocol,
+						Metric:   DefaultToMetric - 1,
+						Table:    DefaultTable,
+					},
+					Depends: []LRGDependencyConfiguration{
+						{Gateway: "main", State: LRGDependencyMissing},
+					},
+				},
+			},
+		}, {
+			// Dependency on a later gateway
+			input: `
+- name: lte
+  from:
+    prefix: 0.0.0.0/0
+  depends:
+    - gateway: main
+      state: missing
+- name: main
+  from:
+    prefix: 0.0.0.0/0`,
+			err: true,
+		}, {
+			// Dependency on itself
+			input: `
+- name: lte
+  from:
+    prefix: 0.0.0.0/0
+  depends:
+    - gateway: lte
+      state: missing`,
+			err: true,
+		}, {
+			// Dependency without a state
+			input: `
+- name: main
+  from:
+    prefix: 0.0.0.0/0
+- from:
+    prefix: 0.0.0.0/0
+  depends:
+    - gateway: main`,
+			err: true,
+		}, {
+			// Dependency with an unknown state
+			input: `
+- name: main
+  from:
+    prefix: 0.0.0.0/0
+- from:
+    prefix: 0.0.0.0/0
+  depends:
+    - gateway: main
+      state: installing`,
+			err: true,
+		}, {
+			input: `
+- name: a
+  from:
+    prefix: 10.1.0.0/16
+- name: b
+  from:
+    prefix: 10.2.0.0/16
+- from:
+    prefix: 10.0.0.0/8
+  aggregate:
+    gateways: [a, b]
+    lost: 1`,
+			want: Configuration{
+				LRGConfiguration{
+					Name: "a",
+					From: LRGFromConfiguration{
+						Prefix: config.MustParsePrefix("10.1.0.0/16"),
+						Table:  DefaultTable,
+					},
+					To: LRGToConfiguration{
+						Prefix:   config.MustParsePrefix("10.1.0.0/16"),
+						Protocol: DefaultToProtocol,
+						Metric:   DefaultToMetric,
+						Table:    DefaultTable,
+					},
+				},
+				LRGConfiguration{
+					Name: "b",
+					From: LRGFromConfiguration{
+						Prefix: config.MustParsePrefix("10.2.0.0/16"),
+						Table:  DefaultTable,
+					},
+					To: LRGToConfiguration{
+						Prefix:   config.MustParsePrefix("10.2.0.0/16"),
+						Protocol: DefaultToProtocol,
+						Metric:   DefaultToMetric,
+						Table:    DefaultTable,
+					},
+				},
+				LRGConfiguration{
+					From: LRGFromConfiguration{
+						Prefix: config.MustParsePrefix("10.0.0.0/8"),
+						Table:  DefaultTable,
+					},
+					To: LRGToConfiguration{
+						Prefix:   config.MustParsePrefix("10.0.0.0/8"),
+						Protocol: DefaultToProtocol,
+						Metric:   DefaultToMetric,
+						Table:    DefaultTable,
+					},
+					Aggregate: &LRGAggregateConfiguration{
+						Gateways: []string{"a", "b"},
+						Lost:     1,
+					},
+				},
+			},
+		}, {
+			// Aggregate of a later gateway
+			input: `
+- from:
+    prefix: 10.0.0.0/8
+  aggregate:
+    gateways: [a]
+- name: a
+  from:
+    prefix: 10.1.0.0/16`,
+			err: true,
+		}, {
+			// Aggregate not covering a gateway
+			input: `
+- name: a
+  from:
+    prefix: 10.1.0.0/16
+- from:
+    prefix: 10.1.0.0/16
+    table: 100
+  aggregate:
+    gateways: [a]`,
+			err: true,
+		}, {
+			// Aggregate of another family
+			input: `
+- name: a
+  from:
+    prefix: 2001:db8::/32
+- from:
+    prefix: 0.0.0.0/0
+  aggregate:
+    gateways: [a]`,
+			err: true,
+		}, {
+			// Aggregate never lost enough gateways
+			input: `
+- name: a
+  from:
+    prefix: 10.1.0.0/16
+- from:
+    prefix: 10.0.0.0/8
+  aggregate:
+    gateways: [a]
+    lost: 1`,
+			err: true,
+		}, {
+			// Aggregate without gateways
+			input: `
+- from:
+    prefix: 10.0.0.0/8
+  aggregate:
+    lost: 1`,
+			err: true,
+		}, {
+			// Aggregate of the same gateway twice
+			input: `
+- name: a
+  from:
+    prefix: 10.1.0.0/16
+- from:
+    prefix: 10.0.0.0/8
+  aggregate:
+    gateways: [a, a]
+    lost: 1`,
+			err: true,
+		}, {
+			// Duplicate names
+			input: `
+- name: main
+  from:
+    prefix: 0.0.0.0/0
+- name: main
+  from:
+    prefix: ::/0`,
+			err: true,
+		}, {
+			// Two gateways installing the same route
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+    table: 100
+  to:
+    table: main
+- from:
+    prefix: 0.0.0.0/0
+    table: 101
+  to:
+    table: main`,
+			err: true,
+		}, {
+			// A stale route colliding with another gateway
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+    table: 100
+  to:
+    table: main
+    metric: 4294967294
+- from:
+    prefix: 0.0.0.0/0
+    table: 101
+  to:
+    table: main
+    stale:
+      metric: 4294967294`,
+			err: true,
+		}, {
+			// A gateway using the route of another gateway
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+    table: 100
+  to:
+    table: main
+    protocol: 100
+- from:
+    prefix: 0.0.0.0/0
+  to:
+    table: 200`,
+			err: true,
+		}, {
+			// A gateway using its own route
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+    protocol: 254`,
+			err: true,
+		}, {
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+    table: 100
+  to:
+    table: main
+    protocol: 100
+- from:
+    prefix: 0.0.0.0/0
+    protocol: 12
+  to:
+    table: 200`,
+			want: Configuration{
+				LRGConfiguration{
+					From: LRGFromConfiguration{
+						Prefix: defaultIPv4,
+						Table:  config.Table{ID: 100},
+					},
+					To: LRGToConfiguration{
+						Prefix:   defaultIPv4,
+						Protocol: config.Protocol{ID: 100},
+						Metric:   DefaultToMetric,
+						Table:    DefaultTable,
+					},
+				},
+				LRGConfiguration{
+					From: LRGFromConfiguration{
+						Prefix:   defaultIPv4,
+						Protocol: &config.Protocol{ID: 12},
+						Table:    DefaultTable,
+					},
+					To: LRGToConfiguration{
+						Prefix:   defaultIPv4,
+						Protocol: DefaultToProtocol,
+						Metric:   DefaultToMetric,
+						Table:    config.Table{ID: 200},
+					},
+				},
+			},
+		}, {
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+  install:
+    backoffmaxinterval: 10s
+    giveupafter: 5m
+    confirm: echo
+    confirmtimeout: 30s`,
+			want: Configuration{
+				LRGConfiguration{
+					From: LRGFromConfiguration{
+						Prefix: defaultIPv4,
+						Table:  DefaultTable,
+					},
+					To: LRGToConfiguration{
+						Prefix:   defaultIPv4,
+						Protocol: DefaultToProtocol,
+						Metric:   DefaultToMetric,
+						Table:    DefaultTable,
+					},
+					Install: &InstallConfiguration{
+						BackoffInterval:    DefaultInstallConfiguration.BackoffInterval,
+						BackoffMaxInterval: config.Duration(10 * time.Second),
+						BackoffMultiplier:  DefaultInstallConfiguration.BackoffMultiplier,
+						InfoDelay:          DefaultInstallConfiguration.InfoDelay,
+						WarningDelay:       DefaultInstallConfiguration.WarningDelay,
+						ErrorDelay:         DefaultInstallConfiguration.ErrorDelay,
+						GiveUpAfter:        config.Duration(5 * time.Minute),
+						Confirm:            LRGConfirmModeEcho,
+						ConfirmTimeout:     config.Duration(30 * time.Second),
+					},
+				},
+			},
+		}, {
+			// Maximum interval lower than interval
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+  install:
+    backoffinterval: 10s
+    backoffmaxinterval: 1s`,
+			err: true,
+		}, {
+			// Negative confirmation timeout
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+  install:
+    confirmtimeout: -1s`,
+			err: true,
+		}, {
+			// Multiplier lower than 1
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+  install:
+    backoffmultiplier: 0.5`,
+			err: true,
+		}, {
+			// Alert delays not increasing
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+  install:
+    warningdelay: 2m`,
+			err: true,
+		}, {
+			// Negative give up delay
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+  install:
+    giveupafter: -1s`,
+			err: true,
+		}, {
+			// Unknown confirmation mode
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+  install:
+    confirm: maybe`,
+			err: true,
+		}, {
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+  to:
+    stale:
+      metric: 4294967294
+      realm: 10`,
+			want: Configuration{
+				LRGConfiguration{
+					From: LRGFromConfiguration{
+						Prefix: defaultIPv4,
+						Table:  DefaultTable,
+					},
+					To: LRGToConfiguration{
+						Prefix:   defaultIPv4,
+						Protocol: DefaultToProtocol,
+						Metric:   DefaultToMetric,
+						Table:    DefaultTable,
+						Stale: &LRGStaleConfiguration{
+							Metric: &metricStale,
+							Realm:  &realm10,
+						},
+					},
+				},
+			},
+		}, {
+			// Stale gateway without any change
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+  to:
+    stale: {}`,
+			err: true,
+		}, {
+			// Stale gateway with a realm for IPv6
+			input: `
+- from:
+    prefix: ::/0
+  to:
+    stale:
+      realm: 10`,
+			err: true,
+		}, {
+			// Condition without anything to check
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+  when:
+    interval: 30s`,
+			err: true,
+		}, {
+			// Condition with several things to check
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+  when:
+    interface: eth0
+    file: /run/keepalived/master`,
+			err: true,
+		}, {
+			// Condition with a null interval
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+  when:
+    interface: eth0
+    interval: 0s`,
+			err: true,
+		}, {
+			// TOS with IPv6
+			input: `
+- from:
+    prefix: ::/0
+    tos: 16`,
+			err: true,
+		}, {
+			// TOS with IPv6 target
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+  to:
+    prefix: ::/0
+    tos: 16`,
+			err: true,
+		}, {
+			// Source prefix with IPv4
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+    source: 192.168.0.0/16`,
+			err: true,
+		}, {
+			// Source prefix with another family
+			input: `
+- from:
+    prefix: ::/0
+    source: 192.168.0.0/16`,
+			err: true,
+		}, {
+			// Router advertisement mode with IPv4
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+    mode: ra`,
+			err: true,
+		}, {
+			// Router advertisement mode with another protocol
+			input: `
+- from:
+    prefix: ::/0
+    mode: ra
+    protocol: kernel`,
+			err: true,
+		}, {
+			// Unknown mode
+			input: `
+- from:
+    prefix: ::/0
+    mode: unknown`,
+			err: true,
+		}, {
+			// Expiry with IPv4
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+  to:
+    expires: 5m`,
+			err: true,
+		}, {
+			// Expiry too short
+			input: `
+- from:
+    prefix: ::/0
+  to:
+    expires: 1s`,
+			err: true,
+		}, {
+			// Rule without a dedicated table
 			input: `
 - from:
     prefix: 0.0.0.0/0
-    protocol: kernel
-    metric: 0
-    table: 254
   to:
-    protocol: 254
-    metric: 1000
+    rule: {}`,
+			err: true,
+		}, {
+			// Rule with a reserved table
+			input: `
+- from:
+    prefix: 0.0.0.0/0
     table: public
-    blackhole: true`,
-			want: Configuration{
-				LRGConfiguration{
-					From: LRGFromConfiguration{
-						Prefix:   defaultIPv4,
-						Protocol: &config.Protocol{ID: 2, Name: "kernel"},
-						Metric:   &metric0,
-						Table:    config.Table{ID: 254},
-					},
-					To: LRGToConfiguration{
-						Prefix:    defaultIPv4,
-						Protocol:  config.Protocol{ID: 254},
-						Metric:    metric1000,
-						Table:     config.Table{ID: 90, Name: "public"},
-						Blackhole: true,
-					},
-				},
-			},
+  to:
+    table: main
+    rule: {}`,
+			err: true,
+		}, {
+			// Previous rule priority being the current one
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+  to:
+    table: public
+    rule:
+      previouspriorities: [40000]`,
+			err: true,
+		}, {
+			// Conflicting rule priorities
+			input: `
+- from:
+    prefix: 0.0.0.0/0
+  to:
+    table: public
+    rule:
+      priority: 33000
+- from:
+    prefix: 10.16.0.0/16
+  to:
+    table: public
+    rule:
+      priority: 34000`,
+			err: true,
 		},
 	}
 	for _, tc := range cases {
@@ -185,6 +1050,9 @@ func TestFromMatch(t *testing.T) {
 	defaultIPv6 := net.IPNet(config.MustParsePrefix("::/0"))
 	randomPrefix := net.IPNet(config.MustParsePrefix("10.16.0.0/16"))
 	metric1000 := config.Metric(1000)
+	source1 := config.MustParsePrefix("2001:db8:1::/48")
+	sourceAny := config.MustParsePrefix("::/0")
+	tos16 := uint8(16)
 	cases := []struct {
 		config   LRGFromConfiguration
 		route    netlink.Route
@@ -378,12 +1246,127 @@ func TestFromMatch(t *testing.T) {
 				Table:    254,
 			},
 			expected: false,
+		}, {
+			config: LRGFromConfiguration{
+				Prefix: config.Prefix(defaultIPv6),
+				Table:  config.Table{ID: 254},
+				Mode:   LRGFromModeRA,
+			},
+			route: netlink.Route{
+				Dst:      &defaultIPv6,
+				Protocol: syscall.RTPROT_RA,
+				Table:    254,
+			},
+			expected: true,
+		}, {
+			config: LRGFromConfiguration{
+				Prefix: config.Prefix(defaultIPv6),
+				Table:  config.Table{ID: 254},
+				Mode:   LRGFromModeRA,
+			},
+			route: netlink.Route{
+				Dst:      &defaultIPv6,
+				Protocol: syscall.RTPROT_BOOT,
+				Table:    254,
+			},
+			expected: false,
+		}, {
+			config: LRGFromConfiguration{
+				Prefix: config.Prefix(defaultIPv6),
+				Table:  config.Table{ID: 254},
+				Source: &source1,
+			},
+			route: netlink.Route{
+				Dst:       &defaultIPv6,
+				Table:     254,
+				SrcPrefix: config.MustParseCIDR("2001:db8:1::/48"),
+			},
+			expected: true,
+		}, {
+			config: LRGFromConfiguration{
+				Prefix: config.Prefix(defaultIPv6),
+				Table:  config.Table{ID: 254},
+				Source: &source1,
+			},
+			route: netlink.Route{
+				Dst:       &defaultIPv6,
+				Table:     254,
+				SrcPrefix: config.MustParseCIDR("2001:db8:2::/48"),
+			},
+			expected: false,
+		}, {
+			config: LRGFromConfiguration{
+				Prefix: config.Prefix(defaultIPv6),
+				Table:  config.Table{ID: 254},
+				Source: &source1,
+			},
+			route: netlink.Route{
+				Dst:   &defaultIPv6,
+				Table: 254,
+			},
+			expected: false,
+		}, {
+			config: LRGFromConfiguration{
+				Prefix: config.Prefix(defaultIPv6),
+				Table:  config.Table{ID: 254},
+			},
+			route: netlink.Route{
+				Dst:       &defaultIPv6,
+				Table:     254,
+				SrcPrefix: config.MustParseCIDR("2001:db8:1::/48"),
+			},
+			expected: false,
+		}, {
+			config: LRGFromConfiguration{
+				Prefix: config.Prefix(defaultIPv6),
+				Table:  config.Table{ID: 254},
+				Source: &sourceAny,
+			},
+			route: netlink.Route{
+				Dst:   &defaultIPv6,
+				Table: 254,
+			},
+			expected: true,
+		}, {
+			config: LRGFromConfiguration{
+				Prefix: config.Prefix(defaultIPv4),
+				Table:  config.Table{ID: 254},
+				Tos:    &tos16,
+			},
+			route: netlink.Route{
+				Dst:   &defaultIPv4,
+				Table: 254,
+				Tos:   16,
+			},
+			expected: true,
+		}, {
+			config: LRGFromConfiguration{
+				Prefix: config.Prefix(defaultIPv4),
+				Table:  config.Table{ID: 254},
+				Tos:    &tos16,
+			},
+			route: netlink.Route{
+				Dst:   &defaultIPv4,
+				Table: 254,
+			},
+			expected: false,
+		}, {
+			config: LRGFromConfiguration{
+				Prefix: config.Prefix(defaultIPv4),
+				Table:  config.Table{ID: 254},
+			},
+			route: netlink.Route{
+				Dst:   &defaultIPv4,
+				Table: 254,
+				Tos:   16,
+			},
+			expected: true,
 		},
 	}
 	for _, tc := range cases {
 		got := tc.config.Match(&tc.route)
 		if tc.expected != got {
-			t.Errorf("LRGFromConfiguration.Match(%s,%s) == %s but expected %s",
+			t.Errorf("LRGFromConfiguration.Match(%v,%v) == %s but expected %s",
 				tc.config, tc.route,
 				strconv.FormatBool(got), strconv.FormatBool(tc.expected))
 		}
@@ -394,6 +1377,10 @@ func TestToMatch(t *testing.T) {
 	defaultIPv4 := net.IPNet(config.MustParsePrefix("0.0.0.0/0"))
 	defaultIPv6 := net.IPNet(config.MustParsePrefix("::/0"))
 	randomPrefix := net.IPNet(config.MustParsePrefix("10.16.0.0/16"))
+	source1 := config.MustParsePrefix("2001:db8:1::/48")
+	tos0 := uint8(0)
+	staleProtocol := config.Protocol{ID: 6}
+	staleMetric := config.Metric(20)
 	cases := []struct {
 		config   LRGToConfiguration
 		route    netlink.Route
@@ -525,6 +1512,106 @@ func TestToMatch(t *testing.T) {
 				Table:    254,
 			},
 			expected: false,
+		}, {
+			config: LRGToConfiguration{
+				Prefix:   config.Prefix(defaultIPv6),
+				Metric:   10,
+				Protocol: config.Protocol{ID: 5},
+				Table:    config.Table{ID: 254},
+				Source:   &source1,
+			},
+			route: netlink.Route{
+				Dst:       &defaultIPv6,
+				Priority:  10,
+				Protocol:  5,
+				Table:     254,
+				SrcPrefix: config.MustParseCIDR("2001:db8:1::/48"),
+			},
+			expected: true,
+		}, {
+			config: LRGToConfiguration{
+				Prefix:   config.Prefix(defaultIPv6),
+				Metric:   10,
+				Protocol: config.Protocol{ID: 5},
+				Table:    config.Table{ID: 254},
+				Source:   &source1,
+			},
+			route: netlink.Route{
+				Dst:      &defaultIPv6,
+				Priority: 10,
+				Protocol: 5,
+				Table:    254,
+			},
+			expected: false,
+		}, {
+			config: LRGToConfiguration{
+				Prefix:   config.Prefix(defaultIPv4),
+				Metric:   10,
+				Protocol: config.Protocol{ID: 5},
+				Table:    config.Table{ID: 254},
+				Tos:      &tos0,
+			},
+			route: netlink.Route{
+				Dst:      &defaultIPv4,
+				Priority: 10,
+				Protocol: 5,
+				Table:    254,
+				Tos:      16,
+			},
+			expected: false,
+		}, {
+			config: LRGToConfiguration{
+				Prefix:   config.Prefix(defaultIPv4),
+				Metric:   10,
+				Protocol: config.Protocol{ID: 5},
+				Table:    config.Table{ID: 254},
+				Stale: &LRGStaleConfiguration{
+					Protocol: &staleProtocol,
+					Metric:   &staleMetric,
+				},
+			},
+			route: netlink.Route{
+				Dst:      &defaultIPv4,
+				Priority: 20,
+				Protocol: 6,
+				Table:    254,
+			},
+			expected: true,
+		}, {
+			config: LRGToConfiguration{
+				Prefix:   config.Prefix(defaultIPv4),
+				Metric:   10,
+				Protocol: config.Protocol{ID: 5},
+				Table:    config.Table{ID: 254},
+				Stale: &LRGStaleConfiguration{
+					Metric: &staleMetric,
+				},
+			},
+			route: netlink.Route{
+				Dst:      &defaultIPv4,
+				Priority: 20,
+				Protocol: 5,
+				Table:    254,
+			},
+			expected: true,
+		}, {
+			config: LRGToConfiguration{
+				Prefix:   config.Prefix(defaultIPv4),
+				Metric:   10,
+				Protocol: config.Protocol{ID: 5},
+				Table:    config.Table{ID: 254},
+				Stale: &LRGStaleConfiguration{
+					Protocol: &staleProtocol,
+					Metric:   &staleMetric,
+				},
+			},
+			route: netlink.Route{
+				Dst:      &defaultIPv4,
+				Priority: 20,
+				Protocol: 5,
+				Table:    254,
+			},
+			expected: false,
 		},
 	}
 	for _, tc := range cases {
@@ -536,3 +1623,83 @@ func TestToMatch(t *testing.T) {
 		}
 	}
 }
+
+func TestToMatchRule(t *testing.T) {
+	defaultIPv4 := config.MustParsePrefix("0.0.0.0/0")
+	defaultIPv6 := config.MustParsePrefix("::/0")
+	toConfig := func(prefix config.Prefix, rule *LRGRuleConfiguration) LRGToConfiguration {
+		return LRGToConfiguration{
+			Prefix: prefix,
+			Table:  config.Table{ID: 90},
+			Rule:   rule,
+		}
+	}
+	newRule := func(family, priority, table int) knetlink.Rule {
+		rule := knetlink.NewRule()
+		rule.Family = family
+		rule.Priority = priority
+		rule.Table = table
+		return *rule
+	}
+	withSource := newRule(knetlink.FAMILY_V4, 40000, 90)
+	withSource.Src = config.MustParseCIDR("192.168.0.0/16")
+	cases := []struct {
+		config   LRGToConfiguration
+		rule     knetlink.Rule
+		expected bool
+		stale    bool
+	}{
+		{
+			config:   toConfig(defaultIPv4, &LRGRuleConfiguration{Priority: 40000}),
+			rule:     newRule(knetlink.FAMILY_V4, 40000, 90),
+			expected: true,
+		}, {
+			config: toConfig(defaultIPv4, nil),
+			rule:   newRule(knetlink.FAMILY_V4, 40000, 90),
+		}, {
+			config: toConfig(defaultIPv4, &LRGRuleConfiguration{Priority: 40000}),
+			rule:   newRule(knetlink.FAMILY_V6, 40000, 90),
+		}, {
+			config:   toConfig(defaultIPv6, &LRGRuleConfiguration{Priority: 40000}),
+			rule:     newRule(knetlink.FAMILY_V6, 40000, 90),
+			expected: true,
+		}, {
+			config: toConfig(defaultIPv4, &LRGRuleConfiguration{Priority: 40000}),
+			rule:   newRule(knetlink.FAMILY_V4, 40000, 91),
+		}, {
+			config: toConfig(defaultIPv4, &LRGRuleConfiguration{Priority: 40000}),
+			rule:   newRule(knetlink.FAMILY_V4, 39000, 90),
+		}, {
+			config: toConfig(defaultIPv4, &LRGRuleConfiguration{
+				Priority:           40000,
+				PreviousPriorities: []uint{38000, 39000},
+			}),
+			rule:  newRule(knetlink.FAMILY_V4, 39000, 90),
+			stale: true,
+		}, {
+			config: toConfig(defaultIPv4, &LRGRuleConfiguration{
+				Priority:           40000,
+				PreviousPriorities: []uint{39000},
+			}),
+			rule:     newRule(knetlink.FAMILY_V4, 40000, 90),
+			expected: true,
+		}, {
+			config: toConfig(defaultIPv4, &LRGRuleConfiguration{Priority: 40000}),
+			rule:   withSource,
+		},
+	}
+	for _, tc := range cases {
+		got := tc.config.MatchRule(&tc.rule)
+		if tc.expected != got {
+			t.Errorf("LRGToConfiguration.MatchRule(%s,%s) == %s but expected %s",
+				tc.config, tc.rule,
+				strconv.FormatBool(got), strconv.FormatBool(tc.expected))
+		}
+		got = tc.config.MatchStaleRule(&tc.rule)
+		if tc.stale != got {
+			t.Errorf("LRGToConfiguration.MatchStaleRule(%s,%s) == %s but expected %s",
+				tc.config, tc.rule,
+				strconv.FormatBool(got), strconv.FormatBool(tc.stale))
+		}
+	}
+}
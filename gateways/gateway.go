@@ -21,6 +21,11 @@ const (
 	LRGStateInstalling
 	// LRGStateInstalled when gateway is installed
 	LRGStateInstalled
+	// LRGStateFailed when gateway installation has been abandoned
+	LRGStateFailed
+
+	// lrgStateUnknown when the state of the gateway is not known yet
+	lrgStateUnknown int64 = -1
 )
 
 // gateway is the combination of a last-resort gateway configuration
@@ -33,21 +38,139 @@ type gateway struct {
 
 type gatewayState struct {
 	notification    chan netlink.Notification
-	currentRoute    *knetlink.Route
-	candidateRoutes []*knetlink.Route
+	currentRoute    *netlink.Route
+	replacedRoute   *netlink.Route
+	candidateRoutes []*netlink.Route
+	nexthops        map[uint32]*netlink.Nexthop
+
+	// The whole RIB has been received since the last start of RIB
+	synced bool
 
 	// Timer to install and retry installing a route
 	installationBackoff *backoff.ExponentialBackOff
 	installationTicker  *backoff.Ticker
 	installationTick    <-chan time.Time
+	installationGaveUp  bool
+
+	// When installation has to be confirmed, time of the first
+	// installation of the current route not confirmed yet
+	confirmSince time.Time
+
+	// Installation is suspended until a link used by the current
+	// route comes up
+	linkWait bool
+
+	// Once a nexthop needed the onlink flag, routes are installed
+	// with it
+	onlink bool
+
+	// Timer to refresh the expiry of the current route
+	refreshTicker *time.Ticker
+	refreshTick   <-chan time.Time
+
+	// Policy rule state and timer to install and retry installing it
+	ruleInstalled           bool
+	ruleInstallationBackoff *backoff.ExponentialBackOff
+	ruleInstallationTicker  *backoff.Ticker
+	ruleInstallationTick    <-chan time.Time
+
+	// Latest evaluation of the condition, if any
+	condition      chan bool
+	conditionState evaluation
+
+	// Current state (LRGState*) and gateways depending on it
+	installState int64
+	dependents   []gateway
+
+	// Dependencies on other gateways, with their latest known
+	// state
+	dependencies      []gatewayDependency
+	dependencyUpdates chan dependencyUpdate
+	dependencyStates  map[uint]int64
+	dependenciesState evaluation
+
+	// Aggregates covering this gateway, with the state of the
+	// candidates last reported to them
+	aggregates      []gateway
+	aggregateReport *aggregateUpdate
+
+	// For an aggregate, the covered gateways with their latest
+	// known state and the lost ones, in the order they were lost
+	aggregated       []uint
+	aggregateUpdates chan aggregateUpdate
+	aggregatedStates map[uint]aggregateUpdate
+	aggregatedLost   []uint
+	aggregateState   evaluation
 }
 
+// gatewayDependency is a dependency on the state of another gateway.
+type gatewayDependency struct {
+	index uint
+	state int64
+}
+
+// dependencyUpdate is sent to a gateway when the state of a gateway it
+// depends on changes.
+type dependencyUpdate struct {
+	index uint
+	state int64
+}
+
+// aggregateUpdate is sent to an aggregate when the candidates of a
+// gateway it covers change. A gateway is lost when it has no candidate
+// anymore. The route is its best candidate, or the last one when lost.
+type aggregateUpdate struct {
+	index uint
+	lost  bool
+	route *netlink.Route
+}
+
+// evaluation is the result of the evaluation of the condition or of
+// the dependencies of a gateway.
+type evaluation int
+
 const (
-	installFailureInfoDelay    = 5 * time.Second
-	installFailureWarningDelay = 30 * time.Second
-	installFailureErrorDelay   = 1 * time.Minute
+	// evaluationPending when not evaluated yet
+	evaluationPending evaluation = iota
+	// evaluationUnmet when evaluated as not met
+	evaluationUnmet
+	// evaluationMet when evaluated as met
+	evaluationMet
 )
 
+// newEvaluation returns the evaluation matching the provided result.
+func newEvaluation(met bool) evaluation {
+	if met {
+		return evaluationMet
+	}
+	return evaluationUnmet
+}
+
+// evaluated tells if the condition, the dependencies and, for an
+// aggregate, the covered gateways of a gateway have been
+// evaluated. Until then, the route of the gateway is neither installed
+// nor withdrawn.
+func (s *gatewayState) evaluated() bool {
+	return s.conditionState != evaluationPending &&
+		s.dependenciesState != evaluationPending &&
+		s.aggregateState != evaluationPending
+}
+
+// enabled tells if the route of a gateway should be installed: its
+// condition and its dependencies should be met. An aggregate should
+// also have lost enough covered gateways.
+func (s *gatewayState) enabled() bool {
+	return s.conditionState == evaluationMet &&
+		s.dependenciesState == evaluationMet &&
+		s.aggregateState == evaluationMet
+}
+
+// installed tells if the current route, if any, is not waiting to be
+// installed.
+func (s *gatewayState) installed() bool {
+	return s.installationTick == nil && !s.installationGaveUp && !s.linkWait
+}
+
 // newGateway initializes a last-resort gateway from its
 // configuration.
 func newGateway(index uint, config *LRGConfiguration) gateway {
@@ -56,8 +179,26 @@ func newGateway(index uint, config *LRGConfiguration) gateway {
 		config: config,
 		state: &gatewayState{
 			notification: make(chan netlink.Notification, 100),
+			nexthops:     map[uint32]*netlink.Nexthop{},
+			condition:    make(chan bool),
+
+			installState:      lrgStateUnknown,
+			dependencyUpdates: make(chan dependencyUpdate, 100),
+			dependencyStates:  map[uint]int64{},
+
+			aggregateUpdates: make(chan aggregateUpdate, 100),
+			aggregatedStates: map[uint]aggregateUpdate{},
 		},
 	}
+	if config.When == nil {
+		gw.state.conditionState = evaluationMet
+	}
+	if len(config.Depends) == 0 {
+		gw.state.dependenciesState = evaluationMet
+	}
+	if config.Aggregate == nil {
+		gw.state.aggregateState = evaluationMet
+	}
 	return gw
 }
 
@@ -74,6 +215,12 @@ func (c *Component) runGateway(gateway gateway) error {
 	c.r.Counter("count").Inc(1)
 	defer c.r.Info(fmt.Sprintf("stopping handler for gateway %s", gateway))
 	defer c.r.Counter("count").Dec(1)
+	if gateway.config.To.Expires != 0 {
+		// Refresh often enough to survive a few failures
+		gateway.state.refreshTicker = time.NewTicker(time.Duration(gateway.config.To.Expires) / 3)
+		gateway.state.refreshTick = gateway.state.refreshTicker.C
+		defer gateway.state.refreshTicker.Stop()
+	}
 	for {
 		select {
 		case <-c.t.Dying():
@@ -82,6 +229,10 @@ func (c *Component) runGateway(gateway gateway) error {
 				gateway.state.installationTicker.Stop()
 				gateway.state.installationTick = nil
 			}
+			if gateway.state.ruleInstallationTick != nil {
+				gateway.state.ruleInstallationTicker.Stop()
+				gateway.state.ruleInstallationTick = nil
+			}
 			return nil
 
 		case notification := <-gateway.state.notification:
@@ -90,43 +241,224 @@ func (c *Component) runGateway(gateway gateway) error {
 			// the next event.
 			c.processNotification(&gateway, notification)
 
+		case update := <-gateway.state.dependencyUpdates:
+			// A gateway we depend on has changed state
+			c.processDependencyUpdate(&gateway, update)
+
+		case update := <-gateway.state.aggregateUpdates:
+			// A gateway we cover has changed candidates
+			c.processAggregateUpdate(&gateway, update)
+
+		case met := <-gateway.state.condition:
+			// The condition has been evaluated
+			c.processCondition(&gateway, met)
+
 		case <-gateway.state.installationTick:
 			// We should try to install the current route
 			c.r.Debug(fmt.Sprintf("installing route %s", gateway.state.currentRoute),
 				"gateway", gateway)
 			if err := c.d.Netlink.AddRoute(*gateway.state.currentRoute); err != nil {
-				elapsed := gateway.state.installationBackoff.GetElapsedTime()
-				if elapsed > installFailureErrorDelay {
-					c.r.Error(err, "unable to install route",
-						"route", gateway.state.currentRoute,
-						"elapsed", elapsed)
-				} else {
-					alert := c.r.Debug
-					if elapsed > installFailureWarningDelay {
-						alert = c.r.Warn
-					} else if elapsed > installFailureInfoDelay {
-						alert = c.r.Info
-					}
-					alert("unable to install route",
-						"route", gateway.state.currentRoute,
-						"err", err,
-						"elapsed", elapsed)
+				if err := c.routeInstallFailed(&gateway, err); err != nil {
+					return err
 				}
-				c.r.Counter(fmt.Sprintf("gw%d.install.errors", gateway.index)).Inc(1)
-				c.r.Counter("install.errors").Inc(1)
+				continue
+			}
+			if !c.routeConfirmed(&gateway) {
+				// Installation is retried until confirmed
+				c.confirmGiveUp(&gateway)
 				continue
 			}
 			gateway.state.installationTicker.Stop()
 			gateway.state.installationTick = nil
-			c.r.Gauge(fmt.Sprintf("gw%d.state", gateway.index)).Update(LRGStateInstalled)
+			c.removeReplacedRoute(&gateway)
+			c.updateState(&gateway, LRGStateInstalled)
+
+		case <-gateway.state.refreshTick:
+			// We should refresh the expiry of the current
+			// route, unless we are already installing it.
+			if gateway.state.currentRoute == nil || !gateway.state.installed() {
+				continue
+			}
+			route := *gateway.state.currentRoute
+			route.Expires = gateway.config.To.expiresSeconds()
+			c.r.Debug(fmt.Sprintf("refreshing route %s", &route),
+				"gateway", gateway)
+			if err := c.d.Netlink.AddRoute(route); err != nil {
+				c.r.Warn("unable to refresh route",
+					"route", &route,
+					"err", err,
+					"gateway", gateway)
+				c.r.Counter(fmt.Sprintf("gw%d.refresh.errors", gateway.index)).Inc(1)
+				c.r.Counter("refresh.errors").Inc(1)
+				gateway.state.currentRoute = &route
+				c.installRoute(&gateway)
+				continue
+			}
+			c.r.Counter(fmt.Sprintf("gw%d.refresh.count", gateway.index)).Inc(1)
+
+		case <-gateway.state.ruleInstallationTick:
+			// We should try to install the policy rule
+			rule := gateway.config.To.TargetRule()
+			c.r.Debug(fmt.Sprintf("installing rule %s", rule),
+				"gateway", gateway)
+			if err := c.d.Netlink.AddRule(*rule); err != nil {
+				elapsed := gateway.state.ruleInstallationBackoff.GetElapsedTime()
+				class := installErrorClass(err)
+				c.r.Counter(fmt.Sprintf("gw%d.rule.install.errors.%s", gateway.index, class)).Inc(1)
+				c.r.Counter(fmt.Sprintf("install.errors.%s", class)).Inc(1)
+				if class == installErrorPermission {
+					return c.installForbidden(&gateway, err, "rule", rule)
+				}
+				c.installFailed(&gateway, err, "unable to install rule", elapsed,
+					"rule", rule)
+				if c.installGiveUp(&gateway, elapsed) {
+					c.r.Error(err, "giving up installing rule",
+						"rule", rule,
+						"gateway", gateway)
+					gateway.state.ruleInstallationTicker.Stop()
+					gateway.state.ruleInstallationTick = nil
+					c.r.Counter(fmt.Sprintf("gw%d.rule.install.failed", gateway.index)).Inc(1)
+					c.r.Gauge(fmt.Sprintf("gw%d.rule.state", gateway.index)).Update(LRGStateFailed)
+				}
+				continue
+			}
+			gateway.state.ruleInstallationTicker.Stop()
+			gateway.state.ruleInstallationTick = nil
+			gateway.state.ruleInstalled = true
+			c.r.Gauge(fmt.Sprintf("gw%d.rule.state", gateway.index)).Update(LRGStateInstalled)
+		}
+	}
+}
+
+// Classes of errors when installing a route or a rule. Each class has
+// its own counters and its own reaction.
+const (
+	installErrorUnreachable = "unreachable" // nexthop not on-link
+	installErrorExists      = "exists"      // conflicting entry
+	installErrorNoDevice    = "nodevice"    // device is gone
+	installErrorPermission  = "permission"  // missing CAP_NET_ADMIN
+	installErrorOther       = "other"
+)
+
+// installErrorClass returns the class of an error returned when
+// installing a route or a rule.
+func installErrorClass(err error) string {
+	switch errors.Cause(err) {
+	case syscall.ENETUNREACH:
+		return installErrorUnreachable
+	case syscall.EEXIST:
+		return installErrorExists
+	case syscall.ENODEV:
+		return installErrorNoDevice
+	case syscall.EPERM:
+		return installErrorPermission
+	default:
+		return installErrorOther
+	}
+}
+
+// routeInstallFailed handles a failure to install the current route
+// of the provided gateway. Depending on the class of the error,
+// installation is retried with the onlink flag, suspended until a
+// link comes up or retried as usual. A non-nil error is returned when
+// the daemon should terminate.
+func (c *Component) routeInstallFailed(gateway *gateway, err error) error {
+	route := gateway.state.currentRoute
+	elapsed := gateway.state.installationBackoff.GetElapsedTime()
+	class := installErrorClass(err)
+	c.r.Counter(fmt.Sprintf("gw%d.install.errors.%s", gateway.index, class)).Inc(1)
+	c.r.Counter(fmt.Sprintf("install.errors.%s", class)).Inc(1)
+	switch class {
+	case installErrorPermission:
+		return c.installForbidden(gateway, err, "route", route)
+	case installErrorUnreachable:
+		if onlink := onlinkRoute(route); onlink != nil {
+			c.r.Info("nexthop unreachable, retry with onlink flag",
+				"route", route,
+				"err", err,
+				"gateway", gateway)
+			gateway.state.onlink = true
+			gateway.state.currentRoute = onlink
+			return nil
 		}
+		c.installFailed(gateway, err, "unable to install route", elapsed,
+			"route", route)
+	case installErrorNoDevice:
+		c.r.Info("device is missing, wait for link up to install route",
+			"route", route,
+			"err", err,
+			"gateway", gateway)
+		gateway.state.installationTicker.Stop()
+		gateway.state.installationTick = nil
+		gateway.state.linkWait = true
+		return nil
+	case installErrorExists:
+		// Routes are replaced, this should not happen.
+		c.r.Error(err, "unable to install route",
+			"route", route,
+			"elapsed", elapsed,
+			"gateway", gateway)
+	default:
+		c.installFailed(gateway, err, "unable to install route", elapsed,
+			"route", route)
 	}
+	if c.installGiveUp(gateway, elapsed) {
+		c.r.Error(err, "giving up installing route",
+			"route", route,
+			"gateway", gateway)
+		gateway.state.installationTicker.Stop()
+		gateway.state.installationTick = nil
+		gateway.state.installationGaveUp = true
+		c.r.Counter(fmt.Sprintf("gw%d.install.failed", gateway.index)).Inc(1)
+		c.updateState(gateway, LRGStateFailed)
+	}
+	return nil
+}
+
+// installForbidden handles a failure to install a route or a rule
+// because of missing privileges. Retrying is useless, so the daemon
+// fails with this error.
+func (c *Component) installForbidden(gateway *gateway, err error, ctx ...interface{}) error {
+	err = errors.Wrap(err, "not allowed to modify kernel routing tables")
+	c.r.Error(err, "terminating", append(ctx, "gateway", gateway)...)
+	if c.d.Daemon != nil {
+		c.d.Daemon.Fail(err)
+	}
+	return err
+}
+
+// installFailed reports a failure to install a route or a rule. The
+// longer the installation has been failing, the louder the alert.
+func (c *Component) installFailed(gateway *gateway, err error, msg string, elapsed time.Duration, ctx ...interface{}) {
+	install := gateway.config.install()
+	ctx = append(ctx, "elapsed", elapsed, "gateway", gateway)
+	if elapsed > time.Duration(install.ErrorDelay) {
+		c.r.Error(err, msg, ctx...)
+		return
+	}
+	alert := c.r.Debug
+	if elapsed > time.Duration(install.WarningDelay) {
+		alert = c.r.Warn
+	} else if elapsed > time.Duration(install.InfoDelay) {
+		alert = c.r.Info
+	}
+	alert(msg, append(ctx, "err", err)...)
+}
+
+// installGiveUp tells if installation of a route or a rule should be
+// abandoned after failing for the provided duration.
+func (c *Component) installGiveUp(gateway *gateway, elapsed time.Duration) bool {
+	giveUp := time.Duration(gateway.config.install().GiveUpAfter)
+	return giveUp > 0 && elapsed >= giveUp
 }
 
 // pushNotification forwards a given notification to a gateway to be
 // processed.
 func (c *Component) pushNotification(gateway gateway, notification netlink.Notification) {
-	gateway.state.notification <- notification
+	select {
+	case gateway.state.notification <- notification:
+	case <-c.t.Dying():
+	}
 }
 
 // processNotification will handle a notification for the given
@@ -135,10 +467,39 @@ func (c *Component) processNotification(gateway *gateway, notification netlink.N
 	switch {
 	case notification.StartOfRIB:
 		c.r.Debug("received start of RIB event", "gateway", gateway)
-		gateway.state.candidateRoutes = []*knetlink.Route{}
+		gateway.state.synced = false
+		gateway.state.candidateRoutes = []*netlink.Route{}
+		gateway.state.nexthops = map[uint32]*netlink.Nexthop{}
+		gateway.state.ruleInstalled = false
 	case notification.EndOfRIB:
 		c.r.Debug("received end of RIB event", "gateway", gateway)
+		gateway.state.synced = true
 		c.installCandidateRoute(gateway)
+		c.installRule(gateway)
+	case notification.RuleUpdate != nil:
+		c.processRuleUpdate(gateway, notification.RuleUpdate)
+	case notification.LinkUpdate != nil:
+		c.processLinkUpdate(gateway, notification.LinkUpdate)
+	case notification.NexthopUpdate != nil:
+		c.r.Counter(fmt.Sprintf("gw%d.updates.nexthops", gateway.index)).Inc(1)
+		nexthop := notification.NexthopUpdate.Nexthop
+		switch notification.NexthopUpdate.Type {
+		case netlink.RTMDelNexthop:
+			c.r.Debug(fmt.Sprintf("update %s removes a nexthop", nexthop),
+				"gateway", gateway)
+			c.removeNexthop(gateway, nexthop.ID)
+			c.installCandidateRoute(gateway)
+		case netlink.RTMNewNexthop:
+			c.r.Debug(fmt.Sprintf("update %s adds a nexthop", nexthop),
+				"gateway", gateway)
+			gateway.state.nexthops[nexthop.ID] = &nexthop
+			c.installCandidateRoute(gateway)
+		default:
+			c.r.Error(errors.New("unknown nexthop update type received"),
+				"",
+				"notification", notification,
+				"gateway", gateway)
+		}
 	case notification.RouteUpdate != nil:
 		c.r.Counter(fmt.Sprintf("gw%d.updates.total", gateway.index)).Inc(1)
 		config := gateway.config
@@ -148,6 +509,14 @@ func (c *Component) processNotification(gateway *gateway, notification netlink.N
 			c.r.Counter(fmt.Sprintf("gw%d.updates.target", gateway.index)).Inc(1)
 			switch notification.RouteUpdate.Type {
 			case syscall.RTM_DELROUTE:
+				if current := gateway.state.currentRoute; current != nil && !sameKey(current, route) {
+					// Removal of a replaced route (for
+					// example, a fresh route replaced by
+					// a stale one)
+					c.r.Debug(fmt.Sprintf("update %s removes a replaced gateway target",
+						route), "gateway", gateway)
+					break
+				}
 				c.r.Debug(fmt.Sprintf("update %s removes current gateway target",
 					route), "gateway", gateway)
 				gateway.state.currentRoute = nil
@@ -155,7 +524,9 @@ func (c *Component) processNotification(gateway *gateway, notification netlink.N
 			case syscall.RTM_NEWROUTE:
 				c.r.Debug(fmt.Sprintf("update %s matches current gateway target",
 					route), "gateway", gateway)
+				c.confirmEcho(gateway, route)
 				gateway.state.currentRoute = route
+				gateway.state.installationGaveUp = false
 				c.installCandidateRoute(gateway)
 			default:
 				c.r.Error(errors.New("unknown route update type received"),
@@ -163,6 +534,15 @@ func (c *Component) processNotification(gateway *gateway, notification netlink.N
 					"notification", notification,
 					"gateway", gateway)
 			}
+		case config.Aggregate != nil:
+			// Candidates of an aggregate come from the
+			// gateways it covers
+			c.r.Counter(fmt.Sprintf("gw%d.updates.alien", gateway.index)).Inc(1)
+		case config.From.Match(route) && config.To.ownProtocol(route.Protocol):
+			// Never use our own routes as candidates
+			c.r.Counter(fmt.Sprintf("gw%d.updates.own", gateway.index)).Inc(1)
+			c.r.Debug(fmt.Sprintf("update %s ignored as it carries our own protocol",
+				route), "gateway", gateway)
 		case config.From.Match(route):
 			c.r.Counter(fmt.Sprintf("gw%d.updates.source", gateway.index)).Inc(1)
 			// Update the candidates. As we may have to
@@ -195,11 +575,249 @@ func (c *Component) processNotification(gateway *gateway, notification netlink.N
 	}
 }
 
+// processCondition will handle a new evaluation of the condition of
+// the given gateway. The route is installed when the condition becomes
+// true and withdrawn when it becomes false.
+func (c *Component) processCondition(gateway *gateway, met bool) {
+	if newEvaluation(met) == gateway.state.conditionState {
+		if gateway.state.evaluated() && !gateway.state.enabled() &&
+			gateway.state.currentRoute != nil {
+			// A previous withdrawal may have failed
+			c.withdrawRoute(gateway)
+		}
+		return
+	}
+	c.r.Info("gateway condition change",
+		"condition", gateway.config.When,
+		"met", met,
+		"gateway", gateway)
+	gateway.state.conditionState = newEvaluation(met)
+	if met {
+		c.r.Gauge(fmt.Sprintf("gw%d.condition", gateway.index)).Update(1)
+	} else {
+		c.r.Gauge(fmt.Sprintf("gw%d.condition", gateway.index)).Update(0)
+	}
+	c.installCandidateRoute(gateway)
+}
+
+// processDependencyUpdate will handle a state change of a gateway the
+// given gateway depends on. The route is installed when all the
+// dependencies are met and withdrawn otherwise. Dependencies are
+// evaluated once the state of all of them is known.
+func (c *Component) processDependencyUpdate(gateway *gateway, update dependencyUpdate) {
+	gateway.state.dependencyStates[update.index] = update.state
+	met := true
+	for _, dependency := range gateway.state.dependencies {
+		state, ok := gateway.state.dependencyStates[dependency.index]
+		if !ok {
+			return
+		}
+		if state != dependency.state {
+			met = false
+		}
+	}
+	if newEvaluation(met) == gateway.state.dependenciesState {
+		return
+	}
+	c.r.Info("gateway dependencies change",
+		"met", met,
+		"gateway", gateway)
+	gateway.state.dependenciesState = newEvaluation(met)
+	c.installCandidateRoute(gateway)
+}
+
+// processAggregateUpdate will handle a change of the candidates of a
+// gateway covered by the given aggregate. The aggregate is installed
+// once more than the configured number of covered gateways are lost,
+// using the last candidate of the most recently lost one. It is
+// evaluated once the state of all of them is known.
+func (c *Component) processAggregateUpdate(gateway *gateway, update aggregateUpdate) {
+	state := gateway.state
+	previous := state.aggregatedStates[update.index]
+	state.aggregatedStates[update.index] = update
+	switch {
+	case update.lost && !previous.lost:
+		state.aggregatedLost = append(state.aggregatedLost, update.index)
+	case !update.lost && previous.lost:
+		lost := make([]uint, 0, len(state.aggregatedLost))
+		for _, index := range state.aggregatedLost {
+			if index != update.index {
+				lost = append(lost, index)
+			}
+		}
+		state.aggregatedLost = lost
+	}
+	lost := len(state.aggregatedLost)
+	c.r.Gauge(fmt.Sprintf("gw%d.aggregate.lost", gateway.index)).Update(int64(lost))
+	for _, index := range state.aggregated {
+		if _, ok := state.aggregatedStates[index]; !ok {
+			return
+		}
+	}
+	met := lost > int(gateway.config.Aggregate.Lost)
+	if newEvaluation(met) != state.aggregateState {
+		c.r.Info("gateway aggregate change",
+			"lost", lost,
+			"met", met,
+			"gateway", gateway)
+		state.aggregateState = newEvaluation(met)
+	}
+	// The candidate may change even when the evaluation doesn't
+	c.installCandidateRoute(gateway)
+}
+
+// aggregateCandidates returns the candidates of the provided
+// aggregate: the last candidate of the most recently lost gateway it
+// covers, if any.
+func aggregateCandidates(gateway *gateway) []*netlink.Route {
+	state := gateway.state
+	if len(state.aggregatedLost) == 0 {
+		return nil
+	}
+	last := state.aggregatedLost[len(state.aggregatedLost)-1]
+	return []*netlink.Route{state.aggregatedStates[last].route}
+}
+
+// updateAggregates reports the candidates of the given gateway to the
+// aggregates covering it, once the initial RIB is known. Only changes
+// are reported.
+func (c *Component) updateAggregates(gateway *gateway, candidates []*netlink.Route) {
+	state := gateway.state
+	if len(state.aggregates) == 0 || !state.synced {
+		return
+	}
+	update := aggregateUpdate{index: gateway.index}
+	if best := bestCandidateRoute(candidates); best != nil {
+		update.route = copyRoute(best)
+	} else if state.aggregateReport != nil && state.aggregateReport.route != nil {
+		update.route = state.aggregateReport.route
+		update.lost = true
+	}
+	if report := state.aggregateReport; report != nil && report.lost == update.lost &&
+		(report.route == update.route ||
+			(report.route != nil && update.route != nil && report.route.Equal(*update.route))) {
+		return
+	}
+	state.aggregateReport = &update
+	for _, aggregate := range state.aggregates {
+		select {
+		case <-c.t.Dying():
+			return
+		case aggregate.state.aggregateUpdates <- update:
+		}
+	}
+}
+
+// updateState will update the state of the given gateway. Gateways
+// depending on it are notified when the state changes.
+func (c *Component) updateState(gateway *gateway, state int64) {
+	c.r.Gauge(fmt.Sprintf("gw%d.state", gateway.index)).Update(state)
+	if state == gateway.state.installState {
+		return
+	}
+	gateway.state.installState = state
+	for _, dependent := range gateway.state.dependents {
+		select {
+		case <-c.t.Dying():
+			return
+		case dependent.state.dependencyUpdates <- dependencyUpdate{
+			index: gateway.index,
+			state: state,
+		}:
+		}
+	}
+}
+
+// processLinkUpdate will handle a link update for the given
+// gateway. When the installation of the current route is waiting for
+// a missing link, it is resumed once any link comes up: a recreated
+// device gets a new index, so candidate routes are selected again
+// before retrying. If the device is still missing, installation waits
+// again for the next link.
+func (c *Component) processLinkUpdate(gateway *gateway, update *knetlink.LinkUpdate) {
+	attrs := update.Link.Attrs()
+	route := gateway.state.currentRoute
+	if !gateway.state.linkWait || route == nil ||
+		update.Header.Type != syscall.RTM_NEWLINK ||
+		!linkUp(attrs) {
+		return
+	}
+	c.r.Info("link is up, resume route installation",
+		"link", attrs.Name,
+		"index", attrs.Index,
+		"route", route,
+		"gateway", gateway)
+	c.installCandidateRoute(gateway)
+	if gateway.state.linkWait {
+		// Same target, retry it
+		c.installRoute(gateway)
+	}
+}
+
+// processRuleUpdate will handle a rule update for the given
+// gateway. The policy rule is reinstalled when removed and rules for
+// the dedicated table with another priority are removed.
+func (c *Component) processRuleUpdate(gateway *gateway, update *netlink.RuleUpdate) {
+	config := &gateway.config.To
+	rule := &update.Rule
+	switch {
+	case config.MatchRule(rule):
+		c.r.Counter(fmt.Sprintf("gw%d.updates.rule", gateway.index)).Inc(1)
+		switch update.Type {
+		case syscall.RTM_DELRULE:
+			c.r.Debug(fmt.Sprintf("update %s removes policy rule", rule),
+				"gateway", gateway)
+			gateway.state.ruleInstalled = false
+			c.installRule(gateway)
+		case syscall.RTM_NEWRULE:
+			c.r.Debug(fmt.Sprintf("update %s matches policy rule", rule),
+				"gateway", gateway)
+			gateway.state.ruleInstalled = true
+			if gateway.state.ruleInstallationTick != nil {
+				gateway.state.ruleInstallationTicker.Stop()
+				gateway.state.ruleInstallationTick = nil
+			}
+			c.r.Gauge(fmt.Sprintf("gw%d.rule.state", gateway.index)).Update(LRGStateInstalled)
+		default:
+			c.r.Error(errors.New("unknown rule update type received"),
+				"",
+				"update", update,
+				"gateway", gateway)
+		}
+	case update.Type == syscall.RTM_NEWRULE && config.MatchStaleRule(rule):
+		c.r.Info("removing stale policy rule",
+			"rule", rule,
+			"gateway", gateway)
+		c.r.Counter(fmt.Sprintf("gw%d.updates.rule", gateway.index)).Inc(1)
+		if err := c.d.Netlink.DeleteRule(*rule); err != nil {
+			c.r.Error(err, "unable to remove stale rule",
+				"rule", rule,
+				"gateway", gateway)
+		}
+	}
+}
+
+// installRule will trigger policy rule installation for the provided
+// gateway if it is configured with a rule which is not present.
+// Installation will be retried until it succeeds or until the
+// configured delay to give up.
+func (c *Component) installRule(gateway *gateway) {
+	if gateway.config.To.Rule == nil || gateway.state.ruleInstalled ||
+		gateway.state.ruleInstallationTick != nil {
+		return
+	}
+	c.r.Gauge(fmt.Sprintf("gw%d.rule.state", gateway.index)).Update(LRGStateInstalling)
+	b := newInstallationBackOff(gateway.config.install())
+	gateway.state.ruleInstallationBackoff = b
+	gateway.state.ruleInstallationTicker = backoff.NewTicker(b)
+	gateway.state.ruleInstallationTick = gateway.state.ruleInstallationTicker.C
+}
+
 // removeCandidateRoute will remove a candidate route from the list of
 // candidate routes. The route may not exist. We don't error in this
 // case.
-func (c *Component) removeCandidateRoute(gateway *gateway, route *knetlink.Route) {
-	new := make([]*knetlink.Route, 0, len(gateway.state.candidateRoutes))
+func (c *Component) removeCandidateRoute(gateway *gateway, route *netlink.Route) {
+	new := make([]*netlink.Route, 0, len(gateway.state.candidateRoutes))
 	for _, current := range gateway.state.candidateRoutes {
 		if !current.Equal(*route) {
 			new = append(new, current)
@@ -214,9 +832,13 @@ func (c *Component) removeCandidateRoute(gateway *gateway, route *knetlink.Route
 // candidate routes. If the route exists, nothing is done. If a route
 // has the same table, prefix, tos and priority, it is replaced. When
 // using IPv6 ECMP routes, this may be problematic. This needs to be
-// carefully tested during integration tests.
-func (c *Component) addCandidateRoute(gateway *gateway, route *knetlink.Route) {
-	new := make([]*knetlink.Route, 0, len(gateway.state.candidateRoutes))
+// carefully tested during integration tests. In router advertisement
+// mode, routes from different routers share the same table, prefix,
+// tos and priority, so the gateway and the interface should match
+// too.
+func (c *Component) addCandidateRoute(gateway *gateway, route *netlink.Route) {
+	ra := gateway.config.From.Mode == LRGFromModeRA
+	new := make([]*netlink.Route, 0, len(gateway.state.candidateRoutes))
 	for _, current := range gateway.state.candidateRoutes {
 		if current.Equal(*route) {
 			return
@@ -224,7 +846,8 @@ func (c *Component) addCandidateRoute(gateway *gateway, route *knetlink.Route) {
 		if helpers.IPNetEqual(*current.Dst, *route.Dst) &&
 			current.Table == route.Table &&
 			current.Tos == route.Tos &&
-			current.Priority == route.Priority {
+			current.Priority == route.Priority &&
+			(!ra || (current.Gw.Equal(route.Gw) && current.LinkIndex == route.LinkIndex)) {
 			c.r.Debug(fmt.Sprintf("replace route %s by %s", current, route),
 				"gateway", gateway)
 			continue
@@ -236,57 +859,338 @@ func (c *Component) addCandidateRoute(gateway *gateway, route *knetlink.Route) {
 		"gateway", gateway)
 }
 
+// removeNexthop will remove a nexthop object. The kernel removes
+// routes using a nexthop object when it is deleted without
+// notification. Therefore, we also remove candidates using it. Groups
+// using it are updated and removed if empty.
+func (c *Component) removeNexthop(gateway *gateway, id uint32) {
+	removed := []uint32{id}
+	delete(gateway.state.nexthops, id)
+	for groupID, nexthop := range gateway.state.nexthops {
+		if len(nexthop.Group) == 0 {
+			continue
+		}
+		group := make([]netlink.NexthopGroupMember, 0, len(nexthop.Group))
+		for _, member := range nexthop.Group {
+			if member.ID != id {
+				group = append(group, member)
+			}
+		}
+		switch len(group) {
+		case len(nexthop.Group):
+		case 0:
+			delete(gateway.state.nexthops, groupID)
+			removed = append(removed, groupID)
+		default:
+			updated := *nexthop
+			updated.Group = group
+			gateway.state.nexthops[groupID] = &updated
+		}
+	}
+
+	new := make([]*netlink.Route, 0, len(gateway.state.candidateRoutes))
+outer:
+	for _, current := range gateway.state.candidateRoutes {
+		for _, id := range removed {
+			if current.NHID == int(id) {
+				continue outer
+			}
+		}
+		new = append(new, current)
+	}
+	gateway.state.candidateRoutes = new
+	c.r.Debug(fmt.Sprintf("current list of candidates is %v", gateway.state.candidateRoutes),
+		"gateway", gateway)
+}
+
 // installCandidateRoute will select the best candidate route (sorting by
-// tos, then priority) and will install it.
+// tos, then priority) and will install it. Aggregates covering the
+// gateway are notified of a change of candidates.
 func (c *Component) installCandidateRoute(gateway *gateway) {
-	target := targetRoute(gateway.state.candidateRoutes, &gateway.config.To)
+	candidates := resolveRoutes(gateway.state.candidateRoutes, gateway.state.nexthops)
+	if gateway.config.Aggregate != nil {
+		candidates = aggregateCandidates(gateway)
+	}
+	c.updateAggregates(gateway, candidates)
+	if !gateway.state.evaluated() {
+		c.r.Debug("gateway not evaluated yet",
+			"gateway", gateway)
+		return
+	}
+	if !gateway.state.enabled() {
+		c.withdrawRoute(gateway)
+		return
+	}
+	target := targetRoute(candidates, &gateway.config.To)
+	stale := false
+	if target == nil && gateway.state.currentRoute != nil {
+		// The current route is kept, maybe marked as stale
+		target = gateway.config.To.StaleRoute(gateway.state.currentRoute)
+		stale = target != nil
+	}
+	if target != nil && gateway.state.onlink {
+		if onlink := onlinkRoute(target); onlink != nil {
+			target = onlink
+		}
+	}
 	if target == nil {
 		c.r.Debug("no candidates for gateway",
 			"gateway", gateway)
-		if gateway.state.currentRoute == nil {
-			c.r.Gauge(fmt.Sprintf("gw%d.state", gateway.index)).Update(LRGStateMissing)
+		switch {
+		case gateway.state.currentRoute == nil:
+			c.updateState(gateway, LRGStateMissing)
+		case gateway.state.installed():
+			c.updateState(gateway, LRGStateInstalled)
 		}
 		return
 	}
-	if gateway.state.currentRoute != nil && target.Equal(*gateway.state.currentRoute) {
+	if gateway.state.currentRoute != nil && sameTarget(target, gateway.state.currentRoute) {
 		c.r.Debug("no change for gateway",
 			"gateway", gateway)
+		if gateway.state.installed() {
+			c.updateState(gateway, LRGStateInstalled)
+		}
 		return
 	}
 	c.r.Counter(fmt.Sprintf("gw%d.changes", gateway.index)).Inc(1)
 	c.r.Info("last-resort gateway change",
 		"from", gateway.state.currentRoute,
 		"to", target,
+		"stale", stale,
 		"gateway", gateway)
+	if gateway.config.To.Stale != nil {
+		if stale {
+			c.r.Gauge(fmt.Sprintf("gw%d.stale", gateway.index)).Update(1)
+		} else {
+			c.r.Gauge(fmt.Sprintf("gw%d.stale", gateway.index)).Update(0)
+		}
+	}
+	if current := gateway.state.currentRoute; current != nil &&
+		gateway.state.replacedRoute == nil && !sameKey(current, target) {
+		// The kernel won't replace the current route
+		gateway.state.replacedRoute = current
+	}
 	gateway.state.currentRoute = target
 	c.installRoute(gateway)
 }
 
+// routeConfirmed tells if the installation of the current route of
+// the provided gateway is confirmed, once accepted by the kernel. With
+// the echo mode, the confirmation usually comes with the notification
+// of the route (see confirmEcho). However, the kernel doesn't notify
+// an IPv4 route replaced by an identical one: the route is read back
+// when retrying.
+func (c *Component) routeConfirmed(gateway *gateway) bool {
+	mode := gateway.config.install().Confirm
+	if mode == LRGConfirmModeNone {
+		return true
+	}
+	retry := !gateway.state.confirmSince.IsZero()
+	if !retry {
+		gateway.state.confirmSince = time.Now()
+	} else {
+		// Previous installation was not confirmed
+		c.r.Counter(fmt.Sprintf("gw%d.install.unconfirmed", gateway.index)).Inc(1)
+		c.r.Counter("install.unconfirmed").Inc(1)
+	}
+	if mode == LRGConfirmModeEcho && !retry {
+		return false
+	}
+	present, err := c.d.Netlink.HasRoute(*gateway.state.currentRoute)
+	if err != nil {
+		c.r.Warn("unable to confirm route installation",
+			"route", gateway.state.currentRoute,
+			"err", err,
+			"gateway", gateway)
+		return false
+	}
+	if !present {
+		c.r.Debug(fmt.Sprintf("route %s not read back", gateway.state.currentRoute),
+			"gateway", gateway)
+		return false
+	}
+	c.installConfirmed(gateway)
+	return true
+}
+
+// confirmGiveUp abandons the installation of the current route of the
+// provided gateway when it has not been confirmed for the configured
+// timeout.
+func (c *Component) confirmGiveUp(gateway *gateway) {
+	timeout := time.Duration(gateway.config.install().ConfirmTimeout)
+	if timeout == 0 || time.Since(gateway.state.confirmSince) < timeout {
+		return
+	}
+	c.r.Error(errors.Errorf("not confirmed after %s", timeout),
+		"giving up installing route",
+		"route", gateway.state.currentRoute,
+		"gateway", gateway)
+	gateway.state.installationTicker.Stop()
+	gateway.state.installationTick = nil
+	gateway.state.installationGaveUp = true
+	gateway.state.confirmSince = time.Time{}
+	c.r.Counter(fmt.Sprintf("gw%d.install.failed", gateway.index)).Inc(1)
+	c.updateState(gateway, LRGStateFailed)
+}
+
+// confirmEcho confirms the installation of the current route of the
+// provided gateway when the kernel notifies a route reflecting it
+// (see netlink.SameRoute).
+func (c *Component) confirmEcho(gateway *gateway, route *netlink.Route) {
+	state := gateway.state
+	if gateway.config.install().Confirm != LRGConfirmModeEcho ||
+		state.confirmSince.IsZero() || state.installationTick == nil ||
+		state.currentRoute == nil || !netlink.SameRoute(*state.currentRoute, *route) {
+		return
+	}
+	c.installConfirmed(gateway)
+	state.installationTicker.Stop()
+	state.installationTick = nil
+	c.removeReplacedRoute(gateway)
+}
+
+// installConfirmed records the latency between the installation of
+// the current route of the provided gateway and its confirmation.
+func (c *Component) installConfirmed(gateway *gateway) {
+	latency := int64(time.Since(gateway.state.confirmSince) / time.Microsecond)
+	gateway.state.confirmSince = time.Time{}
+	c.r.Histogram(fmt.Sprintf("gw%d.install.latency", gateway.index)).Update(latency)
+	c.r.Histogram("install.latency").Update(latency)
+}
+
+// removeReplacedRoute will remove the route replaced by the current
+// route of the provided gateway, if any. This is needed when the
+// current route cannot replace it, for example when a fresh route is
+// marked as stale with another metric.
+func (c *Component) removeReplacedRoute(gateway *gateway) {
+	replaced := gateway.state.replacedRoute
+	if replaced == nil {
+		return
+	}
+	gateway.state.replacedRoute = nil
+	if current := gateway.state.currentRoute; current != nil && sameKey(current, replaced) {
+		// The current route has replaced it
+		return
+	}
+	c.r.Debug(fmt.Sprintf("removing replaced route %s", replaced),
+		"gateway", gateway)
+	if err := c.d.Netlink.DeleteRoute(*replaced); err != nil {
+		c.r.Error(err, "unable to remove replaced route",
+			"route", replaced,
+			"gateway", gateway)
+	}
+}
+
+// sameTarget tells if the current last-resort route, as notified by
+// the kernel, matches the target route. The kernel may change some
+// attributes, like the remaining time before expiry or the flags
+// reflecting the state of the link. Only the attributes set from the
+// configuration or copied from the candidate are compared.
+func sameTarget(target, current *netlink.Route) bool {
+	onlink := int(knetlink.FLAG_ONLINK)
+	return netlink.SameRoute(*target, *current) &&
+		target.Protocol == current.Protocol &&
+		target.Realm == current.Realm &&
+		target.Src.Equal(current.Src) &&
+		target.Flags&onlink == current.Flags&onlink
+}
+
+// sameKey tells if two last-resort routes would replace each
+// other. Other fields of the key (prefix, table, TOS) don't change for
+// a given gateway.
+func sameKey(route1, route2 *netlink.Route) bool {
+	return route1.Protocol == route2.Protocol &&
+		route1.Priority == route2.Priority
+}
+
+// withdrawRoute will remove the current route of the provided
+// gateway, if any, and stop trying to install it. This is used when
+// the condition, the dependencies or the aggregate of the gateway are
+// not met.
+func (c *Component) withdrawRoute(gateway *gateway) {
+	if gateway.state.installationTick != nil {
+		gateway.state.installationTicker.Stop()
+		gateway.state.installationTick = nil
+	}
+	gateway.state.linkWait = false
+	gateway.state.confirmSince = time.Time{}
+	c.removeReplacedRoute(gateway)
+	if gateway.state.currentRoute != nil {
+		c.r.Info("last-resort gateway withdrawal",
+			"route", gateway.state.currentRoute,
+			"gateway", gateway)
+		if err := c.d.Netlink.DeleteRoute(*gateway.state.currentRoute); err != nil {
+			c.r.Error(err, "unable to withdraw route",
+				"route", gateway.state.currentRoute,
+				"gateway", gateway)
+			c.r.Counter(fmt.Sprintf("gw%d.withdraw.errors", gateway.index)).Inc(1)
+			return
+		}
+		c.r.Counter(fmt.Sprintf("gw%d.withdrawals", gateway.index)).Inc(1)
+		gateway.state.currentRoute = nil
+	}
+	c.updateState(gateway, LRGStateMissing)
+}
+
 // installRoute will trigger route installation for the provided
-// gateway. Installation will be retried until it succeeds. It just
-// sets a ticker to be used in gateway loop.
+// gateway. Installation will be retried until it succeeds or until
+// the configured delay to give up. It just sets a ticker to be used in
+// gateway loop.
 func (c *Component) installRoute(gateway *gateway) {
-	c.r.Gauge(fmt.Sprintf("gw%d.state", gateway.index)).Update(LRGStateInstalling)
+	c.updateState(gateway, LRGStateInstalling)
 	if gateway.state.installationTick != nil {
 		gateway.state.installationTicker.Stop()
 	}
-	b := backoff.NewExponentialBackOff()
-	b.InitialInterval = time.Duration(100 * time.Millisecond)
-	b.MaxInterval = 1 * time.Minute
-	b.MaxElapsedTime = 0 // Never stops
-	b.Multiplier = 2
+	gateway.state.installationGaveUp = false
+	gateway.state.linkWait = false
+	gateway.state.confirmSince = time.Time{}
+	b := newInstallationBackOff(gateway.config.install())
 	gateway.state.installationBackoff = b
 	gateway.state.installationTicker = backoff.NewTicker(b)
 	gateway.state.installationTick = gateway.state.installationTicker.C
 }
 
+// newInstallationBackOff returns the backoff used to retry installing
+// a route or a rule.
+func newInstallationBackOff(install *InstallConfiguration) *backoff.ExponentialBackOff {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = time.Duration(install.BackoffInterval)
+	b.MaxInterval = time.Duration(install.BackoffMaxInterval)
+	b.MaxElapsedTime = 0 // Giving up is handled by the gateway loop
+	b.Multiplier = install.BackoffMultiplier
+	return b
+}
+
+// IPv6 router preferences (RFC 4191), as encoded by the kernel.
+const (
+	routerPrefMedium = 0
+	routerPrefHigh   = 1
+	routerPrefLow    = 3
+)
+
+// routerPrefRank returns a rank for a router preference. The lower,
+// the better.
+func routerPrefRank(pref int) int {
+	switch pref {
+	case routerPrefHigh:
+		return 0
+	case routerPrefLow:
+		return 2
+	default:
+		return 1
+	}
+}
+
 // bestCandidateRoute will return the best candidate route (sorting by
-// tos, then priority, using the older one in case of equality).
-func bestCandidateRoute(candidates []*knetlink.Route) (best *knetlink.Route) {
+// tos, then priority, then router preference, using the older one in
+// case of equality).
+func bestCandidateRoute(candidates []*netlink.Route) (best *netlink.Route) {
 	for _, current := range candidates {
 		if best == nil ||
 			best.Tos > current.Tos ||
-			(best.Tos == current.Tos && best.Priority > current.Priority) {
+			(best.Tos == current.Tos && best.Priority > current.Priority) ||
+			(best.Tos == current.Tos && best.Priority == current.Priority &&
+				routerPrefRank(best.Pref) > routerPrefRank(current.Pref)) {
 			best = current
 		}
 	}
@@ -296,18 +1200,24 @@ func bestCandidateRoute(candidates []*knetlink.Route) (best *knetlink.Route) {
 // targetRoute will build the target routes from the configuration and
 // the list of candidates. It may return nil if there is no candidate
 // and no blackhole route was requested.
-func targetRoute(candidates []*knetlink.Route, config *LRGToConfiguration) (target *knetlink.Route) {
+func targetRoute(candidates []*netlink.Route, config *LRGToConfiguration) (target *netlink.Route) {
 	best := bestCandidateRoute(candidates)
 	if best == nil {
 		if !config.Blackhole {
 			return
 		}
-		target = &knetlink.Route{
+		target = &netlink.Route{
 			Type: syscall.RTN_BLACKHOLE,
 		}
 	} else {
-		bestCopy := *best
-		target = &bestCopy
+		target = copyRoute(best)
+		if (best.Dst.IP.To4() == nil) != (config.Prefix.IP.To4() == nil) {
+			// The preferred source and the router
+			// preference only make sense for the
+			// family of the selected route.
+			target.Src = nil
+			target.Pref = 0
+		}
 	}
 
 	// Modify some fields to match configuration
@@ -316,6 +1226,161 @@ func targetRoute(candidates []*knetlink.Route, config *LRGToConfiguration) (targ
 	target.Protocol = int(config.Protocol.ID)
 	target.Priority = int(config.Metric)
 	target.Table = int(config.Table.ID)
+	target.Expires = config.expiresSeconds()
+	if config.Tos != nil {
+		target.Tos = int(*config.Tos)
+	}
+	target.SrcPrefix = nil
+	if config.Source != nil {
+		if ones, _ := config.Source.Mask.Size(); ones > 0 {
+			src := net.IPNet(*config.Source)
+			target.SrcPrefix = &src
+		}
+	}
+	if dst.IP.To4() != nil {
+		viaGateways(target)
+	}
 
 	return
 }
+
+// viaGateways turns the IPv6 gateways of an IPv4 route into "via
+// inet6" nexthops (RFC 5549). The kernel only accepts such gateways
+// through the RTA_VIA attribute. They come from nexthop objects or
+// from an IPv6 selected route. The route is modified in place.
+func viaGateways(route *netlink.Route) {
+	if route.Gw != nil && route.Gw.To4() == nil {
+		route.Via = &netlink.Via{AddrFamily: knetlink.FAMILY_V6, Addr: route.Gw}
+		route.Gw = nil
+	}
+	for _, nh := range route.MultiPath {
+		if nh.Gw != nil && nh.Gw.To4() == nil {
+			nh.Via = &netlink.Via{AddrFamily: knetlink.FAMILY_V6, Addr: nh.Gw}
+			nh.Gw = nil
+		}
+	}
+}
+
+// resolveRoutes returns the provided routes with nexthop objects
+// replaced by inline nexthops. This way, last-resort routes don't
+// depend on nexthop objects owned by a routing daemon that may remove
+// them on exit. Routes referencing an unknown nexthop object are
+// omitted.
+func resolveRoutes(routes []*netlink.Route, nexthops map[uint32]*netlink.Nexthop) []*netlink.Route {
+	resolved := make([]*netlink.Route, 0, len(routes))
+	for _, route := range routes {
+		if route := resolveRoute(route, nexthops); route != nil {
+			resolved = append(resolved, route)
+		}
+	}
+	return resolved
+}
+
+// resolveRoute returns the provided route with its nexthop object
+// replaced by inline nexthops. Flags and encapsulations of the nexthop
+// objects are carried over. It returns nil if the route references an
+// unknown nexthop object.
+func resolveRoute(route *netlink.Route, nexthops map[uint32]*netlink.Nexthop) *netlink.Route {
+	if route.NHID == 0 {
+		return route
+	}
+	nexthop, ok := nexthops[uint32(route.NHID)]
+	if !ok {
+		return nil
+	}
+	resolved := copyRoute(route)
+	resolved.NHID = 0
+	resolved.LinkIndex = 0
+	resolved.Gw = nil
+	resolved.Flags = 0
+	resolved.Encap = nil
+	resolved.MultiPath = nil
+	switch {
+	case nexthop.Blackhole:
+		resolved.Type = syscall.RTN_BLACKHOLE
+	case len(nexthop.Group) > 0:
+		for _, member := range nexthop.Group {
+			nh, ok := nexthops[member.ID]
+			if !ok || nh.Blackhole || len(nh.Group) > 0 {
+				return nil
+			}
+			resolved.MultiPath = append(resolved.MultiPath, &netlink.NexthopInfo{
+				LinkIndex: nh.LinkIndex,
+				Gw:        nh.Gw,
+				Hops:      member.Weight - 1,
+				Flags:     nh.Flags,
+				Encap:     nh.Encap,
+			})
+		}
+	default:
+		resolved.LinkIndex = nexthop.LinkIndex
+		resolved.Gw = nexthop.Gw
+		resolved.Flags = nexthop.Flags
+		resolved.Encap = nexthop.Encap
+	}
+	return resolved
+}
+
+// onlinkRoute returns a copy of the provided route with the onlink
+// flag set on each nexthop with a gateway. Nil is returned when no
+// nexthop needs the flag.
+func onlinkRoute(route *netlink.Route) *netlink.Route {
+	onlink := int(knetlink.FLAG_ONLINK)
+	changed := false
+	copied := copyRoute(route)
+	if (copied.Gw != nil || copied.Via != nil) && copied.Flags&onlink == 0 {
+		copied.Flags |= onlink
+		changed = true
+	}
+	for _, nh := range copied.MultiPath {
+		if (nh.Gw != nil || nh.Via != nil) && nh.Flags&onlink == 0 {
+			nh.Flags |= onlink
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return copied
+}
+
+// copyRoute returns a copy of the provided route. Nexthops of
+// multipath routes are copied too, as well as encapsulations and "via"
+// gateways, so that the copy doesn't share anything mutable with the
+// original route.
+func copyRoute(route *netlink.Route) *netlink.Route {
+	copied := *route
+	copied.Encap = copyEncap(route.Encap)
+	copied.Via = copyVia(route.Via)
+	if route.MultiPath != nil {
+		copied.MultiPath = make([]*netlink.NexthopInfo, 0, len(route.MultiPath))
+		for _, nh := range route.MultiPath {
+			nhCopy := *nh
+			nhCopy.Encap = copyEncap(nh.Encap)
+			nhCopy.Via = copyVia(nh.Via)
+			copied.MultiPath = append(copied.MultiPath, &nhCopy)
+		}
+	}
+	return &copied
+}
+
+// copyEncap returns a copy of the provided encapsulation. Only MPLS
+// encapsulations are decoded by the netlink package, others are
+// returned as is.
+func copyEncap(encap knetlink.Encap) knetlink.Encap {
+	if mpls, ok := encap.(*knetlink.MPLSEncap); ok && mpls != nil {
+		return &knetlink.MPLSEncap{Labels: append([]int(nil), mpls.Labels...)}
+	}
+	return encap
+}
+
+// copyVia returns a copy of the provided "via" gateway.
+func copyVia(via *netlink.Via) *netlink.Via {
+	if via == nil {
+		return nil
+	}
+	return &netlink.Via{
+		AddrFamily: via.AddrFamily,
+		Addr:       append(net.IP(nil), via.Addr...),
+	}
+}
@@ -4,16 +4,20 @@ import (
 	"net"
 	"syscall"
 	"testing"
+	"time"
 
-	"github.com/vishvananda/netlink"
+	knetlink "github.com/vishvananda/netlink"
 
 	"lrg/config"
 	"lrg/helpers"
+	"lrg/netlink"
 )
 
 func TestBestCandidateRoute(t *testing.T) {
 	cases := []netlink.Route{
+		{Tos: 0, Priority: 0, Pref: routerPrefHigh},
 		{Tos: 0, Priority: 0},
+		{Tos: 0, Priority: 0, Pref: routerPrefLow},
 		{Tos: 0, Priority: 1},
 		{Tos: 0, Priority: 2},
 		{Tos: 1, Priority: 0},
@@ -22,7 +26,8 @@ func TestBestCandidateRoute(t *testing.T) {
 		{Tos: 2, Priority: 0},
 		{Tos: 2, Priority: 1},
 		{Tos: 2, Priority: 2},
-		{Tos: 2, Priority: 3},
+		{Tos: 2, Priority: 3, Pref: routerPrefHigh},
+		{Tos: 2, Priority: 3, Pref: routerPrefMedium},
 	}
 	linkIndex := 1
 	for i1, r1 := range cases {
@@ -72,6 +77,8 @@ func TestBestCandidateRoute(t *testing.T) {
 }
 
 func TestTargetRoute(t *testing.T) {
+	sourcePrefix := config.MustParsePrefix("2001:db8:2::/48")
+	tos4 := uint8(4)
 	cases := []struct {
 		candidate *netlink.Route
 		config    LRGToConfiguration
@@ -128,6 +135,178 @@ func TestTargetRoute(t *testing.T) {
 				Type:     syscall.RTN_UNICAST,
 				Gw:       net.IPv4(1, 1, 1, 1),
 			},
+		}, {
+			// Source-specific route
+			candidate: &netlink.Route{
+				Dst:       config.MustParseCIDR("::/0"),
+				SrcPrefix: config.MustParseCIDR("2001:db8:1::/48"),
+				Table:     200,
+				Protocol:  2,
+				Priority:  10,
+				Gw:        net.ParseIP("2001:db8::1"),
+			},
+			config: LRGToConfiguration{
+				Prefix:   config.MustParsePrefix("::/0"),
+				Table:    config.Table{ID: 254},
+				Protocol: config.Protocol{ID: 5},
+				Metric:   1000,
+				Source:   &sourcePrefix,
+			},
+			expected: &netlink.Route{
+				Dst:       config.MustParseCIDR("::/0"),
+				SrcPrefix: config.MustParseCIDR("2001:db8:2::/48"),
+				Table:     254,
+				Protocol:  5,
+				Priority:  1000,
+				Gw:        net.ParseIP("2001:db8::1"),
+			},
+		}, {
+			// IPv4 route with an IPv6 gateway
+			candidate: &netlink.Route{
+				Dst:      config.MustParseCIDR("0.0.0.0/0"),
+				Table:    200,
+				Protocol: 2,
+				Priority: 10,
+				Via: &netlink.Via{
+					AddrFamily: knetlink.FAMILY_V6,
+					Addr:       net.ParseIP("fe80::1"),
+				},
+				LinkIndex: 2,
+			},
+			config: LRGToConfiguration{
+				Prefix:   config.MustParsePrefix("0.0.0.0/0"),
+				Table:    config.Table{ID: 254},
+				Protocol: config.Protocol{ID: 5},
+				Metric:   1000,
+			},
+			expected: &netlink.Route{
+				Dst:      config.MustParseCIDR("0.0.0.0/0"),
+				Table:    254,
+				Protocol: 5,
+				Priority: 1000,
+				Via: &netlink.Via{
+					AddrFamily: knetlink.FAMILY_V6,
+					Addr:       net.ParseIP("fe80::1"),
+				},
+				LinkIndex: 2,
+			},
+		}, {
+			// IPv6 route copied as an IPv4 route
+			candidate: &netlink.Route{
+				Dst:      config.MustParseCIDR("::/0"),
+				Table:    200,
+				Protocol: 2,
+				Priority: 10,
+				MultiPath: []*netlink.NexthopInfo{
+					{LinkIndex: 2, Gw: net.ParseIP("fe80::1")},
+					{LinkIndex: 3, Gw: net.ParseIP("fe80::2")},
+				},
+			},
+			config: LRGToConfiguration{
+				Prefix:   config.MustParsePrefix("0.0.0.0/0"),
+				Table:    config.Table{ID: 254},
+				Protocol: config.Protocol{ID: 5},
+				Metric:   1000,
+			},
+			expected: &netlink.Route{
+				Dst:      config.MustParseCIDR("0.0.0.0/0"),
+				Table:    254,
+				Protocol: 5,
+				Priority: 1000,
+				MultiPath: []*netlink.NexthopInfo{
+					{
+						LinkIndex: 2,
+						Via: &netlink.Via{
+							AddrFamily: knetlink.FAMILY_V6,
+							Addr:       net.ParseIP("fe80::1"),
+						},
+					}, {
+						LinkIndex: 3,
+						Via: &netlink.Via{
+							AddrFamily: knetlink.FAMILY_V6,
+							Addr:       net.ParseIP("fe80::2"),
+						},
+					},
+				},
+			},
+		}, {
+			// IPv6 route with a preferred source copied as an IPv4 route
+			candidate: &netlink.Route{
+				Dst:       config.MustParseCIDR("::/0"),
+				Table:     200,
+				Protocol:  2,
+				Priority:  10,
+				LinkIndex: 2,
+				Gw:        net.ParseIP("fe80::1"),
+				Src:       net.ParseIP("2001:db8::10"),
+				Pref:      1,
+			},
+			config: LRGToConfiguration{
+				Prefix:   config.MustParsePrefix("0.0.0.0/0"),
+				Table:    config.Table{ID: 254},
+				Protocol: config.Protocol{ID: 5},
+				Metric:   1000,
+			},
+			expected: &netlink.Route{
+				Dst:       config.MustParseCIDR("0.0.0.0/0"),
+				Table:     254,
+				Protocol:  5,
+				Priority:  1000,
+				LinkIndex: 2,
+				Via: &netlink.Via{
+					AddrFamily: knetlink.FAMILY_V6,
+					Addr:       net.ParseIP("fe80::1"),
+				},
+			},
+		}, {
+			// TOS-specific route
+			candidate: &netlink.Route{
+				Dst:      config.MustParseCIDR("0.0.0.0/0"),
+				Table:    200,
+				Protocol: 2,
+				Priority: 10,
+				Tos:      16,
+				Gw:       net.IPv4(1, 1, 1, 1),
+			},
+			config: LRGToConfiguration{
+				Prefix:   config.MustParsePrefix("0.0.0.0/0"),
+				Table:    config.Table{ID: 254},
+				Protocol: config.Protocol{ID: 5},
+				Metric:   1000,
+				Tos:      &tos4,
+			},
+			expected: &netlink.Route{
+				Dst:      config.MustParseCIDR("0.0.0.0/0"),
+				Table:    254,
+				Protocol: 5,
+				Priority: 1000,
+				Tos:      4,
+				Gw:       net.IPv4(1, 1, 1, 1),
+			},
+		}, {
+			// Expiring route
+			candidate: &netlink.Route{
+				Dst:      config.MustParseCIDR("::/0"),
+				Table:    200,
+				Protocol: 2,
+				Priority: 10,
+				Gw:       net.ParseIP("2001:db8::1"),
+			},
+			config: LRGToConfiguration{
+				Prefix:   config.MustParsePrefix("::/0"),
+				Table:    config.Table{ID: 254},
+				Protocol: config.Protocol{ID: 5},
+				Metric:   1000,
+				Expires:  config.Duration(90 * time.Second),
+			},
+			expected: &netlink.Route{
+				Dst:      config.MustParseCIDR("::/0"),
+				Table:    254,
+				Protocol: 5,
+				Priority: 1000,
+				Gw:       net.ParseIP("2001:db8::1"),
+				Expires:  90,
+			},
 		}, {
 			candidate: &netlink.Route{
 				Dst:      config.MustParseCIDR("::/0"),
@@ -152,6 +331,76 @@ func TestTargetRoute(t *testing.T) {
 				Type:     syscall.RTN_UNICAST,
 				Gw:       net.ParseIP("2001:db8:15::1"),
 			},
+		}, {
+			candidate: &netlink.Route{
+				Dst:      config.MustParseCIDR("0.0.0.0/0"),
+				Table:    200,
+				Protocol: 2,
+				Priority: 10,
+				Type:     syscall.RTN_UNICAST,
+				Gw:       net.IPv4(1, 1, 1, 1),
+				Encap:    &knetlink.MPLSEncap{Labels: []int{100}},
+			},
+			config: LRGToConfiguration{
+				Prefix:   config.MustParsePrefix("0.0.0.0/0"),
+				Table:    config.Table{ID: 254},
+				Protocol: config.Protocol{ID: 5},
+				Metric:   1000,
+			},
+			expected: &netlink.Route{
+				Dst:      config.MustParseCIDR("0.0.0.0/0"),
+				Table:    254,
+				Protocol: 5,
+				Priority: 1000,
+				Type:     syscall.RTN_UNICAST,
+				Gw:       net.IPv4(1, 1, 1, 1),
+				Encap:    &knetlink.MPLSEncap{Labels: []int{100}},
+			},
+		}, {
+			candidate: &netlink.Route{
+				Dst:      config.MustParseCIDR("0.0.0.0/0"),
+				Table:    200,
+				Protocol: 2,
+				Priority: 10,
+				Type:     syscall.RTN_UNICAST,
+				MultiPath: []*netlink.NexthopInfo{
+					&netlink.NexthopInfo{
+						LinkIndex: 2,
+						Gw:        net.IPv4(1, 1, 1, 1),
+						Encap:     &knetlink.MPLSEncap{Labels: []int{100}},
+					},
+					&netlink.NexthopInfo{
+						LinkIndex: 3,
+						Gw:        net.IPv4(1, 1, 1, 2),
+						Encap:     &knetlink.MPLSEncap{Labels: []int{200, 300}},
+					},
+				},
+			},
+			config: LRGToConfiguration{
+				Prefix:   config.MustParsePrefix("0.0.0.0/0"),
+				Table:    config.Table{ID: 254},
+				Protocol: config.Protocol{ID: 5},
+				Metric:   1000,
+			},
+			expected: &netlink.Route{
+				Dst:      config.MustParseCIDR("0.0.0.0/0"),
+				Table:    254,
+				Protocol: 5,
+				Priority: 1000,
+				Type:     syscall.RTN_UNICAST,
+				MultiPath: []*netlink.NexthopInfo{
+					&netlink.NexthopInfo{
+						LinkIndex: 2,
+						Gw:        net.IPv4(1, 1, 1, 1),
+						Encap:     &knetlink.MPLSEncap{Labels: []int{100}},
+					},
+					&netlink.NexthopInfo{
+						LinkIndex: 3,
+						Gw:        net.IPv4(1, 1, 1, 2),
+						Encap:     &knetlink.MPLSEncap{Labels: []int{200, 300}},
+					},
+				},
+			},
 		},
 	}
 	for _, tc := range cases {
@@ -177,3 +426,208 @@ func TestTargetRoute(t *testing.T) {
 		}
 	}
 }
+
+func TestTargetRouteEncap(t *testing.T) {
+	candidate := &netlink.Route{
+		Dst:      config.MustParseCIDR("0.0.0.0/0"),
+		Table:    254,
+		Priority: 10,
+		MultiPath: []*netlink.NexthopInfo{
+			&netlink.NexthopInfo{
+				LinkIndex: 2,
+				Gw:        net.IPv4(1, 1, 1, 1),
+				Encap:     &knetlink.MPLSEncap{Labels: []int{100}},
+			},
+		},
+	}
+	to := LRGToConfiguration{
+		Prefix:   config.MustParsePrefix("0.0.0.0/0"),
+		Table:    config.Table{ID: 254},
+		Protocol: config.Protocol{ID: 5},
+		Metric:   1000,
+	}
+	target := targetRoute([]*netlink.Route{candidate}, &to)
+
+	// The copy should not share nexthops with the candidate
+	if target.MultiPath[0] == candidate.MultiPath[0] {
+		t.Fatalf("targetRoute() shares nexthops with the candidate route")
+	}
+	candidate.MultiPath[0].Gw = net.IPv4(1, 1, 1, 2)
+	if !target.MultiPath[0].Gw.Equal(net.IPv4(1, 1, 1, 1)) {
+		t.Fatalf("targetRoute() nexthop modified by candidate route change")
+	}
+	if target.MultiPath[0].Encap == candidate.MultiPath[0].Encap {
+		t.Fatalf("targetRoute() shares nexthop encapsulation with the candidate route")
+	}
+	candidate.MultiPath[0].Encap.(*knetlink.MPLSEncap).Labels[0] = 200
+	if labels := target.MultiPath[0].Encap.(*knetlink.MPLSEncap).Labels; labels[0] != 100 {
+		t.Fatalf("targetRoute() nexthop encapsulation modified by candidate route change")
+	}
+
+	// A different encapsulation should make the target different
+	other := *target
+	other.MultiPath = []*netlink.NexthopInfo{
+		&netlink.NexthopInfo{
+			LinkIndex: 2,
+			Gw:        net.IPv4(1, 1, 1, 1),
+			Encap:     &knetlink.MPLSEncap{Labels: []int{200}},
+		},
+	}
+	if target.Equal(other) {
+		t.Errorf("targetRoute() equal to a route with a different nexthop encap")
+	}
+	other.MultiPath = target.MultiPath
+	other.Encap = &knetlink.MPLSEncap{Labels: []int{100}}
+	if target.Equal(other) {
+		t.Errorf("targetRoute() equal to a route with a different encap")
+	}
+}
+
+func TestResolveRoute(t *testing.T) {
+	nexthops := map[uint32]*netlink.Nexthop{
+		10: &netlink.Nexthop{ID: 10, LinkIndex: 2, Gw: net.IPv4(1, 1, 1, 1)},
+		11: &netlink.Nexthop{ID: 11, LinkIndex: 3, Gw: net.IPv4(1, 1, 1, 2)},
+		12: &netlink.Nexthop{ID: 12, Group: []netlink.NexthopGroupMember{
+			{ID: 10, Weight: 1},
+			{ID: 11, Weight: 5},
+		}},
+		13: &netlink.Nexthop{ID: 13, Blackhole: true},
+		14: &netlink.Nexthop{ID: 14, Group: []netlink.NexthopGroupMember{
+			{ID: 10, Weight: 1},
+			{ID: 15, Weight: 1},
+		}},
+		16: &netlink.Nexthop{
+			ID:        16,
+			LinkIndex: 3,
+			Gw:        net.IPv4(1, 1, 1, 4),
+			Flags:     syscall.RTNH_F_ONLINK,
+			Encap:     &knetlink.MPLSEncap{Labels: []int{100}},
+		},
+		17: &netlink.Nexthop{ID: 17, Group: []netlink.NexthopGroupMember{
+			{ID: 10, Weight: 1},
+			{ID: 16, Weight: 1},
+		}},
+	}
+	cases := []struct {
+		description string
+		route       netlink.Route
+		expected    *netlink.Route
+	}{
+		{
+			description: "inline nexthop",
+			route: netlink.Route{
+				Dst:       config.MustParseCIDR("0.0.0.0/0"),
+				LinkIndex: 2,
+				Gw:        net.IPv4(1, 1, 1, 3),
+			},
+			expected: &netlink.Route{
+				Dst:       config.MustParseCIDR("0.0.0.0/0"),
+				LinkIndex: 2,
+				Gw:        net.IPv4(1, 1, 1, 3),
+			},
+		}, {
+			description: "single nexthop object",
+			route: netlink.Route{
+				Dst:       config.MustParseCIDR("0.0.0.0/0"),
+				LinkIndex: 2,
+				Gw:        net.IPv4(1, 1, 1, 1),
+				NHID:      10,
+			},
+			expected: &netlink.Route{
+				Dst:       config.MustParseCIDR("0.0.0.0/0"),
+				LinkIndex: 2,
+				Gw:        net.IPv4(1, 1, 1, 1),
+			},
+		}, {
+			description: "group nexthop object",
+			route: netlink.Route{
+				Dst:  config.MustParseCIDR("0.0.0.0/0"),
+				NHID: 12,
+			},
+			expected: &netlink.Route{
+				Dst: config.MustParseCIDR("0.0.0.0/0"),
+				MultiPath: []*netlink.NexthopInfo{
+					&netlink.NexthopInfo{
+						LinkIndex: 2,
+						Gw:        net.IPv4(1, 1, 1, 1),
+					},
+					&netlink.NexthopInfo{
+						LinkIndex: 3,
+						Gw:        net.IPv4(1, 1, 1, 2),
+						Hops:      4,
+					},
+				},
+			},
+		}, {
+			description: "nexthop object with flags and encapsulation",
+			route: netlink.Route{
+				Dst:  config.MustParseCIDR("0.0.0.0/0"),
+				NHID: 16,
+			},
+			expected: &netlink.Route{
+				Dst:       config.MustParseCIDR("0.0.0.0/0"),
+				LinkIndex: 3,
+				Gw:        net.IPv4(1, 1, 1, 4),
+				Flags:     syscall.RTNH_F_ONLINK,
+				Encap:     &knetlink.MPLSEncap{Labels: []int{100}},
+			},
+		}, {
+			description: "group with flags and encapsulation",
+			route: netlink.Route{
+				Dst:  config.MustParseCIDR("0.0.0.0/0"),
+				NHID: 17,
+			},
+			expected: &netlink.Route{
+				Dst: config.MustParseCIDR("0.0.0.0/0"),
+				MultiPath: []*netlink.NexthopInfo{
+					&netlink.NexthopInfo{
+						LinkIndex: 2,
+						Gw:        net.IPv4(1, 1, 1, 1),
+					},
+					&netlink.NexthopInfo{
+						LinkIndex: 3,
+						Gw:        net.IPv4(1, 1, 1, 4),
+						Flags:     syscall.RTNH_F_ONLINK,
+						Encap:     &knetlink.MPLSEncap{Labels: []int{100}},
+					},
+				},
+			},
+		}, {
+			description: "blackhole nexthop object",
+			route: netlink.Route{
+				Dst:  config.MustParseCIDR("0.0.0.0/0"),
+				NHID: 13,
+			},
+			expected: &netlink.Route{
+				Dst:  config.MustParseCIDR("0.0.0.0/0"),
+				Type: syscall.RTN_BLACKHOLE,
+			},
+		}, {
+			description: "unknown nexthop object",
+			route: netlink.Route{
+				Dst:  config.MustParseCIDR("0.0.0.0/0"),
+				NHID: 20,
+			},
+			expected: nil,
+		}, {
+			description: "group with unknown nexthop object",
+			route: netlink.Route{
+				Dst:  config.MustParseCIDR("0.0.0.0/0"),
+				NHID: 14,
+			},
+			expected: nil,
+		},
+	}
+	for _, tc := range cases {
+		got := resolveRoute(&tc.route, nexthops)
+		if got == nil || tc.expected == nil {
+			if got != tc.expected {
+				t.Errorf("resolveRoute(%q) == %v but expected %v", tc.description, got, tc.expected)
+			}
+			continue
+		}
+		if diff := helpers.Diff(got, tc.expected); diff != "" {
+			t.Errorf("resolveRoute(%q) (-got +want):\n%s", tc.description, diff)
+		}
+	}
+}
@@ -3,8 +3,11 @@
 package gateways
 
 import (
+	"net"
+
 	"gopkg.in/tomb.v2"
 
+	"lrg/daemon"
 	"lrg/netlink"
 	"lrg/reporter"
 )
@@ -17,12 +20,14 @@ type Component struct {
 	t      tomb.Tomb
 	config Configuration
 
-	gateways []gateway
+	gateways    []gateway
+	unsubscribe func()
 }
 
 // Dependencies are the dependencies for the gateway component.
 type Dependencies struct {
 	Netlink netlink.Component
+	Daemon  daemon.Component
 }
 
 // New creates a new gateway component.
@@ -39,11 +44,32 @@ func New(reporter *reporter.Reporter, configuration Configuration, dependencies
 // Start will activate the gateway component. For each last-resort
 // gateway, a goroutine will be spawned to handle it.
 func (c *Component) Start() error {
-	for index, gwConfig := range c.config {
-		gw := newGateway(uint(index+1), &gwConfig)
+	names := map[string]gateway{}
+	for index := range c.config {
+		gw := newGateway(uint(index+1), &c.config[index])
+		for _, dependency := range gw.config.Depends {
+			// Configuration ensures this is a previous gateway
+			other := names[dependency.Gateway]
+			other.state.dependents = append(other.state.dependents, gw)
+			gw.state.dependencies = append(gw.state.dependencies, gatewayDependency{
+				index: other.index,
+				state: dependency.State.gatewayState(),
+			})
+		}
+		if gw.config.Aggregate != nil {
+			for _, name := range gw.config.Aggregate.Gateways {
+				// Configuration ensures this is a previous gateway
+				other := names[name]
+				other.state.aggregates = append(other.state.aggregates, gw)
+				gw.state.aggregated = append(gw.state.aggregated, other.index)
+			}
+		}
+		if gw.config.Name != "" {
+			names[gw.config.Name] = gw
+		}
 		c.gateways = append(c.gateways, gw)
 	}
-	c.d.Netlink.Subscribe(func(n netlink.Notification) {
+	c.unsubscribe = c.d.Netlink.SubscribeRoutes("gateways", routeFilters(c.config), func(n netlink.Notification) {
 		if c.t.Alive() {
 			for _, gw := range c.gateways {
 				c.r.Counter("notification.count").Inc(1)
@@ -53,7 +79,11 @@ func (c *Component) Start() error {
 	})
 	c.t.Go(func() error {
 		for _, gw := range c.gateways {
+			gw := gw
 			c.t.Go(func() error { return c.runGateway(gw) })
+			if gw.config.When != nil {
+				c.t.Go(func() error { return c.watchCondition(gw) })
+			}
 		}
 		return nil
 	})
@@ -65,5 +95,29 @@ func (c *Component) Stop() error {
 	c.r.Info("shutting down gateway component")
 	defer c.r.Info("gateway component stopped")
 	c.t.Kill(nil)
+	if c.unsubscribe != nil {
+		c.unsubscribe()
+	}
 	return c.t.Wait()
 }
+
+// routeFilters returns the route filters matching the routes the
+// gateways are interested in: the candidate routes and the
+// last-resort routes. Aggregates don't get their candidates from the
+// kernel.
+func routeFilters(configuration Configuration) []netlink.RouteFilter {
+	filters := []netlink.RouteFilter{}
+	for _, gw := range configuration {
+		if gw.Aggregate == nil {
+			filters = append(filters, netlink.RouteFilter{
+				Table:  int(gw.From.Table.ID),
+				Prefix: net.IPNet(gw.From.Prefix),
+			})
+		}
+		filters = append(filters, netlink.RouteFilter{
+			Table:  int(gw.To.Table.ID),
+			Prefix: net.IPNet(gw.To.Prefix),
+		})
+	}
+	return filters
+}
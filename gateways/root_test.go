@@ -1,15 +1,21 @@
 package gateways
 
 import (
+	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"sync"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	knetlink "github.com/vishvananda/netlink"
 
 	"lrg/config"
+	"lrg/daemon"
 	"lrg/helpers"
 	"lrg/netlink"
 	"lrg/reporter"
@@ -17,6 +23,8 @@ import (
 
 func TestGateways(t *testing.T) {
 	defaultIPv4 := config.MustParsePrefix("0.0.0.0/0")
+	sourcePrefix := config.MustParsePrefix("2001:db8:1::/48")
+	tos16 := uint8(16)
 	simpleConfiguration := Configuration{
 		LRGConfiguration{
 			From: LRGFromConfiguration{
@@ -37,7 +45,7 @@ func TestGateways(t *testing.T) {
 		description   string
 		config        Configuration
 		notifications []netlink.Notification
-		expected      knetlink.Route
+		expected      netlink.Route
 	}{
 		{
 			description: "empty configuration",
@@ -46,7 +54,7 @@ func TestGateways(t *testing.T) {
 				netlink.Notification{StartOfRIB: true},
 				netlink.Notification{EndOfRIB: true},
 			},
-			expected: knetlink.Route{},
+			expected: netlink.Route{},
 		}, {
 			description: "empty RIB",
 			config:      simpleConfiguration,
@@ -54,7 +62,7 @@ func TestGateways(t *testing.T) {
 				netlink.Notification{StartOfRIB: true},
 				netlink.Notification{EndOfRIB: true},
 			},
-			expected: knetlink.Route{},
+			expected: netlink.Route{},
 		}, {
 			description: "empty RIB with blackhole enabled",
 			config: Configuration{
@@ -76,13 +84,46 @@ func TestGateways(t *testing.T) {
 				netlink.Notification{StartOfRIB: true},
 				netlink.Notification{EndOfRIB: true},
 			},
-			expected: knetlink.Route{
+			expected: netlink.Route{
 				Dst:      config.MustParseCIDR("0.0.0.0/0"),
 				Table:    int(DefaultTable.ID),
 				Protocol: int(DefaultToProtocol.ID),
 				Priority: int(DefaultToMetric),
 				Type:     syscall.RTN_BLACKHOLE,
 			},
+		}, {
+			description: "candidate carrying our own protocol",
+			config: Configuration{
+				LRGConfiguration{
+					From: LRGFromConfiguration{
+						Prefix: defaultIPv4,
+						Table:  DefaultTable,
+					},
+					To: LRGToConfiguration{
+						Prefix:   defaultIPv4,
+						Protocol: DefaultToProtocol,
+						Metric:   DefaultToMetric,
+						Table:    config.Table{ID: 200},
+					},
+				},
+			},
+			notifications: []netlink.Notification{
+				netlink.Notification{StartOfRIB: true},
+				netlink.Notification{
+					RouteUpdate: &netlink.RouteUpdate{
+						Type: syscall.RTM_NEWROUTE,
+						Route: netlink.Route{
+							Dst:       config.MustParseCIDR("0.0.0.0/0"),
+							Table:     int(DefaultTable.ID),
+							Protocol:  int(DefaultToProtocol.ID),
+							LinkIndex: 2,
+							Gw:        net.ParseIP("192.0.2.1"),
+						},
+					},
+				},
+				netlink.Notification{EndOfRIB: true},
+			},
+			expected: netlink.Route{},
 		}, {
 			description: "non-default target table",
 			config: Configuration{
@@ -104,7 +145,7 @@ func TestGateways(t *testing.T) {
 				netlink.Notification{StartOfRIB: true},
 				netlink.Notification{EndOfRIB: true},
 			},
-			expected: knetlink.Route{
+			expected: netlink.Route{
 				Dst:      config.MustParseCIDR("0.0.0.0/0"),
 				Table:    200,
 				Protocol: int(DefaultToProtocol.ID),
@@ -132,7 +173,7 @@ func TestGateways(t *testing.T) {
 				netlink.Notification{StartOfRIB: true},
 				netlink.Notification{EndOfRIB: true},
 			},
-			expected: knetlink.Route{
+			expected: netlink.Route{
 				Dst:      config.MustParseCIDR("0.0.0.0/0"),
 				Table:    int(DefaultTable.ID),
 				Protocol: int(DefaultToProtocol.ID),
@@ -160,7 +201,7 @@ func TestGateways(t *testing.T) {
 				netlink.Notification{StartOfRIB: true},
 				netlink.Notification{EndOfRIB: true},
 			},
-			expected: knetlink.Route{
+			expected: netlink.Route{
 				Dst:      config.MustParseCIDR("0.0.0.0/0"),
 				Table:    int(DefaultTable.ID),
 				Protocol: 5,
@@ -188,7 +229,7 @@ func TestGateways(t *testing.T) {
 				netlink.Notification{StartOfRIB: true},
 				netlink.Notification{EndOfRIB: true},
 			},
-			expected: knetlink.Route{
+			expected: netlink.Route{
 				Dst:      config.MustParseCIDR("10.0.0.0/8"),
 				Table:    int(DefaultTable.ID),
 				Protocol: int(DefaultToProtocol.ID),
@@ -201,9 +242,9 @@ func TestGateways(t *testing.T) {
 			notifications: []netlink.Notification{
 				netlink.Notification{StartOfRIB: true},
 				netlink.Notification{
-					RouteUpdate: &knetlink.RouteUpdate{
+					RouteUpdate: &netlink.RouteUpdate{
 						Type: syscall.RTM_NEWROUTE,
-						Route: knetlink.Route{
+						Route: netlink.Route{
 							Dst:   config.MustParseCIDR("0.0.0.0/0"),
 							Table: int(DefaultTable.ID),
 						},
@@ -211,7 +252,7 @@ func TestGateways(t *testing.T) {
 				},
 				netlink.Notification{EndOfRIB: true},
 			},
-			expected: knetlink.Route{
+			expected: netlink.Route{
 				Dst:      config.MustParseCIDR("0.0.0.0/0"),
 				Table:    int(DefaultTable.ID),
 				Protocol: int(DefaultToProtocol.ID),
@@ -223,9 +264,9 @@ func TestGateways(t *testing.T) {
 			notifications: []netlink.Notification{
 				netlink.Notification{StartOfRIB: true},
 				netlink.Notification{
-					RouteUpdate: &knetlink.RouteUpdate{
+					RouteUpdate: &netlink.RouteUpdate{
 						Type: syscall.RTM_NEWROUTE,
-						Route: knetlink.Route{
+						Route: netlink.Route{
 							Dst:   config.MustParseCIDR("10.0.0.0/8"),
 							Table: int(DefaultTable.ID),
 						},
@@ -233,25 +274,25 @@ func TestGateways(t *testing.T) {
 				},
 				netlink.Notification{EndOfRIB: true},
 			},
-			expected: knetlink.Route{},
+			expected: netlink.Route{},
 		}, {
 			description: "candidate route disappears",
 			config:      simpleConfiguration,
 			notifications: []netlink.Notification{
 				netlink.Notification{StartOfRIB: true},
 				netlink.Notification{
-					RouteUpdate: &knetlink.RouteUpdate{
+					RouteUpdate: &netlink.RouteUpdate{
 						Type: syscall.RTM_NEWROUTE,
-						Route: knetlink.Route{
+						Route: netlink.Route{
 							Dst:   config.MustParseCIDR("0.0.0.0/0"),
 							Table: int(DefaultTable.ID),
 						},
 					},
 				},
 				netlink.Notification{
-					RouteUpdate: &knetlink.RouteUpdate{
+					RouteUpdate: &netlink.RouteUpdate{
 						Type: syscall.RTM_DELROUTE,
-						Route: knetlink.Route{
+						Route: netlink.Route{
 							Dst:   config.MustParseCIDR("0.0.0.0/0"),
 							Table: int(DefaultTable.ID),
 						},
@@ -259,7 +300,7 @@ func TestGateways(t *testing.T) {
 				},
 				netlink.Notification{EndOfRIB: true},
 			},
-			expected: knetlink.Route{
+			expected: netlink.Route{
 				Dst:      config.MustParseCIDR("0.0.0.0/0"),
 				Table:    int(DefaultTable.ID),
 				Protocol: int(DefaultToProtocol.ID),
@@ -271,18 +312,18 @@ func TestGateways(t *testing.T) {
 			notifications: []netlink.Notification{
 				netlink.Notification{StartOfRIB: true},
 				netlink.Notification{
-					RouteUpdate: &knetlink.RouteUpdate{
+					RouteUpdate: &netlink.RouteUpdate{
 						Type: syscall.RTM_NEWROUTE,
-						Route: knetlink.Route{
+						Route: netlink.Route{
 							Dst:   config.MustParseCIDR("0.0.0.0/0"),
 							Table: int(DefaultTable.ID),
 						},
 					},
 				},
 				netlink.Notification{
-					RouteUpdate: &knetlink.RouteUpdate{
+					RouteUpdate: &netlink.RouteUpdate{
 						Type: syscall.RTM_NEWROUTE,
-						Route: knetlink.Route{
+						Route: netlink.Route{
 							Dst:   config.MustParseCIDR("0.0.0.0/0"),
 							Table: int(DefaultTable.ID),
 							Gw:    net.ParseIP("1.1.1.1"),
@@ -291,7 +332,7 @@ func TestGateways(t *testing.T) {
 				},
 				netlink.Notification{EndOfRIB: true},
 			},
-			expected: knetlink.Route{
+			expected: netlink.Route{
 				Dst:      config.MustParseCIDR("0.0.0.0/0"),
 				Table:    int(DefaultTable.ID),
 				Protocol: int(DefaultToProtocol.ID),
@@ -304,18 +345,18 @@ func TestGateways(t *testing.T) {
 			notifications: []netlink.Notification{
 				netlink.Notification{StartOfRIB: true},
 				netlink.Notification{
-					RouteUpdate: &knetlink.RouteUpdate{
+					RouteUpdate: &netlink.RouteUpdate{
 						Type: syscall.RTM_NEWROUTE,
-						Route: knetlink.Route{
+						Route: netlink.Route{
 							Dst:   config.MustParseCIDR("0.0.0.0/0"),
 							Table: int(DefaultTable.ID),
 						},
 					},
 				},
 				netlink.Notification{
-					RouteUpdate: &knetlink.RouteUpdate{
+					RouteUpdate: &netlink.RouteUpdate{
 						Type: syscall.RTM_NEWROUTE,
-						Route: knetlink.Route{
+						Route: netlink.Route{
 							Dst:      config.MustParseCIDR("0.0.0.0/0"),
 							Table:    int(DefaultTable.ID),
 							Gw:       net.ParseIP("1.1.1.1"),
@@ -325,7 +366,7 @@ func TestGateways(t *testing.T) {
 				},
 				netlink.Notification{EndOfRIB: true},
 			},
-			expected: knetlink.Route{
+			expected: netlink.Route{
 				Dst:      config.MustParseCIDR("0.0.0.0/0"),
 				Table:    int(DefaultTable.ID),
 				Protocol: int(DefaultToProtocol.ID),
@@ -337,9 +378,9 @@ func TestGateways(t *testing.T) {
 			notifications: []netlink.Notification{
 				netlink.Notification{StartOfRIB: true},
 				netlink.Notification{
-					RouteUpdate: &knetlink.RouteUpdate{
+					RouteUpdate: &netlink.RouteUpdate{
 						Type: syscall.RTM_NEWROUTE,
-						Route: knetlink.Route{
+						Route: netlink.Route{
 							Dst:   config.MustParseCIDR("0.0.0.0/0"),
 							Table: int(DefaultTable.ID),
 						},
@@ -347,9 +388,9 @@ func TestGateways(t *testing.T) {
 				},
 				netlink.Notification{EndOfRIB: true},
 				netlink.Notification{
-					RouteUpdate: &knetlink.RouteUpdate{
+					RouteUpdate: &netlink.RouteUpdate{
 						Type: syscall.RTM_NEWROUTE,
-						Route: knetlink.Route{
+						Route: netlink.Route{
 							Dst:      config.MustParseCIDR("0.0.0.0/0"),
 							Table:    int(DefaultTable.ID),
 							Gw:       net.ParseIP("1.1.1.1"),
@@ -358,16 +399,16 @@ func TestGateways(t *testing.T) {
 					},
 				},
 				netlink.Notification{
-					RouteUpdate: &knetlink.RouteUpdate{
+					RouteUpdate: &netlink.RouteUpdate{
 						Type: syscall.RTM_DELROUTE,
-						Route: knetlink.Route{
+						Route: netlink.Route{
 							Dst:   config.MustParseCIDR("0.0.0.0/0"),
 							Table: int(DefaultTable.ID),
 						},
 					},
 				},
 			},
-			expected: knetlink.Route{
+			expected: netlink.Route{
 				Dst:      config.MustParseCIDR("0.0.0.0/0"),
 				Table:    int(DefaultTable.ID),
 				Protocol: int(DefaultToProtocol.ID),
@@ -375,114 +416,1998 @@ func TestGateways(t *testing.T) {
 				Gw:       net.ParseIP("1.1.1.1"),
 			},
 		}, {
-			description: "target route disappears",
+			description: "candidate route with a nexthop object",
 			config:      simpleConfiguration,
 			notifications: []netlink.Notification{
 				netlink.Notification{StartOfRIB: true},
 				netlink.Notification{
-					RouteUpdate: &knetlink.RouteUpdate{
+					NexthopUpdate: &netlink.NexthopUpdate{
+						Type: netlink.RTMNewNexthop,
+						Nexthop: netlink.Nexthop{
+							ID:        10,
+							LinkIndex: 2,
+							Gw:        net.ParseIP("1.1.1.1"),
+						},
+					},
+				},
+				netlink.Notification{
+					RouteUpdate: &netlink.RouteUpdate{
 						Type: syscall.RTM_NEWROUTE,
-						Route: knetlink.Route{
+						Route: netlink.Route{
 							Dst:   config.MustParseCIDR("0.0.0.0/0"),
 							Table: int(DefaultTable.ID),
+							NHID:  10,
 						},
 					},
 				},
 				netlink.Notification{EndOfRIB: true},
-				netlink.Notification{}, // don't remember last installed route
+			},
+			expected: netlink.Route{
+				Dst:       config.MustParseCIDR("0.0.0.0/0"),
+				Table:     int(DefaultTable.ID),
+				Protocol:  int(DefaultToProtocol.ID),
+				Priority:  int(DefaultToMetric),
+				LinkIndex: 2,
+				Gw:        net.ParseIP("1.1.1.1"),
+			},
+		}, {
+			description: "candidate route with a nexthop object received later",
+			config:      simpleConfiguration,
+			notifications: []netlink.Notification{
+				netlink.Notification{StartOfRIB: true},
 				netlink.Notification{
-					RouteUpdate: &knetlink.RouteUpdate{
-						Type: syscall.RTM_DELROUTE,
-						Route: knetlink.Route{
-							Dst:      config.MustParseCIDR("0.0.0.0/0"),
-							Table:    int(DefaultTable.ID),
-							Protocol: int(DefaultToProtocol.ID),
-							Priority: int(DefaultToMetric),
+					RouteUpdate: &netlink.RouteUpdate{
+						Type: syscall.RTM_NEWROUTE,
+						Route: netlink.Route{
+							Dst:   config.MustParseCIDR("0.0.0.0/0"),
+							Table: int(DefaultTable.ID),
+							NHID:  10,
+						},
+					},
+				},
+				netlink.Notification{EndOfRIB: true},
+				netlink.Notification{
+					NexthopUpdate: &netlink.NexthopUpdate{
+						Type: netlink.RTMNewNexthop,
+						Nexthop: netlink.Nexthop{
+							ID:        10,
+							LinkIndex: 2,
+							Gw:        net.ParseIP("1.1.1.1"),
 						},
 					},
 				},
 			},
-			expected: knetlink.Route{
-				Dst:      config.MustParseCIDR("0.0.0.0/0"),
-				Table:    int(DefaultTable.ID),
-				Protocol: int(DefaultToProtocol.ID),
-				Priority: int(DefaultToMetric),
+			expected: netlink.Route{
+				Dst:       config.MustParseCIDR("0.0.0.0/0"),
+				Table:     int(DefaultTable.ID),
+				Protocol:  int(DefaultToProtocol.ID),
+				Priority:  int(DefaultToMetric),
+				LinkIndex: 2,
+				Gw:        net.ParseIP("1.1.1.1"),
 			},
 		}, {
-			description: "target route changes and get reinstalled",
+			description: "nexthop object updated",
 			config:      simpleConfiguration,
 			notifications: []netlink.Notification{
 				netlink.Notification{StartOfRIB: true},
 				netlink.Notification{
-					RouteUpdate: &knetlink.RouteUpdate{
+					NexthopUpdate: &netlink.NexthopUpdate{
+						Type: netlink.RTMNewNexthop,
+						Nexthop: netlink.Nexthop{
+							ID:        10,
+							LinkIndex: 2,
+							Gw:        net.ParseIP("1.1.1.1"),
+						},
+					},
+				},
+				netlink.Notification{
+					RouteUpdate: &netlink.RouteUpdate{
 						Type: syscall.RTM_NEWROUTE,
-						Route: knetlink.Route{
+						Route: netlink.Route{
 							Dst:   config.MustParseCIDR("0.0.0.0/0"),
 							Table: int(DefaultTable.ID),
+							NHID:  10,
 						},
 					},
 				},
 				netlink.Notification{EndOfRIB: true},
-				netlink.Notification{}, // don't remember last installed route
 				netlink.Notification{
-					RouteUpdate: &knetlink.RouteUpdate{
+					NexthopUpdate: &netlink.NexthopUpdate{
+						Type: netlink.RTMNewNexthop,
+						Nexthop: netlink.Nexthop{
+							ID:        10,
+							LinkIndex: 2,
+							Gw:        net.ParseIP("1.1.1.2"),
+						},
+					},
+				},
+			},
+			expected: netlink.Route{
+				Dst:       config.MustParseCIDR("0.0.0.0/0"),
+				Table:     int(DefaultTable.ID),
+				Protocol:  int(DefaultToProtocol.ID),
+				Priority:  int(DefaultToMetric),
+				LinkIndex: 2,
+				Gw:        net.ParseIP("1.1.1.2"),
+			},
+		}, {
+			description: "nexthop object removed",
+			config:      simpleConfiguration,
+			notifications: []netlink.Notification{
+				netlink.Notification{StartOfRIB: true},
+				netlink.Notification{
+					NexthopUpdate: &netlink.NexthopUpdate{
+						Type: netlink.RTMNewNexthop,
+						Nexthop: netlink.Nexthop{
+							ID:        10,
+							LinkIndex: 2,
+							Gw:        net.ParseIP("1.1.1.1"),
+						},
+					},
+				},
+				netlink.Notification{
+					RouteUpdate: &netlink.RouteUpdate{
+						Type: syscall.RTM_NEWROUTE,
+						Route: netlink.Route{
+							Dst:   config.MustParseCIDR("0.0.0.0/0"),
+							Table: int(DefaultTable.ID),
+							NHID:  10,
+						},
+					},
+				},
+				netlink.Notification{
+					NexthopUpdate: &netlink.NexthopUpdate{
+						Type: netlink.RTMNewNexthop,
+						Nexthop: netlink.Nexthop{
+							ID:        11,
+							LinkIndex: 2,
+							Gw:        net.ParseIP("1.1.1.2"),
+						},
+					},
+				},
+				netlink.Notification{
+					RouteUpdate: &netlink.RouteUpdate{
 						Type: syscall.RTM_NEWROUTE,
-						Route: knetlink.Route{
+						Route: netlink.Route{
 							Dst:      config.MustParseCIDR("0.0.0.0/0"),
 							Table:    int(DefaultTable.ID),
-							Protocol: int(DefaultToProtocol.ID),
-							Priority: int(DefaultToMetric),
-							Gw:       net.ParseIP("1.1.1.1"),
+							Priority: 200,
+							NHID:     11,
+						},
+					},
+				},
+				netlink.Notification{EndOfRIB: true},
+				netlink.Notification{
+					NexthopUpdate: &netlink.NexthopUpdate{
+						Type: netlink.RTMDelNexthop,
+						Nexthop: netlink.Nexthop{
+							ID:        10,
+							LinkIndex: 2,
+							Gw:        net.ParseIP("1.1.1.1"),
 						},
 					},
 				},
 			},
-			expected: knetlink.Route{
-				Dst:      config.MustParseCIDR("0.0.0.0/0"),
-				Table:    int(DefaultTable.ID),
-				Protocol: int(DefaultToProtocol.ID),
-				Priority: int(DefaultToMetric),
+			expected: netlink.Route{
+				Dst:       config.MustParseCIDR("0.0.0.0/0"),
+				Table:     int(DefaultTable.ID),
+				Protocol:  int(DefaultToProtocol.ID),
+				Priority:  int(DefaultToMetric),
+				LinkIndex: 2,
+				Gw:        net.ParseIP("1.1.1.2"),
 			},
-		},
-	}
-	for _, tc := range cases {
-		var lock sync.Mutex
-		last := knetlink.Route{}
-		nl, inject := netlink.NewMock(func(r knetlink.Route) error {
-			lock.Lock()
-			defer lock.Unlock()
-			last = r
-			return nil
-		})
-		c, err := New(r, tc.config, Dependencies{Netlink: nl})
-		if err != nil {
-			t.Errorf("New(%s) error:\n%+v", tc.config, err)
-		}
-		if err := c.Start(); err != nil {
-			t.Errorf("Start() error:\n%+v", err)
-			continue
-		}
-		empty := netlink.Notification{}
-		for _, r := range tc.notifications {
-			if r == empty {
-				time.Sleep(20 * time.Millisecond)
-				lock.Lock()
-				last = knetlink.Route{}
-				lock.Unlock()
-			} else {
-				inject(r)
-			}
-		}
-		time.Sleep(20 * time.Millisecond)
-		lock.Lock()
-		lastCopy := last
-		lock.Unlock()
-		if diff := helpers.Diff(lastCopy, tc.expected); diff != "" {
-			t.Errorf("Unexpected last resort gateway [%s]\n** Config:\n%+v\n** Notifications:\n%+v\n** Result (-got +want):\n%s",
-				tc.description, tc.config, tc.notifications, diff)
-		}
-		if err := c.Stop(); err != nil {
-			t.Errorf("Stop() error:\n%+v", err)
-		}
+		}, {
+			description: "last resort route in a dedicated table",
+			config: Configuration{
+				LRGConfiguration{
+					From: LRGFromConfiguration{
+						Prefix: defaultIPv4,
+						Table:  DefaultTable,
+					},
+					To: LRGToConfiguration{
+						Prefix:   defaultIPv4,
+						Protocol: DefaultToProtocol,
+						Metric:   DefaultToMetric,
+						Table:    config.Table{ID: 90},
+						Rule:     &LRGRuleConfiguration{Priority: 40000},
+					},
+				},
+			},
+			notifications: []netlink.Notification{
+				netlink.Notification{StartOfRIB: true},
+				netlink.Notification{
+					RouteUpdate: &netlink.RouteUpdate{
+						Type: syscall.RTM_NEWROUTE,
+						Route: netlink.Route{
+							Dst:       config.MustParseCIDR("0.0.0.0/0"),
+							Table:     int(DefaultTable.ID),
+							LinkIndex: 2,
+							Gw:        net.ParseIP("1.1.1.1"),
+						},
+					},
+				},
+				netlink.Notification{EndOfRIB: true},
+			},
+			expected: netlink.Route{
+				Dst:       config.MustParseCIDR("0.0.0.0/0"),
+				Table:     90,
+				Protocol:  int(DefaultToProtocol.ID),
+				Priority:  int(DefaultToMetric),
+				LinkIndex: 2,
+				Gw:        net.ParseIP("1.1.1.1"),
+			},
+		}, {
+			description: "several routers in router advertisement mode",
+			config: Configuration{
+				LRGConfiguration{
+					From: LRGFromConfiguration{
+						Prefix: config.MustParsePrefix("::/0"),
+						Table:  DefaultTable,
+						Mode:   LRGFromModeRA,
+					},
+					To: LRGToConfiguration{
+						Prefix:   config.MustParsePrefix("::/0"),
+						Protocol: DefaultToProtocol,
+						Metric:   DefaultToMetric,
+						Table:    DefaultTable,
+					},
+				},
+			},
+			notifications: []netlink.Notification{
+				netlink.Notification{StartOfRIB: true},
+				netlink.Notification{
+					RouteUpdate: &netlink.RouteUpdate{
+						Type: syscall.RTM_NEWROUTE,
+						Route: netlink.Route{
+							Dst:       config.MustParseCIDR("::/0"),
+							Table:     int(DefaultTable.ID),
+							Protocol:  syscall.RTPROT_RA,
+							Priority:  1024,
+							LinkIndex: 2,
+							Gw:        net.ParseIP("fe80::1"),
+							Expires:   1800,
+						},
+					},
+				},
+				netlink.Notification{
+					RouteUpdate: &netlink.RouteUpdate{
+						Type: syscall.RTM_NEWROUTE,
+						Route: netlink.Route{
+							Dst:       config.MustParseCIDR("::/0"),
+							Table:     int(DefaultTable.ID),
+							Protocol:  syscall.RTPROT_RA,
+							Priority:  1024,
+							LinkIndex: 3,
+							Gw:        net.ParseIP("fe80::2"),
+							Expires:   1800,
+						},
+					},
+				},
+				netlink.Notification{EndOfRIB: true},
+			},
+			expected: netlink.Route{
+				Dst:       config.MustParseCIDR("::/0"),
+				Table:     int(DefaultTable.ID),
+				Protocol:  int(DefaultToProtocol.ID),
+				Priority:  int(DefaultToMetric),
+				LinkIndex: 2,
+				Gw:        net.ParseIP("fe80::1"),
+			},
+		}, {
+			description: "router disappears in router advertisement mode",
+			config: Configuration{
+				LRGConfiguration{
+					From: LRGFromConfiguration{
+						Prefix: config.MustParsePrefix("::/0"),
+						Table:  DefaultTable,
+						Mode:   LRGFromModeRA,
+					},
+					To: LRGToConfiguration{
+						Prefix:   config.MustParsePrefix("::/0"),
+						Protocol: DefaultToProtocol,
+						Metric:   DefaultToMetric,
+						Table:    DefaultTable,
+					},
+				},
+			},
+			notifications: []netlink.Notification{
+				netlink.Notification{StartOfRIB: true},
+				netlink.Notification{
+					RouteUpdate: &netlink.RouteUpdate{
+						Type: syscall.RTM_NEWROUTE,
+						Route: netlink.Route{
+							Dst:       config.MustParseCIDR("::/0"),
+							Table:     int(DefaultTable.ID),
+							Protocol:  syscall.RTPROT_RA,
+							Priority:  1024,
+							LinkIndex: 2,
+							Gw:        net.ParseIP("fe80::1"),
+						},
+					},
+				},
+				netlink.Notification{
+					RouteUpdate: &netlink.RouteUpdate{
+						Type: syscall.RTM_NEWROUTE,
+						Route: netlink.Route{
+							Dst:       config.MustParseCIDR("::/0"),
+							Table:     int(DefaultTable.ID),
+							Protocol:  syscall.RTPROT_RA,
+							Priority:  1024,
+							LinkIndex: 3,
+							Gw:        net.ParseIP("fe80::2"),
+						},
+					},
+				},
+				netlink.Notification{EndOfRIB: true},
+				netlink.Notification{
+					RouteUpdate: &netlink.RouteUpdate{
+						Type: syscall.RTM_DELROUTE,
+						Route: netlink.Route{
+							Dst:       config.MustParseCIDR("::/0"),
+							Table:     int(DefaultTable.ID),
+							Protocol:  syscall.RTPROT_RA,
+							Priority:  1024,
+							LinkIndex: 2,
+							Gw:        net.ParseIP("fe80::1"),
+						},
+					},
+				},
+			},
+			expected: netlink.Route{
+				Dst:       config.MustParseCIDR("::/0"),
+				Table:     int(DefaultTable.ID),
+				Protocol:  int(DefaultToProtocol.ID),
+				Priority:  int(DefaultToMetric),
+				LinkIndex: 3,
+				Gw:        net.ParseIP("fe80::2"),
+			},
+		}, {
+			description: "router preference in router advertisement mode",
+			config: Configuration{
+				LRGConfiguration{
+					From: LRGFromConfiguration{
+						Prefix: config.MustParsePrefix("::/0"),
+						Table:  DefaultTable,
+						Mode:   LRGFromModeRA,
+					},
+					To: LRGToConfiguration{
+						Prefix:   config.MustParsePrefix("::/0"),
+						Protocol: DefaultToProtocol,
+						Metric:   DefaultToMetric,
+						Table:    DefaultTable,
+					},
+				},
+			},
+			notifications: []netlink.Notification{
+				netlink.Notification{StartOfRIB: true},
+				netlink.Notification{
+					RouteUpdate: &netlink.RouteUpdate{
+						Type: syscall.RTM_NEWROUTE,
+						Route: netlink.Route{
+							Dst:       config.MustParseCIDR("::/0"),
+							Table:     int(DefaultTable.ID),
+							Protocol:  syscall.RTPROT_RA,
+							Priority:  1024,
+							LinkIndex: 2,
+							Gw:        net.ParseIP("fe80::1"),
+							Pref:      routerPrefLow,
+						},
+					},
+				},
+				netlink.Notification{
+					RouteUpdate: &netlink.RouteUpdate{
+						Type: syscall.RTM_NEWROUTE,
+						Route: netlink.Route{
+							Dst:       config.MustParseCIDR("::/0"),
+							Table:     int(DefaultTable.ID),
+							Protocol:  syscall.RTPROT_RA,
+							Priority:  1024,
+							LinkIndex: 3,
+							Gw:        net.ParseIP("fe80::2"),
+							Pref:      routerPrefHigh,
+						},
+					},
+				},
+				netlink.Notification{
+					RouteUpdate: &netlink.RouteUpdate{
+						Type: syscall.RTM_NEWROUTE,
+						Route: netlink.Route{
+							Dst:       config.MustParseCIDR("::/0"),
+							Table:     int(DefaultTable.ID),
+							Protocol:  syscall.RTPROT_RA,
+							Priority:  1024,
+							LinkIndex: 4,
+							Gw:        net.ParseIP("fe80::3"),
+						},
+					},
+				},
+				netlink.Notification{EndOfRIB: true},
+			},
+			expected: netlink.Route{
+				Dst:       config.MustParseCIDR("::/0"),
+				Table:     int(DefaultTable.ID),
+				Protocol:  int(DefaultToProtocol.ID),
+				Priority:  int(DefaultToMetric),
+				LinkIndex: 3,
+				Gw:        net.ParseIP("fe80::2"),
+				Pref:      routerPrefHigh,
+			},
+		}, {
+			description: "source-specific routes",
+			config: Configuration{
+				LRGConfiguration{
+					From: LRGFromConfiguration{
+						Prefix: config.MustParsePrefix("::/0"),
+						Table:  DefaultTable,
+						Source: &sourcePrefix,
+					},
+					To: LRGToConfiguration{
+						Prefix:   config.MustParsePrefix("::/0"),
+						Protocol: DefaultToProtocol,
+						Metric:   DefaultToMetric,
+						Table:    DefaultTable,
+						Source:   &sourcePrefix,
+					},
+				},
+			},
+			notifications: []netlink.Notification{
+				netlink.Notification{StartOfRIB: true},
+				netlink.Notification{
+					RouteUpdate: &netlink.RouteUpdate{
+						Type: syscall.RTM_NEWROUTE,
+						Route: netlink.Route{
+							Dst:       config.MustParseCIDR("::/0"),
+							SrcPrefix: config.MustParseCIDR("2001:db8:2::/48"),
+							Table:     int(DefaultTable.ID),
+							Priority:  100,
+							LinkIndex: 2,
+							Gw:        net.ParseIP("2001:db8:ff::2"),
+						},
+					},
+				},
+				netlink.Notification{
+					RouteUpdate: &netlink.RouteUpdate{
+						Type: syscall.RTM_NEWROUTE,
+						Route: netlink.Route{
+							Dst:       config.MustParseCIDR("::/0"),
+							SrcPrefix: config.MustParseCIDR("2001:db8:1::/48"),
+							Table:     int(DefaultTable.ID),
+							Priority:  200,
+							LinkIndex: 2,
+							Gw:        net.ParseIP("2001:db8:ff::1"),
+						},
+					},
+				},
+				netlink.Notification{EndOfRIB: true},
+			},
+			expected: netlink.Route{
+				Dst:       config.MustParseCIDR("::/0"),
+				SrcPrefix: config.MustParseCIDR("2001:db8:1::/48"),
+				Table:     int(DefaultTable.ID),
+				Protocol:  int(DefaultToProtocol.ID),
+				Priority:  int(DefaultToMetric),
+				LinkIndex: 2,
+				Gw:        net.ParseIP("2001:db8:ff::1"),
+			},
+		}, {
+			description: "TOS-specific routes",
+			config: Configuration{
+				LRGConfiguration{
+					From: LRGFromConfiguration{
+						Prefix: config.MustParsePrefix("0.0.0.0/0"),
+						Table:  DefaultTable,
+						Tos:    &tos16,
+					},
+					To: LRGToConfiguration{
+						Prefix:   config.MustParsePrefix("0.0.0.0/0"),
+						Protocol: DefaultToProtocol,
+						Metric:   DefaultToMetric,
+						Table:    DefaultTable,
+						Tos:      &tos16,
+					},
+				},
+			},
+			notifications: []netlink.Notification{
+				netlink.Notification{StartOfRIB: true},
+				netlink.Notification{
+					RouteUpdate: &netlink.RouteUpdate{
+						Type: syscall.RTM_NEWROUTE,
+						Route: netlink.Route{
+							Dst:       config.MustParseCIDR("0.0.0.0/0"),
+							Table:     int(DefaultTable.ID),
+							Priority:  100,
+							LinkIndex: 2,
+							Gw:        net.ParseIP("192.0.2.1"),
+						},
+					},
+				},
+				netlink.Notification{
+					RouteUpdate: &netlink.RouteUpdate{
+						Type: syscall.RTM_NEWROUTE,
+						Route: netlink.Route{
+							Dst:       config.MustParseCIDR("0.0.0.0/0"),
+							Table:     int(DefaultTable.ID),
+							Tos:       16,
+							Priority:  200,
+							LinkIndex: 2,
+							Gw:        net.ParseIP("192.0.2.2"),
+						},
+					},
+				},
+				netlink.Notification{EndOfRIB: true},
+			},
+			expected: netlink.Route{
+				Dst:       config.MustParseCIDR("0.0.0.0/0"),
+				Table:     int(DefaultTable.ID),
+				Protocol:  int(DefaultToProtocol.ID),
+				Priority:  int(DefaultToMetric),
+				Tos:       16,
+				LinkIndex: 2,
+				Gw:        net.ParseIP("192.0.2.2"),
+			},
+		}, {
+			description: "target route disappears",
+			config:      simpleConfiguration,
+			notifications: []netlink.Notification{
+				netlink.Notification{StartOfRIB: true},
+				netlink.Notification{
+					RouteUpdate: &netlink.RouteUpdate{
+						Type: syscall.RTM_NEWROUTE,
+						Route: netlink.Route{
+							Dst:   config.MustParseCIDR("0.0.0.0/0"),
+							Table: int(DefaultTable.ID),
+						},
+					},
+				},
+				netlink.Notification{EndOfRIB: true},
+				netlink.Notification{}, // don't remember last installed route
+				netlink.Notification{
+					RouteUpdate: &netlink.RouteUpdate{
+						Type: syscall.RTM_DELROUTE,
+						Route: netlink.Route{
+							Dst:      config.MustParseCIDR("0.0.0.0/0"),
+							Table:    int(DefaultTable.ID),
+							Protocol: int(DefaultToProtocol.ID),
+							Priority: int(DefaultToMetric),
+						},
+					},
+				},
+			},
+			expected: netlink.Route{
+				Dst:      config.MustParseCIDR("0.0.0.0/0"),
+				Table:    int(DefaultTable.ID),
+				Protocol: int(DefaultToProtocol.ID),
+				Priority: int(DefaultToMetric),
+			},
+		}, {
+			description: "target route changes and get reinstalled",
+			config:      simpleConfiguration,
+			notifications: []netlink.Notification{
+				netlink.Notification{StartOfRIB: true},
+				netlink.Notification{
+					RouteUpdate: &netlink.RouteUpdate{
+						Type: syscall.RTM_NEWROUTE,
+						Route: netlink.Route{
+							Dst:   config.MustParseCIDR("0.0.0.0/0"),
+							Table: int(DefaultTable.ID),
+						},
+					},
+				},
+				netlink.Notification{EndOfRIB: true},
+				netlink.Notification{}, // don't remember last installed route
+				netlink.Notification{
+					RouteUpdate: &netlink.RouteUpdate{
+						Type: syscall.RTM_NEWROUTE,
+						Route: netlink.Route{
+							Dst:      config.MustParseCIDR("0.0.0.0/0"),
+							Table:    int(DefaultTable.ID),
+							Protocol: int(DefaultToProtocol.ID),
+							Priority: int(DefaultToMetric),
+							Gw:       net.ParseIP("1.1.1.1"),
+						},
+					},
+				},
+			},
+			expected: netlink.Route{
+				Dst:      config.MustParseCIDR("0.0.0.0/0"),
+				Table:    int(DefaultTable.ID),
+				Protocol: int(DefaultToProtocol.ID),
+				Priority: int(DefaultToMetric),
+			},
+		},
+	}
+	for _, tc := range cases {
+		var lock sync.Mutex
+		last := netlink.Route{}
+		nl, inject := netlink.NewMock(netlink.MockCallbacks{
+			AddRoute: func(r netlink.Route) error {
+				lock.Lock()
+				defer lock.Unlock()
+				last = r
+				return nil
+			},
+		})
+		c, err := New(r, tc.config, Dependencies{Netlink: nl})
+		if err != nil {
+			t.Errorf("New(%s) error:\n%+v", tc.config, err)
+		}
+		if err := c.Start(); err != nil {
+			t.Errorf("Start() error:\n%+v", err)
+			continue
+		}
+		empty := netlink.Notification{}
+		for _, r := range tc.notifications {
+			if r == empty {
+				time.Sleep(20 * time.Millisecond)
+				lock.Lock()
+				last = netlink.Route{}
+				lock.Unlock()
+			} else {
+				inject(r)
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		lock.Lock()
+		lastCopy := last
+		lock.Unlock()
+		if diff := helpers.Diff(lastCopy, tc.expected); diff != "" {
+			t.Errorf("Unexpected last resort gateway [%s]\n** Config:\n%+v\n** Notifications:\n%+v\n** Result (-got +want):\n%s",
+				tc.description, tc.config, tc.notifications, diff)
+		}
+		if err := c.Stop(); err != nil {
+			t.Errorf("Stop() error:\n%+v", err)
+		}
+	}
+}
+
+func TestGatewayRules(t *testing.T) {
+	defaultIPv4 := config.MustParsePrefix("0.0.0.0/0")
+	ruleConfiguration := Configuration{
+		LRGConfiguration{
+			From: LRGFromConfiguration{
+				Prefix: defaultIPv4,
+				Table:  DefaultTable,
+			},
+			To: LRGToConfiguration{
+				Prefix:   defaultIPv4,
+				Protocol: DefaultToProtocol,
+				Metric:   DefaultToMetric,
+				Table:    config.Table{ID: 90},
+				Rule: &LRGRuleConfiguration{
+					Priority:           40000,
+					PreviousPriorities: []uint{39000},
+				},
+			},
+		},
+	}
+	newRule := func(priority int) knetlink.Rule {
+		rule := knetlink.NewRule()
+		rule.Family = knetlink.FAMILY_V4
+		rule.Priority = priority
+		rule.Table = 90
+		return *rule
+	}
+	newRuleNotification := func(kind uint16, priority int) netlink.Notification {
+		return netlink.Notification{
+			RuleUpdate: &netlink.RuleUpdate{
+				Type: kind,
+				Rule: newRule(priority),
+			},
+		}
+	}
+	r := reporter.NewMock()
+	cases := []struct {
+		description   string
+		notifications []netlink.Notification
+		added         []knetlink.Rule
+		deleted       []knetlink.Rule
+	}{
+		{
+			description: "missing rule",
+			notifications: []netlink.Notification{
+				netlink.Notification{StartOfRIB: true},
+				netlink.Notification{EndOfRIB: true},
+			},
+			added:   []knetlink.Rule{newRule(40000)},
+			deleted: []knetlink.Rule{},
+		}, {
+			description: "existing rule",
+			notifications: []netlink.Notification{
+				netlink.Notification{StartOfRIB: true},
+				newRuleNotification(syscall.RTM_NEWRULE, 40000),
+				netlink.Notification{EndOfRIB: true},
+			},
+			added:   []knetlink.Rule{},
+			deleted: []knetlink.Rule{},
+		}, {
+			description: "removed rule",
+			notifications: []netlink.Notification{
+				netlink.Notification{StartOfRIB: true},
+				newRuleNotification(syscall.RTM_NEWRULE, 40000),
+				netlink.Notification{EndOfRIB: true},
+				newRuleNotification(syscall.RTM_DELRULE, 40000),
+			},
+			added:   []knetlink.Rule{newRule(40000)},
+			deleted: []knetlink.Rule{},
+		}, {
+			description: "stale rule",
+			notifications: []netlink.Notification{
+				netlink.Notification{StartOfRIB: true},
+				newRuleNotification(syscall.RTM_NEWRULE, 40000),
+				newRuleNotification(syscall.RTM_NEWRULE, 39000),
+				netlink.Notification{EndOfRIB: true},
+			},
+			added:   []knetlink.Rule{},
+			deleted: []knetlink.Rule{newRule(39000)},
+		}, {
+			description: "rule with another priority",
+			notifications: []netlink.Notification{
+				netlink.Notification{StartOfRIB: true},
+				newRuleNotification(syscall.RTM_NEWRULE, 40000),
+				newRuleNotification(syscall.RTM_NEWRULE, 100),
+				netlink.Notification{EndOfRIB: true},
+			},
+			added:   []knetlink.Rule{},
+			deleted: []knetlink.Rule{},
+		},
+	}
+	for _, tc := range cases {
+		var lock sync.Mutex
+		added := []knetlink.Rule{}
+		deleted := []knetlink.Rule{}
+		nl, inject := netlink.NewMock(netlink.MockCallbacks{
+			AddRule: func(r knetlink.Rule) error {
+				lock.Lock()
+				defer lock.Unlock()
+				added = append(added, r)
+				return nil
+			},
+			DeleteRule: func(r knetlink.Rule) error {
+				lock.Lock()
+				defer lock.Unlock()
+				deleted = append(deleted, r)
+				return nil
+			},
+		})
+		c, err := New(r, ruleConfiguration, Dependencies{Netlink: nl})
+		if err != nil {
+			t.Errorf("New(%s) error:\n%+v", ruleConfiguration, err)
+		}
+		if err := c.Start(); err != nil {
+			t.Errorf("Start() error:\n%+v", err)
+			continue
+		}
+		for _, n := range tc.notifications {
+			inject(n)
+		}
+		time.Sleep(200 * time.Millisecond)
+		if err := c.Stop(); err != nil {
+			t.Errorf("Stop() error:\n%+v", err)
+		}
+		lock.Lock()
+		if diff := helpers.Diff(added, tc.added); diff != "" {
+			t.Errorf("Unexpected added rules [%s] (-got +want):\n%s",
+				tc.description, diff)
+		}
+		if diff := helpers.Diff(deleted, tc.deleted); diff != "" {
+			t.Errorf("Unexpected deleted rules [%s] (-got +want):\n%s",
+				tc.description, diff)
+		}
+		lock.Unlock()
+	}
+}
+
+func TestGatewayRefresh(t *testing.T) {
+	defaultIPv6 := config.MustParsePrefix("::/0")
+	expiringConfiguration := Configuration{
+		LRGConfiguration{
+			From: LRGFromConfiguration{
+				Prefix: defaultIPv6,
+				Table:  DefaultTable,
+			},
+			To: LRGToConfiguration{
+				Prefix:   defaultIPv6,
+				Protocol: DefaultToProtocol,
+				Metric:   DefaultToMetric,
+				Table:    DefaultTable,
+				Expires:  MinToExpires,
+			},
+		},
+	}
+	r := reporter.NewMock()
+	var lock sync.Mutex
+	routes := []netlink.Route{}
+	nl, inject := netlink.NewMock(netlink.MockCallbacks{
+		AddRoute: func(r netlink.Route) error {
+			lock.Lock()
+			defer lock.Unlock()
+			routes = append(routes, r)
+			return nil
+		},
+	})
+	c, err := New(r, expiringConfiguration, Dependencies{Netlink: nl})
+	if err != nil {
+		t.Fatalf("New(%s) error:\n%+v", expiringConfiguration, err)
+	}
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start() error:\n%+v", err)
+	}
+	inject(netlink.Notification{StartOfRIB: true})
+	inject(netlink.Notification{
+		RouteUpdate: &netlink.RouteUpdate{
+			Type: syscall.RTM_NEWROUTE,
+			Route: netlink.Route{
+				Dst:       config.MustParseCIDR("::/0"),
+				Table:     int(DefaultTable.ID),
+				LinkIndex: 2,
+				Gw:        net.ParseIP("2001:db8::1"),
+			},
+		},
+	})
+	inject(netlink.Notification{EndOfRIB: true})
+	// Refresh happens every second
+	time.Sleep(1500 * time.Millisecond)
+	if err := c.Stop(); err != nil {
+		t.Errorf("Stop() error:\n%+v", err)
+	}
+
+	expected := netlink.Route{
+		Dst:       config.MustParseCIDR("::/0"),
+		Table:     int(DefaultTable.ID),
+		Protocol:  int(DefaultToProtocol.ID),
+		Priority:  int(DefaultToMetric),
+		LinkIndex: 2,
+		Gw:        net.ParseIP("2001:db8::1"),
+		Expires:   3,
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if diff := helpers.Diff(routes, []netlink.Route{expected, expected}); diff != "" {
+		t.Errorf("Unexpected installed routes (-got +want):\n%s", diff)
+	}
+	if counter := r.Counter("gw1.refresh.count").Snapshot().Count(); counter != 1 {
+		t.Errorf("refresh counter incorrect (%d, expected 1)", counter)
+	}
+}
+
+func TestGatewayCondition(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lrg-")
+	if err != nil {
+		t.Fatalf("TempDir() error:\n%+v", err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "master")
+
+	conditionalConfiguration := Configuration{
+		LRGConfiguration{
+			From: LRGFromConfiguration{
+				Prefix: config.MustParsePrefix("0.0.0.0/0"),
+				Table:  DefaultTable,
+			},
+			To: LRGToConfiguration{
+				Prefix:   config.MustParsePrefix("0.0.0.0/0"),
+				Protocol: DefaultToProtocol,
+				Metric:   DefaultToMetric,
+				Table:    DefaultTable,
+			},
+			When: &LRGWhenConfiguration{
+				File:     stateFile,
+				Interval: config.Duration(50 * time.Millisecond),
+			},
+		},
+	}
+	r := reporter.NewMock()
+	var lock sync.Mutex
+	added := []netlink.Route{}
+	deleted := []netlink.Route{}
+	nl, inject := netlink.NewMock(netlink.MockCallbacks{
+		AddRoute: func(r netlink.Route) error {
+			lock.Lock()
+			defer lock.Unlock()
+			added = append(added, r)
+			return nil
+		},
+		DeleteRoute: func(r netlink.Route) error {
+			lock.Lock()
+			defer lock.Unlock()
+			deleted = append(deleted, r)
+			return nil
+		},
+	})
+	c, err := New(r, conditionalConfiguration, Dependencies{Netlink: nl})
+	if err != nil {
+		t.Fatalf("New(%s) error:\n%+v", conditionalConfiguration, err)
+	}
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start() error:\n%+v", err)
+	}
+	defer func() {
+		if err := c.Stop(); err != nil {
+			t.Errorf("Stop() error:\n%+v", err)
+		}
+	}()
+	inject(netlink.Notification{StartOfRIB: true})
+	inject(netlink.Notification{
+		RouteUpdate: &netlink.RouteUpdate{
+			Type: syscall.RTM_NEWROUTE,
+			Route: netlink.Route{
+				Dst:       config.MustParseCIDR("0.0.0.0/0"),
+				Table:     int(DefaultTable.ID),
+				LinkIndex: 2,
+				Gw:        net.ParseIP("192.0.2.1"),
+			},
+		},
+	})
+	inject(netlink.Notification{EndOfRIB: true})
+	expected := netlink.Route{
+		Dst:       config.MustParseCIDR("0.0.0.0/0"),
+		Table:     int(DefaultTable.ID),
+		Protocol:  int(DefaultToProtocol.ID),
+		Priority:  int(DefaultToMetric),
+		LinkIndex: 2,
+		Gw:        net.ParseIP("192.0.2.1"),
+	}
+	check := func(step string, expectedAdded, expectedDeleted []netlink.Route) {
+		time.Sleep(200 * time.Millisecond)
+		lock.Lock()
+		defer lock.Unlock()
+		if diff := helpers.Diff(added, expectedAdded); diff != "" {
+			t.Errorf("%s: unexpected installed routes (-got +want):\n%s", step, diff)
+		}
+		if diff := helpers.Diff(deleted, expectedDeleted); diff != "" {
+			t.Errorf("%s: unexpected withdrawn routes (-got +want):\n%s", step, diff)
+		}
+	}
+
+	// Condition not met: nothing is installed
+	check("initial", []netlink.Route{}, []netlink.Route{})
+
+	// Condition met: route is installed
+	if err := ioutil.WriteFile(stateFile, []byte("MASTER\n"), 0644); err != nil {
+		t.Fatalf("WriteFile() error:\n%+v", err)
+	}
+	check("file created", []netlink.Route{expected}, []netlink.Route{})
+
+	// Condition not met anymore: route is withdrawn
+	if err := os.Remove(stateFile); err != nil {
+		t.Fatalf("Remove() error:\n%+v", err)
+	}
+	check("file removed", []netlink.Route{expected}, []netlink.Route{expected})
+	if gauge := r.Gauge("gw1.state").Snapshot().Value(); gauge != LRGStateMissing {
+		t.Errorf("gateway state incorrect (%d, expected %d)", gauge, LRGStateMissing)
+	}
+}
+
+func TestGatewayConditionRestart(t *testing.T) {
+	// The route installed before a restart is kept while the
+	// condition is not evaluated yet.
+	conditionalConfiguration := Configuration{
+		LRGConfiguration{
+			From: LRGFromConfiguration{
+				Prefix: config.MustParsePrefix("0.0.0.0/0"),
+				Table:  DefaultTable,
+			},
+			To: LRGToConfiguration{
+				Prefix:   config.MustParsePrefix("0.0.0.0/0"),
+				Protocol: DefaultToProtocol,
+				Metric:   DefaultToMetric,
+				Table:    DefaultTable,
+			},
+			When: &LRGWhenConfiguration{
+				Command:  "sleep 0.3",
+				Interval: config.Duration(time.Second),
+			},
+		},
+	}
+	r := reporter.NewMock()
+	var lock sync.Mutex
+	added := []netlink.Route{}
+	deleted := []netlink.Route{}
+	nl, inject := netlink.NewMock(netlink.MockCallbacks{
+		AddRoute: func(r netlink.Route) error {
+			lock.Lock()
+			defer lock.Unlock()
+			added = append(added, r)
+			return nil
+		},
+		DeleteRoute: func(r netlink.Route) error {
+			lock.Lock()
+			defer lock.Unlock()
+			deleted = append(deleted, r)
+			return nil
+		},
+	})
+	c, err := New(r, conditionalConfiguration, Dependencies{Netlink: nl})
+	if err != nil {
+		t.Fatalf("New(%s) error:\n%+v", conditionalConfiguration, err)
+	}
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start() error:\n%+v", err)
+	}
+	defer func() {
+		if err := c.Stop(); err != nil {
+			t.Errorf("Stop() error:\n%+v", err)
+		}
+	}()
+	installed := netlink.Route{
+		Dst:       config.MustParseCIDR("0.0.0.0/0"),
+		Table:     int(DefaultTable.ID),
+		Protocol:  int(DefaultToProtocol.ID),
+		Priority:  int(DefaultToMetric),
+		LinkIndex: 2,
+		Gw:        net.ParseIP("192.0.2.1"),
+	}
+	inject(netlink.Notification{StartOfRIB: true})
+	inject(netlink.Notification{
+		RouteUpdate: &netlink.RouteUpdate{
+			Type: syscall.RTM_NEWROUTE,
+			Route: netlink.Route{
+				Dst:       config.MustParseCIDR("0.0.0.0/0"),
+				Table:     int(DefaultTable.ID),
+				LinkIndex: 2,
+				Gw:        net.ParseIP("192.0.2.1"),
+			},
+		},
+	})
+	inject(netlink.Notification{
+		RouteUpdate: &netlink.RouteUpdate{
+			Type:  syscall.RTM_NEWROUTE,
+			Route: installed,
+		},
+	})
+	inject(netlink.Notification{EndOfRIB: true})
+	check := func(step string, expectedDeleted []netlink.Route) {
+		lock.Lock()
+		defer lock.Unlock()
+		if diff := helpers.Diff(added, []netlink.Route{}); diff != "" {
+			t.Errorf("%s: unexpected installed routes (-got +want):\n%s", step, diff)
+		}
+		if diff := helpers.Diff(deleted, expectedDeleted); diff != "" {
+			t.Errorf("%s: unexpected withdrawn routes (-got +want):\n%s", step, diff)
+		}
+	}
+
+	// Condition not evaluated yet: route is kept
+	time.Sleep(100 * time.Millisecond)
+	check("not evaluated", []netlink.Route{})
+
+	// Condition met: route is still kept
+	time.Sleep(500 * time.Millisecond)
+	check("condition met", []netlink.Route{})
+	if gauge := r.Gauge("gw1.state").Snapshot().Value(); gauge != LRGStateInstalled {
+		t.Errorf("gateway state incorrect (%d, expected %d)", gauge, LRGStateInstalled)
+	}
+}
+
+func TestGatewayDependencies(t *testing.T) {
+	defaultIPv4 := config.MustParsePrefix("0.0.0.0/0")
+	bird := config.Protocol{ID: 12}
+	dependentConfiguration := Configuration{
+		LRGConfiguration{
+			Name: "main",
+			From: LRGFromConfiguration{
+				Prefix:   defaultIPv4,
+				Protocol: &bird,
+				Table:    DefaultTable,
+			},
+			To: LRGToConfiguration{
+				Prefix:   defaultIPv4,
+				Protocol: DefaultToProtocol,
+				Metric:   DefaultToMetric,
+				Table:    DefaultTable,
+			},
+		},
+		LRGConfiguration{
+			Name: "lte",
+			From: LRGFromConfiguration{
+				Prefix: defaultIPv4,
+				Table:  config.Table{ID: 100},
+			},
+			To: LRGToConfiguration{
+				Prefix:   defaultIPv4,
+				Protocol: DefaultToProtocol,
+				Metric:   DefaultToMetric - 1,
+				Table:    DefaultTable,
+			},
+			Depends: []LRGDependencyConfiguration{
+				{Gateway: "main", State: LRGDependencyMissing},
+			},
+		},
+	}
+	r := reporter.NewMock()
+	var lock sync.Mutex
+	added := []netlink.Route{}
+	deleted := []netlink.Route{}
+	nl, inject := netlink.NewMock(netlink.MockCallbacks{
+		AddRoute: func(r netlink.Route) error {
+			lock.Lock()
+			defer lock.Unlock()
+			added = append(added, r)
+			return nil
+		},
+		DeleteRoute: func(r netlink.Route) error {
+			lock.Lock()
+			defer lock.Unlock()
+			deleted = append(deleted, r)
+			return nil
+		},
+	})
+	c, err := New(r, dependentConfiguration, Dependencies{Netlink: nl})
+	if err != nil {
+		t.Fatalf("New(%s) error:\n%+v", dependentConfiguration, err)
+	}
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start() error:\n%+v", err)
+	}
+	defer func() {
+		if err := c.Stop(); err != nil {
+			t.Errorf("Stop() error:\n%+v", err)
+		}
+	}()
+	check := func(step string, expectedAdded, expectedDeleted []netlink.Route) {
+		time.Sleep(200 * time.Millisecond)
+		lock.Lock()
+		defer lock.Unlock()
+		if diff := helpers.Diff(added, expectedAdded); diff != "" {
+			t.Errorf("%s: unexpected installed routes (-got +want):\n%s", step, diff)
+		}
+		if diff := helpers.Diff(deleted, expectedDeleted); diff != "" {
+			t.Errorf("%s: unexpected withdrawn routes (-got +want):\n%s", step, diff)
+		}
+	}
+	lteRoute := netlink.Route{
+		Dst:       config.MustParseCIDR("0.0.0.0/0"),
+		Table:     int(DefaultTable.ID),
+		Protocol:  int(DefaultToProtocol.ID),
+		Priority:  int(DefaultToMetric - 1),
+		LinkIndex: 3,
+		Gw:        net.ParseIP("192.0.2.2"),
+	}
+	mainRoute := netlink.Route{
+		Dst:       config.MustParseCIDR("0.0.0.0/0"),
+		Table:     int(DefaultTable.ID),
+		Protocol:  int(DefaultToProtocol.ID),
+		Priority:  int(DefaultToMetric),
+		LinkIndex: 2,
+		Gw:        net.ParseIP("192.0.2.1"),
+	}
+
+	// Main gateway is missing: LTE gateway is installed
+	inject(netlink.Notification{StartOfRIB: true})
+	inject(netlink.Notification{
+		RouteUpdate: &netlink.RouteUpdate{
+			Type: syscall.RTM_NEWROUTE,
+			Route: netlink.Route{
+				Dst:       config.MustParseCIDR("0.0.0.0/0"),
+				Table:     100,
+				LinkIndex: 3,
+				Gw:        net.ParseIP("192.0.2.2"),
+			},
+		},
+	})
+	inject(netlink.Notification{EndOfRIB: true})
+	check("main missing", []netlink.Route{lteRoute}, []netlink.Route{})
+
+	// Main gateway is installed: LTE gateway is withdrawn
+	inject(netlink.Notification{
+		RouteUpdate: &netlink.RouteUpdate{
+			Type: syscall.RTM_NEWROUTE,
+			Route: netlink.Route{
+				Dst:       config.MustParseCIDR("0.0.0.0/0"),
+				Table:     int(DefaultTable.ID),
+				Protocol:  int(bird.ID),
+				LinkIndex: 2,
+				Gw:        net.ParseIP("192.0.2.1"),
+			},
+		},
+	})
+	check("main installed", []netlink.Route{lteRoute, mainRoute}, []netlink.Route{lteRoute})
+	if gauge := r.Gauge("gw1.state").Snapshot().Value(); gauge != LRGStateInstalled {
+		t.Errorf("main gateway state incorrect (%d, expected %d)", gauge, LRGStateInstalled)
+	}
+	if gauge := r.Gauge("gw2.state").Snapshot().Value(); gauge != LRGStateMissing {
+		t.Errorf("LTE gateway state incorrect (%d, expected %d)", gauge, LRGStateMissing)
+	}
+
+	// Restart with the LTE gateway installed: it is kept until
+	// the dependencies are evaluated, which is delayed by a slow
+	// condition on the main gateway.
+	lock.Lock()
+	added = []netlink.Route{}
+	deleted = []netlink.Route{}
+	lock.Unlock()
+	c.Stop()
+	restartConfiguration := Configuration{dependentConfiguration[0], dependentConfiguration[1]}
+	restartConfiguration[0].When = &LRGWhenConfiguration{
+		Command:  "sleep 0.1",
+		Interval: config.Duration(time.Second),
+	}
+	c, err = New(r, restartConfiguration, Dependencies{Netlink: nl})
+	if err != nil {
+		t.Fatalf("New(%s) error:\n%+v", restartConfiguration, err)
+	}
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start() error:\n%+v", err)
+	}
+	inject(netlink.Notification{StartOfRIB: true})
+	inject(netlink.Notification{
+		RouteUpdate: &netlink.RouteUpdate{
+			Type:  syscall.RTM_NEWROUTE,
+			Route: lteRoute,
+		},
+	})
+	inject(netlink.Notification{
+		RouteUpdate: &netlink.RouteUpdate{
+			Type: syscall.RTM_NEWROUTE,
+			Route: netlink.Route{
+				Dst:       config.MustParseCIDR("0.0.0.0/0"),
+				Table:     100,
+				LinkIndex: 3,
+				Gw:        net.ParseIP("192.0.2.2"),
+			},
+		},
+	})
+	inject(netlink.Notification{EndOfRIB: true})
+	check("restart", []netlink.Route{}, []netlink.Route{})
+}
+
+func TestGatewayAggregate(t *testing.T) {
+	bird := config.Protocol{ID: 12}
+	specific := func(name, prefix string) LRGConfiguration {
+		return LRGConfiguration{
+			Name: name,
+			From: LRGFromConfiguration{
+				Prefix:   config.MustParsePrefix(prefix),
+				Protocol: &bird,
+				Table:    DefaultTable,
+			},
+			To: LRGToConfiguration{
+				Prefix:   config.MustParsePrefix(prefix),
+				Protocol: DefaultToProtocol,
+				Metric:   DefaultToMetric,
+				Table:    DefaultTable,
+			},
+		}
+	}
+	aggregateConfiguration := Configuration{
+		specific("a", "10.1.0.0/16"),
+		specific("b", "10.2.0.0/16"),
+		specific("c", "10.3.0.0/16"),
+		LRGConfiguration{
+			From: LRGFromConfiguration{
+				Prefix: config.MustParsePrefix("10.0.0.0/8"),
+				Table:  DefaultTable,
+			},
+			To: LRGToConfiguration{
+				Prefix:   config.MustParsePrefix("10.0.0.0/8"),
+				Protocol: DefaultToProtocol,
+				Metric:   DefaultToMetric,
+				Table:    DefaultTable,
+			},
+			Aggregate: &LRGAggregateConfiguration{
+				Gateways: []string{"a", "b", "c"},
+				Lost:     1,
+			},
+		},
+	}
+	r := reporter.NewMock()
+	var lock sync.Mutex
+	added := []netlink.Route{}
+	deleted := []netlink.Route{}
+	aggregate := config.MustParseCIDR("10.0.0.0/8")
+	nl, inject := netlink.NewMock(netlink.MockCallbacks{
+		AddRoute: func(r netlink.Route) error {
+			lock.Lock()
+			defer lock.Unlock()
+			if helpers.IPNetEqual(*r.Dst, *aggregate) {
+				added = append(added, r)
+			}
+			return nil
+		},
+		DeleteRoute: func(r netlink.Route) error {
+			lock.Lock()
+			defer lock.Unlock()
+			if helpers.IPNetEqual(*r.Dst, *aggregate) {
+				deleted = append(deleted, r)
+			}
+			return nil
+		},
+	})
+	c, err := New(r, aggregateConfiguration, Dependencies{Netlink: nl})
+	if err != nil {
+		t.Fatalf("New(%s) error:\n%+v", aggregateConfiguration, err)
+	}
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start() error:\n%+v", err)
+	}
+	defer func() {
+		if err := c.Stop(); err != nil {
+			t.Errorf("Stop() error:\n%+v", err)
+		}
+	}()
+	check := func(step string, expectedAdded, expectedDeleted []netlink.Route, expectedLost int64) {
+		time.Sleep(200 * time.Millisecond)
+		lock.Lock()
+		defer lock.Unlock()
+		if diff := helpers.Diff(added, expectedAdded); diff != "" {
+			t.Errorf("%s: unexpected installed aggregates (-got +want):\n%s", step, diff)
+		}
+		if diff := helpers.Diff(deleted, expectedDeleted); diff != "" {
+			t.Errorf("%s: unexpected withdrawn aggregates (-got +want):\n%s", step, diff)
+		}
+		if gauge := r.Gauge("gw4.aggregate.lost").Snapshot().Value(); gauge != expectedLost {
+			t.Errorf("%s: lost gateways %d, expected %d", step, gauge, expectedLost)
+		}
+	}
+	candidate := func(prefix string, link int) netlink.Route {
+		return netlink.Route{
+			Dst:       config.MustParseCIDR(prefix),
+			Table:     int(DefaultTable.ID),
+			Protocol:  int(bird.ID),
+			LinkIndex: link,
+			Gw:        net.ParseIP(fmt.Sprintf("192.0.2.%d", link)),
+		}
+	}
+	update := func(kind uint16, route netlink.Route) {
+		inject(netlink.Notification{
+			RouteUpdate: &netlink.RouteUpdate{Type: kind, Route: route},
+		})
+	}
+	aggregateRoute := netlink.Route{
+		Dst:       aggregate,
+		Table:     int(DefaultTable.ID),
+		Protocol:  int(DefaultToProtocol.ID),
+		Priority:  int(DefaultToMetric),
+		LinkIndex: 2,
+		Gw:        net.ParseIP("192.0.2.2"),
+	}
+
+	// All specifics present: no aggregate
+	inject(netlink.Notification{StartOfRIB: true})
+	update(syscall.RTM_NEWROUTE, candidate("10.1.0.0/16", 1))
+	update(syscall.RTM_NEWROUTE, candidate("10.2.0.0/16", 2))
+	update(syscall.RTM_NEWROUTE, candidate("10.3.0.0/16", 3))
+	inject(netlink.Notification{EndOfRIB: true})
+	check("all present", []netlink.Route{}, []netlink.Route{}, 0)
+
+	// One specific lost: still no aggregate
+	update(syscall.RTM_DELROUTE, candidate("10.1.0.0/16", 1))
+	check("one lost", []netlink.Route{}, []netlink.Route{}, 1)
+
+	// Two specifics lost: aggregate toward the last lost one
+	update(syscall.RTM_DELROUTE, candidate("10.2.0.0/16", 2))
+	check("two lost", []netlink.Route{aggregateRoute}, []netlink.Route{}, 2)
+	if gauge := r.Gauge("gw4.state").Snapshot().Value(); gauge != LRGStateInstalled {
+		t.Errorf("aggregate state incorrect (%d, expected %d)", gauge, LRGStateInstalled)
+	}
+
+	// One specific back: aggregate withdrawn
+	update(syscall.RTM_NEWROUTE, candidate("10.1.0.0/16", 1))
+	check("one back", []netlink.Route{aggregateRoute}, []netlink.Route{aggregateRoute}, 1)
+}
+
+func TestGatewayStale(t *testing.T) {
+	defaultIPv4 := config.MustParsePrefix("0.0.0.0/0")
+	staleMetric := DefaultToMetric - 1
+	staleRealm := uint32(10)
+	staleConfiguration := Configuration{
+		LRGConfiguration{
+			From: LRGFromConfiguration{
+				Prefix: defaultIPv4,
+				Table:  DefaultTable,
+			},
+			To: LRGToConfiguration{
+				Prefix:   defaultIPv4,
+				Protocol: DefaultToProtocol,
+				Metric:   DefaultToMetric,
+				Table:    DefaultTable,
+				Stale: &LRGStaleConfiguration{
+					Metric: &staleMetric,
+					Realm:  &staleRealm,
+				},
+			},
+		},
+	}
+	r := reporter.NewMock()
+	var lock sync.Mutex
+	added := []netlink.Route{}
+	deleted := []netlink.Route{}
+	nl, inject := netlink.NewMock(netlink.MockCallbacks{
+		AddRoute: func(r netlink.Route) error {
+			lock.Lock()
+			defer lock.Unlock()
+			added = append(added, r)
+			return nil
+		},
+		DeleteRoute: func(r netlink.Route) error {
+			lock.Lock()
+			defer lock.Unlock()
+			deleted = append(deleted, r)
+			return nil
+		},
+	})
+	c, err := New(r, staleConfiguration, Dependencies{Netlink: nl})
+	if err != nil {
+		t.Fatalf("New(%s) error:\n%+v", staleConfiguration, err)
+	}
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start() error:\n%+v", err)
+	}
+	defer func() {
+		if err := c.Stop(); err != nil {
+			t.Errorf("Stop() error:\n%+v", err)
+		}
+	}()
+	check := func(step string, expectedAdded, expectedDeleted []netlink.Route, expectedStale int64) {
+		time.Sleep(200 * time.Millisecond)
+		lock.Lock()
+		defer lock.Unlock()
+		if diff := helpers.Diff(added, expectedAdded); diff != "" {
+			t.Errorf("%s: unexpected installed routes (-got +want):\n%s", step, diff)
+		}
+		if diff := helpers.Diff(deleted, expectedDeleted); diff != "" {
+			t.Errorf("%s: unexpected removed routes (-got +want):\n%s", step, diff)
+		}
+		if gauge := r.Gauge("gw1.stale").Snapshot().Value(); gauge != expectedStale {
+			t.Errorf("%s: stale gauge incorrect (%d, expected %d)", step, gauge, expectedStale)
+		}
+	}
+	candidate := netlink.Route{
+		Dst:       config.MustParseCIDR("0.0.0.0/0"),
+		Table:     int(DefaultTable.ID),
+		LinkIndex: 2,
+		Gw:        net.ParseIP("192.0.2.1"),
+	}
+	fresh := netlink.Route{
+		Dst:       config.MustParseCIDR("0.0.0.0/0"),
+		Table:     int(DefaultTable.ID),
+		Protocol:  int(DefaultToProtocol.ID),
+		Priority:  int(DefaultToMetric),
+		LinkIndex: 2,
+		Gw:        net.ParseIP("192.0.2.1"),
+	}
+	stale := fresh
+	stale.Priority = int(staleMetric)
+	stale.Realm = int(staleRealm)
+
+	inject(netlink.Notification{StartOfRIB: true})
+	inject(netlink.Notification{
+		RouteUpdate: &netlink.RouteUpdate{
+			Type:  syscall.RTM_NEWROUTE,
+			Route: candidate,
+		},
+	})
+	inject(netlink.Notification{EndOfRIB: true})
+	check("fresh", []netlink.Route{fresh}, []netlink.Route{}, 0)
+
+	// Candidate lost: the route is marked as stale
+	inject(netlink.Notification{
+		RouteUpdate: &netlink.RouteUpdate{
+			Type:  syscall.RTM_DELROUTE,
+			Route: candidate,
+		},
+	})
+	check("stale", []netlink.Route{fresh, stale}, []netlink.Route{fresh}, 1)
+
+	// Removal of the fresh route is not the removal of the
+	// current route
+	inject(netlink.Notification{
+		RouteUpdate: &netlink.RouteUpdate{
+			Type:  syscall.RTM_DELROUTE,
+			Route: fresh,
+		},
+	})
+	check("fresh removed", []netlink.Route{fresh, stale}, []netlink.Route{fresh}, 1)
+
+	// Candidate back: the route is fresh again
+	inject(netlink.Notification{
+		RouteUpdate: &netlink.RouteUpdate{
+			Type:  syscall.RTM_NEWROUTE,
+			Route: candidate,
+		},
+	})
+	check("fresh again", []netlink.Route{fresh, stale, fresh}, []netlink.Route{fresh, stale}, 0)
+}
+
+func TestGatewayGiveUp(t *testing.T) {
+	defaultIPv4 := config.MustParsePrefix("0.0.0.0/0")
+	failingConfiguration := Configuration{
+		LRGConfiguration{
+			From: LRGFromConfiguration{
+				Prefix: defaultIPv4,
+				Table:  DefaultTable,
+			},
+			To: LRGToConfiguration{
+				Prefix:   defaultIPv4,
+				Protocol: DefaultToProtocol,
+				Metric:   DefaultToMetric,
+				Table:    DefaultTable,
+			},
+			Install: &InstallConfiguration{
+				BackoffInterval:    config.Duration(10 * time.Millisecond),
+				BackoffMaxInterval: config.Duration(20 * time.Millisecond),
+				BackoffMultiplier:  2,
+				GiveUpAfter:        config.Duration(100 * time.Millisecond),
+			},
+		},
+	}
+	r := reporter.NewMock()
+	var lock sync.Mutex
+	attempts := 0
+	nl, inject := netlink.NewMock(netlink.MockCallbacks{
+		AddRoute: func(r netlink.Route) error {
+			lock.Lock()
+			defer lock.Unlock()
+			attempts++
+			return syscall.ENETUNREACH
+		},
+	})
+	c, err := New(r, failingConfiguration, Dependencies{Netlink: nl})
+	if err != nil {
+		t.Fatalf("New(%s) error:\n%+v", failingConfiguration, err)
+	}
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start() error:\n%+v", err)
+	}
+	defer func() {
+		if err := c.Stop(); err != nil {
+			t.Errorf("Stop() error:\n%+v", err)
+		}
+	}()
+	inject(netlink.Notification{StartOfRIB: true})
+	inject(netlink.Notification{
+		RouteUpdate: &netlink.RouteUpdate{
+			Type: syscall.RTM_NEWROUTE,
+			Route: netlink.Route{
+				Dst:       config.MustParseCIDR("0.0.0.0/0"),
+				Table:     int(DefaultTable.ID),
+				LinkIndex: 2,
+				Gw:        net.ParseIP("192.0.2.1"),
+			},
+		},
+	})
+	inject(netlink.Notification{EndOfRIB: true})
+	time.Sleep(400 * time.Millisecond)
+
+	lock.Lock()
+	before := attempts
+	lock.Unlock()
+	if before < 2 {
+		t.Errorf("installation attempted %d times, expected several attempts", before)
+	}
+	if gauge := r.Gauge("gw1.state").Snapshot().Value(); gauge != LRGStateFailed {
+		t.Errorf("gw1.state == %d, expected %d", gauge, LRGStateFailed)
+	}
+	if counter := r.Counter("gw1.install.failed").Snapshot().Count(); counter != 1 {
+		t.Errorf("gw1.install.failed == %d, expected 1", counter)
+	}
+
+	// No more attempts once we gave up
+	time.Sleep(200 * time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	if attempts != before {
+		t.Errorf("installation attempted %d times after giving up", attempts-before)
+	}
+}
+
+func TestGatewayInstallErrors(t *testing.T) {
+	defaultIPv4 := config.MustParsePrefix("0.0.0.0/0")
+	configuration := Configuration{
+		LRGConfiguration{
+			From: LRGFromConfiguration{
+				Prefix: defaultIPv4,
+				Table:  DefaultTable,
+			},
+			To: LRGToConfiguration{
+				Prefix:   defaultIPv4,
+				Protocol: DefaultToProtocol,
+				Metric:   DefaultToMetric,
+				Table:    DefaultTable,
+			},
+		},
+	}
+	target := netlink.Route{
+		Dst:       config.MustParseCIDR("0.0.0.0/0"),
+		Table:     int(DefaultTable.ID),
+		Protocol:  int(DefaultToProtocol.ID),
+		Priority:  int(DefaultToMetric),
+		LinkIndex: 2,
+		Gw:        net.ParseIP("192.0.2.1"),
+	}
+	onlinkTarget := target
+	onlinkTarget.Flags = int(knetlink.FLAG_ONLINK)
+	linkUpdate := func(index int, flags net.Flags) netlink.Notification {
+		return netlink.Notification{
+			LinkUpdate: &knetlink.LinkUpdate{
+				Header: syscall.NlMsghdr{Type: syscall.RTM_NEWLINK},
+				Link: &knetlink.Dummy{
+					LinkAttrs: knetlink.LinkAttrs{
+						Index:     index,
+						Name:      "eth0",
+						Flags:     flags,
+						OperState: knetlink.OperUnknown,
+					},
+				},
+			},
+		}
+	}
+
+	cases := []struct {
+		description   string
+		errors        []error // returned by successive installation attempts
+		notifications []netlink.Notification
+		expected      []netlink.Route
+		counter       string
+		count         int64 // expected value of counter, 1 if unset
+		state         int64
+		terminated    bool
+	}{
+		{
+			description: "nexthop not on-link",
+			errors:      []error{syscall.ENETUNREACH},
+			expected:    []netlink.Route{target, onlinkTarget},
+			counter:     "gw1.install.errors.unreachable",
+			state:       LRGStateInstalled,
+		}, {
+			description: "invalid route",
+			errors:      []error{syscall.EINVAL},
+			expected:    []netlink.Route{target, target},
+			counter:     "gw1.install.errors.other",
+			state:       LRGStateInstalled,
+		}, {
+			description: "conflicting route",
+			errors:      []error{syscall.EEXIST},
+			expected:    []netlink.Route{target, target},
+			counter:     "gw1.install.errors.exists",
+			state:       LRGStateInstalled,
+		}, {
+			description: "missing device",
+			errors:      []error{syscall.ENODEV},
+			expected:    []netlink.Route{target},
+			counter:     "gw1.install.errors.nodevice",
+			state:       LRGStateInstalling,
+		}, {
+			description: "missing device, other link up",
+			errors:      []error{syscall.ENODEV},
+			notifications: []netlink.Notification{
+				linkUpdate(3, net.FlagUp),
+			},
+			expected: []netlink.Route{target, target},
+			counter:  "gw1.install.errors.nodevice",
+			state:    LRGStateInstalled,
+		}, {
+			description: "missing device, still missing after other link up",
+			errors:      []error{syscall.ENODEV, syscall.ENODEV},
+			notifications: []netlink.Notification{
+				linkUpdate(3, net.FlagUp),
+			},
+			expected: []netlink.Route{target, target},
+			counter:  "gw1.install.errors.nodevice",
+			count:    2,
+			state:    LRGStateInstalling,
+		}, {
+			description: "missing device, link still down",
+			errors:      []error{syscall.ENODEV},
+			notifications: []netlink.Notification{
+				linkUpdate(2, 0),
+			},
+			expected: []netlink.Route{target},
+			counter:  "gw1.install.errors.nodevice",
+			state:    LRGStateInstalling,
+		}, {
+			description: "missing device, link up",
+			errors:      []error{syscall.ENODEV},
+			notifications: []netlink.Notification{
+				linkUpdate(2, net.FlagUp),
+			},
+			expected: []netlink.Route{target, target},
+			counter:  "gw1.install.errors.nodevice",
+			state:    LRGStateInstalled,
+		}, {
+			description: "missing privileges",
+			errors:      []error{syscall.EPERM},
+			expected:    []netlink.Route{target},
+			counter:     "gw1.install.errors.permission",
+			state:       LRGStateInstalling,
+			terminated:  true,
+		}, {
+			description: "other error",
+			errors:      []error{syscall.ENOMEM},
+			expected:    []netlink.Route{target, target},
+			counter:     "gw1.install.errors.other",
+			state:       LRGStateInstalled,
+		},
+	}
+	for _, tc := range cases {
+		r := reporter.NewMock()
+		var lock sync.Mutex
+		added := []netlink.Route{}
+		nl, inject := netlink.NewMock(netlink.MockCallbacks{
+			AddRoute: func(r netlink.Route) error {
+				lock.Lock()
+				defer lock.Unlock()
+				added = append(added, r)
+				if len(added) <= len(tc.errors) {
+					return errors.Wrap(tc.errors[len(added)-1], "cannot install route")
+				}
+				return nil
+			},
+		})
+		d := daemon.NewMock()
+		c, err := New(r, configuration, Dependencies{Netlink: nl, Daemon: d})
+		if err != nil {
+			t.Fatalf("New(%s) error:\n%+v", configuration, err)
+		}
+		if err := c.Start(); err != nil {
+			t.Fatalf("Start() error:\n%+v", err)
+		}
+		inject(netlink.Notification{StartOfRIB: true})
+		inject(netlink.Notification{
+			RouteUpdate: &netlink.RouteUpdate{
+				Type: syscall.RTM_NEWROUTE,
+				Route: netlink.Route{
+					Dst:       config.MustParseCIDR("0.0.0.0/0"),
+					Table:     int(DefaultTable.ID),
+					LinkIndex: 2,
+					Gw:        net.ParseIP("192.0.2.1"),
+				},
+			},
+		})
+		inject(netlink.Notification{EndOfRIB: true})
+		time.Sleep(500 * time.Millisecond)
+		for _, notification := range tc.notifications {
+			inject(notification)
+		}
+		time.Sleep(200 * time.Millisecond)
+
+		lock.Lock()
+		if diff := helpers.Diff(added, tc.expected); diff != "" {
+			t.Errorf("%s: unexpected installed routes (-got +want):\n%s", tc.description, diff)
+		}
+		lock.Unlock()
+		count := tc.count
+		if count == 0 {
+			count = 1
+		}
+		if counter := r.Counter(tc.counter).Snapshot().Count(); counter != count {
+			t.Errorf("%s: %s == %d, expected %d", tc.description, tc.counter, counter, count)
+		}
+		if gauge := r.Gauge("gw1.state").Snapshot().Value(); gauge != tc.state {
+			t.Errorf("%s: gw1.state == %d, expected %d", tc.description, gauge, tc.state)
+		}
+		terminated := false
+		select {
+		case <-d.Terminated():
+			terminated = true
+		default:
+		}
+		if terminated != tc.terminated {
+			t.Errorf("%s: terminated == %v, expected %v", tc.description, terminated, tc.terminated)
+		}
+		if failed := d.Failure() != nil; failed != tc.terminated {
+			t.Errorf("%s: Failure() != nil == %v, expected %v", tc.description, failed, tc.terminated)
+		}
+		err = c.Stop()
+		switch {
+		case err != nil && !tc.terminated:
+			t.Errorf("%s: Stop() error:\n%+v", tc.description, err)
+		case err == nil && tc.terminated:
+			t.Errorf("%s: Stop() should have returned an error", tc.description)
+		}
+	}
+}
+
+func TestGatewayConfirm(t *testing.T) {
+	defaultIPv4 := config.MustParsePrefix("0.0.0.0/0")
+	cases := []struct {
+		description string
+		mode        LRGConfirmMode
+		timeout     time.Duration
+		readBack    []bool
+		echo        bool
+		state       int64
+		confirmed   int64
+	}{
+		{"no confirmation", LRGConfirmModeNone, 0, []bool{false}, false, LRGStateInstalled, 0},
+		{"read back", LRGConfirmModeReadBack, 0, []bool{false, false, true}, false, LRGStateInstalled, 1},
+		{"not read back", LRGConfirmModeReadBack, 0, []bool{false}, false, LRGStateInstalling, 0},
+		{"not read back before timeout", LRGConfirmModeReadBack, 100 * time.Millisecond, []bool{false}, false, LRGStateFailed, 0},
+		{"echo", LRGConfirmModeEcho, 0, []bool{false}, true, LRGStateInstalled, 1},
+		{"no echo", LRGConfirmModeEcho, 0, []bool{false}, false, LRGStateInstalling, 0},
+		// An identical IPv4 route is replaced without notification
+		{"no echo but read back", LRGConfirmModeEcho, 0, []bool{true}, false, LRGStateInstalled, 1},
+	}
+	for _, tc := range cases {
+		configuration := Configuration{
+			LRGConfiguration{
+				From: LRGFromConfiguration{
+					Prefix: defaultIPv4,
+					Table:  DefaultTable,
+				},
+				To: LRGToConfiguration{
+					Prefix:   defaultIPv4,
+					Protocol: DefaultToProtocol,
+					Metric:   DefaultToMetric,
+					Table:    DefaultTable,
+				},
+				Install: &InstallConfiguration{
+					BackoffInterval:    config.Duration(10 * time.Millisecond),
+					BackoffMaxInterval: config.Duration(20 * time.Millisecond),
+					BackoffMultiplier:  2,
+					Confirm:            tc.mode,
+					ConfirmTimeout:     config.Duration(tc.timeout),
+				},
+			},
+		}
+		r := reporter.NewMock()
+		var lock sync.Mutex
+		var added *netlink.Route
+		readBacks := 0
+		nl, inject := netlink.NewMock(netlink.MockCallbacks{
+			AddRoute: func(route netlink.Route) error {
+				lock.Lock()
+				defer lock.Unlock()
+				added = &route
+				return nil
+			},
+			HasRoute: func(route netlink.Route) (bool, error) {
+				lock.Lock()
+				defer lock.Unlock()
+				readBacks++
+				if readBacks > len(tc.readBack) {
+					return tc.readBack[len(tc.readBack)-1], nil
+				}
+				return tc.readBack[readBacks-1], nil
+			},
+		})
+		c, err := New(r, configuration, Dependencies{Netlink: nl})
+		if err != nil {
+			t.Fatalf("New(%s) error:\n%+v", configuration, err)
+		}
+		if err := c.Start(); err != nil {
+			t.Fatalf("Start() error:\n%+v", err)
+		}
+		inject(netlink.Notification{StartOfRIB: true})
+		inject(netlink.Notification{
+			RouteUpdate: &netlink.RouteUpdate{
+				Type: syscall.RTM_NEWROUTE,
+				Route: netlink.Route{
+					Dst:       config.MustParseCIDR("0.0.0.0/0"),
+					Table:     int(DefaultTable.ID),
+					LinkIndex: 2,
+					Gw:        net.ParseIP("192.0.2.1"),
+				},
+			},
+		})
+		inject(netlink.Notification{EndOfRIB: true})
+		time.Sleep(200 * time.Millisecond)
+		if tc.echo {
+			// The kernel sets or changes some attributes
+			lock.Lock()
+			echo := *added
+			lock.Unlock()
+			echo.Scope = knetlink.SCOPE_UNIVERSE
+			echo.Flags |= 0x10 // RTNH_F_LINKDOWN
+			echo.Expires = 100
+			inject(netlink.Notification{
+				RouteUpdate: &netlink.RouteUpdate{
+					Type:  syscall.RTM_NEWROUTE,
+					Route: echo,
+				},
+			})
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		if gauge := r.Gauge("gw1.state").Snapshot().Value(); gauge != tc.state {
+			t.Errorf("%s: gw1.state == %d, expected %d", tc.description, gauge, tc.state)
+		}
+		if count := r.Histogram("gw1.install.latency").Snapshot().Count(); count != tc.confirmed {
+			t.Errorf("%s: gw1.install.latency count == %d, expected %d",
+				tc.description, count, tc.confirmed)
+		}
+		unconfirmed := r.Counter("gw1.install.unconfirmed").Snapshot().Count()
+		if tc.state == LRGStateInstalling && unconfirmed == 0 {
+			t.Errorf("%s: installation should have been retried", tc.description)
+		}
+		if err := c.Stop(); err != nil {
+			t.Errorf("%s: Stop() error:\n%+v", tc.description, err)
+		}
+	}
+}
+
+func TestGatewayFakeKernel(t *testing.T) {
+	defaultIPv4 := config.MustParsePrefix("0.0.0.0/0")
+	configuration := Configuration{
+		LRGConfiguration{
+			From: LRGFromConfiguration{
+				Prefix: defaultIPv4,
+				Table:  DefaultTable,
+			},
+			To: LRGToConfiguration{
+				Prefix:   defaultIPv4,
+				Protocol: DefaultToProtocol,
+				Metric:   DefaultToMetric,
+				Table:    DefaultTable,
+			},
+			Install: &InstallConfiguration{
+				BackoffInterval:    config.Duration(10 * time.Millisecond),
+				BackoffMaxInterval: config.Duration(20 * time.Millisecond),
+				BackoffMultiplier:  2,
+				Confirm:            LRGConfirmModeEcho,
+			},
+		},
+	}
+	birdRoute := func(gw string) netlink.Route {
+		return netlink.Route{
+			Dst:       config.MustParseCIDR("0.0.0.0/0"),
+			Table:     int(DefaultTable.ID),
+			Protocol:  12,
+			LinkIndex: 2,
+			Gw:        net.ParseIP(gw),
+		}
+	}
+	lrgRoute := func(gw string) netlink.Route {
+		route := birdRoute(gw)
+		route.Protocol = int(DefaultToProtocol.ID)
+		route.Priority = int(DefaultToMetric)
+		return route
+	}
+	checkRoutes := func(description string, expected []netlink.Route, nl *netlink.FakeComponent) {
+		// Leave some time to the gateways to update the RIB
+		time.Sleep(100 * time.Millisecond)
+		if diff := helpers.Diff(nl.Routes(), expected); diff != "" {
+			t.Errorf("%s (-got, +want):\n%s", description, diff)
+		}
+	}
+
+	r := reporter.NewMock()
+	nl := netlink.NewFake()
+	nl.InjectRoute(birdRoute("192.0.2.1"))
+	c, err := New(r, configuration, Dependencies{Netlink: nl})
+	if err != nil {
+		t.Fatalf("New(%s) error:\n%+v", configuration, err)
+	}
+	if err := nl.Start(); err != nil {
+		t.Fatalf("Start() error:\n%+v", err)
+	}
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start() error:\n%+v", err)
+	}
+	defer func() {
+		if err := c.Stop(); err != nil {
+			t.Errorf("Stop() error:\n%+v", err)
+		}
+	}()
+
+	// The route is copied and the copy is confirmed by the echo
+	checkRoutes("initial RIB", []netlink.Route{
+		birdRoute("192.0.2.1"),
+		lrgRoute("192.0.2.1"),
+	}, nl)
+	if gauge := r.Gauge("gw1.state").Snapshot().Value(); gauge != LRGStateInstalled {
+		t.Errorf("gw1.state == %d, expected %d", gauge, LRGStateInstalled)
+	}
+	if count := r.Histogram("gw1.install.latency").Snapshot().Count(); count != 1 {
+		t.Errorf("gw1.install.latency count == %d, expected 1", count)
+	}
+
+	// A change lost during an overflow is caught up on resync
+	nl.Overflow()
+	nl.InjectRoute(birdRoute("192.0.2.2"))
+	nl.Resync()
+	checkRoutes("after resync", []netlink.Route{
+		birdRoute("192.0.2.2"),
+		lrgRoute("192.0.2.2"),
+	}, nl)
+
+	// The copy survives the removal of the original route and a
+	// new RIB
+	if err := nl.InjectRouteDeletion(birdRoute("192.0.2.2")); err != nil {
+		t.Fatalf("InjectRouteDeletion() error:\n%+v", err)
 	}
+	nl.Restart()
+	checkRoutes("after removal", []netlink.Route{
+		lrgRoute("192.0.2.2"),
+	}, nl)
 }
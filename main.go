@@ -16,6 +16,9 @@ func main() {
 		case cmd.UsageError:
 			os.Stderr.WriteString(fmt.Sprintf("Usage error: %s\n", err))
 			os.Stderr.WriteString("Use --help for usage\n")
+		case cmd.FatalError:
+			os.Stderr.WriteString(fmt.Sprintf("Fatal error: %v\n", err))
+			os.Exit(cmd.FatalErrorStatus)
 		default:
 			os.Stderr.WriteString(fmt.Sprintf("Runtime error: %v\n", err))
 		}
@@ -1,15 +1,28 @@
 package netlink
 
 import (
+	"syscall"
+
 	"github.com/pkg/errors"
-	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
 )
 
 // AddRoute will install the specified route. It will replace an
 // existing route with the same characteristics. No retry logic is
 // attempted, so error must be handled in upper layers.
-func (c *realComponent) AddRoute(route netlink.Route) error {
-	if err := netlink.RouteReplace(&route); err != nil {
+func (c *realComponent) AddRoute(route Route) error {
+	return addRoute(nil, route)
+}
+
+// addRoute will install the specified route using the provided
+// socket (or a new one when nil).
+func addRoute(s *nl.NetlinkSocket, route Route) error {
+	req, err := routeRequest(syscall.RTM_NEWROUTE,
+		syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, route)
+	if err == nil {
+		err = executeRouteRequest(s, req)
+	}
+	if err != nil {
 		return errors.Wrapf(err, "cannot install route %s", route)
 	}
 	return nil
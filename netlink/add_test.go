@@ -8,16 +8,15 @@ import (
 	"syscall"
 	"testing"
 
-	"github.com/vishvananda/netlink"
-
 	"lrg/config"
+	"lrg/daemon"
 	"lrg/helpers"
 	"lrg/reporter"
 )
 
 func TestAddRoute(t *testing.T) {
 	r := reporter.NewMock()
-	c, err := New(r, DefaultConfiguration)
+	c, err := New(r, DefaultConfiguration, Dependencies{Daemon: daemon.NewMock()})
 	if err != nil {
 		t.Fatalf("New() error:\n%+v", err)
 	}
@@ -33,12 +32,12 @@ func TestAddRoute(t *testing.T) {
 
 	cases := []struct {
 		setup    string
-		route    netlink.Route
+		route    Route
 		expected string
 	}{
 		{
 			setup: "",
-			route: netlink.Route{
+			route: Route{
 				LinkIndex: 2,
 				Dst:       config.MustParseCIDR("192.168.26.0/24"),
 				Table:     syscall.RT_TABLE_MAIN,
@@ -46,7 +45,7 @@ func TestAddRoute(t *testing.T) {
 			expected: "192.168.26.0/24 dev dummy0",
 		}, {
 			setup: "",
-			route: netlink.Route{
+			route: Route{
 				LinkIndex: 2,
 				Dst:       config.MustParseCIDR("2001:db8:16::/64"),
 				Table:     syscall.RT_TABLE_MAIN,
@@ -54,7 +53,7 @@ func TestAddRoute(t *testing.T) {
 			expected: "2001:db8:16::/64 dev dummy0 metric 1024 pref medium",
 		}, {
 			setup: "",
-			route: netlink.Route{
+			route: Route{
 				LinkIndex: 2,
 				Dst:       config.MustParseCIDR("192.168.26.0/24"),
 				Table:     syscall.RT_TABLE_MAIN,
@@ -63,7 +62,7 @@ func TestAddRoute(t *testing.T) {
 			expected: "192.168.26.0/24 dev dummy0 metric 10",
 		}, {
 			setup: "",
-			route: netlink.Route{
+			route: Route{
 				LinkIndex: 2,
 				Dst:       config.MustParseCIDR("2001:db8:16::/64"),
 				Table:     syscall.RT_TABLE_MAIN,
@@ -72,7 +71,7 @@ func TestAddRoute(t *testing.T) {
 			expected: "2001:db8:16::/64 dev dummy0 metric 10 pref medium",
 		}, {
 			setup: "",
-			route: netlink.Route{
+			route: Route{
 				LinkIndex: 2,
 				Dst:       config.MustParseCIDR("192.168.26.0/24"),
 				Table:     syscall.RT_TABLE_MAIN,
@@ -81,7 +80,7 @@ func TestAddRoute(t *testing.T) {
 			expected: "192.168.26.0/24 dev dummy0 proto kernel",
 		}, {
 			setup: "",
-			route: netlink.Route{
+			route: Route{
 				LinkIndex: 2,
 				Dst:       config.MustParseCIDR("2001:db8:54::/64"),
 				Table:     syscall.RT_TABLE_MAIN,
@@ -90,7 +89,7 @@ func TestAddRoute(t *testing.T) {
 			expected: "2001:db8:54::/64 dev dummy0 proto kernel metric 1024 pref medium",
 		}, {
 			setup: "",
-			route: netlink.Route{
+			route: Route{
 				LinkIndex: 2,
 				Dst:       config.MustParseCIDR("192.168.26.0/24"),
 				Table:     100,
@@ -98,7 +97,7 @@ func TestAddRoute(t *testing.T) {
 			expected: "192.168.26.0/24 dev dummy0 table 100",
 		}, {
 			setup: "",
-			route: netlink.Route{
+			route: Route{
 				LinkIndex: 2,
 				Dst:       config.MustParseCIDR("2001:db8:54::/64"),
 				Table:     100,
@@ -106,7 +105,7 @@ func TestAddRoute(t *testing.T) {
 			expected: "2001:db8:54::/64 dev dummy0 table 100 metric 1024 pref medium",
 		}, {
 			setup: "ip route add 192.168.26.0/24 dev dummy0",
-			route: netlink.Route{
+			route: Route{
 				LinkIndex: 2,
 				Dst:       config.MustParseCIDR("192.168.27.0/24"),
 				Gw:        net.ParseIP("192.168.26.1"),
@@ -118,14 +117,14 @@ func TestAddRoute(t *testing.T) {
 `,
 		}, {
 			setup: "ip route add 192.168.26.0/24 dev dummy0",
-			route: netlink.Route{
+			route: Route{
 				Dst: config.MustParseCIDR("192.168.27.0/24"),
-				MultiPath: []*netlink.NexthopInfo{
-					&netlink.NexthopInfo{
+				MultiPath: []*NexthopInfo{
+					&NexthopInfo{
 						LinkIndex: 2,
 						Gw:        net.ParseIP("192.168.26.1"),
 					},
-					&netlink.NexthopInfo{
+					&NexthopInfo{
 						LinkIndex: 2,
 						Gw:        net.ParseIP("192.168.26.2"),
 					},
@@ -143,7 +142,7 @@ nexthop via 192.168.26.2 dev dummy0 weight 1
 ip route add 192.168.26.0/24 dev dummy0
 ip route add 192.168.27.0/24 via 192.168.26.1
 `,
-			route: netlink.Route{
+			route: Route{
 				Dst:   config.MustParseCIDR("192.168.27.0/24"),
 				Gw:    net.ParseIP("192.168.26.2"),
 				Table: syscall.RT_TABLE_MAIN,
@@ -157,7 +156,7 @@ ip route add 192.168.27.0/24 via 192.168.26.1
 ip route add 2001:db8:26::/64 dev dummy0
 ip route add 2001:db8:27::/64 via 2001:db8:26::1
 `,
-			route: netlink.Route{
+			route: Route{
 				Dst:   config.MustParseCIDR("2001:db8:27::/64"),
 				Gw:    net.ParseIP("2001:db8:26::2"),
 				Table: syscall.RT_TABLE_MAIN,
@@ -171,14 +170,14 @@ ip route add 2001:db8:27::/64 via 2001:db8:26::1
 ip route add 192.168.26.0/24 dev dummy0
 ip route add 192.168.27.0/24 via 192.168.26.1
 `,
-			route: netlink.Route{
+			route: Route{
 				Dst: config.MustParseCIDR("192.168.27.0/24"),
-				MultiPath: []*netlink.NexthopInfo{
-					&netlink.NexthopInfo{
+				MultiPath: []*NexthopInfo{
+					&NexthopInfo{
 						LinkIndex: 2,
 						Gw:        net.ParseIP("192.168.26.1"),
 					},
-					&netlink.NexthopInfo{
+					&NexthopInfo{
 						LinkIndex: 2,
 						Gw:        net.ParseIP("192.168.26.2"),
 					},
@@ -196,7 +195,7 @@ nexthop via 192.168.26.2 dev dummy0 weight 1
 ip route add 192.168.26.0/24 dev dummy0
 ip route add 192.168.27.0/24 via 192.168.26.1
 `,
-			route: netlink.Route{
+			route: Route{
 				Dst:      config.MustParseCIDR("192.168.27.0/24"),
 				Gw:       net.ParseIP("192.168.26.2"),
 				Priority: 100,
@@ -212,7 +211,7 @@ ip route add 192.168.27.0/24 via 192.168.26.1
 ip route add 2001:db8:26::/64 dev dummy0
 ip route add 2001:db8:27::/64 via 2001:db8:26::1
 `,
-			route: netlink.Route{
+			route: Route{
 				Dst:      config.MustParseCIDR("2001:db8:27::/64"),
 				Gw:       net.ParseIP("2001:db8:26::2"),
 				Priority: 100,
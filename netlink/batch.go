@@ -0,0 +1,43 @@
+package netlink
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// RouteOperation is an operation on a route for ApplyRoutes. The
+// route is either replaced, like with AddRoute, or removed, like with
+// DeleteRoute.
+type RouteOperation struct {
+	Delete bool
+	Route  Route
+}
+
+// ApplyRoutes will apply the provided operations in order, using the
+// same netlink socket. All operations are attempted, even when some
+// of them fail. The result of each operation (nil on success) is
+// returned in the same order. This is not atomic: the kernel may
+// expose an intermediate state. Like for AddRoute and DeleteRoute, no
+// retry logic is attempted.
+func (c *realComponent) ApplyRoutes(operations []RouteOperation) []error {
+	results := make([]error, len(operations))
+	s, err := nl.Subscribe(syscall.NETLINK_ROUTE)
+	if err != nil {
+		err = errors.Wrap(err, "cannot open netlink socket")
+		for i := range results {
+			results[i] = err
+		}
+		return results
+	}
+	defer s.Close()
+	for i, operation := range operations {
+		if operation.Delete {
+			results[i] = deleteRoute(s, operation.Route)
+		} else {
+			results[i] = addRoute(s, operation.Route)
+		}
+	}
+	return results
+}
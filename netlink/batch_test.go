@@ -0,0 +1,112 @@
+package netlink
+
+import (
+	"bytes"
+	"net"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+
+	"lrg/config"
+	"lrg/daemon"
+	"lrg/helpers"
+	"lrg/reporter"
+)
+
+func TestApplyRoutes(t *testing.T) {
+	resetNamespace(t)
+	r := reporter.NewMock()
+	c, err := New(r, DefaultConfiguration, Dependencies{Daemon: daemon.NewMock()})
+	if err != nil {
+		t.Fatalf("New() error:\n%+v", err)
+	}
+
+	setup := `
+ip route add 192.168.26.0/24 dev dummy0 metric 100
+ip route add 192.168.27.0/24 dev dummy0
+`
+	var outbuf, errbuf bytes.Buffer
+	cmd := exec.Command("sh", "-exc", setup)
+	cmd.Stdout = &outbuf
+	cmd.Stderr = &errbuf
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Unable to setup routes\n** Setup:\n%s\n** Stdout:\n%s\n** Stderr:\n%s\n** Error:\n%+v",
+			setup, outbuf.String(), errbuf.String(), err)
+	}
+
+	results := c.ApplyRoutes([]RouteOperation{
+		{
+			// Change the metric of a route
+			Route: Route{
+				LinkIndex: 2,
+				Dst:       config.MustParseCIDR("192.168.26.0/24"),
+				Priority:  200,
+				Table:     syscall.RT_TABLE_MAIN,
+			},
+		}, {
+			Delete: true,
+			Route: Route{
+				LinkIndex: 2,
+				Dst:       config.MustParseCIDR("192.168.26.0/24"),
+				Priority:  100,
+				Table:     syscall.RT_TABLE_MAIN,
+			},
+		}, {
+			// Unreachable gateway
+			Route: Route{
+				Dst:   config.MustParseCIDR("192.168.28.0/24"),
+				Gw:    net.ParseIP("10.0.0.1"),
+				Table: syscall.RT_TABLE_MAIN,
+			},
+		}, {
+			// Already missing
+			Delete: true,
+			Route: Route{
+				LinkIndex: 2,
+				Dst:       config.MustParseCIDR("192.168.29.0/24"),
+				Table:     syscall.RT_TABLE_MAIN,
+			},
+		}, {
+			Route: Route{
+				LinkIndex: 2,
+				Dst:       config.MustParseCIDR("192.168.30.0/24"),
+				Table:     syscall.RT_TABLE_MAIN,
+			},
+		},
+	})
+	failed := []bool{}
+	for _, err := range results {
+		failed = append(failed, err != nil)
+	}
+	if diff := helpers.Diff(failed, []bool{false, false, true, false, false}); diff != "" {
+		t.Errorf("ApplyRoutes() failures (-got, +want):\n%s\n%v", diff, results)
+	}
+	if err := results[2]; err != nil && !strings.Contains(err.Error(), "192.168.28.0/24") {
+		t.Errorf("ApplyRoutes() error %q should mention the route", err)
+	}
+
+	outbuf.Reset()
+	errbuf.Reset()
+	cmd = exec.Command("sh", "-c", `
+ip route show table 0 \
+  | grep -v table.local \
+  | grep -v '^fe80::/64 dev dummy0 '
+`)
+	cmd.Stdout = &outbuf
+	cmd.Stderr = &errbuf
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Unable to get routes\n** Stdout:\n%s\n** Stderr:\n%s\n** Error:\n%+v",
+			outbuf.String(), errbuf.String(), err)
+	}
+	expected := helpers.TrimSpaces(`
+192.168.26.0/24 dev dummy0 metric 200
+192.168.27.0/24 dev dummy0 scope link
+192.168.30.0/24 dev dummy0
+`)
+	got := helpers.TrimSpaces(outbuf.String())
+	if diff := helpers.Diff(strings.Split(got, "\n"),
+		strings.Split(expected, "\n")); diff != "" {
+		t.Errorf("ApplyRoutes() (-got +want):\n%s", diff)
+	}
+}
@@ -0,0 +1,93 @@
+package netlink
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+)
+
+// HasRoute tells if the kernel has a route reflecting the specified
+// one (see SameRoute). The table of the route is read back from the
+// kernel. No retry logic is attempted, so error must be handled in
+// upper layers.
+func (c *realComponent) HasRoute(route Route) (bool, error) {
+	family := netlink.FAMILY_V4
+	if route.Dst != nil && route.Dst.IP.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	routes, err := routeList(family, route.Table)
+	if err != nil {
+		return false, errors.Wrapf(err, "cannot read back route %s", route)
+	}
+	for _, other := range routes {
+		if SameRoute(route, other) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// SameRoute tells if a route notified or read back from the kernel
+// reflects the requested one: they have the same key (table,
+// destination, source prefix, TOS and metric), the same type and the
+// same next hops. Other attributes, like flags, scope or preference, may be set
+// or changed by the kernel. As the kernel may split an IPv6 multipath
+// route into one route for each next hop, a route with only one of
+// the requested next hops also matches.
+func SameRoute(requested, route Route) bool {
+	if requested.Table != route.Table ||
+		routeType(requested) != routeType(route) ||
+		requested.Tos != route.Tos ||
+		requested.Priority != route.Priority ||
+		!ipNetPtrEqual(requested.Dst, route.Dst) ||
+		!ipNetPtrEqual(requested.SrcPrefix, route.SrcPrefix) {
+		return false
+	}
+	if requested.NHID != 0 || route.NHID != 0 {
+		return requested.NHID == route.NHID
+	}
+	if len(requested.MultiPath) > 0 && len(route.MultiPath) == 0 {
+		for _, nh := range requested.MultiPath {
+			if sameNexthop(nh, &NexthopInfo{
+				LinkIndex: route.LinkIndex,
+				Gw:        route.Gw,
+				Via:       route.Via,
+				Encap:     route.Encap,
+			}) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(requested.MultiPath) != len(route.MultiPath) {
+		return false
+	}
+	for i := range requested.MultiPath {
+		if !sameNexthop(requested.MultiPath[i], route.MultiPath[i]) {
+			return false
+		}
+	}
+	return requested.LinkIndex == route.LinkIndex &&
+		requested.Gw.Equal(route.Gw) &&
+		requested.Via.Equal(route.Via) &&
+		encapEqual(requested.Encap, route.Encap)
+}
+
+// routeType returns the type of a route. Without type, a route is
+// unicast.
+func routeType(route Route) int {
+	if route.Type == 0 {
+		return syscall.RTN_UNICAST
+	}
+	return route.Type
+}
+
+// sameNexthop tells if two next hops of a multipath route use the
+// same gateway through the same link. Weight and flags are ignored.
+func sameNexthop(nh1, nh2 *NexthopInfo) bool {
+	return nh1.LinkIndex == nh2.LinkIndex &&
+		nh1.Gw.Equal(nh2.Gw) &&
+		nh1.Via.Equal(nh2.Via) &&
+		encapEqual(nh1.Encap, nh2.Encap)
+}
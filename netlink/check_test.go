@@ -0,0 +1,160 @@
+package netlink
+
+import (
+	"bytes"
+	"net"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"lrg/config"
+	"lrg/daemon"
+	"lrg/reporter"
+)
+
+func TestHasRoute(t *testing.T) {
+	resetNamespace(t)
+	r := reporter.NewMock()
+	c, err := New(r, DefaultConfiguration, Dependencies{Daemon: daemon.NewMock()})
+	if err != nil {
+		t.Fatalf("New() error:\n%+v", err)
+	}
+
+	setup := `
+ip route add 192.168.24.0/24 dev dummy0
+ip route add 192.168.25.0/24 via 192.168.24.1 table 100 proto 254 metric 100
+ip route add 2001:db8:24::/64 dev dummy0 table 100
+`
+	var outbuf, errbuf bytes.Buffer
+	cmd := exec.Command("sh", "-exc", setup)
+	cmd.Stdout = &outbuf
+	cmd.Stderr = &errbuf
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Unable to setup routes\n** Setup:\n%s\n** Stdout:\n%s\n** Stderr:\n%s\n** Error:\n%+v",
+			setup, outbuf.String(), errbuf.String(), err)
+	}
+
+	route := Route{
+		LinkIndex: 2,
+		Dst:       config.MustParseCIDR("192.168.25.0/24"),
+		Gw:        net.ParseIP("192.168.24.1").To4(),
+		Protocol:  254,
+		Priority:  100,
+		Table:     100,
+		Type:      syscall.RTN_UNICAST,
+	}
+	otherGateway := route
+	otherGateway.Gw = net.ParseIP("192.168.24.2").To4()
+	otherTable := route
+	otherTable.Table = syscall.RT_TABLE_MAIN
+	cases := []struct {
+		description string
+		route       Route
+		expected    bool
+	}{
+		{"present", route, true},
+		{"other gateway", otherGateway, false},
+		{"other table", otherTable, false},
+		{"IPv6", Route{
+			LinkIndex: 2,
+			Dst:       config.MustParseCIDR("2001:db8:24::/64"),
+			Protocol:  syscall.RTPROT_BOOT,
+			Priority:  1024,
+			Table:     100,
+			Type:      syscall.RTN_UNICAST,
+		}, true},
+		{"missing table", Route{
+			LinkIndex: 2,
+			Dst:       config.MustParseCIDR("192.168.25.0/24"),
+			Table:     101,
+		}, false},
+	}
+	for _, tc := range cases {
+		got, err := c.HasRoute(tc.route)
+		if err != nil {
+			t.Errorf("HasRoute(%s) error:\n%+v", tc.description, err)
+			continue
+		}
+		if got != tc.expected {
+			t.Errorf("HasRoute(%s) == %v, expected %v", tc.description, got, tc.expected)
+		}
+	}
+}
+
+func TestSameRoute(t *testing.T) {
+	_, prefix4, _ := net.ParseCIDR("192.168.1.0/24")
+	_, prefix6, _ := net.ParseCIDR("2001:db8:1::/64")
+	requested4 := Route{
+		Dst:       prefix4,
+		Table:     254,
+		Priority:  100,
+		LinkIndex: 2,
+		Gw:        net.ParseIP("192.168.0.1"),
+		Protocol:  254,
+	}
+	requested6 := Route{
+		Dst:      prefix6,
+		Table:    254,
+		Priority: 100,
+		MultiPath: []*NexthopInfo{
+			{LinkIndex: 2, Gw: net.ParseIP("2001:db8::1")},
+			{LinkIndex: 3, Gw: net.ParseIP("2001:db8::2")},
+		},
+	}
+	cases := []struct {
+		description string
+		requested   Route
+		modify      func(*Route)
+		expected    bool
+	}{
+		{"identical", requested4, func(*Route) {}, true},
+		{"attributes set by the kernel", requested4, func(r *Route) {
+			r.Type = syscall.RTN_UNICAST
+			r.Scope = netlink.SCOPE_UNIVERSE
+			r.Flags = 0x10 // RTNH_F_LINKDOWN
+			r.Pref = 1
+			r.Expires = 10
+			r.Protocol = 12
+		}, true},
+		{"different gateway", requested4, func(r *Route) {
+			r.Gw = net.ParseIP("192.168.0.2")
+		}, false},
+		{"different link", requested4, func(r *Route) {
+			r.LinkIndex = 3
+		}, false},
+		{"different metric", requested4, func(r *Route) {
+			r.Priority = 101
+		}, false},
+		{"different type", requested4, func(r *Route) {
+			r.Type = syscall.RTN_BLACKHOLE
+		}, false},
+		{"multipath", requested6, func(r *Route) {
+			r.MultiPath = []*NexthopInfo{
+				{LinkIndex: 2, Gw: net.ParseIP("2001:db8::1"), Hops: 1},
+				{LinkIndex: 3, Gw: net.ParseIP("2001:db8::2")},
+			}
+		}, true},
+		{"multipath split", requested6, func(r *Route) {
+			r.MultiPath = nil
+			r.LinkIndex = 3
+			r.Gw = net.ParseIP("2001:db8::2")
+		}, true},
+		{"multipath split with another next hop", requested6, func(r *Route) {
+			r.MultiPath = nil
+			r.LinkIndex = 3
+			r.Gw = net.ParseIP("2001:db8::3")
+		}, false},
+		{"multipath with missing next hop", requested6, func(r *Route) {
+			r.MultiPath = r.MultiPath[:1]
+		}, false},
+	}
+	for _, tc := range cases {
+		route := tc.requested
+		tc.modify(&route)
+		if got := SameRoute(tc.requested, route); got != tc.expected {
+			t.Errorf("SameRoute(%s) == %v, expected %v", tc.description, got, tc.expected)
+		}
+	}
+}
@@ -1,9 +1,11 @@
 package netlink
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
 
 	"lrg/config"
 )
@@ -11,19 +13,122 @@ import (
 // Configuration contains the configuration for netlink component.
 type Configuration struct {
 	SocketSize         uint
+	SocketMaxSize      uint
 	ChannelSize        uint
 	BackoffInterval    config.Duration
 	BackoffMaxInterval config.Duration
 	CureInterval       config.Duration
+	Families           []Family
+	Record             config.FilePath
+	Escalation         EscalationConfiguration
+}
+
+// EscalationConfiguration tells what to do when the subscription to
+// kernel changes keeps failing: after the provided number of failures
+// within the provided window, the action is executed.
+type EscalationConfiguration struct {
+	Failures uint
+	Window   config.Duration
+	Action   EscalationAction
+}
+
+// EscalationAction is the action to execute on persistent failures.
+type EscalationAction string
+
+const (
+	// EscalationActionNone only logs failures.
+	EscalationActionNone EscalationAction = ""
+	// EscalationActionUnhealthy marks the daemon as unhealthy
+	// until failures stop.
+	EscalationActionUnhealthy EscalationAction = "unhealthy"
+	// EscalationActionExit terminates the daemon with a
+	// distinct exit status.
+	EscalationActionExit EscalationAction = "exit"
+)
+
+// UnmarshalText parses an escalation action.
+func (a *EscalationAction) UnmarshalText(text []byte) error {
+	switch action := EscalationAction(text); action {
+	case EscalationActionUnhealthy, EscalationActionExit:
+		*a = action
+	case "none":
+		*a = EscalationActionNone
+	default:
+		return errors.Errorf("unknown escalation action %q", action)
+	}
+	return nil
+}
+
+// DefaultEscalationConfiguration is the default configuration for
+// the escalation of persistent failures.
+var DefaultEscalationConfiguration = EscalationConfiguration{
+	Failures: 10,
+	Window:   config.Duration(10 * time.Minute),
+	Action:   EscalationActionNone,
+}
+
+// UnmarshalYAML parses the configuration for the escalation of
+// persistent failures from YAML. Missing keys get their default
+// value.
+func (c *EscalationConfiguration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawConfiguration EscalationConfiguration
+	raw := rawConfiguration(DefaultEscalationConfiguration)
+	if err := unmarshal(&raw); err != nil {
+		return errors.Wrap(err, "unable to decode escalation configuration")
+	}
+	switch {
+	case raw.Failures == 0:
+		return errors.New("number of failures before escalation should be positive")
+	case raw.Window <= 0:
+		return errors.Errorf("escalation window should be positive (%s)", raw.Window)
+	}
+	*c = EscalationConfiguration(raw)
+	return nil
+}
+
+// Family is an address family whose routes are read from the kernel.
+type Family int
+
+const (
+	// FamilyIPv4 is the IPv4 address family.
+	FamilyIPv4 Family = netlink.FAMILY_V4
+	// FamilyIPv6 is the IPv6 address family.
+	FamilyIPv6 Family = netlink.FAMILY_V6
+)
+
+// UnmarshalText parses an address family.
+func (f *Family) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "ipv4":
+		*f = FamilyIPv4
+	case "ipv6":
+		*f = FamilyIPv6
+	default:
+		return errors.Errorf("unknown family %q", string(text))
+	}
+	return nil
+}
+
+// String turns an address family into a string.
+func (f Family) String() string {
+	switch f {
+	case FamilyIPv4:
+		return "IPv4"
+	case FamilyIPv6:
+		return "IPv6"
+	}
+	return fmt.Sprintf("family %d", int(f))
 }
 
 // DefaultConfiguration is the default configuration of the netlink component.
 var DefaultConfiguration = Configuration{
 	SocketSize:         0,
+	SocketMaxSize:      0,
 	ChannelSize:        100,
 	BackoffInterval:    config.Duration(10 * time.Millisecond),
 	BackoffMaxInterval: config.Duration(10 * time.Second),
 	CureInterval:       config.Duration(30 * time.Second),
+	Escalation:         DefaultEscalationConfiguration,
 }
 
 // UnmarshalYAML parses the configuration for the netlink component from
@@ -34,6 +139,17 @@ func (c *Configuration) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err := unmarshal(&raw); err != nil {
 		return errors.Wrap(err, "unable to decode netlink component configuration")
 	}
+	if raw.SocketMaxSize != 0 && raw.SocketMaxSize < raw.SocketSize {
+		return errors.Errorf("maximum socket size should be greater than socket size (%d)",
+			raw.SocketMaxSize)
+	}
+	families := map[Family]bool{}
+	for _, family := range raw.Families {
+		if families[family] {
+			return errors.Errorf("family %s enabled twice", family)
+		}
+		families[family] = true
+	}
 
 	*c = Configuration(raw)
 	return nil
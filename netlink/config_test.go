@@ -14,6 +14,7 @@ func TestUnmarshalConfiguration(t *testing.T) {
 	cases := []struct {
 		in   string
 		want Configuration
+		err  bool
 	}{
 		{
 			in:   "{}",
@@ -31,7 +32,96 @@ backoffmaxinterval: 1m
 				BackoffInterval:    config.Duration(time.Second),
 				BackoffMaxInterval: config.Duration(time.Minute),
 				CureInterval:       DefaultConfiguration.CureInterval,
+				Escalation:         DefaultConfiguration.Escalation,
 			},
+		}, {
+			in: `
+socketsize: 1000000
+socketmaxsize: 8000000
+`,
+			want: Configuration{
+				SocketSize:         1000000,
+				SocketMaxSize:      8000000,
+				ChannelSize:        DefaultConfiguration.ChannelSize,
+				BackoffInterval:    DefaultConfiguration.BackoffInterval,
+				BackoffMaxInterval: DefaultConfiguration.BackoffMaxInterval,
+				CureInterval:       DefaultConfiguration.CureInterval,
+				Escalation:         DefaultConfiguration.Escalation,
+			},
+		}, {
+			in: `
+socketsize: 1000000
+socketmaxsize: 500000
+`,
+			err: true,
+		}, {
+			in: `
+families: [ipv6]
+`,
+			want: Configuration{
+				ChannelSize:        DefaultConfiguration.ChannelSize,
+				BackoffInterval:    DefaultConfiguration.BackoffInterval,
+				BackoffMaxInterval: DefaultConfiguration.BackoffMaxInterval,
+				CureInterval:       DefaultConfiguration.CureInterval,
+				Escalation:         DefaultConfiguration.Escalation,
+				Families:           []Family{FamilyIPv6},
+			},
+		}, {
+			in: `
+families: [ipv4, mpls]
+`,
+			err: true,
+		}, {
+			in: `
+families: [ipv4, ipv4]
+`,
+			err: true,
+		}, {
+			in: `
+escalation:
+  action: exit
+  failures: 5
+`,
+			want: Configuration{
+				ChannelSize:        DefaultConfiguration.ChannelSize,
+				BackoffInterval:    DefaultConfiguration.BackoffInterval,
+				BackoffMaxInterval: DefaultConfiguration.BackoffMaxInterval,
+				CureInterval:       DefaultConfiguration.CureInterval,
+				Escalation: EscalationConfiguration{
+					Failures: 5,
+					Window:   DefaultEscalationConfiguration.Window,
+					Action:   EscalationActionExit,
+				},
+			},
+		}, {
+			in: `
+escalation:
+  action: unhealthy
+  window: 1m
+`,
+			want: Configuration{
+				ChannelSize:        DefaultConfiguration.ChannelSize,
+				BackoffInterval:    DefaultConfiguration.BackoffInterval,
+				BackoffMaxInterval: DefaultConfiguration.BackoffMaxInterval,
+				CureInterval:       DefaultConfiguration.CureInterval,
+				Escalation: EscalationConfiguration{
+					Failures: DefaultEscalationConfiguration.Failures,
+					Window:   config.Duration(time.Minute),
+					Action:   EscalationActionUnhealthy,
+				},
+			},
+		}, {
+			in: `
+escalation:
+  action: reboot
+`,
+			err: true,
+		}, {
+			in: `
+escalation:
+  failures: 0
+`,
+			err: true,
 		},
 	}
 
@@ -39,9 +129,13 @@ backoffmaxinterval: 1m
 		var got Configuration
 		err := yaml.Unmarshal([]byte(c.in), &got)
 		switch {
-		case err != nil:
+		case err != nil && !c.err:
 			t.Errorf("Unmarshal(%q) error:\n%+v",
 				c.in, err)
+		case err == nil && c.err:
+			t.Errorf("Unmarshal(%q) == %+v but expected error",
+				c.in, got)
+		case err != nil:
 		default:
 			if diff := helpers.Diff(got, c.want); diff != "" {
 				t.Errorf("Unmarshal(%q) (-got +want):\n%s", c.in, diff)
@@ -0,0 +1,34 @@
+package netlink
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// DeleteRoute will remove the specified route. A missing route is not
+// an error. No retry logic is attempted, so error must be handled in
+// upper layers.
+func (c *realComponent) DeleteRoute(route Route) error {
+	return deleteRoute(nil, route)
+}
+
+// deleteRoute will remove the specified route using the provided
+// socket (or a new one when nil).
+func deleteRoute(s *nl.NetlinkSocket, route Route) error {
+	if route.Scope == netlink.SCOPE_UNIVERSE {
+		// Like iproute2, match any scope. Otherwise, the
+		// kernel would not find routes with a link scope.
+		route.Scope = netlink.SCOPE_NOWHERE
+	}
+	req, err := routeRequest(syscall.RTM_DELROUTE, 0, route)
+	if err == nil {
+		err = executeRouteRequest(s, req)
+	}
+	if err != nil && err != syscall.ESRCH {
+		return errors.Wrapf(err, "cannot remove route %s", route)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package netlink
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+
+	"lrg/config"
+	"lrg/daemon"
+	"lrg/helpers"
+	"lrg/reporter"
+)
+
+func TestDeleteRoute(t *testing.T) {
+	r := reporter.NewMock()
+	c, err := New(r, DefaultConfiguration, Dependencies{Daemon: daemon.NewMock()})
+	if err != nil {
+		t.Fatalf("New() error:\n%+v", err)
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start() error:\n%+v", err)
+	}
+	defer func() {
+		if err := c.Stop(); err != nil {
+			t.Fatalf("Stop() error:\n%+v", err)
+		}
+	}()
+
+	cases := []struct {
+		setup    string
+		route    Route
+		expected string
+	}{
+		{
+			setup: `
+ip route add 192.168.26.0/24 dev dummy0
+ip route add 192.168.27.0/24 dev dummy0
+`,
+			route: Route{
+				LinkIndex: 2,
+				Dst:       config.MustParseCIDR("192.168.26.0/24"),
+				Table:     syscall.RT_TABLE_MAIN,
+			},
+			expected: "192.168.27.0/24 dev dummy0 scope link",
+		}, {
+			setup: `
+ip route add 192.168.26.0/24 dev dummy0 metric 100
+ip route add 192.168.26.0/24 dev dummy0 metric 200
+`,
+			route: Route{
+				LinkIndex: 2,
+				Dst:       config.MustParseCIDR("192.168.26.0/24"),
+				Priority:  200,
+				Table:     syscall.RT_TABLE_MAIN,
+			},
+			expected: "192.168.26.0/24 dev dummy0 scope link metric 100",
+		}, {
+			setup: `
+ip route add 2001:db8:16::/64 dev dummy0 table 100
+ip route add 2001:db8:17::/64 dev dummy0 table 100
+`,
+			route: Route{
+				LinkIndex: 2,
+				Dst:       config.MustParseCIDR("2001:db8:16::/64"),
+				Table:     100,
+			},
+			expected: "2001:db8:17::/64 dev dummy0 table 100 metric 1024 pref medium",
+		}, {
+			// Already missing
+			setup: `
+ip route add 192.168.27.0/24 dev dummy0
+`,
+			route: Route{
+				LinkIndex: 2,
+				Dst:       config.MustParseCIDR("192.168.26.0/24"),
+				Table:     syscall.RT_TABLE_MAIN,
+			},
+			expected: "192.168.27.0/24 dev dummy0 scope link",
+		},
+	}
+
+	for idx, tc := range cases {
+		resetNamespace(t)
+		var outbuf, errbuf bytes.Buffer
+		cmd := exec.Command("sh", "-exc", tc.setup)
+		cmd.Stdout = &outbuf
+		cmd.Stderr = &errbuf
+		if err := cmd.Run(); err != nil {
+			t.Errorf("Unable to setup routes\n** Setup:\n%s\n** Stdout:\n%s\n** Stderr:\n%s\n** Error:\n%+v",
+				tc.setup, outbuf.String(), errbuf.String(), err)
+			continue
+		}
+
+		if err := c.DeleteRoute(tc.route); err != nil {
+			t.Errorf("DeleteRoute(%d: %s) error:\n%+v", idx, tc.route, err)
+			continue
+		}
+
+		outbuf.Reset()
+		errbuf.Reset()
+		cmd = exec.Command("sh", "-c", `
+ip route show table 0 \
+  | grep -v table.local \
+  | grep -v '^fe80::/64 dev dummy0 '
+`)
+		cmd.Stdout = &outbuf
+		cmd.Stderr = &errbuf
+		if err := cmd.Run(); err != nil {
+			t.Errorf("Unable to get routes\n** Stdout:\n%s\n** Stderr:\n%s\n** Error:\n%+v",
+				outbuf.String(), errbuf.String(), err)
+			continue
+		}
+		expected := helpers.TrimSpaces(tc.expected)
+		got := helpers.TrimSpaces(outbuf.String())
+		if diff := helpers.Diff(strings.Split(got, "\n"),
+			strings.Split(expected, "\n")); diff != "" {
+			t.Errorf("DeleteRoute(%d: %s) (-got +want):\n%s", idx, tc.route, diff)
+		}
+	}
+}
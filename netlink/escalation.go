@@ -0,0 +1,83 @@
+package netlink
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// escalation counts the failures of the subscription to kernel
+// changes within a sliding window. Once escalated, failures are cured
+// after a quiet period: cureTick fires when no failure happened for
+// the cure interval.
+type escalation struct {
+	config    EscalationConfiguration
+	failures  []time.Time
+	escalated bool
+	cureTick  <-chan time.Time
+}
+
+// failure records a failure at the provided time. It tells if the
+// failures should be escalated. Once escalated, failures are not
+// escalated again until cured.
+func (e *escalation) failure(now time.Time) bool {
+	start := now.Add(-time.Duration(e.config.Window))
+	recent := e.failures[:0]
+	for _, t := range e.failures {
+		if t.After(start) {
+			recent = append(recent, t)
+		}
+	}
+	e.failures = append(recent, now)
+	if e.escalated || uint(len(e.failures)) < e.config.Failures {
+		return false
+	}
+	e.escalated = true
+	return true
+}
+
+// cure ends the escalation. Previous failures are kept until they
+// leave the window. It tells if the failures were escalated.
+func (e *escalation) cure() bool {
+	escalated := e.escalated
+	e.escalated = false
+	return escalated
+}
+
+// failed reports a failure of the subscription to kernel changes and
+// executes the configured action when failures are persistent.
+func (c *realComponent) failed(err error) {
+	c.r.Counter("escalation.failures").Inc(1)
+	c.escalation.cureTick = time.After(time.Duration(c.config.CureInterval))
+	if !c.escalation.failure(time.Now()) {
+		return
+	}
+	c.r.Counter("escalation.escalated").Inc(1)
+	err = errors.Wrapf(err, "%d failures in %s",
+		c.config.Escalation.Failures, c.config.Escalation.Window)
+	switch c.config.Escalation.Action {
+	case EscalationActionUnhealthy:
+		c.d.Daemon.MarkUnhealthy(err)
+	case EscalationActionExit:
+		c.r.Error(err, "terminating")
+		c.d.Daemon.Fail(err)
+	default:
+		c.r.Error(err, "persistent netlink failures")
+	}
+}
+
+// cured is called when no failure happened for the cure interval.
+// If the subscription to kernel changes works again, the daemon is
+// marked as healthy again if the failures were escalated. Otherwise,
+// the cure is delayed.
+func (c *realComponent) cured() {
+	if c.state != updateRoutes {
+		c.escalation.cureTick = time.After(time.Duration(c.config.CureInterval))
+		return
+	}
+	c.escalation.cureTick = nil
+	if c.escalation.cure() &&
+		c.config.Escalation.Action == EscalationActionUnhealthy {
+		c.d.Daemon.MarkHealthy()
+	}
+}
@@ -0,0 +1,143 @@
+package netlink
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"lrg/config"
+	"lrg/daemon"
+	"lrg/reporter"
+)
+
+func TestEscalationWindow(t *testing.T) {
+	e := escalation{config: EscalationConfiguration{
+		Failures: 3,
+		Window:   config.Duration(time.Minute),
+	}}
+	now := time.Now()
+	cases := []struct {
+		offset   time.Duration
+		expected bool
+	}{
+		{0, false},
+		{30 * time.Second, false},
+		// First failure is out of the window
+		{70 * time.Second, false},
+		{80 * time.Second, true},
+		// Already escalated
+		{90 * time.Second, false},
+	}
+	for _, tc := range cases {
+		if got := e.failure(now.Add(tc.offset)); got != tc.expected {
+			t.Errorf("failure(+%s) == %v, expected %v", tc.offset, got, tc.expected)
+		}
+	}
+	if !e.cure() {
+		t.Error("cure() == false, expected true")
+	}
+	if e.cure() {
+		t.Error("cure() == true, expected false")
+	}
+	// Cure keeps the failures still in the window
+	if !e.failure(now.Add(100 * time.Second)) {
+		t.Error("failure() after cure() == false, expected true")
+	}
+}
+
+func TestEscalationActions(t *testing.T) {
+	cases := []struct {
+		action    EscalationAction
+		unhealthy bool
+		failure   bool
+	}{
+		{EscalationActionNone, false, false},
+		{EscalationActionUnhealthy, true, false},
+		{EscalationActionExit, false, true},
+	}
+	for _, tc := range cases {
+		r := reporter.NewMock()
+		d := daemon.NewMock()
+		configuration := DefaultConfiguration
+		configuration.Escalation = EscalationConfiguration{
+			Failures: 2,
+			Window:   config.Duration(time.Minute),
+			Action:   tc.action,
+		}
+		nl, err := New(r, configuration, Dependencies{Daemon: d})
+		if err != nil {
+			t.Fatalf("New() error:\n%+v", err)
+		}
+		c := nl.(*realComponent)
+
+		c.failed(errors.New("first failure"))
+		if d.Health() != nil || d.Failure() != nil {
+			t.Errorf("%q: escalated after one failure", tc.action)
+		}
+		c.failed(errors.New("second failure"))
+		if got := d.Health() != nil; got != tc.unhealthy {
+			t.Errorf("%q: unhealthy == %v, expected %v", tc.action, got, tc.unhealthy)
+		}
+		if got := d.Failure() != nil; got != tc.failure {
+			t.Errorf("%q: failed == %v, expected %v", tc.action, got, tc.failure)
+		}
+		if counter := r.Counter("escalation.escalated").Snapshot().Count(); counter != 1 {
+			t.Errorf("%q: escalation.escalated == %d, expected 1", tc.action, counter)
+		}
+
+		c.state = updateRoutes
+		c.cured()
+		if d.Health() != nil {
+			t.Errorf("%q: still unhealthy once cured", tc.action)
+		}
+	}
+}
+
+func TestEscalationCure(t *testing.T) {
+	r := reporter.NewMock()
+	d := daemon.NewMock()
+	configuration := DefaultConfiguration
+	configuration.CureInterval = config.Duration(100 * time.Millisecond)
+	configuration.Escalation = EscalationConfiguration{
+		Failures: 3,
+		Window:   config.Duration(time.Minute),
+		Action:   EscalationActionUnhealthy,
+	}
+	nl, err := New(r, configuration, Dependencies{Daemon: d})
+	if err != nil {
+		t.Fatalf("New() error:\n%+v", err)
+	}
+	c := nl.(*realComponent)
+	c.state = updateRoutes
+
+	// Failures spaced just under the cure interval are escalated
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			select {
+			case <-c.escalation.cureTick:
+				t.Fatalf("cured after failure %d", i)
+			case <-time.After(80 * time.Millisecond):
+			}
+		}
+		c.failed(errors.New("failure"))
+	}
+	if d.Health() == nil {
+		t.Fatal("not unhealthy after three failures")
+	}
+
+	// Cured only after a full quiet interval
+	start := time.Now()
+	select {
+	case <-c.escalation.cureTick:
+		c.cured()
+	case <-time.After(time.Second):
+		t.Fatal("not cured after a quiet interval")
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("cured after %s, expected at least 100ms", elapsed)
+	}
+	if d.Health() != nil {
+		t.Error("still unhealthy once cured")
+	}
+}
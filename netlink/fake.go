@@ -0,0 +1,388 @@
+// +build !release
+
+package netlink
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+
+	"lrg/reporter"
+)
+
+// FakeComponent is a netlink component keeping an in-memory RIB
+// instead of using the kernel. Like the kernel, changes to the RIB
+// are notified to the subscribers, including the ones requested by
+// the subscribers themselves. Routes and rules are stored as
+// provided. The methods not part of the Component interface simulate
+// the kernel and the other processes changing the RIB. They return
+// once all subscribers have handled the resulting notifications.
+type FakeComponent struct {
+	lock   sync.Mutex
+	routes map[string]Route
+	rules  map[string]netlink.Rule
+
+	// Notifications waiting to be queued to subscribers. Like
+	// with the kernel, they are queued asynchronously, in order,
+	// by a single goroutine, as queuing may block. Subscribers
+	// can therefore modify the RIB from their callback.
+	outboxLock sync.Mutex
+	outboxCond *sync.Cond
+	outbox     []fakeNotification
+	draining   bool
+
+	// Copy of the notified entries, to notify the differences
+	// after an overflow. While overflowing, changes are not
+	// notified.
+	rib         *shadowRIB
+	overflowing bool
+
+	observerSubComponent
+}
+
+// NewFake creates a new fake netlink component with an empty RIB.
+func NewFake() *FakeComponent {
+	c := &FakeComponent{
+		routes:               map[string]Route{},
+		rules:                map[string]netlink.Rule{},
+		rib:                  newShadowRIB(),
+		observerSubComponent: newObserver(reporter.NewMock(), DefaultConfiguration.ChannelSize),
+	}
+	c.outboxCond = sync.NewCond(&c.outboxLock)
+	return c
+}
+
+// fakeNotification is a notification waiting to be queued to the
+// subscribers registered when it was emitted.
+type fakeNotification struct {
+	notification Notification
+	subscribers  []*subscriber
+}
+
+// fakeRouteKey returns the key of a route in the fake RIB. Like the
+// kernel when replacing a route, the gateway is not part of the key.
+func fakeRouteKey(route Route) string {
+	return fmt.Sprintf("%d %s %s %d %d",
+		route.Table, route.Dst, route.SrcPrefix, route.Tos, route.Priority)
+}
+
+// fakeRuleKey returns the key of a rule in the fake RIB.
+func fakeRuleKey(rule netlink.Rule) string {
+	key, _, _ := shadowKey(Notification{RuleUpdate: &RuleUpdate{Rule: rule}})
+	return key
+}
+
+// Subscribe registers a new subscriber for all routes. The current
+// RIB is first sent to it. The returned function unsubscribes it.
+func (c *FakeComponent) Subscribe(name string, cb func(Notification)) func() {
+	return c.SubscribeRoutes(name, nil, cb)
+}
+
+// SubscribeRoutes registers a new subscriber only interested in the
+// routes matching one of the provided filters. The current RIB is
+// first sent to it. The returned function unsubscribes it.
+func (c *FakeComponent) SubscribeRoutes(name string, filters []RouteFilter, cb func(Notification)) func() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	s := c.addSubscriber(name, filters, cb, nil)
+	for _, n := range c.rib.snapshot() {
+		c.post([]*subscriber{s}, n)
+	}
+	return func() {
+		c.unsubscribe(s)
+	}
+}
+
+// emit sends a notification to the current subscribers. It is called
+// with the lock held, but the notification is queued later.
+func (c *FakeComponent) emit(n Notification) {
+	c.observerSubComponent.lock.Lock()
+	subscribers := append([]*subscriber{}, c.subscribers...)
+	c.observerSubComponent.lock.Unlock()
+	c.post(subscribers, n)
+}
+
+// post appends a notification to the outbox and starts the goroutine
+// draining it if needed.
+func (c *FakeComponent) post(subscribers []*subscriber, n Notification) {
+	c.outboxLock.Lock()
+	defer c.outboxLock.Unlock()
+	c.outbox = append(c.outbox, fakeNotification{n, subscribers})
+	if !c.draining {
+		c.draining = true
+		go c.drain()
+	}
+}
+
+// drain queues the notifications of the outbox to their subscribers
+// until the outbox is empty.
+func (c *FakeComponent) drain() {
+	for {
+		c.outboxLock.Lock()
+		if len(c.outbox) == 0 {
+			c.draining = false
+			c.outboxCond.Broadcast()
+			c.outboxLock.Unlock()
+			return
+		}
+		next := c.outbox[0]
+		c.outbox = c.outbox[1:]
+		c.outboxLock.Unlock()
+		for _, s := range next.subscribers {
+			c.enqueue(s, next.notification)
+		}
+	}
+}
+
+// flush waits for the outbox to be drained and for all subscribers
+// to handle the queued notifications, including the ones resulting
+// from changes made by the subscribers themselves.
+func (c *FakeComponent) flush() {
+	for {
+		c.outboxLock.Lock()
+		for c.draining {
+			c.outboxCond.Wait()
+		}
+		c.outboxLock.Unlock()
+		c.observerSubComponent.flush()
+		c.outboxLock.Lock()
+		draining := c.draining
+		c.outboxLock.Unlock()
+		if !draining {
+			return
+		}
+	}
+}
+
+// Start sends the initial RIB to the subscribers.
+func (c *FakeComponent) Start() error {
+	c.Restart()
+	return nil
+}
+
+// Stop does nothing.
+func (c *FakeComponent) Stop() error {
+	return nil
+}
+
+// publish records a notification in the shadow RIB and sends it to
+// the subscribers, unless it doesn't bring anything new during a
+// resynchronization. While overflowing, nothing is sent. Route
+// updates are only sent to the subscribers interested in them. It is
+// called with the lock held.
+func (c *FakeComponent) publish(n Notification) {
+	if c.overflowing || !c.rib.started {
+		return
+	}
+	if c.rib.update(n) {
+		c.emit(n)
+	}
+}
+
+// dump publishes the content of the RIB: rules, then routes.
+func (c *FakeComponent) dump() {
+	keys := make([]string, 0, len(c.rules))
+	for key := range c.rules {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		c.publish(Notification{RuleUpdate: &RuleUpdate{
+			Type: syscall.RTM_NEWRULE,
+			Rule: c.rules[key],
+		}})
+	}
+	keys = make([]string, 0, len(c.routes))
+	for key := range c.routes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		c.publish(Notification{RouteUpdate: &RouteUpdate{
+			Type:  syscall.RTM_NEWROUTE,
+			Route: c.routes[key],
+		}})
+	}
+}
+
+// addRoute adds or replaces a route and notifies it. It is called
+// with the lock held.
+func (c *FakeComponent) addRoute(route Route) {
+	c.routes[fakeRouteKey(route)] = route
+	c.publish(Notification{RouteUpdate: &RouteUpdate{
+		Type:  syscall.RTM_NEWROUTE,
+		Route: route,
+	}})
+}
+
+// deleteRoute removes a route and notifies the removal. It is called
+// with the lock held. It returns ESRCH if the route is not present.
+func (c *FakeComponent) deleteRoute(route Route) error {
+	key := fakeRouteKey(route)
+	existing, ok := c.routes[key]
+	if !ok {
+		return syscall.ESRCH
+	}
+	delete(c.routes, key)
+	c.publish(Notification{RouteUpdate: &RouteUpdate{
+		Type:  syscall.RTM_DELROUTE,
+		Route: existing,
+	}})
+	return nil
+}
+
+// AddRoute installs the specified route. It will replace an existing
+// route with the same characteristics.
+func (c *FakeComponent) AddRoute(route Route) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.addRoute(route)
+	return nil
+}
+
+// DeleteRoute removes the specified route. A missing route is not an
+// error.
+func (c *FakeComponent) DeleteRoute(route Route) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.deleteRoute(route)
+	return nil
+}
+
+// ApplyRoutes installs or removes the specified routes in order.
+func (c *FakeComponent) ApplyRoutes(operations []RouteOperation) []error {
+	results := make([]error, len(operations))
+	for i, operation := range operations {
+		if operation.Delete {
+			results[i] = c.DeleteRoute(operation.Route)
+		} else {
+			results[i] = c.AddRoute(operation.Route)
+		}
+	}
+	return results
+}
+
+// HasRoute tells if the RIB has a route reflecting the specified one
+// (see SameRoute).
+func (c *FakeComponent) HasRoute(route Route) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	existing, ok := c.routes[fakeRouteKey(route)]
+	return ok && SameRoute(route, existing), nil
+}
+
+// AddRule installs the specified rule. An existing identical rule is
+// not an error.
+func (c *FakeComponent) AddRule(rule netlink.Rule) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := fakeRuleKey(rule)
+	if _, ok := c.rules[key]; ok {
+		return nil
+	}
+	c.rules[key] = rule
+	c.publish(Notification{RuleUpdate: &RuleUpdate{
+		Type: syscall.RTM_NEWRULE,
+		Rule: rule,
+	}})
+	return nil
+}
+
+// DeleteRule removes the specified rule. A missing rule is not an
+// error.
+func (c *FakeComponent) DeleteRule(rule netlink.Rule) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := fakeRuleKey(rule)
+	if _, ok := c.rules[key]; !ok {
+		return nil
+	}
+	delete(c.rules, key)
+	c.publish(Notification{RuleUpdate: &RuleUpdate{
+		Type: syscall.RTM_DELRULE,
+		Rule: rule,
+	}})
+	return nil
+}
+
+// InjectRoute adds or replaces a route in the RIB, like another
+// process, for example a routing daemon, would do.
+func (c *FakeComponent) InjectRoute(route Route) {
+	c.lock.Lock()
+	c.addRoute(route)
+	c.lock.Unlock()
+	c.flush()
+}
+
+// InjectRouteDeletion removes a route from the RIB, like another
+// process would do. It returns an error if the route is not present.
+func (c *FakeComponent) InjectRouteDeletion(route Route) error {
+	c.lock.Lock()
+	err := c.deleteRoute(route)
+	c.lock.Unlock()
+	c.flush()
+	if err != nil {
+		return errors.Wrapf(err, "cannot remove route %s", route)
+	}
+	return nil
+}
+
+// Routes returns the routes of the RIB.
+func (c *FakeComponent) Routes() []Route {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	keys := make([]string, 0, len(c.routes))
+	for key := range c.routes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	routes := make([]Route, 0, len(keys))
+	for _, key := range keys {
+		routes = append(routes, c.routes[key])
+	}
+	return routes
+}
+
+// Overflow simulates an overflow of the receive buffer (ENOBUFS): the
+// changes to the RIB are not notified until Resync is called.
+func (c *FakeComponent) Overflow() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.overflowing = true
+}
+
+// Resync recovers from an overflow like the real component: only the
+// differences with the previously notified RIB are notified, then the
+// end of the RIB.
+func (c *FakeComponent) Resync() {
+	c.lock.Lock()
+	c.overflowing = false
+	if c.rib.synced {
+		c.rib.startResync()
+		c.dump()
+		for _, n := range c.rib.endResync() {
+			c.emit(n)
+		}
+		c.emit(Notification{EndOfRIB: true})
+	}
+	c.lock.Unlock()
+	c.flush()
+}
+
+// Restart notifies the start of a new RIB, the whole RIB and the end
+// of the RIB. Subscribers have to discard the previous RIB.
+func (c *FakeComponent) Restart() {
+	c.lock.Lock()
+	c.overflowing = false
+	c.rib.reset()
+	c.emit(Notification{StartOfRIB: true})
+	c.dump()
+	c.rib.synced = true
+	c.emit(Notification{EndOfRIB: true})
+	c.lock.Unlock()
+	c.flush()
+}
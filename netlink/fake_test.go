@@ -0,0 +1,147 @@
+package netlink
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+
+	"lrg/helpers"
+)
+
+func TestFake(t *testing.T) {
+	_, prefix1, _ := net.ParseCIDR("192.168.1.0/24")
+	_, prefix2, _ := net.ParseCIDR("192.168.2.0/24")
+	_, prefix3, _ := net.ParseCIDR("192.168.3.0/24")
+	route1 := Route{Dst: prefix1, Table: 254, LinkIndex: 2}
+	route2 := Route{Dst: prefix2, Table: 254, LinkIndex: 2}
+	route3 := Route{Dst: prefix3, Table: 254, LinkIndex: 2}
+	route1bis := Route{Dst: prefix1, Table: 254, LinkIndex: 3}
+
+	c := NewFake()
+	c.InjectRoute(route1)
+	got := []string{}
+	c.Subscribe("test", func(n Notification) {
+		switch {
+		case n.StartOfRIB:
+			got = append(got, "start")
+		case n.EndOfRIB:
+			got = append(got, "end")
+		case n.RouteUpdate != nil:
+			op := "add"
+			if n.RouteUpdate.Type == syscall.RTM_DELROUTE {
+				op = "del"
+			}
+			got = append(got, fmt.Sprintf("%s %s dev %d",
+				op, n.RouteUpdate.Dst, n.RouteUpdate.LinkIndex))
+		case n.RuleUpdate != nil:
+			got = append(got, fmt.Sprintf("rule %d", n.RuleUpdate.Type))
+		}
+	})
+	check := func(description string, expected []string) {
+		c.flush()
+		if diff := helpers.Diff(got, expected); diff != "" {
+			t.Errorf("%s (-got, +want):\n%s", description, diff)
+		}
+		got = []string{}
+	}
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start() error:\n%+v", err)
+	}
+	check("initial RIB", []string{
+		"start",
+		"add 192.168.1.0/24 dev 2",
+		"end",
+	})
+
+	// Changes are echoed
+	if err := c.AddRoute(route2); err != nil {
+		t.Fatalf("AddRoute() error:\n%+v", err)
+	}
+	if err := c.AddRoute(route1bis); err != nil {
+		t.Fatalf("AddRoute() error:\n%+v", err)
+	}
+	if err := c.DeleteRoute(route3); err != nil {
+		t.Fatalf("DeleteRoute() error:\n%+v", err)
+	}
+	if err := c.AddRule(netlink.Rule{Priority: 100, Table: 100}); err != nil {
+		t.Fatalf("AddRule() error:\n%+v", err)
+	}
+	check("changes", []string{
+		"add 192.168.2.0/24 dev 2",
+		"add 192.168.1.0/24 dev 3",
+		fmt.Sprintf("rule %d", syscall.RTM_NEWRULE),
+	})
+	if present, _ := c.HasRoute(route1); present {
+		t.Error("HasRoute(route1) == true, expected false")
+	}
+	if present, _ := c.HasRoute(route1bis); !present {
+		t.Error("HasRoute(route1bis) == false, expected true")
+	}
+
+	// Changes during an overflow are lost, then only differences
+	// are sent.
+	c.Overflow()
+	c.InjectRoute(route3)
+	if err := c.InjectRouteDeletion(route2); err != nil {
+		t.Fatalf("InjectRouteDeletion() error:\n%+v", err)
+	}
+	check("overflow", []string{})
+	c.Resync()
+	check("resync", []string{
+		"add 192.168.3.0/24 dev 2",
+		"del 192.168.2.0/24 dev 2",
+		"end",
+	})
+
+	// A restart sends the whole RIB
+	c.Restart()
+	check("restart", []string{
+		"start",
+		fmt.Sprintf("rule %d", syscall.RTM_NEWRULE),
+		"add 192.168.1.0/24 dev 3",
+		"add 192.168.3.0/24 dev 2",
+		"end",
+	})
+
+	if err := c.InjectRouteDeletion(route2); err == nil {
+		t.Error("InjectRouteDeletion() should have failed")
+	}
+	if diff := helpers.Diff(c.Routes(), []Route{route1bis, route3}); diff != "" {
+		t.Errorf("Routes() (-got, +want):\n%s", diff)
+	}
+}
+
+func TestFakeChangesFromCallback(t *testing.T) {
+	// Subscribers modifying the RIB from their callback while their
+	// queue is full should not block.
+	c := NewFake()
+	count := int(DefaultConfiguration.ChannelSize) * 3
+	for i := 0; i < count; i++ {
+		_, prefix, _ := net.ParseCIDR(fmt.Sprintf("10.%d.%d.0/24", i/256, i%256))
+		c.InjectRoute(Route{Dst: prefix, Table: 254, LinkIndex: 2})
+	}
+	c.Subscribe("test", func(n Notification) {
+		if n.RouteUpdate != nil && n.RouteUpdate.Table == 254 {
+			route := n.RouteUpdate.Route
+			route.Table = 100
+			c.AddRoute(route)
+		}
+	})
+	done := make(chan struct{})
+	go func() {
+		c.Start()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start() is blocked")
+	}
+	if got := len(c.Routes()); got != 2*count {
+		t.Errorf("len(Routes()) == %d, expected %d", got, 2*count)
+	}
+}
@@ -0,0 +1,178 @@
+package netlink
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink/nl"
+
+	"lrg/helpers"
+)
+
+// The netlink library dumps routes from all tables and filters them
+// afterwards. With strict checking (Linux 4.20+), the kernel only
+// dumps the routes of the requested table. Dumps are therefore done
+// here.
+
+const (
+	solNetlink          = 270
+	netlinkGetStrictChk = 12
+)
+
+// RouteFilter selects the routes a subscriber is interested in:
+// routes of the provided table whose destination is the provided
+// prefix. The family is the one of the prefix.
+type RouteFilter struct {
+	Table  int
+	Prefix net.IPNet
+}
+
+// family returns the family of the prefix of a route filter.
+func (f RouteFilter) family() Family {
+	if f.Prefix.IP.To4() != nil {
+		return FamilyIPv4
+	}
+	return FamilyIPv6
+}
+
+// routeFamily returns the family of a route.
+func routeFamily(route *Route) Family {
+	if route.Dst != nil && route.Dst.IP.To4() == nil {
+		return FamilyIPv6
+	}
+	return FamilyIPv4
+}
+
+// Match tells if a route filter matches the given route.
+func (f RouteFilter) Match(route *Route) bool {
+	return route.Table == f.Table &&
+		route.Dst != nil &&
+		helpers.IPNetEqual(f.Prefix, *route.Dst)
+}
+
+// routeFilters is a set of route filters. A nil set matches any
+// route.
+type routeFilters []RouteFilter
+
+// match tells if one of the route filters matches the given route.
+func (fs routeFilters) match(route *Route) bool {
+	if fs == nil {
+		return true
+	}
+	for _, f := range fs {
+		if f.Match(route) {
+			return true
+		}
+	}
+	return false
+}
+
+// covers tells if the routes matched by the provided route filters
+// are also matched by these route filters.
+func (fs routeFilters) covers(other routeFilters) bool {
+	if fs == nil {
+		return true
+	}
+	if other == nil {
+		return false
+	}
+outer:
+	for _, o := range other {
+		for _, f := range fs {
+			if f.Table == o.Table && helpers.IPNetEqual(f.Prefix, o.Prefix) {
+				continue outer
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// tables returns the tables to dump for the provided family. A nil
+// result means all tables should be dumped.
+func (fs routeFilters) tables(family Family) []int {
+	if fs == nil {
+		return nil
+	}
+	tables := []int{}
+	seen := map[int]bool{}
+	for _, f := range fs {
+		if f.family() == family && !seen[f.Table] {
+			seen[f.Table] = true
+			tables = append(tables, f.Table)
+		}
+	}
+	return tables
+}
+
+// routeList returns the routes of the provided table for the provided
+// family. When the table is syscall.RT_TABLE_UNSPEC, routes of all
+// tables are returned. When the kernel doesn't support strict
+// checking, routes from other tables are dumped too and discarded
+// here. Cloned routes are ignored.
+func routeList(family int, table int) ([]Route, error) {
+	s, err := nl.Subscribe(syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open netlink socket")
+	}
+	defer s.Close()
+	strict := true
+	if err := syscall.SetsockoptInt(s.GetFd(), solNetlink, netlinkGetStrictChk, 1); err != nil {
+		strict = false
+	}
+
+	req := nl.NewNetlinkRequest(syscall.RTM_GETROUTE, syscall.NLM_F_DUMP)
+	msg := &nl.RtMsg{RtMsg: syscall.RtMsg{Family: uint8(family)}}
+	if table < 256 {
+		msg.Table = uint8(table)
+	}
+	req.AddData(msg)
+	if table != syscall.RT_TABLE_UNSPEC {
+		req.AddData(uint32Attr(syscall.RTA_TABLE, table))
+	}
+	if err := s.Send(req); err != nil {
+		return nil, errors.Wrap(err, "cannot send route dump request")
+	}
+
+	routes := []Route{}
+	for {
+		msgs, err := s.Receive()
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot receive routes")
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != req.Seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return routes, nil
+			case syscall.NLMSG_ERROR:
+				errno := -int32(nl.NativeEndian().Uint32(m.Data[0:4]))
+				switch {
+				case errno == 0:
+					return routes, nil
+				case strict && syscall.Errno(errno) == syscall.ENOENT:
+					// The table doesn't exist yet
+					return routes, nil
+				}
+				return nil, syscall.Errno(errno)
+			case syscall.RTM_NEWROUTE:
+			default:
+				continue
+			}
+			if nl.DeserializeRtMsg(m.Data).Flags&syscall.RTM_F_CLONED != 0 {
+				continue
+			}
+			route, err := deserializeRoute(m.Data)
+			if err != nil {
+				return nil, errors.Wrap(err, "cannot decode route")
+			}
+			if table != syscall.RT_TABLE_UNSPEC && route.Table != table {
+				continue
+			}
+			routes = append(routes, route)
+		}
+	}
+}
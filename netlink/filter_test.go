@@ -0,0 +1,216 @@
+package netlink
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"testing"
+	"time"
+
+	"lrg/daemon"
+	"lrg/helpers"
+	"lrg/reporter"
+)
+
+func TestRouteFilterTables(t *testing.T) {
+	filters := routeFilters{
+		{Table: 100, Prefix: net.IPNet{IP: net.ParseIP("0.0.0.0"), Mask: net.CIDRMask(0, 32)}},
+		{Table: 254, Prefix: net.IPNet{IP: net.ParseIP("::"), Mask: net.CIDRMask(0, 128)}},
+		{Table: 100, Prefix: net.IPNet{IP: net.ParseIP("192.168.0.0"), Mask: net.CIDRMask(16, 32)}},
+		{Table: 1000, Prefix: net.IPNet{IP: net.ParseIP("192.168.0.0"), Mask: net.CIDRMask(16, 32)}},
+	}
+	cases := []struct {
+		filters  routeFilters
+		family   Family
+		expected []int
+	}{
+		{nil, FamilyIPv4, nil},
+		{routeFilters{}, FamilyIPv4, []int{}},
+		{filters, FamilyIPv4, []int{100, 1000}},
+		{filters, FamilyIPv6, []int{254}},
+	}
+	for _, tc := range cases {
+		got := tc.filters.tables(tc.family)
+		if diff := helpers.Diff(got, tc.expected); diff != "" {
+			t.Errorf("tables(%d) (-got, +want):\n%s", tc.family, diff)
+		}
+	}
+}
+
+func TestFilterRoutes(t *testing.T) {
+	resetNamespace(t)
+
+	r := reporter.NewMock()
+	c, err := New(r, DefaultConfiguration, Dependencies{Daemon: daemon.NewMock()})
+	if err != nil {
+		t.Fatalf("New() error:\n%+v", err)
+	}
+	_, prefix1, _ := net.ParseCIDR("192.168.26.0/24")
+	_, prefix2, _ := net.ParseCIDR("2001:db8:25::/64")
+	_, prefix3, _ := net.ParseCIDR("10.0.0.0/8")
+	filters := []RouteFilter{
+		{Table: 100, Prefix: *prefix1},
+		{Table: 254, Prefix: *prefix2},
+		// This table doesn't exist yet
+		{Table: 1000, Prefix: *prefix3},
+	}
+
+	// Setup observer
+	got := []string{}
+	done := make(chan struct{})
+	updates := make(chan string)
+	c.SubscribeRoutes("test", filters, func(notification Notification) {
+		if notification.EndOfRIB {
+			close(done)
+			return
+		}
+		if u := notification.RouteUpdate; u != nil {
+			update := fmt.Sprintf("%s table %d", u.Dst, u.Table)
+			select {
+			case <-done:
+				updates <- update
+			default:
+				got = append(got, update)
+			}
+		}
+	})
+
+	// Add some initial routes
+	setup := `
+ip route add 192.168.24.0/24 dev dummy0
+ip route add 2001:db8:24::/64 dev dummy0
+ip route add 2001:db8:25::/64 via 2001:db8:24::1
+ip route add 2001:db8:25::/64 via 2001:db8:24::1 table 100
+ip route add 192.168.26.0/24 dev dummy0 table 100
+ip route add 192.168.26.0/24 dev dummy0 table 101
+ip route add 192.168.27.0/24 dev dummy0 table 100
+`
+	var outbuf, errbuf bytes.Buffer
+	cmd := exec.Command("sh", "-exc", setup)
+	cmd.Stdout = &outbuf
+	cmd.Stderr = &errbuf
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Unable to setup routes\n** Setup:\n%s\n** Stdout:\n%s\n** Stderr:\n%s\n** Error:\n%+v",
+			setup, outbuf.String(), errbuf.String(), err)
+	}
+
+	// Start component
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start() error:\n%+v", err)
+	}
+	defer func() {
+		if err := c.Stop(); err != nil {
+			t.Fatalf("Stop() error:\n%+v", err)
+		}
+	}()
+
+	// Only matching routes are dumped
+	<-done
+	expected := []string{
+		"192.168.26.0/24 table 100",
+		"2001:db8:25::/64 table 254",
+	}
+	if diff := helpers.Diff(got, expected); diff != "" {
+		t.Errorf("initial routes (-got, +want):\n%s", diff)
+	}
+
+	// Only matching routes are sent
+	setup = `
+ip route add 192.168.28.0/24 dev dummy0 table 100
+ip route add 10.0.0.0/8 dev dummy0 table 1001
+ip route add 10.0.0.0/8 dev dummy0 table 1000
+`
+	outbuf.Reset()
+	errbuf.Reset()
+	cmd = exec.Command("sh", "-exc", setup)
+	cmd.Stdout = &outbuf
+	cmd.Stderr = &errbuf
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Unable to setup routes\n** Setup:\n%s\n** Stdout:\n%s\n** Stderr:\n%s\n** Error:\n%+v",
+			setup, outbuf.String(), errbuf.String(), err)
+	}
+	if update := <-updates; update != "10.0.0.0/8 table 1000" {
+		t.Errorf("update == %q, expected %q", update, "10.0.0.0/8 table 1000")
+	}
+	if counter := r.Counter("route.filtered").Snapshot().Count(); counter < 2 {
+		t.Errorf("route.filtered == %d, expected at least 2", counter)
+	}
+}
+
+func TestFilterRoutesPerSubscriber(t *testing.T) {
+	resetNamespace(t)
+
+	r := reporter.NewMock()
+	c, err := New(r, DefaultConfiguration, Dependencies{Daemon: daemon.NewMock()})
+	if err != nil {
+		t.Fatalf("New() error:\n%+v", err)
+	}
+	_, prefix, _ := net.ParseCIDR("192.168.26.0/24")
+	setup := `
+ip route add 192.168.26.0/24 dev dummy0 table 100
+ip route add 192.168.26.0/24 dev dummy0 table 101
+ip route add 192.168.26.0/24 dev dummy0 table 102
+`
+	var outbuf, errbuf bytes.Buffer
+	cmd := exec.Command("sh", "-exc", setup)
+	cmd.Stdout = &outbuf
+	cmd.Stderr = &errbuf
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Unable to setup routes\n** Setup:\n%s\n** Stdout:\n%s\n** Stderr:\n%s\n** Error:\n%+v",
+			setup, outbuf.String(), errbuf.String(), err)
+	}
+
+	// Each subscriber collects its routes until the provided
+	// number of ends of RIB
+	subscribe := func(table int, ends int) (*[]string, chan struct{}) {
+		got := []string{}
+		done := make(chan struct{})
+		c.SubscribeRoutes(fmt.Sprintf("table%d", table),
+			[]RouteFilter{{Table: table, Prefix: *prefix}},
+			func(notification Notification) {
+				switch {
+				case ends == 0:
+				case notification.EndOfRIB:
+					ends--
+					if ends == 0 {
+						close(done)
+					}
+				case notification.RouteUpdate != nil:
+					u := notification.RouteUpdate
+					got = append(got, fmt.Sprintf("%s table %d", u.Dst, u.Table))
+				}
+			})
+		return &got, done
+	}
+	got1, done1 := subscribe(100, 1)
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start() error:\n%+v", err)
+	}
+	defer func() {
+		if err := c.Stop(); err != nil {
+			t.Fatalf("Stop() error:\n%+v", err)
+		}
+	}()
+	<-done1
+
+	// A subscriber needing another table once the RIB has been
+	// dumped gets the current RIB, then triggers a
+	// resynchronization.
+	got2, done2 := subscribe(101, 2)
+	select {
+	case <-done2:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no end of RIB for second subscriber")
+	}
+	c.(*realComponent).flush()
+	if diff := helpers.Diff(*got1, []string{"192.168.26.0/24 table 100"}); diff != "" {
+		t.Errorf("first subscriber (-got, +want):\n%s", diff)
+	}
+	if diff := helpers.Diff(*got2, []string{"192.168.26.0/24 table 101"}); diff != "" {
+		t.Errorf("second subscriber (-got, +want):\n%s", diff)
+	}
+	if counter := r.Counter("resync.count").Snapshot().Count(); counter != 1 {
+		t.Errorf("resync.count == %d, expected 1", counter)
+	}
+}
@@ -0,0 +1,61 @@
+package netlink
+
+import (
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// The netlink library is able to decode links but cannot set the
+// receive buffer of the socket used to listen to them. Subscription
+// is therefore done here.
+
+// linkSubscribe will send link updates to the provided channel. The
+// channel is closed on error (after calling the provided error
+// callback) or when done is closed. The receive buffer of the socket
+// is set to the provided size.
+func linkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}, buffer socketBuffer, cberr func(error)) error {
+	s, err := nl.Subscribe(syscall.NETLINK_ROUTE, syscall.RTNLGRP_LINK)
+	if err != nil {
+		return err
+	}
+	if err := buffer.apply(s); err != nil {
+		s.Close()
+		return err
+	}
+	go func() {
+		<-done
+		s.Close()
+	}()
+	go func() {
+		defer close(ch)
+		for {
+			msgs, err := s.Receive()
+			if err != nil {
+				cberr(err)
+				return
+			}
+			for _, m := range msgs {
+				if m.Header.Type != syscall.RTM_NEWLINK && m.Header.Type != syscall.RTM_DELLINK {
+					continue
+				}
+				link, err := netlink.LinkDeserialize(&m.Header, m.Data)
+				if err != nil {
+					cberr(err)
+					return
+				}
+				select {
+				case <-done:
+					return
+				case ch <- netlink.LinkUpdate{
+					IfInfomsg: *nl.DeserializeIfInfomsg(m.Data),
+					Header:    m.Header,
+					Link:      link,
+				}:
+				}
+			}
+		}
+	}()
+	return nil
+}
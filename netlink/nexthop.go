@@ -0,0 +1,226 @@
+package netlink
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// The netlink library doesn't know about nexthop objects (introduced
+// in Linux 5.3). Only the small subset needed to dump and to listen
+// to them is implemented here.
+
+const (
+	// RTMNewNexthop is the type of a nexthop update adding a nexthop.
+	RTMNewNexthop = 104
+	// RTMDelNexthop is the type of a nexthop update removing a nexthop.
+	RTMDelNexthop = 105
+
+	rtmGetNexthop  = 106
+	rtnlgrpNexthop = 32
+
+	nhaID        = 1
+	nhaGroup     = 2
+	nhaBlackhole = 4
+	nhaOif       = 5
+	nhaGateway   = 6
+	nhaEncapType = 7
+	nhaEncap     = 8
+
+	sizeofNhmsg      = 8
+	sizeofNexthopGrp = 8
+)
+
+// Nexthop is a nexthop object. It is either a single nexthop (a
+// gateway and/or an output interface, with optional flags and
+// encapsulation), a blackhole or a group of other nexthop objects.
+type Nexthop struct {
+	ID        uint32
+	Protocol  int
+	LinkIndex int
+	Gw        net.IP
+	Flags     int
+	Encap     netlink.Encap
+	Blackhole bool
+	Group     []NexthopGroupMember
+}
+
+// NexthopGroupMember is a member of a nexthop group.
+type NexthopGroupMember struct {
+	ID     uint32
+	Weight int
+}
+
+// NexthopUpdate is sent when a nexthop object changes. Type is either
+// RTMNewNexthop or RTMDelNexthop.
+type NexthopUpdate struct {
+	Type uint16
+	Nexthop
+}
+
+func (n Nexthop) String() string {
+	elems := []string{fmt.Sprintf("ID: %d", n.ID)}
+	switch {
+	case n.Blackhole:
+		elems = append(elems, "Blackhole")
+	case len(n.Group) > 0:
+		members := make([]string, 0, len(n.Group))
+		for _, member := range n.Group {
+			members = append(members, fmt.Sprintf("%d,%d", member.ID, member.Weight))
+		}
+		elems = append(elems, fmt.Sprintf("Group: %s", strings.Join(members, "/")))
+	default:
+		elems = append(elems, fmt.Sprintf("Ifindex: %d", n.LinkIndex))
+		elems = append(elems, fmt.Sprintf("Gw: %s", n.Gw))
+		elems = append(elems, fmt.Sprintf("Flags: %s", listFlags(n.Flags)))
+		if n.Encap != nil {
+			elems = append(elems, fmt.Sprintf("Encap: %s", n.Encap))
+		}
+	}
+	elems = append(elems, fmt.Sprintf("Protocol: %d", n.Protocol))
+	return fmt.Sprintf("{%s}", strings.Join(elems, " "))
+}
+
+// nhMsg is the header of a nexthop message (struct nhmsg).
+type nhMsg struct {
+	Family   uint8
+	Scope    uint8
+	Protocol uint8
+	Flags    uint32
+}
+
+func (msg *nhMsg) Len() int {
+	return sizeofNhmsg
+}
+
+func (msg *nhMsg) Serialize() []byte {
+	b := make([]byte, sizeofNhmsg)
+	b[0] = msg.Family
+	b[1] = msg.Scope
+	b[2] = msg.Protocol
+	nl.NativeEndian().PutUint32(b[4:], msg.Flags)
+	return b
+}
+
+// deserializeNexthop decodes a nexthop message.
+func deserializeNexthop(m []byte) (Nexthop, error) {
+	if len(m) < sizeofNhmsg {
+		return Nexthop{}, errors.New("nexthop message too short")
+	}
+	native := nl.NativeEndian()
+	nh := Nexthop{
+		Protocol: int(m[2]),
+		Flags:    int(native.Uint32(m[4:8])),
+	}
+	attrs, err := nl.ParseRouteAttr(m[sizeofNhmsg:])
+	if err != nil {
+		return Nexthop{}, errors.Wrap(err, "cannot parse nexthop attributes")
+	}
+	var encapType, encap []byte
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case nhaID:
+			if len(attr.Value) < 4 {
+				return Nexthop{}, errors.New("nexthop ID too short")
+			}
+			nh.ID = native.Uint32(attr.Value[0:4])
+		case nhaGroup:
+			for i := 0; i+sizeofNexthopGrp <= len(attr.Value); i += sizeofNexthopGrp {
+				nh.Group = append(nh.Group, NexthopGroupMember{
+					ID: native.Uint32(attr.Value[i : i+4]),
+					// Weight is encoded minus one
+					Weight: int(attr.Value[i+4]) + 1,
+				})
+			}
+		case nhaBlackhole:
+			nh.Blackhole = true
+		case nhaOif:
+			if len(attr.Value) < 4 {
+				return Nexthop{}, errors.New("nexthop interface too short")
+			}
+			nh.LinkIndex = int(native.Uint32(attr.Value[0:4]))
+		case nhaGateway:
+			nh.Gw = net.IP(attr.Value)
+		case nhaEncapType:
+			encapType = attr.Value
+		case nhaEncap:
+			encap = attr.Value
+		}
+	}
+	if nh.Encap, err = decodeEncap(encapType, encap); err != nil {
+		return Nexthop{}, err
+	}
+	if nh.ID == 0 {
+		return Nexthop{}, errors.New("nexthop without ID")
+	}
+	return nh, nil
+}
+
+// nexthopList returns the nexthop objects for all families.
+func nexthopList() ([]Nexthop, error) {
+	req := nl.NewNetlinkRequest(rtmGetNexthop, syscall.NLM_F_DUMP)
+	req.AddData(&nhMsg{Family: syscall.AF_UNSPEC})
+	msgs, err := req.Execute(syscall.NETLINK_ROUTE, RTMNewNexthop)
+	if err != nil {
+		return nil, err
+	}
+	nexthops := make([]Nexthop, 0, len(msgs))
+	for _, m := range msgs {
+		nh, err := deserializeNexthop(m)
+		if err != nil {
+			return nil, err
+		}
+		nexthops = append(nexthops, nh)
+	}
+	return nexthops, nil
+}
+
+// nexthopSubscribe will send nexthop updates to the provided
+// channel. The channel is closed on error (after calling the provided
+// error callback) or when done is closed. The receive buffer of the
+// socket is set to the provided size.
+func nexthopSubscribe(ch chan<- NexthopUpdate, done <-chan struct{}, buffer socketBuffer, cberr func(error)) error {
+	s, err := nl.Subscribe(syscall.NETLINK_ROUTE, rtnlgrpNexthop)
+	if err != nil {
+		return err
+	}
+	if err := buffer.apply(s); err != nil {
+		s.Close()
+		return err
+	}
+	go func() {
+		<-done
+		s.Close()
+	}()
+	go func() {
+		defer close(ch)
+		for {
+			msgs, err := s.Receive()
+			if err != nil {
+				cberr(err)
+				return
+			}
+			for _, m := range msgs {
+				if m.Header.Type != RTMNewNexthop && m.Header.Type != RTMDelNexthop {
+					continue
+				}
+				nh, err := deserializeNexthop(m.Data)
+				if err != nil {
+					cberr(err)
+					return
+				}
+				select {
+				case <-done:
+					return
+				case ch <- NexthopUpdate{Type: m.Header.Type, Nexthop: nh}:
+				}
+			}
+		}
+	}()
+	return nil
+}
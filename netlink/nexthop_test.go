@@ -0,0 +1,130 @@
+package netlink
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+
+	"lrg/helpers"
+)
+
+func TestDeserializeNexthop(t *testing.T) {
+	native := nl.NativeEndian()
+	u32 := func(v uint32) []byte {
+		b := make([]byte, 4)
+		native.PutUint32(b, v)
+		return b
+	}
+	group := func(members ...NexthopGroupMember) []byte {
+		b := []byte{}
+		for _, member := range members {
+			b = append(b, u32(member.ID)...)
+			b = append(b, uint8(member.Weight-1), 0, 0, 0)
+		}
+		return b
+	}
+	message := func(protocol uint8, attrs ...*nl.RtAttr) []byte {
+		b := (&nhMsg{Family: 2, Protocol: protocol}).Serialize()
+		for _, attr := range attrs {
+			b = append(b, attr.Serialize()...)
+		}
+		return b
+	}
+	onlink := func(b []byte) []byte {
+		native.PutUint32(b[4:8], syscall.RTNH_F_ONLINK)
+		return b
+	}
+	encapType := make([]byte, 2)
+	native.PutUint16(encapType, nl.LWTUNNEL_ENCAP_MPLS)
+	encap, err := (&netlink.MPLSEncap{Labels: []int{100}}).Encode()
+	if err != nil {
+		t.Fatalf("Encode() error:\n%+v", err)
+	}
+
+	cases := []struct {
+		description string
+		message     []byte
+		expected    Nexthop
+		err         bool
+	}{
+		{
+			description: "gateway",
+			message: message(186,
+				nl.NewRtAttr(nhaID, u32(10)),
+				nl.NewRtAttr(nhaOif, u32(2)),
+				nl.NewRtAttr(nhaGateway, net.ParseIP("192.168.24.1").To4())),
+			expected: Nexthop{
+				ID:        10,
+				Protocol:  186,
+				LinkIndex: 2,
+				Gw:        net.ParseIP("192.168.24.1"),
+			},
+		}, {
+			description: "onlink gateway with encapsulation",
+			message: onlink(message(186,
+				nl.NewRtAttr(nhaID, u32(10)),
+				nl.NewRtAttr(nhaOif, u32(2)),
+				nl.NewRtAttr(nhaGateway, net.ParseIP("192.168.24.1").To4()),
+				nl.NewRtAttr(nhaEncapType, encapType),
+				nl.NewRtAttr(nhaEncap, encap))),
+			expected: Nexthop{
+				ID:        10,
+				Protocol:  186,
+				LinkIndex: 2,
+				Gw:        net.ParseIP("192.168.24.1"),
+				Flags:     syscall.RTNH_F_ONLINK,
+				Encap:     &netlink.MPLSEncap{Labels: []int{100}},
+			},
+		}, {
+			description: "blackhole",
+			message: message(3,
+				nl.NewRtAttr(nhaID, u32(11)),
+				nl.NewRtAttr(nhaBlackhole, []byte{})),
+			expected: Nexthop{
+				ID:        11,
+				Protocol:  3,
+				Blackhole: true,
+			},
+		}, {
+			description: "group",
+			message: message(186,
+				nl.NewRtAttr(nhaID, u32(12)),
+				nl.NewRtAttr(nhaGroup, group(
+					NexthopGroupMember{ID: 10, Weight: 1},
+					NexthopGroupMember{ID: 13, Weight: 20}))),
+			expected: Nexthop{
+				ID:       12,
+				Protocol: 186,
+				Group: []NexthopGroupMember{
+					{ID: 10, Weight: 1},
+					{ID: 13, Weight: 20},
+				},
+			},
+		}, {
+			description: "missing ID",
+			message: message(186,
+				nl.NewRtAttr(nhaOif, u32(2))),
+			err: true,
+		}, {
+			description: "truncated message",
+			message:     []byte{2, 0, 186},
+			err:         true,
+		},
+	}
+	for _, tc := range cases {
+		got, err := deserializeNexthop(tc.message)
+		switch {
+		case err != nil && !tc.err:
+			t.Errorf("deserializeNexthop(%q) error:\n%+v", tc.description, err)
+		case err == nil && tc.err:
+			t.Errorf("deserializeNexthop(%q) == %v but expected error", tc.description, got)
+		case err == nil:
+			if diff := helpers.Diff(got, tc.expected); diff != "" {
+				t.Errorf("deserializeNexthop(%q) (-got +want):\n%s", tc.description, diff)
+			}
+		}
+	}
+}
@@ -1,49 +1,268 @@
 package netlink
 
 import (
+	"fmt"
 	"sync"
 
 	"github.com/vishvananda/netlink"
+
+	"lrg/reporter"
 )
 
 // Notification represents a notification to be sent to a
 // subscriber. Only one of each member is set at a time: either the
-// notification contains a route update, or it is the start of a new
-// RIB or the end of the initial RIB.
+// notification contains a route update, a nexthop update, a rule
+// update, or it is the start of a new RIB or the end of the initial
+// RIB.
 type Notification struct {
-	RouteUpdate *netlink.RouteUpdate // Route update or nil if no route
-	StartOfRIB  bool                 // Previous RIB should be discarded
-	EndOfRIB    bool                 // End of initial RIB
+	RouteUpdate   *RouteUpdate        // Route update or nil if no route
+	NexthopUpdate *NexthopUpdate      // Nexthop update or nil if no nexthop
+	RuleUpdate    *RuleUpdate         // Rule update or nil if no rule
+	LinkUpdate    *netlink.LinkUpdate // Link update or nil if no link
+	StartOfRIB    bool                // Previous RIB should be discarded
+	EndOfRIB      bool                // End of initial RIB
 }
 
-// observerSubComponent send notifications to a registered subscriber.
+// observerSubComponent send notifications to registered
+// subscribers. Each subscriber has its own queue and goroutine, so a
+// slow subscriber only delays the others once its queue is full.
+// Subscribers may only be interested in some routes: filters is the
+// union of their route filters and refilter is signaled when a new
+// subscriber widens it.
 type observerSubComponent struct {
-	callback     func(Notification)
-	callbackLock sync.RWMutex
-	subscribed   chan struct{}
-	once         sync.Once
+	r           *reporter.Reporter
+	queueSize   uint
+	lock        sync.Mutex
+	subscribers []*subscriber
+	subscribed  chan struct{}
+	once        sync.Once
+	filters     routeFilters
+	refilter    chan struct{}
+}
+
+// subscriber is a registered subscriber. Notifications are queued
+// until the callback is able to handle them. Closing stop stops the
+// delivery of notifications. The number of notifications not yet
+// handled is kept to be able to wait for them, even while other
+// notifications are queued.
+type subscriber struct {
+	name        string
+	filters     routeFilters
+	callback    func(Notification)
+	queue       chan Notification
+	pendingLock sync.Mutex
+	pendingCond *sync.Cond
+	pending     int
+	stopped     bool
+	stop        chan struct{}
+	stopOnce    sync.Once
+	done        chan struct{}
 }
 
-// newObserver returns a new observer subcomponent.
-func newObserver() observerSubComponent {
-	return observerSubComponent{subscribed: make(chan struct{})}
+// updatePending updates the number of notifications not yet handled
+// by the subscriber.
+func (s *subscriber) updatePending(delta int) {
+	s.pendingLock.Lock()
+	s.pending += delta
+	if s.pending == 0 {
+		s.pendingCond.Broadcast()
+	}
+	s.pendingLock.Unlock()
 }
 
-// Subscribe or replace a callback. When replacing, old notifications are not sent.
-func (c *observerSubComponent) Subscribe(cb func(Notification)) {
-	c.callbackLock.Lock()
-	defer c.callbackLock.Unlock()
-	c.callback = cb
+// wait waits for the subscriber to handle the queued notifications,
+// unless it is unsubscribed.
+func (s *subscriber) wait() {
+	s.pendingLock.Lock()
+	for s.pending > 0 && !s.stopped {
+		s.pendingCond.Wait()
+	}
+	s.pendingLock.Unlock()
+}
+
+// newObserver returns a new observer subcomponent. Each subscriber
+// can queue up to the provided number of notifications.
+func newObserver(r *reporter.Reporter, queueSize uint) observerSubComponent {
+	return observerSubComponent{
+		r:          r,
+		queueSize:  queueSize,
+		subscribed: make(chan struct{}),
+		refilter:   make(chan struct{}, 1),
+	}
+}
+
+// Subscribe registers a new subscriber for all routes. The name is
+// used for the metrics of the subscriber. The returned function
+// unsubscribes it.
+func (c *observerSubComponent) Subscribe(name string, cb func(Notification)) func() {
+	return c.subscribe(name, nil, cb, nil)
+}
+
+// SubscribeRoutes registers a new subscriber only interested in the
+// routes matching one of the provided filters. Other notifications
+// are not filtered. The returned function unsubscribes it.
+func (c *observerSubComponent) SubscribeRoutes(name string, filters []RouteFilter, cb func(Notification)) func() {
+	return c.subscribe(name, filters, cb, nil)
+}
+
+// subscribe registers a new subscriber. The provided notifications
+// are sent to it before any other notification. The returned
+// function unsubscribes it. Once this function returns, the callback
+// is not called anymore. Therefore, it should not be called from the
+// callback.
+func (c *observerSubComponent) subscribe(name string, filters []RouteFilter, cb func(Notification), initial []Notification) func() {
+	s := c.addSubscriber(name, filters, cb, initial)
+	return func() {
+		c.unsubscribe(s)
+	}
+}
+
+// addSubscriber registers a new subscriber and sends it the provided
+// notifications. Without filters, the subscriber is interested in
+// all routes.
+func (c *observerSubComponent) addSubscriber(name string, filters []RouteFilter, cb func(Notification), initial []Notification) *subscriber {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	s := &subscriber{
+		name:     name,
+		callback: cb,
+		queue:    make(chan Notification, c.queueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if filters != nil {
+		s.filters = append(routeFilters{}, filters...)
+	}
+	s.pendingCond = sync.NewCond(&s.pendingLock)
+	go c.deliver(s)
+	for _, n := range initial {
+		c.enqueue(s, n)
+	}
+	widened := !c.filters.covers(s.filters)
+	c.subscribers = append(c.subscribers, s)
+	c.r.Gauge("subscribers").Update(int64(len(c.subscribers)))
+	c.updateFilters()
+	if widened {
+		select {
+		case c.refilter <- struct{}{}:
+		default:
+		}
+	}
 	c.once.Do(func() {
 		close(c.subscribed)
 	})
+	return s
 }
 
-// notify will notify the eventual subscriber of a route update.
+// unsubscribe removes a subscriber and waits for its callback to
+// return.
+func (c *observerSubComponent) unsubscribe(s *subscriber) {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		s.pendingLock.Lock()
+		s.stopped = true
+		s.pendingCond.Broadcast()
+		s.pendingLock.Unlock()
+	})
+	c.lock.Lock()
+	for i, other := range c.subscribers {
+		if other == s {
+			c.subscribers = append(c.subscribers[:i], c.subscribers[i+1:]...)
+			break
+		}
+	}
+	c.r.Gauge("subscribers").Update(int64(len(c.subscribers)))
+	c.updateFilters()
+	c.lock.Unlock()
+	<-s.done
+}
+
+// updateFilters computes the union of the route filters of the
+// subscribers. It is called with the lock held.
+func (c *observerSubComponent) updateFilters() {
+	var filters routeFilters
+	for _, s := range c.subscribers {
+		if s.filters == nil {
+			filters = nil
+			break
+		}
+		if filters == nil {
+			filters = routeFilters{}
+		}
+		filters = append(filters, s.filters...)
+	}
+	c.filters = filters
+}
+
+// routeFilters returns the union of the route filters of the
+// subscribers. A nil result means all routes are needed.
+func (c *observerSubComponent) routeFilters() routeFilters {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.filters
+}
+
+// deliver sends the queued notifications of a subscriber to its
+// callback until it is unsubscribed.
+func (c *observerSubComponent) deliver(s *subscriber) {
+	defer close(s.done)
+	for {
+		select {
+		case <-s.stop:
+			return
+		case n := <-s.queue:
+			select {
+			case <-s.stop:
+				return
+			default:
+			}
+			s.callback(n)
+			c.r.Counter(fmt.Sprintf("subscriber.%s.notifications", s.name)).Inc(1)
+			s.updatePending(-1)
+		}
+	}
+}
+
+// enqueue queues a notification for a subscriber, unless it is a
+// route update the subscriber is not interested in. When the queue is
+// full, it waits for some room, unless the subscriber is removed.
+func (c *observerSubComponent) enqueue(s *subscriber, n Notification) {
+	if n.RouteUpdate != nil && !s.filters.match(&n.RouteUpdate.Route) {
+		return
+	}
+	s.updatePending(1)
+	select {
+	case s.queue <- n:
+		return
+	default:
+	}
+	c.r.Counter(fmt.Sprintf("subscriber.%s.full", s.name)).Inc(1)
+	select {
+	case s.queue <- n:
+	case <-s.stop:
+		s.updatePending(-1)
+	}
+}
+
+// notify will queue a notification for all subscribers. The lock is
+// released before queueing: waiting for a full queue should not block
+// other subscribers from subscribing or unsubscribing.
 func (c *observerSubComponent) notify(notification Notification) {
-	c.callbackLock.RLock()
-	defer c.callbackLock.RUnlock()
-	if c.callback != nil {
-		c.callback(notification)
+	c.lock.Lock()
+	subscribers := append([]*subscriber{}, c.subscribers...)
+	c.lock.Unlock()
+	for _, s := range subscribers {
+		c.enqueue(s, notification)
+	}
+}
+
+// flush waits for all subscribers to handle the queued
+// notifications.
+func (c *observerSubComponent) flush() {
+	c.lock.Lock()
+	subscribers := append([]*subscriber{}, c.subscribers...)
+	c.lock.Unlock()
+	for _, s := range subscribers {
+		s.wait()
 	}
 }
@@ -0,0 +1,233 @@
+package netlink
+
+import (
+	"bytes"
+	"net"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"lrg/daemon"
+	"lrg/helpers"
+	"lrg/reporter"
+)
+
+func TestObserver(t *testing.T) {
+	r := reporter.NewMock()
+	c := newObserver(r, 1)
+	got1 := []Notification{}
+	got2 := []Notification{}
+	blocked := make(chan struct{})
+	unsubscribe1 := c.subscribe("first", nil, func(n Notification) {
+		got1 = append(got1, n)
+	}, []Notification{{StartOfRIB: true}})
+	unsubscribe2 := c.Subscribe("second", func(n Notification) {
+		if n.EndOfRIB {
+			<-blocked
+		}
+		got2 = append(got2, n)
+	})
+
+	c.notify(Notification{EndOfRIB: true})
+	// The second subscriber is blocked, this fills its queue
+	c.notify(Notification{StartOfRIB: true})
+	close(blocked)
+	c.flush()
+	unsubscribe1()
+	c.notify(Notification{EndOfRIB: true})
+	c.flush()
+	unsubscribe2()
+	// Nobody is listening anymore
+	c.notify(Notification{StartOfRIB: true})
+	c.flush()
+
+	if diff := helpers.Diff(got1, []Notification{
+		{StartOfRIB: true},
+		{EndOfRIB: true},
+		{StartOfRIB: true},
+	}); diff != "" {
+		t.Errorf("first subscriber (-got, +want):\n%s", diff)
+	}
+	if diff := helpers.Diff(got2, []Notification{
+		{EndOfRIB: true},
+		{StartOfRIB: true},
+		{EndOfRIB: true},
+	}); diff != "" {
+		t.Errorf("second subscriber (-got, +want):\n%s", diff)
+	}
+	if counter := r.Counter("subscriber.first.notifications").Snapshot().Count(); counter != 3 {
+		t.Errorf("subscriber.first.notifications == %d, expected 3", counter)
+	}
+	if counter := r.Counter("subscriber.second.notifications").Snapshot().Count(); counter != 3 {
+		t.Errorf("subscriber.second.notifications == %d, expected 3", counter)
+	}
+	if gauge := r.Gauge("subscribers").Snapshot().Value(); gauge != 0 {
+		t.Errorf("subscribers == %d, expected 0", gauge)
+	}
+}
+
+func TestObserverFullQueue(t *testing.T) {
+	c := newObserver(reporter.NewMock(), 1)
+	blocked := make(chan struct{})
+	unsubscribe1 := c.Subscribe("slow", func(n Notification) {
+		<-blocked
+	})
+	notified := make(chan struct{})
+	go func() {
+		// The first notification blocks the callback, the
+		// second one fills the queue, the third one waits.
+		for i := 0; i < 3; i++ {
+			c.notify(Notification{EndOfRIB: true})
+		}
+		close(notified)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// Subscribing while a notification waits for a full queue
+	subscribed := make(chan func())
+	go func() {
+		subscribed <- c.Subscribe("other", func(n Notification) {})
+	}()
+	var unsubscribe2 func()
+	select {
+	case unsubscribe2 = <-subscribed:
+	case <-time.After(time.Second):
+		t.Fatalf("Subscribe() blocked by a full queue")
+	}
+	close(blocked)
+	<-notified
+	c.flush()
+	unsubscribe1()
+	unsubscribe2()
+}
+
+func TestObserverRouteFilters(t *testing.T) {
+	c := newObserver(reporter.NewMock(), 10)
+	_, prefix1, _ := net.ParseCIDR("192.168.1.0/24")
+	_, prefix2, _ := net.ParseCIDR("192.168.2.0/24")
+	filter1 := RouteFilter{Table: 100, Prefix: *prefix1}
+	filter2 := RouteFilter{Table: 100, Prefix: *prefix2}
+	route1 := Notification{RouteUpdate: &RouteUpdate{
+		Type:  syscall.RTM_NEWROUTE,
+		Route: Route{Dst: prefix1, Table: 100},
+	}}
+	route2 := Notification{RouteUpdate: &RouteUpdate{
+		Type:  syscall.RTM_NEWROUTE,
+		Route: Route{Dst: prefix2, Table: 100},
+	}}
+
+	got1 := []Notification{}
+	got2 := []Notification{}
+	c.SubscribeRoutes("first", []RouteFilter{filter1}, func(n Notification) {
+		got1 = append(got1, n)
+	})
+	unsubscribe2 := c.SubscribeRoutes("second", []RouteFilter{filter2}, func(n Notification) {
+		got2 = append(got2, n)
+	})
+	if diff := helpers.Diff(c.routeFilters(), routeFilters{filter1, filter2}); diff != "" {
+		t.Errorf("routeFilters() (-got, +want):\n%s", diff)
+	}
+	// The first subscriber doesn't widen the filters, the second does
+	select {
+	case <-c.refilter:
+	default:
+		t.Error("refilter not signaled")
+	}
+
+	c.notify(route1)
+	c.notify(route2)
+	c.notify(Notification{EndOfRIB: true})
+	c.flush()
+	if diff := helpers.Diff(got1, []Notification{route1, {EndOfRIB: true}}); diff != "" {
+		t.Errorf("first subscriber (-got, +want):\n%s", diff)
+	}
+	if diff := helpers.Diff(got2, []Notification{route2, {EndOfRIB: true}}); diff != "" {
+		t.Errorf("second subscriber (-got, +want):\n%s", diff)
+	}
+
+	// Already covered filters don't trigger a resynchronization
+	unsubscribe3 := c.SubscribeRoutes("third", []RouteFilter{filter2}, func(Notification) {})
+	select {
+	case <-c.refilter:
+		t.Error("refilter signaled for covered filters")
+	default:
+	}
+	unsubscribe3()
+	unsubscribe2()
+	if diff := helpers.Diff(c.routeFilters(), routeFilters{filter1}); diff != "" {
+		t.Errorf("routeFilters() after unsubscribe (-got, +want):\n%s", diff)
+	}
+
+	// A subscriber for all routes removes the filters
+	c.Subscribe("fourth", func(Notification) {})
+	if c.routeFilters() != nil {
+		t.Errorf("routeFilters() == %v, expected nil", c.routeFilters())
+	}
+	select {
+	case <-c.refilter:
+	default:
+		t.Error("refilter not signaled")
+	}
+}
+
+func TestLateSubscriber(t *testing.T) {
+	resetNamespace(t)
+
+	r := reporter.NewMock()
+	c, err := New(r, DefaultConfiguration, Dependencies{Daemon: daemon.NewMock()})
+	if err != nil {
+		t.Fatalf("New() error:\n%+v", err)
+	}
+	done := make(chan struct{})
+	added := make(chan struct{})
+	c.Subscribe("first", func(n Notification) {
+		switch {
+		case n.EndOfRIB:
+			close(done)
+		case n.RouteUpdate != nil && n.RouteUpdate.Dst.String() == "192.168.24.0/24":
+			close(added)
+		}
+	})
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start() error:\n%+v", err)
+	}
+	defer func() {
+		if err := c.Stop(); err != nil {
+			t.Fatalf("Stop() error:\n%+v", err)
+		}
+	}()
+	<-done
+
+	setup := "ip route add 192.168.24.0/24 dev dummy0"
+	var outbuf, errbuf bytes.Buffer
+	cmd := exec.Command("sh", "-exc", setup)
+	cmd.Stdout = &outbuf
+	cmd.Stderr = &errbuf
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Unable to setup routes\n** Setup:\n%s\n** Stdout:\n%s\n** Stderr:\n%s\n** Error:\n%+v",
+			setup, outbuf.String(), errbuf.String(), err)
+	}
+	<-added
+
+	// The second subscriber gets the current RIB
+	events := []string{}
+	done = make(chan struct{})
+	unsubscribe := c.Subscribe("second", func(n Notification) {
+		switch {
+		case n.StartOfRIB:
+			events = append(events, "start")
+		case n.EndOfRIB:
+			events = append(events, "end")
+			close(done)
+		case n.RouteUpdate != nil && n.RouteUpdate.Table == syscall.RT_TABLE_MAIN &&
+			n.RouteUpdate.Dst.IP.To4() != nil:
+			events = append(events, n.RouteUpdate.Dst.String())
+		}
+	})
+	defer unsubscribe()
+	<-done
+	if diff := helpers.Diff(events, []string{"start", "192.168.24.0/24", "end"}); diff != "" {
+		t.Errorf("events for late subscriber (-got, +want):\n%s", diff)
+	}
+}
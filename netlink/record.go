@@ -0,0 +1,169 @@
+package netlink
+
+import (
+	"encoding/gob"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+)
+
+// Notifications can be recorded into a file to be replayed later. The
+// file is a gob stream: a header, then one record for each
+// notification. Each record is written with a single write, so a
+// crash only loses the notification being written. Only the
+// attributes of links used by subscribers are recorded.
+
+// recordVersion is the version of the record format.
+const recordVersion = 1
+
+func init() {
+	gob.Register(&netlink.MPLSEncap{})
+	gob.Register(&netlink.MPLSDestination{})
+}
+
+// recordHeader is the first item of a record file.
+type recordHeader struct {
+	Version int
+}
+
+// record is a recorded notification with the time it was sent to
+// subscribers.
+type record struct {
+	Time          time.Time
+	RouteUpdate   *RouteUpdate
+	NexthopUpdate *NexthopUpdate
+	RuleUpdate    *RuleUpdate
+	LinkUpdate    *recordedLink
+	StartOfRIB    bool
+	EndOfRIB      bool
+}
+
+// recordedLink is a recorded link update.
+type recordedLink struct {
+	Type      uint16
+	Index     int
+	Name      string
+	Flags     net.Flags
+	OperState netlink.LinkOperState
+}
+
+// newRecord turns a notification into a record.
+func newRecord(t time.Time, n Notification) record {
+	r := record{
+		Time:          t,
+		RouteUpdate:   n.RouteUpdate,
+		NexthopUpdate: n.NexthopUpdate,
+		RuleUpdate:    n.RuleUpdate,
+		StartOfRIB:    n.StartOfRIB,
+		EndOfRIB:      n.EndOfRIB,
+	}
+	if n.LinkUpdate != nil {
+		attrs := n.LinkUpdate.Link.Attrs()
+		r.LinkUpdate = &recordedLink{
+			Type:      n.LinkUpdate.Header.Type,
+			Index:     attrs.Index,
+			Name:      attrs.Name,
+			Flags:     attrs.Flags,
+			OperState: attrs.OperState,
+		}
+	}
+	return r
+}
+
+// notification turns a record back into a notification.
+func (r record) notification() Notification {
+	n := Notification{
+		RouteUpdate:   r.RouteUpdate,
+		NexthopUpdate: r.NexthopUpdate,
+		RuleUpdate:    r.RuleUpdate,
+		StartOfRIB:    r.StartOfRIB,
+		EndOfRIB:      r.EndOfRIB,
+	}
+	if l := r.LinkUpdate; l != nil {
+		n.LinkUpdate = &netlink.LinkUpdate{
+			Header: syscall.NlMsghdr{Type: l.Type},
+			Link: &netlink.Device{LinkAttrs: netlink.LinkAttrs{
+				Index:     l.Index,
+				Name:      l.Name,
+				Flags:     l.Flags,
+				OperState: l.OperState,
+			}},
+		}
+	}
+	return n
+}
+
+// recorder writes notifications into a record file.
+type recorder struct {
+	file    *os.File
+	encoder *gob.Encoder
+}
+
+// newRecorder creates a new record file. An existing file is
+// truncated.
+func newRecorder(path string) (*recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open record file %q", path)
+	}
+	r := &recorder{
+		file:    file,
+		encoder: gob.NewEncoder(file),
+	}
+	if err := r.encoder.Encode(recordHeader{Version: recordVersion}); err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "unable to write header to record file %q", path)
+	}
+	return r, nil
+}
+
+// record writes a notification into the record file.
+func (r *recorder) record(t time.Time, n Notification) error {
+	if err := r.encoder.Encode(newRecord(t, n)); err != nil {
+		return errors.Wrap(err, "unable to record notification")
+	}
+	return nil
+}
+
+// close closes the record file.
+func (r *recorder) close() error {
+	return r.file.Close()
+}
+
+// recordReader reads notifications from a record file.
+type recordReader struct {
+	decoder *gob.Decoder
+}
+
+// newRecordReader checks the header of a record file and returns a
+// reader for its records.
+func newRecordReader(input io.Reader) (*recordReader, error) {
+	decoder := gob.NewDecoder(input)
+	var header recordHeader
+	if err := decoder.Decode(&header); err != nil {
+		return nil, errors.Wrap(err, "unable to read record header")
+	}
+	if header.Version != recordVersion {
+		return nil, errors.Errorf("unsupported record version %d", header.Version)
+	}
+	return &recordReader{decoder: decoder}, nil
+}
+
+// next returns the next record. At the end of the file, io.EOF is
+// returned. A truncated record is handled as the end of the file.
+func (r *recordReader) next() (record, error) {
+	var rec record
+	switch err := r.decoder.Decode(&rec); err {
+	case nil:
+		return rec, nil
+	case io.EOF, io.ErrUnexpectedEOF:
+		return record{}, io.EOF
+	default:
+		return record{}, errors.Wrap(err, "unable to read record")
+	}
+}
@@ -0,0 +1,294 @@
+package netlink
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+
+	"lrg/config"
+	"lrg/daemon"
+	"lrg/helpers"
+	"lrg/reporter"
+)
+
+func TestRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lrg-record")
+	if err != nil {
+		t.Fatalf("TempDir() error:\n%+v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "record")
+
+	_, prefix1, _ := net.ParseCIDR("192.168.1.0/24")
+	_, prefix2, _ := net.ParseCIDR("2001:db8:1::/64")
+	_, prefix3, _ := net.ParseCIDR("10.0.0.0/8")
+	notifications := []Notification{
+		{StartOfRIB: true},
+		{NexthopUpdate: &NexthopUpdate{
+			Type: RTMNewNexthop,
+			Nexthop: Nexthop{
+				ID:        10,
+				Protocol:  syscall.RTPROT_STATIC,
+				LinkIndex: 2,
+				Gw:        net.ParseIP("192.168.0.1"),
+			},
+		}},
+		{RuleUpdate: &RuleUpdate{
+			Type: syscall.RTM_NEWRULE,
+			Rule: netlink.Rule{
+				Priority:          100,
+				Family:            netlink.FAMILY_V4,
+				Table:             100,
+				Src:               prefix1,
+				SuppressIfgroup:   -1,
+				SuppressPrefixlen: -1,
+			},
+		}},
+		{RouteUpdate: &RouteUpdate{
+			Type: syscall.RTM_NEWROUTE,
+			Route: Route{
+				Dst:       prefix1,
+				Gw:        net.ParseIP("192.168.0.1"),
+				LinkIndex: 2,
+				Table:     254,
+				Protocol:  syscall.RTPROT_BOOT,
+				Encap:     &netlink.MPLSEncap{Labels: []int{100}},
+			},
+		}},
+		{RouteUpdate: &RouteUpdate{
+			Type: syscall.RTM_NEWROUTE,
+			Route: Route{
+				Dst:   prefix2,
+				Table: 100,
+				MultiPath: []*NexthopInfo{
+					{LinkIndex: 2, Gw: net.ParseIP("2001:db8::1")},
+					{LinkIndex: 3, Gw: net.ParseIP("2001:db8::2")},
+				},
+			},
+		}},
+		{LinkUpdate: &netlink.LinkUpdate{
+			Header: syscall.NlMsghdr{Type: syscall.RTM_NEWLINK},
+			Link: &netlink.Device{LinkAttrs: netlink.LinkAttrs{
+				Index:     2,
+				Name:      "eth0",
+				Flags:     net.FlagUp,
+				OperState: netlink.OperUp,
+			}},
+		}},
+		{EndOfRIB: true},
+		{RouteUpdate: &RouteUpdate{
+			Type: syscall.RTM_NEWROUTE,
+			Route: Route{
+				Dst:       prefix3,
+				LinkIndex: 2,
+				Table:     254,
+			},
+		}},
+		{RouteUpdate: &RouteUpdate{
+			Type: syscall.RTM_DELROUTE,
+			Route: Route{
+				Dst:       prefix1,
+				Gw:        net.ParseIP("192.168.0.1"),
+				LinkIndex: 2,
+				Table:     254,
+				Protocol:  syscall.RTPROT_BOOT,
+				Encap:     &netlink.MPLSEncap{Labels: []int{100}},
+			},
+		}},
+	}
+
+	// Record, 20 ms between each notification
+	recorder, err := newRecorder(path)
+	if err != nil {
+		t.Fatalf("newRecorder() error:\n%+v", err)
+	}
+	now := time.Now()
+	for i, n := range notifications {
+		if err := recorder.record(now.Add(time.Duration(i)*20*time.Millisecond), n); err != nil {
+			t.Fatalf("record() error:\n%+v", err)
+		}
+	}
+	if err := recorder.close(); err != nil {
+		t.Fatalf("close() error:\n%+v", err)
+	}
+
+	cases := []struct {
+		speed   float64
+		filters []RouteFilter
+		minimum time.Duration
+		maximum time.Duration
+	}{
+		{speed: 0, maximum: 100 * time.Millisecond},
+		{speed: 1, minimum: 160 * time.Millisecond},
+		{speed: 4, minimum: 40 * time.Millisecond, maximum: 140 * time.Millisecond},
+		{speed: 0, filters: []RouteFilter{{Table: 100, Prefix: *prefix2}}},
+	}
+	for _, tc := range cases {
+		r := reporter.NewMock()
+		c, err := NewReplay(r, path, tc.speed)
+		if err != nil {
+			t.Fatalf("NewReplay() error:\n%+v", err)
+		}
+		got := []Notification{}
+		done := make(chan struct{})
+		unsubscribe := c.SubscribeRoutes("test", tc.filters, func(n Notification) {
+			got = append(got, n)
+			if len(got) == len(notifications) ||
+				(tc.filters != nil && len(got) == 6) {
+				close(done)
+			}
+		})
+		start := time.Now()
+		if err := c.Start(); err != nil {
+			t.Fatalf("Start() error:\n%+v", err)
+		}
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("replay at speed %f did not complete", tc.speed)
+		}
+		elapsed := time.Since(start)
+		unsubscribe()
+		if err := c.Stop(); err != nil {
+			t.Fatalf("Stop() error:\n%+v", err)
+		}
+
+		expected := notifications
+		if tc.filters != nil {
+			expected = []Notification{
+				notifications[0], notifications[1], notifications[2],
+				notifications[4], notifications[5], notifications[6],
+			}
+		}
+		if diff := helpers.Diff(got, expected); diff != "" {
+			t.Errorf("replay at speed %f (-got, +want):\n%s", tc.speed, diff)
+		}
+		if elapsed < tc.minimum {
+			t.Errorf("replay at speed %f took %s, expected at least %s",
+				tc.speed, elapsed, tc.minimum)
+		}
+		if tc.maximum != 0 && elapsed > tc.maximum {
+			t.Errorf("replay at speed %f took %s, expected at most %s",
+				tc.speed, elapsed, tc.maximum)
+		}
+	}
+}
+
+func TestReplayTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lrg-record")
+	if err != nil {
+		t.Fatalf("TempDir() error:\n%+v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "record")
+
+	recorder, err := newRecorder(path)
+	if err != nil {
+		t.Fatalf("newRecorder() error:\n%+v", err)
+	}
+	for _, n := range []Notification{{StartOfRIB: true}, {EndOfRIB: true}} {
+		if err := recorder.record(time.Now(), n); err != nil {
+			t.Fatalf("record() error:\n%+v", err)
+		}
+	}
+	recorder.close()
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat() error:\n%+v", err)
+	}
+	if err := os.Truncate(path, stat.Size()-1); err != nil {
+		t.Fatalf("Truncate() error:\n%+v", err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open() error:\n%+v", err)
+	}
+	defer file.Close()
+	reader, err := newRecordReader(file)
+	if err != nil {
+		t.Fatalf("newRecordReader() error:\n%+v", err)
+	}
+	if rec, err := reader.next(); err != nil || !rec.StartOfRIB {
+		t.Errorf("next() == %+v, %v, expected StartOfRIB", rec, err)
+	}
+	if _, err := reader.next(); err != io.EOF {
+		t.Errorf("next() error == %v, expected EOF", err)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	resetNamespace(t)
+	dir, err := ioutil.TempDir("", "lrg-record")
+	if err != nil {
+		t.Fatalf("TempDir() error:\n%+v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "record")
+
+	r := reporter.NewMock()
+	configuration := DefaultConfiguration
+	configuration.Record = config.FilePath(path)
+	c, err := New(r, configuration, Dependencies{Daemon: daemon.NewMock()})
+	if err != nil {
+		t.Fatalf("New() error:\n%+v", err)
+	}
+	done := make(chan struct{})
+	got := []Notification{}
+	c.Subscribe("test", func(n Notification) {
+		select {
+		case <-done:
+			// Only the initial RIB is checked
+			return
+		default:
+		}
+		got = append(got, n)
+		if n.EndOfRIB {
+			close(done)
+		}
+	})
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start() error:\n%+v", err)
+	}
+	<-done
+	if err := c.Stop(); err != nil {
+		t.Fatalf("Stop() error:\n%+v", err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open() error:\n%+v", err)
+	}
+	defer file.Close()
+	reader, err := newRecordReader(file)
+	if err != nil {
+		t.Fatalf("newRecordReader() error:\n%+v", err)
+	}
+	recorded := []Notification{}
+	for {
+		rec, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("next() error:\n%+v", err)
+		}
+		recorded = append(recorded, rec.notification())
+	}
+	if len(recorded) > len(got) {
+		recorded = recorded[:len(got)]
+	}
+	if diff := helpers.Diff(recorded, got); diff != "" {
+		t.Errorf("recorded notifications (-got, +want):\n%s", diff)
+	}
+	if counter := r.Counter("record.notifications").Snapshot().Count(); counter < int64(len(got)) {
+		t.Errorf("record.notifications == %d, expected at least %d", counter, len(got))
+	}
+}
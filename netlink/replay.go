@@ -0,0 +1,183 @@
+package netlink
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"gopkg.in/tomb.v2"
+
+	"lrg/reporter"
+)
+
+// replayComponent is an implementation of the netlink component
+// sending the notifications from a record file. It doesn't need any
+// access to the kernel. Changes requested by subscribers are ignored:
+// the answers of the kernel, like the notification of an installed
+// route, are already part of the record file.
+type replayComponent struct {
+	r      *reporter.Reporter
+	t      tomb.Tomb
+	file   *os.File
+	reader *recordReader
+	speed  float64
+
+	// Copy of the replayed entries, to send the current RIB to
+	// new subscribers.
+	rib     *shadowRIB
+	ribLock sync.Mutex
+
+	observerSubComponent
+}
+
+// NewReplay creates a new netlink component replaying the provided
+// record file. Delays between notifications are divided by the
+// provided speed. With a speed of 0, notifications are sent without
+// any delay.
+func NewReplay(r *reporter.Reporter, path string, speed float64) (Component, error) {
+	if speed < 0 {
+		return nil, errors.Errorf("invalid replay speed %f", speed)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open record file %q", path)
+	}
+	reader, err := newRecordReader(bufio.NewReader(file))
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "unable to read record file %q", path)
+	}
+	return &replayComponent{
+		r:                    r,
+		file:                 file,
+		reader:               reader,
+		speed:                speed,
+		rib:                  newShadowRIB(),
+		observerSubComponent: newObserver(r, DefaultConfiguration.ChannelSize),
+	}, nil
+}
+
+// Subscribe registers a new subscriber for all routes. The current
+// RIB is first sent to it. The returned function unsubscribes it.
+func (c *replayComponent) Subscribe(name string, cb func(Notification)) func() {
+	return c.SubscribeRoutes(name, nil, cb)
+}
+
+// SubscribeRoutes registers a new subscriber only interested in the
+// routes matching one of the provided filters. The current RIB is
+// first sent to it. The returned function unsubscribes it.
+func (c *replayComponent) SubscribeRoutes(name string, filters []RouteFilter, cb func(Notification)) func() {
+	c.ribLock.Lock()
+	defer c.ribLock.Unlock()
+	return c.subscribe(name, filters, cb, c.rib.snapshot())
+}
+
+// Start the replay component.
+func (c *replayComponent) Start() error {
+	c.t.Go(c.run)
+	return nil
+}
+
+// Stop the replay component.
+func (c *replayComponent) Stop() error {
+	c.r.Info("shutting down netlink replay component")
+	defer c.r.Info("netlink replay component stopped")
+	c.t.Kill(nil)
+	err := c.t.Wait()
+	c.file.Close()
+	return err
+}
+
+// publish records a notification in the shadow RIB and sends it to
+// the subscribers.
+func (c *replayComponent) publish(n Notification) {
+	c.ribLock.Lock()
+	defer c.ribLock.Unlock()
+	switch {
+	case n.StartOfRIB:
+		c.rib.reset()
+	case n.EndOfRIB:
+		c.rib.synced = true
+	default:
+		c.rib.update(n)
+	}
+	c.notify(n)
+	c.r.Counter("replay.notifications").Inc(1)
+}
+
+func (c *replayComponent) run() error {
+	// Start replaying once there is a subscriber
+	select {
+	case <-c.t.Dying():
+		return nil
+	case <-c.subscribed:
+	}
+
+	var previous time.Time
+	for {
+		rec, err := c.reader.next()
+		if err == io.EOF {
+			c.r.Info("end of netlink replay")
+			return nil
+		}
+		if err != nil {
+			c.r.Error(err, "cannot replay notifications")
+			return nil
+		}
+		if c.speed > 0 && !previous.IsZero() && rec.Time.After(previous) {
+			delay := time.Duration(float64(rec.Time.Sub(previous)) / c.speed)
+			select {
+			case <-c.t.Dying():
+				return nil
+			case <-time.After(delay):
+			}
+		}
+		previous = rec.Time
+
+		n := rec.notification()
+		if n.RouteUpdate != nil && !c.routeFilters().match(&n.RouteUpdate.Route) {
+			c.r.Counter("route.filtered").Inc(1)
+			continue
+		}
+		c.publish(n)
+	}
+}
+
+// AddRoute does nothing.
+func (c *replayComponent) AddRoute(route Route) error {
+	c.r.Debug("ignore route addition during replay", "route", route)
+	return nil
+}
+
+// DeleteRoute does nothing.
+func (c *replayComponent) DeleteRoute(route Route) error {
+	c.r.Debug("ignore route deletion during replay", "route", route)
+	return nil
+}
+
+// ApplyRoutes does nothing.
+func (c *replayComponent) ApplyRoutes(operations []RouteOperation) []error {
+	c.r.Debug("ignore route batch during replay", "operations", len(operations))
+	return make([]error, len(operations))
+}
+
+// HasRoute tells all routes are present.
+func (c *replayComponent) HasRoute(route Route) (bool, error) {
+	return true, nil
+}
+
+// AddRule does nothing.
+func (c *replayComponent) AddRule(rule netlink.Rule) error {
+	c.r.Debug("ignore rule addition during replay", "rule", rule)
+	return nil
+}
+
+// DeleteRule does nothing.
+func (c *replayComponent) DeleteRule(rule netlink.Rule) error {
+	c.r.Debug("ignore rule deletion during replay", "rule", rule)
+	return nil
+}
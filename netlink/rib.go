@@ -0,0 +1,236 @@
+package netlink
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// shadowRIB is a copy of the routes, nexthops and rules sent to the
+// subscriber. After an overflow, entries from the fresh dump are
+// compared to this copy to only notify the differences instead of
+// starting again from an empty RIB.
+type shadowRIB struct {
+	entries    map[string]*shadowEntry
+	generation uint
+	resyncing  bool
+	synced     bool
+	started    bool
+}
+
+// shadowEntry is an entry of the shadow RIB. The generation is the
+// one of the last dump where the entry was seen.
+type shadowEntry struct {
+	notification Notification
+	generation   uint
+}
+
+// newShadowRIB returns an empty shadow RIB.
+func newShadowRIB() *shadowRIB {
+	return &shadowRIB{entries: map[string]*shadowEntry{}}
+}
+
+// reset empties the shadow RIB before a full synchronization.
+func (r *shadowRIB) reset() {
+	r.entries = map[string]*shadowEntry{}
+	r.resyncing = false
+	r.synced = false
+	r.started = true
+}
+
+// startResync starts a new resynchronization. Entries from the dump
+// should then be provided to update.
+func (r *shadowRIB) startResync() {
+	r.generation++
+	r.resyncing = true
+}
+
+// endResync ends a resynchronization. It returns the removal
+// notifications for entries not seen during the resynchronization.
+// Routes are removed first, then rules and nexthops.
+func (r *shadowRIB) endResync() []Notification {
+	r.resyncing = false
+	keys := []string{}
+	for key, entry := range r.entries {
+		if entry.generation != r.generation {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var routes, rules, nexthops []Notification
+	for _, key := range keys {
+		n := r.entries[key].notification
+		delete(r.entries, key)
+		switch {
+		case n.RouteUpdate != nil:
+			update := *n.RouteUpdate
+			update.Type = syscall.RTM_DELROUTE
+			routes = append(routes, Notification{RouteUpdate: &update})
+		case n.RuleUpdate != nil:
+			update := *n.RuleUpdate
+			update.Type = syscall.RTM_DELRULE
+			rules = append(rules, Notification{RuleUpdate: &update})
+		case n.NexthopUpdate != nil:
+			update := *n.NexthopUpdate
+			update.Type = RTMDelNexthop
+			nexthops = append(nexthops, Notification{NexthopUpdate: &update})
+		}
+	}
+	return append(append(routes, rules...), nexthops...)
+}
+
+// update records the provided notification into the shadow RIB and
+// tells if it should be sent to the subscriber. During a
+// resynchronization, entries which did not change are not sent
+// again. Other notifications are not recorded and should be sent.
+func (r *shadowRIB) update(n Notification) bool {
+	key, deleted, ok := shadowKey(n)
+	if !ok {
+		return true
+	}
+	if deleted {
+		delete(r.entries, key)
+		if n.RouteUpdate != nil {
+			r.evictRoutes(&n.RouteUpdate.Route)
+		}
+		return true
+	}
+	old, exists := r.entries[key]
+	r.entries[key] = &shadowEntry{notification: n, generation: r.generation}
+	return !r.resyncing || !exists || !sameNotification(old.notification, n)
+}
+
+// evictRoutes removes the IPv6 routes with the same table,
+// destination, source, TOS and priority as the provided removed route
+// and whose nexthops are all nexthops of the removed route. The kernel
+// may notify the removal of a multipath route at once while its
+// nexthops were notified separately, or the other way around.
+func (r *shadowRIB) evictRoutes(removed *Route) {
+	if removed.Dst != nil && removed.Dst.IP.To4() != nil {
+		return
+	}
+	base := routeBaseKey(removed)
+	nexthops := map[string]bool{}
+	for _, nh := range routeNexthops(removed) {
+		nexthops[nh] = true
+	}
+	for key, entry := range r.entries {
+		update := entry.notification.RouteUpdate
+		if update == nil || !strings.HasPrefix(key, base+" ") {
+			continue
+		}
+		included := true
+		for _, nh := range routeNexthops(&update.Route) {
+			included = included && nexthops[nh]
+		}
+		if included {
+			delete(r.entries, key)
+		}
+	}
+}
+
+// snapshot returns the notifications to send to a new subscriber to
+// get the current RIB: the start of a new RIB, the nexthops, the
+// rules, the routes and, if the initial RIB is complete, the end of
+// the initial RIB. Nothing is returned when no RIB was started yet.
+func (r *shadowRIB) snapshot() []Notification {
+	if !r.started {
+		return nil
+	}
+	keys := make([]string, 0, len(r.entries))
+	for key := range r.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var routes, rules, nexthops []Notification
+	for _, key := range keys {
+		n := r.entries[key].notification
+		switch {
+		case n.RouteUpdate != nil:
+			routes = append(routes, n)
+		case n.RuleUpdate != nil:
+			rules = append(rules, n)
+		case n.NexthopUpdate != nil:
+			nexthops = append(nexthops, n)
+		}
+	}
+	notifications := []Notification{{StartOfRIB: true}}
+	notifications = append(notifications, nexthops...)
+	notifications = append(notifications, rules...)
+	notifications = append(notifications, routes...)
+	if r.synced {
+		notifications = append(notifications, Notification{EndOfRIB: true})
+	}
+	return notifications
+}
+
+// shadowKey returns the key of a notification in the shadow RIB and
+// tells if the notification is a removal. The last value is false
+// for notifications not recorded in the shadow RIB. Some IPv6 ECMP
+// routes are notified as several routes with the same destination,
+// so the nexthops are part of the key. A replaced IPv6 route may
+// therefore leave a stale entry, removed during the next
+// resynchronization.
+func shadowKey(n Notification) (string, bool, bool) {
+	switch {
+	case n.RouteUpdate != nil:
+		route := &n.RouteUpdate.Route
+		key := routeBaseKey(route)
+		if route.Dst == nil || route.Dst.IP.To4() == nil {
+			key = fmt.Sprintf("%s %s", key, strings.Join(routeNexthops(route), ","))
+		}
+		return key, n.RouteUpdate.Type == syscall.RTM_DELROUTE, true
+	case n.NexthopUpdate != nil:
+		key := fmt.Sprintf("nexthop %d", n.NexthopUpdate.ID)
+		return key, n.NexthopUpdate.Type == RTMDelNexthop, true
+	case n.RuleUpdate != nil:
+		rule := &n.RuleUpdate.Rule
+		key := fmt.Sprintf("rule %d %d %d %s %s %d/%d %q %q %d %d %d %d",
+			rule.Family, rule.Priority, rule.Table, rule.Src, rule.Dst,
+			rule.Mark, rule.Mask, rule.IifName, rule.OifName,
+			rule.SuppressPrefixlen, rule.SuppressIfgroup, rule.Flow, rule.Goto)
+		return key, n.RuleUpdate.Type == syscall.RTM_DELRULE, true
+	}
+	return "", false, false
+}
+
+// routeBaseKey returns the part of the key of a route shared by
+// IPv4 and IPv6 routes.
+func routeBaseKey(route *Route) string {
+	return fmt.Sprintf("route %d %s %s %d %d",
+		route.Table, route.Dst, route.SrcPrefix, route.Tos, route.Priority)
+}
+
+// routeNexthops returns a sorted description of each nexthop of a
+// route: its gateway, its interface and its gateway of another family.
+func routeNexthops(route *Route) []string {
+	if route.NHID != 0 {
+		return []string{fmt.Sprintf("id %d", route.NHID)}
+	}
+	if len(route.MultiPath) == 0 {
+		return []string{fmt.Sprintf("%s %d %s", route.Gw, route.LinkIndex, route.Via)}
+	}
+	nexthops := make([]string, 0, len(route.MultiPath))
+	for _, nh := range route.MultiPath {
+		nexthops = append(nexthops, fmt.Sprintf("%s %d %s", nh.Gw, nh.LinkIndex, nh.Via))
+	}
+	sort.Strings(nexthops)
+	return nexthops
+}
+
+// sameNotification tells if two notifications for the same key
+// carry the same entry.
+func sameNotification(n1, n2 Notification) bool {
+	switch {
+	case n1.RouteUpdate != nil && n2.RouteUpdate != nil:
+		return n1.RouteUpdate.Route.Equal(n2.RouteUpdate.Route)
+	case n1.NexthopUpdate != nil && n2.NexthopUpdate != nil:
+		return reflect.DeepEqual(n1.NexthopUpdate.Nexthop, n2.NexthopUpdate.Nexthop)
+	case n1.RuleUpdate != nil && n2.RuleUpdate != nil:
+		// The key is the whole rule
+		return true
+	}
+	return false
+}
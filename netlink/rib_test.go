@@ -0,0 +1,187 @@
+package netlink
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"lrg/config"
+	"lrg/helpers"
+)
+
+func TestShadowRIB(t *testing.T) {
+	routeUpdate := func(t uint16, dst string, gw string, priority int) Notification {
+		return Notification{
+			RouteUpdate: &RouteUpdate{
+				Type: t,
+				Route: Route{
+					Dst:       config.MustParseCIDR(dst),
+					Gw:        net.ParseIP(gw),
+					LinkIndex: 2,
+					Priority:  priority,
+					Table:     syscall.RT_TABLE_MAIN,
+				},
+			},
+		}
+	}
+	nexthopUpdate := func(t uint16, id uint32, gw string) Notification {
+		return Notification{
+			NexthopUpdate: &NexthopUpdate{
+				Type: t,
+				Nexthop: Nexthop{
+					ID:        id,
+					LinkIndex: 2,
+					Gw:        net.ParseIP(gw),
+				},
+			},
+		}
+	}
+	ruleUpdate := func(t uint16, priority int, table int) Notification {
+		rule := netlink.NewRule()
+		rule.Family = netlink.FAMILY_V4
+		rule.Priority = priority
+		rule.Table = table
+		return Notification{
+			RuleUpdate: &RuleUpdate{Type: t, Rule: *rule},
+		}
+	}
+
+	rib := newShadowRIB()
+	initial := []Notification{
+		routeUpdate(syscall.RTM_NEWROUTE, "0.0.0.0/0", "192.0.2.1", 0),
+		routeUpdate(syscall.RTM_NEWROUTE, "192.168.1.0/24", "192.0.2.1", 0),
+		routeUpdate(syscall.RTM_NEWROUTE, "192.168.2.0/24", "192.0.2.1", 0),
+		routeUpdate(syscall.RTM_NEWROUTE, "2001:db8:1::/64", "fe80::1", 1024),
+		routeUpdate(syscall.RTM_NEWROUTE, "2001:db8:1::/64", "fe80::2", 1024),
+		nexthopUpdate(RTMNewNexthop, 1, "192.0.2.1"),
+		nexthopUpdate(RTMNewNexthop, 2, "192.0.2.2"),
+		ruleUpdate(syscall.RTM_NEWRULE, 100, 100),
+		ruleUpdate(syscall.RTM_NEWRULE, 101, 101),
+		// Changes during synchronization
+		routeUpdate(syscall.RTM_NEWROUTE, "192.168.3.0/24", "192.0.2.1", 0),
+		routeUpdate(syscall.RTM_DELROUTE, "192.168.3.0/24", "192.0.2.1", 0),
+		routeUpdate(syscall.RTM_NEWROUTE, "192.168.1.0/24", "192.0.2.2", 0),
+	}
+	for _, n := range initial {
+		if !rib.update(n) {
+			t.Errorf("update(%v) == false during initial synchronization", n)
+		}
+	}
+	rib.synced = true
+
+	// Resynchronize with a fresh dump
+	rib.startResync()
+	dump := []Notification{
+		// Unchanged
+		routeUpdate(syscall.RTM_NEWROUTE, "0.0.0.0/0", "192.0.2.1", 0),
+		routeUpdate(syscall.RTM_NEWROUTE, "2001:db8:1::/64", "fe80::1", 1024),
+		nexthopUpdate(RTMNewNexthop, 1, "192.0.2.1"),
+		ruleUpdate(syscall.RTM_NEWRULE, 100, 100),
+		// Modified
+		routeUpdate(syscall.RTM_NEWROUTE, "192.168.1.0/24", "192.0.2.3", 0),
+		nexthopUpdate(RTMNewNexthop, 2, "192.0.2.3"),
+		// New
+		routeUpdate(syscall.RTM_NEWROUTE, "192.168.4.0/24", "192.0.2.1", 0),
+		ruleUpdate(syscall.RTM_NEWRULE, 102, 102),
+	}
+	got := []Notification{}
+	for _, n := range dump {
+		if rib.update(n) {
+			got = append(got, n)
+		}
+	}
+	got = append(got, rib.endResync()...)
+	expected := []Notification{
+		routeUpdate(syscall.RTM_NEWROUTE, "192.168.1.0/24", "192.0.2.3", 0),
+		nexthopUpdate(RTMNewNexthop, 2, "192.0.2.3"),
+		routeUpdate(syscall.RTM_NEWROUTE, "192.168.4.0/24", "192.0.2.1", 0),
+		ruleUpdate(syscall.RTM_NEWRULE, 102, 102),
+		// Removed
+		routeUpdate(syscall.RTM_DELROUTE, "192.168.2.0/24", "192.0.2.1", 0),
+		routeUpdate(syscall.RTM_DELROUTE, "2001:db8:1::/64", "fe80::2", 1024),
+		ruleUpdate(syscall.RTM_DELRULE, 101, 101),
+	}
+	if diff := helpers.Diff(got, expected); diff != "" {
+		t.Errorf("resynchronization (-got, +want):\n%s", diff)
+	}
+
+	// Live updates are always sent
+	live := routeUpdate(syscall.RTM_NEWROUTE, "0.0.0.0/0", "192.0.2.1", 0)
+	if !rib.update(live) {
+		t.Errorf("update(%v) == false after resynchronization", live)
+	}
+
+	// Nothing left to remove
+	rib.startResync()
+	for _, n := range expected[:4] {
+		rib.update(n)
+	}
+	rib.update(live)
+	rib.update(routeUpdate(syscall.RTM_NEWROUTE, "2001:db8:1::/64", "fe80::1", 1024))
+	rib.update(nexthopUpdate(RTMNewNexthop, 1, "192.0.2.1"))
+	rib.update(ruleUpdate(syscall.RTM_NEWRULE, 100, 100))
+	if got := rib.endResync(); len(got) != 0 {
+		t.Errorf("endResync() == %v, expected nothing", got)
+	}
+
+	// Current RIB for new subscribers
+	if got := newShadowRIB().snapshot(); got != nil {
+		t.Errorf("snapshot() == %v before start, expected nothing", got)
+	}
+	rib.started = true
+	expected = []Notification{
+		{StartOfRIB: true},
+		nexthopUpdate(RTMNewNexthop, 1, "192.0.2.1"),
+		nexthopUpdate(RTMNewNexthop, 2, "192.0.2.3"),
+		ruleUpdate(syscall.RTM_NEWRULE, 100, 100),
+		ruleUpdate(syscall.RTM_NEWRULE, 102, 102),
+		routeUpdate(syscall.RTM_NEWROUTE, "0.0.0.0/0", "192.0.2.1", 0),
+		routeUpdate(syscall.RTM_NEWROUTE, "192.168.1.0/24", "192.0.2.3", 0),
+		routeUpdate(syscall.RTM_NEWROUTE, "192.168.4.0/24", "192.0.2.1", 0),
+		routeUpdate(syscall.RTM_NEWROUTE, "2001:db8:1::/64", "fe80::1", 1024),
+		{EndOfRIB: true},
+	}
+	if diff := helpers.Diff(rib.snapshot(), expected); diff != "" {
+		t.Errorf("snapshot() (-got, +want):\n%s", diff)
+	}
+
+	// IPv6 multipath routes notified per nexthop and removed at once
+	multipath := func(t uint16, gws ...string) Notification {
+		n := routeUpdate(t, "2001:db8:2::/64", "", 1024)
+		for _, gw := range gws {
+			n.RouteUpdate.MultiPath = append(n.RouteUpdate.MultiPath,
+				&NexthopInfo{LinkIndex: 2, Gw: net.ParseIP(gw)})
+		}
+		n.RouteUpdate.LinkIndex = 0
+		return n
+	}
+	rib = newShadowRIB()
+	rib.started = true
+	rib.update(routeUpdate(syscall.RTM_NEWROUTE, "2001:db8:2::/64", "fe80::1", 1024))
+	rib.update(routeUpdate(syscall.RTM_NEWROUTE, "2001:db8:2::/64", "fe80::2", 1024))
+	rib.update(routeUpdate(syscall.RTM_NEWROUTE, "2001:db8:2::/64", "fe80::3", 1024))
+	rib.update(multipath(syscall.RTM_DELROUTE, "fe80::1", "fe80::2"))
+	expected = []Notification{
+		{StartOfRIB: true},
+		routeUpdate(syscall.RTM_NEWROUTE, "2001:db8:2::/64", "fe80::3", 1024),
+	}
+	if diff := helpers.Diff(rib.snapshot(), expected); diff != "" {
+		t.Errorf("snapshot() after multipath removal (-got, +want):\n%s", diff)
+	}
+
+	// IPv6 multipath routes with different nexthops don't collapse
+	rib = newShadowRIB()
+	rib.started = true
+	rib.update(multipath(syscall.RTM_NEWROUTE, "fe80::1", "fe80::2"))
+	rib.update(multipath(syscall.RTM_NEWROUTE, "fe80::3", "fe80::4"))
+	rib.update(multipath(syscall.RTM_DELROUTE, "fe80::3", "fe80::4"))
+	expected = []Notification{
+		{StartOfRIB: true},
+		multipath(syscall.RTM_NEWROUTE, "fe80::1", "fe80::2"),
+	}
+	if diff := helpers.Diff(rib.snapshot(), expected); diff != "" {
+		t.Errorf("snapshot() after multipath replacement (-got, +want):\n%s", diff)
+	}
+}
@@ -1,12 +1,14 @@
 // Package netlink handles communication with the kernel (get routes
-// and write routes). It doesn't store any data but publishes it with
-// callbacks. It is a very thin layer and not meant a complete
+// and write routes). It publishes data with callbacks and only keeps
+// a copy of what was published to be able to recover from
+// overflows. It is a very thin layer and not meant a complete
 // abstraction of the underlying netlink library.
 package netlink
 
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -15,6 +17,7 @@ import (
 	"github.com/vishvananda/netlink"
 	"gopkg.in/tomb.v2"
 
+	"lrg/daemon"
 	"lrg/reporter"
 )
 
@@ -22,8 +25,14 @@ import (
 type Component interface {
 	Start() error
 	Stop() error
-	Subscribe(func(Notification))
-	AddRoute(netlink.Route) error
+	Subscribe(string, func(Notification)) func()
+	SubscribeRoutes(string, []RouteFilter, func(Notification)) func()
+	AddRoute(Route) error
+	DeleteRoute(Route) error
+	ApplyRoutes([]RouteOperation) []error
+	HasRoute(Route) (bool, error)
+	AddRule(netlink.Rule) error
+	DeleteRule(netlink.Rule) error
 }
 
 // fsmState represents the current state of the FSM for the netlink component.
@@ -31,8 +40,9 @@ type fsmState int
 
 const (
 	idle fsmState = iota
-	ipv4Routes
-	ipv6Routes
+	nexthops
+	rules
+	routes
 	updateRoutes
 )
 
@@ -40,30 +50,114 @@ const (
 // using Netlink.
 type realComponent struct {
 	r      *reporter.Reporter
+	d      *Dependencies
 	t      tomb.Tomb
 	config Configuration
 
-	// When state == updateRoutes, then updates == liveUpdates
-	updates        chan netlink.RouteUpdate
-	liveUpdates    chan netlink.RouteUpdate
-	state          fsmState
-	subscribeError error
+	// When state == updateRoutes, then updates == liveUpdates,
+	// nexthopUpdates == liveNexthopUpdates, ruleUpdates ==
+	// liveRuleUpdates and linkUpdates == liveLinkUpdates. Links
+	// are not dumped, only changes are sent.
+	updates            chan RouteUpdate
+	liveUpdates        chan RouteUpdate
+	nexthopUpdates     chan NexthopUpdate
+	liveNexthopUpdates chan NexthopUpdate
+	ruleUpdates        chan RuleUpdate
+	liveRuleUpdates    chan RuleUpdate
+	linkUpdates        chan netlink.LinkUpdate
+	liveLinkUpdates    chan netlink.LinkUpdate
+	state              fsmState
+	subscription       *subscription
+
+	// Families whose routes remain to be dumped when state ==
+	// routes. The first one is being dumped.
+	pendingFamilies []Family
+
+	// Requested and effective receive buffer size for
+	// subscriptions. The requested size grows on overflows.
+	socketSize          int
+	effectiveSocketSize int
+
+	// Copy of the published entries, to only publish differences
+	// when resynchronizing after an overflow and to send the
+	// current RIB to new subscribers. The lock is held while
+	// publishing.
+	rib     *shadowRIB
+	ribLock sync.Mutex
+
+	// Record file for notifications, if any.
+	recorder *recorder
+
+	// Failures of the subscription to kernel changes.
+	escalation escalation
 
 	observerSubComponent
 }
 
-// New creates a new gateway component.
-func New(reporter *reporter.Reporter, configuration Configuration) (Component, error) {
+// subscription is the state of the subscriptions to route, nexthop,
+// rule and link changes. Closing done stops all of them. Errors are
+// only available once the matching channel has been closed.
+type subscription struct {
+	done         chan struct{}
+	routeError   error
+	nexthopError error
+	ruleError    error
+	linkError    error
+}
+
+// stopSubscription stops the current subscriptions, if any.
+func (c *realComponent) stopSubscription() {
+	if c.subscription != nil {
+		close(c.subscription.done)
+		c.subscription = nil
+	}
+}
+
+// Dependencies are the dependencies for the netlink component.
+type Dependencies struct {
+	Daemon daemon.Component
+}
+
+// New creates a new netlink component.
+func New(reporter *reporter.Reporter, configuration Configuration, dependencies Dependencies) (Component, error) {
 	c := realComponent{
 		r:                    reporter,
+		d:                    &dependencies,
 		config:               configuration,
-		observerSubComponent: newObserver(),
+		escalation:           escalation{config: configuration.Escalation},
+		socketSize:           int(configuration.SocketSize),
+		rib:                  newShadowRIB(),
+		observerSubComponent: newObserver(reporter, configuration.ChannelSize),
 	}
 	return &c, nil
 }
 
+// Subscribe registers a new subscriber for all routes. The name is
+// used for the metrics of the subscriber. The current RIB is first
+// sent to it. The returned function unsubscribes it.
+func (c *realComponent) Subscribe(name string, cb func(Notification)) func() {
+	return c.SubscribeRoutes(name, nil, cb)
+}
+
+// SubscribeRoutes registers a new subscriber only interested in the
+// routes matching one of the provided filters. Only the tables of the
+// filters of all subscribers are dumped. When a new subscriber needs
+// more routes once they have been dumped, the RIB is resynchronized.
+func (c *realComponent) SubscribeRoutes(name string, filters []RouteFilter, cb func(Notification)) func() {
+	c.ribLock.Lock()
+	defer c.ribLock.Unlock()
+	return c.subscribe(name, filters, cb, c.rib.snapshot())
+}
+
 // Start the netlink component.
 func (c *realComponent) Start() error {
+	if c.config.Record != "" {
+		recorder, err := newRecorder(string(c.config.Record))
+		if err != nil {
+			return err
+		}
+		c.recorder = recorder
+	}
 	c.t.Go(c.run)
 	return nil
 }
@@ -73,35 +167,129 @@ func (c *realComponent) Stop() error {
 	c.r.Info("shutting down netlink component")
 	defer c.r.Info("netlink component stopped")
 	c.t.Kill(nil)
-	return c.t.Wait()
+	err := c.t.Wait()
+	if c.recorder != nil {
+		if err := c.recorder.close(); err != nil {
+			c.r.Error(err, "unable to close record file")
+		}
+		c.recorder = nil
+	}
+	return err
 }
 
-// injectRoutes will inject existing routes into the provided route
-// update channel. The channel is closed once routes have been sent.
-func (c *realComponent) injectRoutes(family int) error {
-	// Get routes from all tables
-	routes, err := netlink.RouteListFiltered(family, &netlink.Route{
-		Table: syscall.RT_TABLE_UNSPEC,
-	}, netlink.RT_FILTER_TABLE)
+// notify records a notification, if requested, and queues it for all
+// subscribers. It is called with the RIB lock held. On error, the
+// recording is stopped.
+func (c *realComponent) notify(n Notification) {
+	if c.recorder != nil {
+		if err := c.recorder.record(time.Now(), n); err != nil {
+			c.r.Error(err, "stop recording notifications")
+			c.r.Counter("record.errors").Inc(1)
+			c.recorder.close()
+			c.recorder = nil
+		} else {
+			c.r.Counter("record.notifications").Inc(1)
+		}
+	}
+	c.observerSubComponent.notify(n)
+}
+
+// injectNexthops will inject existing nexthop objects into the
+// nexthop update channel. The channel is closed once nexthops have
+// been sent. A kernel without support for nexthop objects is handled
+// as a kernel without any nexthop object.
+func (c *realComponent) injectNexthops() error {
+	nexthops, err := nexthopList()
+	switch err {
+	case nil:
+	case syscall.EOPNOTSUPP, syscall.EINVAL:
+		c.r.Debug("nexthop objects not supported", "err", err)
+	default:
+		return err
+	}
+
+	updates := c.nexthopUpdates
+	c.t.Go(func() error {
+		for _, nh := range nexthops {
+			update := NexthopUpdate{
+				Type:    RTMNewNexthop,
+				Nexthop: nh,
+			}
+			select {
+			case <-c.t.Dying():
+				c.r.Debug("component stopped during nexthop injection")
+				return nil
+			case updates <- update:
+				c.r.Counter("nexthop.initial").Inc(1)
+			}
+		}
+		c.r.Debug("all initial nexthops sent")
+		close(updates)
+		return nil
+	})
+	return nil
+}
+
+// injectRules will inject existing rules into the rule update
+// channel. The channel is closed once rules have been sent.
+func (c *realComponent) injectRules() error {
+	rules, err := ruleList()
 	if err != nil {
 		return err
 	}
 
+	updates := c.ruleUpdates
+	c.t.Go(func() error {
+		for _, rule := range rules {
+			update := RuleUpdate{
+				Type: syscall.RTM_NEWRULE,
+				Rule: rule,
+			}
+			select {
+			case <-c.t.Dying():
+				c.r.Debug("component stopped during rule injection")
+				return nil
+			case updates <- update:
+				c.r.Counter("rule.initial").Inc(1)
+			}
+		}
+		c.r.Debug("all initial rules sent")
+		close(updates)
+		return nil
+	})
+	return nil
+}
+
+// injectRoutes will inject existing routes into the provided route
+// update channel. The channel is closed once routes have been sent.
+// When routes are filtered, only the tables of the filters for the
+// provided family are dumped.
+func (c *realComponent) injectRoutes(family Family) error {
+	var routes []Route
+	if tables := c.routeFilters().tables(family); tables == nil {
+		// Get routes from all tables
+		var err error
+		routes, err = routeList(int(family), syscall.RT_TABLE_UNSPEC)
+		if err != nil {
+			return errors.Wrap(err, "cannot dump routes")
+		}
+	} else {
+		for _, table := range tables {
+			tableRoutes, err := routeList(int(family), table)
+			if err != nil {
+				return errors.Wrapf(err, "cannot dump table %d", table)
+			}
+			routes = append(routes, tableRoutes...)
+		}
+	}
+
 	// Send the routes into the route update channel. We have to
 	// handle the case where we need to stop the component before
 	// we were able to send all routes.
-	var familyStr string
-	switch family {
-	case netlink.FAMILY_V4:
-		familyStr = "IPv4"
-	case netlink.FAMILY_V6:
-		familyStr = "IPv6"
-	default:
-		panic("unknown family for injectRoutes")
-	}
+	familyStr := family.String()
 	c.t.Go(func() error {
 		for _, route := range routes {
-			update := netlink.RouteUpdate{
+			update := RouteUpdate{
 				Type:  syscall.RTM_NEWROUTE,
 				Route: route,
 			}
@@ -122,6 +310,66 @@ func (c *realComponent) injectRoutes(family int) error {
 	return nil
 }
 
+// families returns the families whose routes are read from the
+// kernel. When not configured, these are the families of the route
+// filters or, without filters, IPv4 and IPv6.
+func (c *realComponent) families() []Family {
+	if len(c.config.Families) > 0 {
+		return c.config.Families
+	}
+	filters := c.routeFilters()
+	if filters == nil {
+		return []Family{FamilyIPv4, FamilyIPv6}
+	}
+	families := []Family{}
+	for _, family := range []Family{FamilyIPv4, FamilyIPv6} {
+		if len(filters.tables(family)) > 0 {
+			families = append(families, family)
+		}
+	}
+	return families
+}
+
+// familyEnabled tells if the routes of the provided family are read
+// from the kernel.
+func (c *realComponent) familyEnabled(family Family) bool {
+	for _, f := range c.families() {
+		if f == family {
+			return true
+		}
+	}
+	return false
+}
+
+// injectNextRoutes starts the dump of the routes of the next pending
+// family. Once all families have been dumped, the end of the initial
+// RIB is notified and live updates are used.
+func (c *realComponent) injectNextRoutes() error {
+	if len(c.pendingFamilies) == 0 {
+		c.ribLock.Lock()
+		defer c.ribLock.Unlock()
+		for _, n := range c.rib.endResync() {
+			c.notify(n)
+			c.r.Counter("resync.removed").Inc(1)
+			c.r.Counter("callback.calls").Inc(1)
+		}
+		c.rib.synced = true
+		c.notify(Notification{EndOfRIB: true})
+		c.updates = c.liveUpdates
+		c.nexthopUpdates = c.liveNexthopUpdates
+		c.ruleUpdates = c.liveRuleUpdates
+		c.linkUpdates = c.liveLinkUpdates
+		c.state = updateRoutes
+		return nil
+	}
+	c.updates = make(chan RouteUpdate, c.config.ChannelSize)
+	if err := c.injectRoutes(c.pendingFamilies[0]); err != nil {
+		return errors.Wrapf(err, "cannot dump %s routes", c.pendingFamilies[0])
+	}
+	c.state = routes
+	return nil
+}
+
 // transition change the current state to the next one and execute the
 // appropriate actions.
 func (c *realComponent) transition() error {
@@ -130,38 +378,159 @@ func (c *realComponent) transition() error {
 	case idle, updateRoutes:
 		// Start listening to updates right now. Otherwise, we
 		// may lose some updates.
-		c.liveUpdates = make(chan netlink.RouteUpdate, c.config.ChannelSize)
-		c.subscribeError = nil
-		if err := netlink.RouteSubscribeWithOptions(c.liveUpdates, c.t.Dying(),
-			netlink.RouteSubscribeOptions{
-				ErrorCallback: func(err error) {
-					c.subscribeError = err
-				}}); err != nil {
+		c.stopSubscription()
+		c.updates = nil
+		c.nexthopUpdates = nil
+		c.ruleUpdates = nil
+		c.linkUpdates = nil
+		buffer, effective, err := probeSocketBuffer(c.socketSize)
+		if err != nil {
+			return errors.Wrapf(err, "cannot set socket size")
+		}
+		c.effectiveSocketSize = effective
+		c.r.Gauge("socket.size").Update(int64(effective))
+		s := &subscription{done: make(chan struct{})}
+		c.subscription = s
+		c.liveUpdates = make(chan RouteUpdate, c.config.ChannelSize)
+		if err := routeSubscribe(c.liveUpdates, s.done, buffer,
+			func(err error) {
+				s.routeError = err
+			}); err != nil {
 			return errors.Wrapf(err, "cannot subscribe to route changes")
 		}
+		c.liveNexthopUpdates = make(chan NexthopUpdate, c.config.ChannelSize)
+		if err := nexthopSubscribe(c.liveNexthopUpdates, s.done, buffer,
+			func(err error) {
+				s.nexthopError = err
+			}); err != nil {
+			return errors.Wrapf(err, "cannot subscribe to nexthop changes")
+		}
+		c.liveRuleUpdates = make(chan RuleUpdate, c.config.ChannelSize)
+		if err := ruleSubscribe(c.liveRuleUpdates, s.done, buffer,
+			func(err error) {
+				s.ruleError = err
+			}); err != nil {
+			return errors.Wrapf(err, "cannot subscribe to rule changes")
+		}
+		c.liveLinkUpdates = make(chan netlink.LinkUpdate, c.config.ChannelSize)
+		if err := linkSubscribe(c.liveLinkUpdates, s.done, buffer,
+			func(err error) {
+				s.linkError = err
+			}); err != nil {
+			return errors.Wrapf(err, "cannot subscribe to link changes")
+		}
 
-		c.updates = make(chan netlink.RouteUpdate, c.config.ChannelSize)
-		c.notify(Notification{StartOfRIB: true})
-		if err := c.injectRoutes(netlink.FAMILY_V4); err != nil {
+		c.nexthopUpdates = make(chan NexthopUpdate, c.config.ChannelSize)
+		c.ribLock.Lock()
+		if c.rib.synced {
+			// Only the differences with the fresh dump
+			// will be published.
+			c.r.Debug("resynchronize RIB")
+			c.r.Counter("resync.count").Inc(1)
+			c.rib.startResync()
+		} else {
+			c.rib.reset()
+			c.notify(Notification{StartOfRIB: true})
+		}
+		c.ribLock.Unlock()
+		if err := c.injectNexthops(); err != nil {
 			return errors.Wrapf(err, "cannot transition from idle state")
 		}
-		c.state = ipv4Routes
-	case ipv4Routes:
-		c.updates = make(chan netlink.RouteUpdate, c.config.ChannelSize)
-		if err := c.injectRoutes(netlink.FAMILY_V6); err != nil {
-			return errors.Wrapf(err, "cannot transition from IPv4 route state")
+		c.state = nexthops
+	case nexthops:
+		c.ruleUpdates = make(chan RuleUpdate, c.config.ChannelSize)
+		if err := c.injectRules(); err != nil {
+			return errors.Wrapf(err, "cannot transition from nexthop state")
+		}
+		c.state = rules
+	case rules:
+		c.pendingFamilies = append([]Family{}, c.families()...)
+		if err := c.injectNextRoutes(); err != nil {
+			return errors.Wrapf(err, "cannot transition from rule state")
+		}
+	case routes:
+		family := c.pendingFamilies[0]
+		c.pendingFamilies = c.pendingFamilies[1:]
+		if err := c.injectNextRoutes(); err != nil {
+			// Dump this family again on next try
+			c.pendingFamilies = append([]Family{family}, c.pendingFamilies...)
+			return errors.Wrapf(err, "cannot transition from %s route state", family)
 		}
-		c.state = ipv6Routes
-	case ipv6Routes:
-		c.notify(Notification{EndOfRIB: true})
-		c.updates = c.liveUpdates
-		c.state = updateRoutes
 	default:
 		panic("unknown current state")
 	}
 	return nil
 }
 
+// subscriptionFailed reports the error that made a subscription to
+// kernel changes fail.
+func (c *realComponent) subscriptionFailed(err error) {
+	switch e := err.(type) {
+	case syscall.Errno:
+		if e == syscall.ENOBUFS {
+			// Not important, just log something
+			c.r.Info("netlink receive buffer too small",
+				"err", err)
+			c.r.Counter("error.overflow").Inc(1)
+			c.growSocketSize()
+		} else {
+			// Important, send an alert, but try to recover
+			err := errors.Wrapf(err,
+				"fatal error while receiving updates")
+			c.r.Error(err, "")
+			c.r.Counter("error.unknown1").Inc(1)
+			c.failed(err)
+		}
+	default:
+		// Important too, send an alert, try to recover
+		if err == nil {
+			err = errors.New("fatal error while receiving updates")
+		} else {
+			err = errors.Wrapf(err,
+				"fatal error while receiving updates")
+		}
+		c.r.Error(err, "")
+		c.r.Counter("error.unknown2").Inc(1)
+		c.failed(err)
+	}
+}
+
+// transitionFailed reports the error that made a transition fail.
+func (c *realComponent) transitionFailed(err error) {
+	c.r.Error(err, "cannot change state")
+	c.failed(err)
+}
+
+// publish records a notification in the shadow RIB and sends it to
+// the subscriber, unless it doesn't bring anything new during a
+// resynchronization.
+func (c *realComponent) publish(n Notification) {
+	c.ribLock.Lock()
+	defer c.ribLock.Unlock()
+	if !c.rib.update(n) {
+		c.r.Counter("resync.unchanged").Inc(1)
+		return
+	}
+	c.notify(n)
+	c.r.Counter("callback.calls").Inc(1)
+}
+
+// growSocketSize doubles the receive buffer size for the next
+// subscriptions, up to the configured maximum size.
+func (c *realComponent) growSocketSize() {
+	size := 2 * c.effectiveSocketSize
+	if max := int(c.config.SocketMaxSize); size > max {
+		size = max
+	}
+	if size <= c.socketSize || size <= c.effectiveSocketSize {
+		return
+	}
+	c.r.Info("increase netlink receive buffer size",
+		"size", size)
+	c.r.Counter("socket.grow").Inc(1)
+	c.socketSize = size
+}
+
 func (c *realComponent) run() error {
 	c.state = idle
 
@@ -170,19 +539,44 @@ func (c *realComponent) run() error {
 	var transitionTicker *backoff.Ticker
 	var transitionTick <-chan time.Time
 	var cureTick <-chan time.Time
+	delayTransition := func() {
+		// We still need to trigger a transition, but we'll sleep a bit.
+		if transitionTick == nil {
+			b := backoff.NewExponentialBackOff()
+			b.InitialInterval = time.Duration(c.config.BackoffInterval)
+			b.Multiplier = 2
+			b.MaxInterval = time.Duration(c.config.BackoffMaxInterval)
+			b.MaxElapsedTime = 0
+			transitionBackoff = b
+			transitionTicker = backoff.NewTicker(b)
+			transitionTick = transitionTicker.C
+		}
+		if cureTick == nil {
+			cureTick = time.After(time.Duration(c.config.CureInterval))
+		}
+		c.r.Debug("sleep before next transition",
+			"elapsed", transitionBackoff.GetElapsedTime())
+	}
 
 	for {
+		// Resynchronize when route filters are widened, once
+		// routes are updated without error
+		var refilter <-chan struct{}
+		if c.state == updateRoutes && transitionTick == nil {
+			refilter = c.refilter
+		}
 		select {
 		case <-c.t.Dying():
 			if transitionTick != nil {
 				transitionTicker.Stop()
 			}
+			c.stopSubscription()
 			return nil
 
 		// Manage delayed transitions
 		case <-transitionTick:
 			if err := c.transition(); err != nil {
-				c.r.Error(err, "cannot change state")
+				c.transitionFailed(err)
 				continue
 			}
 			transitionTick = nil
@@ -190,15 +584,88 @@ func (c *realComponent) run() error {
 		case <-cureTick:
 			c.r.Debug("no error since a long time, reset transition ticker")
 			cureTick = nil
+		case <-c.escalation.cureTick:
+			c.cured()
+
+		case <-refilter:
+			c.r.Debug("route filters widened, resynchronize RIB")
+			if err := c.transition(); err != nil {
+				c.transitionFailed(err)
+				delayTransition()
+			}
 
 		// Start the FSM once there is a subscriber
 		case <-c.subscribed:
+			// The first dump uses the current route filters
+			select {
+			case <-c.refilter:
+			default:
+			}
 			if err := c.transition(); err != nil {
-				c.r.Error(err, "cannot change state")
+				c.transitionFailed(err)
 			} else {
 				c.subscribed = nil
 			}
 
+		case nexthopUpdate, ok := <-c.nexthopUpdates:
+			if !ok {
+				// Channel has been closed.
+				c.nexthopUpdates = nil
+
+				switch c.state {
+				case nexthops:
+					// OK, just transition to next state.
+					if err := c.transition(); err != nil {
+						c.transitionFailed(err)
+					} else {
+						continue
+					}
+				case updateRoutes:
+					c.subscriptionFailed(c.subscription.nexthopError)
+				}
+				delayTransition()
+				continue
+			}
+
+			c.r.Counter("nexthop.updates").Inc(1)
+			c.publish(Notification{NexthopUpdate: &nexthopUpdate})
+
+		case ruleUpdate, ok := <-c.ruleUpdates:
+			if !ok {
+				// Channel has been closed.
+				c.ruleUpdates = nil
+
+				switch c.state {
+				case rules:
+					// OK, just transition to next state.
+					if err := c.transition(); err != nil {
+						c.transitionFailed(err)
+					} else {
+						continue
+					}
+				case updateRoutes:
+					c.subscriptionFailed(c.subscription.ruleError)
+				}
+				delayTransition()
+				continue
+			}
+
+			c.r.Counter("rule.updates").Inc(1)
+			c.publish(Notification{RuleUpdate: &ruleUpdate})
+
+		case linkUpdate, ok := <-c.linkUpdates:
+			if !ok {
+				// Channel has been closed. This only
+				// happens in updateRoutes state.
+				c.linkUpdates = nil
+				c.subscriptionFailed(c.subscription.linkError)
+				delayTransition()
+				continue
+			}
+
+			c.r.Counter("link.updates").Inc(1)
+			c.publish(Notification{LinkUpdate: &linkUpdate})
+
 		case routeUpdate := <-c.updates:
 			if routeUpdate.Table == syscall.RT_TABLE_UNSPEC {
 				// Channel has been closed. We need to
@@ -207,10 +674,10 @@ func (c *realComponent) run() error {
 				c.updates = nil
 
 				switch c.state {
-				case idle, ipv4Routes, ipv6Routes:
+				case idle, routes:
 					// OK, just transition to next state.
 					if err := c.transition(); err != nil {
-						c.r.Error(err, "cannot change state")
+						c.transitionFailed(err)
 					} else {
 						// Transition now.
 						continue
@@ -218,51 +685,20 @@ func (c *realComponent) run() error {
 
 				case updateRoutes:
 					// Not totally OK, is it important?
-					switch err := c.subscribeError.(type) {
-					case syscall.Errno:
-						if err == syscall.ENOBUFS {
-							// Not important, just log something
-							c.r.Info("netlink receive buffer too small",
-								"err", err)
-							c.r.Counter("error.overflow").Inc(1)
-						} else {
-							// Important, send an alert, but try to recover
-							err := errors.Wrapf(c.subscribeError,
-								"fatal error while receiving route updates")
-							c.r.Error(err, "")
-							c.r.Counter("error.unknown1").Inc(1)
-						}
-					default:
-						// Important too, send an alert, try to recover
-						err = errors.Wrapf(err,
-							"fatal error while receiving route updates")
-						c.r.Error(err, "")
-						c.r.Counter("error.unknown2").Inc(1)
-					}
+					c.subscriptionFailed(c.subscription.routeError)
 				}
 
-				// We still need to trigger a transition, but we'll sleep a bit.
-				if transitionTick == nil {
-					b := backoff.NewExponentialBackOff()
-					b.InitialInterval = time.Duration(c.config.BackoffInterval)
-					b.Multiplier = 2
-					b.MaxInterval = time.Duration(c.config.BackoffMaxInterval)
-					b.MaxElapsedTime = 0
-					transitionBackoff = b
-					transitionTicker = backoff.NewTicker(b)
-					transitionTick = transitionTicker.C
-				}
-				if cureTick == nil {
-					cureTick = time.After(time.Duration(c.config.CureInterval))
-				}
-				c.r.Debug("sleep before next transition",
-					"elapsed", transitionBackoff.GetElapsedTime())
+				delayTransition()
 				continue
 			}
 
-			c.notify(Notification{RouteUpdate: &routeUpdate})
+			if !c.routeFilters().match(&routeUpdate.Route) ||
+				!c.familyEnabled(routeFamily(&routeUpdate.Route)) {
+				c.r.Counter("route.filtered").Inc(1)
+				continue
+			}
 			c.r.Counter("route.updates").Inc(1)
-			c.r.Counter("callback.calls").Inc(1)
+			c.publish(Notification{RouteUpdate: &routeUpdate})
 		}
 	}
 }
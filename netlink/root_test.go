@@ -13,6 +13,7 @@ import (
 	"github.com/vishvananda/netlink"
 
 	"lrg/config"
+	"lrg/daemon"
 	"lrg/helpers"
 	"lrg/reporter"
 )
@@ -47,14 +48,14 @@ ip link set up dev lo
 
 func TestFastStartStop(t *testing.T) {
 	r := reporter.NewMock()
-	c, err := New(r, DefaultConfiguration)
+	c, err := New(r, DefaultConfiguration, Dependencies{Daemon: daemon.NewMock()})
 	if err != nil {
 		t.Fatalf("New() error:\n%+v", err)
 	}
 
 	// Setup observer
 	done := make(chan struct{})
-	c.Subscribe(func(_ Notification) {
+	c.Subscribe("test", func(_ Notification) {
 		<-done
 	})
 
@@ -78,17 +79,17 @@ func TestObserveRoutes(t *testing.T) {
 	resetNamespace(t)
 
 	r := reporter.NewMock()
-	c, err := New(r, DefaultConfiguration)
+	c, err := New(r, DefaultConfiguration, Dependencies{Daemon: daemon.NewMock()})
 	if err != nil {
 		t.Fatalf("New() error:\n%+v", err)
 	}
 
 	// Setup observer
-	var got []*netlink.RouteUpdate
+	var got []*RouteUpdate
 	done := make(chan struct{})
-	c.Subscribe(func(notification Notification) {
+	unsubscribe := c.Subscribe("initial", func(notification Notification) {
 		if notification.StartOfRIB {
-			got = []*netlink.RouteUpdate{}
+			got = []*RouteUpdate{}
 			return
 		}
 		if notification.EndOfRIB {
@@ -96,7 +97,7 @@ func TestObserveRoutes(t *testing.T) {
 			return
 		}
 		u := notification.RouteUpdate
-		if u.Table == syscall.RT_TABLE_LOCAL {
+		if u == nil || u.Table == syscall.RT_TABLE_LOCAL {
 			return
 		}
 		got = append(got, u)
@@ -133,24 +134,24 @@ ip route add 192.168.26.0/24 dev dummy0 table 100
 	// kernel order (order by table, then by prefix). The
 	// component will also order IPv4 routes before IPv6 routes.
 	<-done
-	expected := []netlink.RouteUpdate{
+	expected := []RouteUpdate{
 		{
 			Type: syscall.RTM_NEWROUTE,
-			Route: netlink.Route{
+			Route: Route{
 				LinkIndex: 2,
 				Dst:       config.MustParseCIDR("192.168.26.0/24"),
 				Table:     100,
 			},
 		}, {
 			Type: syscall.RTM_NEWROUTE,
-			Route: netlink.Route{
+			Route: Route{
 				LinkIndex: 2,
 				Dst:       config.MustParseCIDR("192.168.24.0/24"),
 				Table:     syscall.RT_TABLE_MAIN,
 			},
 		}, {
 			Type: syscall.RTM_NEWROUTE,
-			Route: netlink.Route{
+			Route: Route{
 				LinkIndex: 2,
 				Dst:       config.MustParseCIDR("192.168.25.0/24"),
 				Gw:        net.ParseIP("192.168.24.1"),
@@ -158,14 +159,14 @@ ip route add 192.168.26.0/24 dev dummy0 table 100
 			},
 		}, {
 			Type: syscall.RTM_NEWROUTE,
-			Route: netlink.Route{
+			Route: Route{
 				LinkIndex: 2,
 				Dst:       config.MustParseCIDR("2001:db8:24::/64"),
 				Table:     syscall.RT_TABLE_MAIN,
 			},
 		}, {
 			Type: syscall.RTM_NEWROUTE,
-			Route: netlink.Route{
+			Route: Route{
 				LinkIndex: 2,
 				Dst:       config.MustParseCIDR("2001:db8:25::/64"),
 				Gw:        net.ParseIP("2001:db8:24::1"),
@@ -173,7 +174,7 @@ ip route add 192.168.26.0/24 dev dummy0 table 100
 			},
 		}, {
 			Type: syscall.RTM_NEWROUTE,
-			Route: netlink.Route{
+			Route: Route{
 				LinkIndex: 2,
 				Dst:       config.MustParseCIDR("fe80::/64"),
 				Table:     syscall.RT_TABLE_MAIN,
@@ -188,14 +189,14 @@ ip route add 192.168.26.0/24 dev dummy0 table 100
 	// Send some additional routes
 	cases := []struct {
 		setup    string
-		expected []netlink.RouteUpdate
+		expected []RouteUpdate
 	}{
 		{
 			setup: "add 192.168.27.0/24 dev dummy0",
-			expected: []netlink.RouteUpdate{
+			expected: []RouteUpdate{
 				{
 					Type: syscall.RTM_NEWROUTE,
-					Route: netlink.Route{
+					Route: Route{
 						LinkIndex: 2,
 						Dst:       config.MustParseCIDR("192.168.27.0/24"),
 						Table:     syscall.RT_TABLE_MAIN,
@@ -204,10 +205,10 @@ ip route add 192.168.26.0/24 dev dummy0 table 100
 			},
 		}, {
 			setup: "add 192.168.28.0/24 dev dummy0 table 100",
-			expected: []netlink.RouteUpdate{
+			expected: []RouteUpdate{
 				{
 					Type: syscall.RTM_NEWROUTE,
-					Route: netlink.Route{
+					Route: Route{
 						LinkIndex: 2,
 						Dst:       config.MustParseCIDR("192.168.28.0/24"),
 						Table:     100,
@@ -216,10 +217,10 @@ ip route add 192.168.26.0/24 dev dummy0 table 100
 			},
 		}, {
 			setup: "del 192.168.27.0/24 dev dummy0",
-			expected: []netlink.RouteUpdate{
+			expected: []RouteUpdate{
 				{
 					Type: syscall.RTM_DELROUTE,
-					Route: netlink.Route{
+					Route: Route{
 						LinkIndex: 2,
 						Dst:       config.MustParseCIDR("192.168.27.0/24"),
 						Table:     syscall.RT_TABLE_MAIN,
@@ -228,10 +229,10 @@ ip route add 192.168.26.0/24 dev dummy0 table 100
 			},
 		}, {
 			setup: "del 192.168.28.0/24 dev dummy0 table 100",
-			expected: []netlink.RouteUpdate{
+			expected: []RouteUpdate{
 				{
 					Type: syscall.RTM_DELROUTE,
-					Route: netlink.Route{
+					Route: Route{
 						LinkIndex: 2,
 						Dst:       config.MustParseCIDR("192.168.28.0/24"),
 						Table:     100,
@@ -240,10 +241,10 @@ ip route add 192.168.26.0/24 dev dummy0 table 100
 			},
 		}, {
 			setup: "add 2001:db8:27::/64 dev dummy0",
-			expected: []netlink.RouteUpdate{
+			expected: []RouteUpdate{
 				{
 					Type: syscall.RTM_NEWROUTE,
-					Route: netlink.Route{
+					Route: Route{
 						LinkIndex: 2,
 						Dst:       config.MustParseCIDR("2001:db8:27::/64"),
 						Table:     syscall.RT_TABLE_MAIN,
@@ -252,10 +253,10 @@ ip route add 192.168.26.0/24 dev dummy0 table 100
 			},
 		}, {
 			setup: "add 2001:db8:28::/64 dev dummy0 table 100",
-			expected: []netlink.RouteUpdate{
+			expected: []RouteUpdate{
 				{
 					Type: syscall.RTM_NEWROUTE,
-					Route: netlink.Route{
+					Route: Route{
 						LinkIndex: 2,
 						Dst:       config.MustParseCIDR("2001:db8:28::/64"),
 						Table:     100,
@@ -264,10 +265,10 @@ ip route add 192.168.26.0/24 dev dummy0 table 100
 			},
 		}, {
 			setup: "del 2001:db8:27::/64 dev dummy0",
-			expected: []netlink.RouteUpdate{
+			expected: []RouteUpdate{
 				{
 					Type: syscall.RTM_DELROUTE,
-					Route: netlink.Route{
+					Route: Route{
 						LinkIndex: 2,
 						Dst:       config.MustParseCIDR("2001:db8:27::/64"),
 						Table:     syscall.RT_TABLE_MAIN,
@@ -276,10 +277,10 @@ ip route add 192.168.26.0/24 dev dummy0 table 100
 			},
 		}, {
 			setup: "del 2001:db8:28::/64 dev dummy0 table 100",
-			expected: []netlink.RouteUpdate{
+			expected: []RouteUpdate{
 				{
 					Type: syscall.RTM_DELROUTE,
-					Route: netlink.Route{
+					Route: Route{
 						LinkIndex: 2,
 						Dst:       config.MustParseCIDR("2001:db8:28::/64"),
 						Table:     100,
@@ -288,10 +289,10 @@ ip route add 192.168.26.0/24 dev dummy0 table 100
 			},
 		}, {
 			setup: "add 192.168.30.0/24 via 192.168.24.1",
-			expected: []netlink.RouteUpdate{
+			expected: []RouteUpdate{
 				{
 					Type: syscall.RTM_NEWROUTE,
-					Route: netlink.Route{
+					Route: Route{
 						LinkIndex: 2,
 						Dst:       config.MustParseCIDR("192.168.30.0/24"),
 						Gw:        net.ParseIP("192.168.24.1"),
@@ -301,10 +302,10 @@ ip route add 192.168.26.0/24 dev dummy0 table 100
 			},
 		}, {
 			setup: "add 2001:db8:30::/64 via 2001:db8:24::1",
-			expected: []netlink.RouteUpdate{
+			expected: []RouteUpdate{
 				{
 					Type: syscall.RTM_NEWROUTE,
-					Route: netlink.Route{
+					Route: Route{
 						LinkIndex: 2,
 						Dst:       config.MustParseCIDR("2001:db8:30::/64"),
 						Gw:        net.ParseIP("2001:db8:24::1"),
@@ -314,10 +315,10 @@ ip route add 192.168.26.0/24 dev dummy0 table 100
 			},
 		}, {
 			setup: "add 192.168.31.0/24 via 192.168.24.1 proto kernel",
-			expected: []netlink.RouteUpdate{
+			expected: []RouteUpdate{
 				{
 					Type: syscall.RTM_NEWROUTE,
-					Route: netlink.Route{
+					Route: Route{
 						LinkIndex: 2,
 						Dst:       config.MustParseCIDR("192.168.31.0/24"),
 						Gw:        net.ParseIP("192.168.24.1"),
@@ -328,10 +329,10 @@ ip route add 192.168.26.0/24 dev dummy0 table 100
 			},
 		}, {
 			setup: "add 192.168.31.0/24 via 192.168.24.1 metric 200",
-			expected: []netlink.RouteUpdate{
+			expected: []RouteUpdate{
 				{
 					Type: syscall.RTM_NEWROUTE,
-					Route: netlink.Route{
+					Route: Route{
 						LinkIndex: 2,
 						Dst:       config.MustParseCIDR("192.168.31.0/24"),
 						Gw:        net.ParseIP("192.168.24.1"),
@@ -342,10 +343,10 @@ ip route add 192.168.26.0/24 dev dummy0 table 100
 			},
 		}, {
 			setup: "add 2001:db8:31::/64 via 2001:db8:24::1 metric 200",
-			expected: []netlink.RouteUpdate{
+			expected: []RouteUpdate{
 				{
 					Type: syscall.RTM_NEWROUTE,
-					Route: netlink.Route{
+					Route: Route{
 						LinkIndex: 2,
 						Dst:       config.MustParseCIDR("2001:db8:31::/64"),
 						Gw:        net.ParseIP("2001:db8:24::1"),
@@ -354,20 +355,51 @@ ip route add 192.168.26.0/24 dev dummy0 table 100
 					},
 				},
 			},
+		}, {
+			setup: "add 2001:db8:33::/64 from 2001:db8:1::/48 via 2001:db8:24::1",
+			expected: []RouteUpdate{
+				{
+					Type: syscall.RTM_NEWROUTE,
+					Route: Route{
+						LinkIndex: 2,
+						Dst:       config.MustParseCIDR("2001:db8:33::/64"),
+						SrcPrefix: config.MustParseCIDR("2001:db8:1::/48"),
+						Gw:        net.ParseIP("2001:db8:24::1"),
+						Table:     syscall.RT_TABLE_MAIN,
+					},
+				},
+			},
+		}, {
+			// May be dependent on kernel version
+			setup: "add 192.168.34.0/24 via inet6 2001:db8:24::1",
+			expected: []RouteUpdate{
+				{
+					Type: syscall.RTM_NEWROUTE,
+					Route: Route{
+						LinkIndex: 2,
+						Dst:       config.MustParseCIDR("192.168.34.0/24"),
+						Via: &Via{
+							AddrFamily: netlink.FAMILY_V6,
+							Addr:       net.ParseIP("2001:db8:24::1"),
+						},
+						Table: syscall.RT_TABLE_MAIN,
+					},
+				},
+			},
 		}, {
 			setup: "add 192.168.32.0/24 nexthop via 192.168.24.1 nexthop via 192.168.24.2",
-			expected: []netlink.RouteUpdate{
+			expected: []RouteUpdate{
 				{
 					Type: syscall.RTM_NEWROUTE,
-					Route: netlink.Route{
+					Route: Route{
 						LinkIndex: 2,
 						Dst:       config.MustParseCIDR("192.168.32.0/24"),
-						MultiPath: []*netlink.NexthopInfo{
-							&netlink.NexthopInfo{
+						MultiPath: []*NexthopInfo{
+							&NexthopInfo{
 								LinkIndex: 2,
 								Gw:        net.ParseIP("192.168.24.1"),
 							},
-							&netlink.NexthopInfo{
+							&NexthopInfo{
 								LinkIndex: 2,
 								Gw:        net.ParseIP("192.168.24.2"),
 							},
@@ -379,18 +411,18 @@ ip route add 192.168.26.0/24 dev dummy0 table 100
 		}, {
 			// May be dependent on kernel version
 			setup: "add 2001:db8:32::/64 nexthop via 2001:db8:24::1 nexthop via 2001:db8:24::2",
-			expected: []netlink.RouteUpdate{
+			expected: []RouteUpdate{
 				{
 					Type: syscall.RTM_NEWROUTE,
-					Route: netlink.Route{
+					Route: Route{
 						LinkIndex: 2,
 						Dst:       config.MustParseCIDR("2001:db8:32::/64"),
-						MultiPath: []*netlink.NexthopInfo{
-							&netlink.NexthopInfo{
+						MultiPath: []*NexthopInfo{
+							&NexthopInfo{
 								LinkIndex: 2,
 								Gw:        net.ParseIP("2001:db8:24::1"),
 							},
-							&netlink.NexthopInfo{
+							&NexthopInfo{
 								LinkIndex: 2,
 								Gw:        net.ParseIP("2001:db8:24::2"),
 							},
@@ -399,13 +431,49 @@ ip route add 192.168.26.0/24 dev dummy0 table 100
 					},
 				},
 			},
+		}, {
+			// May be dependent on kernel version
+			setup: "add 192.168.35.0/24 nexthop via inet6 2001:db8:24::1 nexthop via inet6 2001:db8:24::2",
+			expected: []RouteUpdate{
+				{
+					Type: syscall.RTM_NEWROUTE,
+					Route: Route{
+						LinkIndex: 2,
+						Dst:       config.MustParseCIDR("192.168.35.0/24"),
+						MultiPath: []*NexthopInfo{
+							&NexthopInfo{
+								LinkIndex: 2,
+								Via: &Via{
+									AddrFamily: netlink.FAMILY_V6,
+									Addr:       net.ParseIP("2001:db8:24::1"),
+								},
+							},
+							&NexthopInfo{
+								LinkIndex: 2,
+								Via: &Via{
+									AddrFamily: netlink.FAMILY_V6,
+									Addr:       net.ParseIP("2001:db8:24::2"),
+								},
+							},
+						},
+						Table: syscall.RT_TABLE_MAIN,
+					},
+				},
+			},
 		},
 	}
 
+	unsubscribe()
 	for _, tc := range cases {
 		ready := make(chan struct{})
-		got := []*netlink.RouteUpdate{}
-		c.Subscribe(func(notification Notification) {
+		got := []*RouteUpdate{}
+		replayed := false
+		unsubscribe := c.Subscribe("test", func(notification Notification) {
+			if !replayed {
+				// Skip the current RIB
+				replayed = notification.EndOfRIB
+				return
+			}
 			u := notification.RouteUpdate
 			if u == nil {
 				t.Fatalf("Non-route update received: %v", notification)
@@ -426,6 +494,7 @@ ip route add 192.168.26.0/24 dev dummy0 table 100
 		case <-ready:
 		case <-timeout:
 		}
+		unsubscribe()
 		if diff := helpers.Diff(got, tc.expected); diff != "" {
 			t.Fatalf("route %q (-got, +want):\n%s", tc.setup, diff)
 		}
@@ -446,6 +515,516 @@ ip route add 192.168.26.0/24 dev dummy0 table 100
 	}
 }
 
+func TestObserveNexthops(t *testing.T) {
+	resetNamespace(t)
+
+	r := reporter.NewMock()
+	c, err := New(r, DefaultConfiguration, Dependencies{Daemon: daemon.NewMock()})
+	if err != nil {
+		t.Fatalf("New() error:\n%+v", err)
+	}
+
+	// Setup observer
+	var got []*NexthopUpdate
+	done := make(chan struct{})
+	unsubscribe := c.Subscribe("initial", func(notification Notification) {
+		switch {
+		case notification.StartOfRIB:
+			got = []*NexthopUpdate{}
+		case notification.EndOfRIB:
+			close(done)
+		case notification.NexthopUpdate != nil:
+			got = append(got, notification.NexthopUpdate)
+		}
+	})
+
+	// Add some initial nexthops
+	setup := `
+ip route add 192.168.24.0/24 dev dummy0
+ip nexthop add id 10 via 192.168.24.1 dev dummy0
+ip nexthop add id 11 via 192.168.24.2 dev dummy0
+ip nexthop add id 12 group 10/11,5
+ip nexthop add id 13 blackhole
+`
+	var outbuf, errbuf bytes.Buffer
+	cmd := exec.Command("sh", "-exc", setup)
+	cmd.Stdout = &outbuf
+	cmd.Stderr = &errbuf
+	if err := cmd.Run(); err != nil {
+		t.Skipf("Unable to setup nexthops, kernel may be too old\n** Setup:\n%s\n** Stdout:\n%s\n** Stderr:\n%s\n** Error:\n%+v",
+			setup, outbuf.String(), errbuf.String(), err)
+	}
+
+	// Start component
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start() error:\n%+v", err)
+	}
+	defer func() {
+		if err := c.Stop(); err != nil {
+			t.Fatalf("Stop() error:\n%+v", err)
+		}
+	}()
+
+	<-done
+	expected := []NexthopUpdate{
+		{
+			Type: RTMNewNexthop,
+			Nexthop: Nexthop{
+				ID:        10,
+				LinkIndex: 2,
+				Gw:        net.ParseIP("192.168.24.1"),
+			},
+		}, {
+			Type: RTMNewNexthop,
+			Nexthop: Nexthop{
+				ID:        11,
+				LinkIndex: 2,
+				Gw:        net.ParseIP("192.168.24.2"),
+			},
+		}, {
+			Type: RTMNewNexthop,
+			Nexthop: Nexthop{
+				ID: 12,
+				Group: []NexthopGroupMember{
+					{ID: 10, Weight: 1},
+					{ID: 11, Weight: 5},
+				},
+			},
+		}, {
+			Type: RTMNewNexthop,
+			Nexthop: Nexthop{
+				ID:        13,
+				Blackhole: true,
+			},
+		},
+	}
+	if diff := helpers.Diff(got, expected); diff != "" {
+		t.Fatalf("initial nexthops received (-got, +want):\n%s", diff)
+	}
+
+	// Update nexthops
+	cases := []struct {
+		setup    string
+		expected []NexthopUpdate
+	}{
+		{
+			setup: "add id 14 via 192.168.24.3 dev dummy0",
+			expected: []NexthopUpdate{
+				{
+					Type: RTMNewNexthop,
+					Nexthop: Nexthop{
+						ID:        14,
+						LinkIndex: 2,
+						Gw:        net.ParseIP("192.168.24.3"),
+					},
+				},
+			},
+		}, {
+			setup: "del id 14",
+			expected: []NexthopUpdate{
+				{
+					Type: RTMDelNexthop,
+					Nexthop: Nexthop{
+						ID:        14,
+						LinkIndex: 2,
+						Gw:        net.ParseIP("192.168.24.3"),
+					},
+				},
+			},
+		},
+	}
+	unsubscribe()
+	for _, tc := range cases {
+		ready := make(chan struct{})
+		got := []*NexthopUpdate{}
+		replayed := false
+		unsubscribe := c.Subscribe("test", func(notification Notification) {
+			if !replayed {
+				// Skip the current RIB
+				replayed = notification.EndOfRIB
+				return
+			}
+			u := notification.NexthopUpdate
+			if u == nil {
+				t.Fatalf("Non-nexthop update received: %v", notification)
+			}
+			got = append(got, u)
+			close(ready)
+		})
+		var outbuf, errbuf bytes.Buffer
+		cmd := exec.Command("sh", "-exc", fmt.Sprintf("ip nexthop %s", tc.setup))
+		cmd.Stdout = &outbuf
+		cmd.Stderr = &errbuf
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("Unable to setup nexthop\n** Setup:\n%s\n** Stdout:\n%s\n** Stderr:\n%s\n** Error:\n%+v",
+				tc.setup, outbuf.String(), errbuf.String(), err)
+		}
+		timeout := time.After(1 * time.Second)
+		select {
+		case <-ready:
+		case <-timeout:
+		}
+		unsubscribe()
+		if diff := helpers.Diff(got, tc.expected); diff != "" {
+			t.Fatalf("nexthop %q (-got, +want):\n%s", tc.setup, diff)
+		}
+	}
+
+	if counter := r.Counter("nexthop.initial").Snapshot().Count(); counter != 4 {
+		t.Errorf("initial nexthop counter incorrect (%d, expected 4)", counter)
+	}
+}
+
+func TestObserveRules(t *testing.T) {
+	resetNamespace(t)
+
+	r := reporter.NewMock()
+	c, err := New(r, DefaultConfiguration, Dependencies{Daemon: daemon.NewMock()})
+	if err != nil {
+		t.Fatalf("New() error:\n%+v", err)
+	}
+
+	// Setup observer. Only rules with a priority between 100 and
+	// 199 are considered.
+	var got []*RuleUpdate
+	done := make(chan struct{})
+	unsubscribe := c.Subscribe("initial", func(notification Notification) {
+		switch {
+		case notification.StartOfRIB:
+			got = []*RuleUpdate{}
+		case notification.EndOfRIB:
+			close(done)
+		case notification.RuleUpdate != nil:
+			u := notification.RuleUpdate
+			if u.Priority >= 100 && u.Priority < 200 {
+				got = append(got, u)
+			}
+		}
+	})
+
+	// Add some initial rules
+	setup := `
+for pref in 100 101 102 103; do
+  while ip -4 rule del pref $pref 2> /dev/null; do :; done
+  while ip -6 rule del pref $pref 2> /dev/null; do :; done
+done
+ip -4 rule add pref 100 table 100
+ip -6 rule add pref 101 table 101
+ip -4 rule add pref 102 from 192.168.0.0/16 table 102
+`
+	var outbuf, errbuf bytes.Buffer
+	cmd := exec.Command("sh", "-exc", setup)
+	cmd.Stdout = &outbuf
+	cmd.Stderr = &errbuf
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Unable to setup rules\n** Setup:\n%s\n** Stdout:\n%s\n** Stderr:\n%s\n** Error:\n%+v",
+			setup, outbuf.String(), errbuf.String(), err)
+	}
+
+	// Start component
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start() error:\n%+v", err)
+	}
+	defer func() {
+		if err := c.Stop(); err != nil {
+			t.Fatalf("Stop() error:\n%+v", err)
+		}
+	}()
+
+	<-done
+	newRule := func(family, priority, table int, src *net.IPNet) netlink.Rule {
+		rule := netlink.NewRule()
+		rule.Family = family
+		rule.Priority = priority
+		rule.Table = table
+		rule.Src = src
+		return *rule
+	}
+	expected := []RuleUpdate{
+		{
+			Type: syscall.RTM_NEWRULE,
+			Rule: newRule(netlink.FAMILY_V4, 100, 100, nil),
+		}, {
+			Type: syscall.RTM_NEWRULE,
+			Rule: newRule(netlink.FAMILY_V4, 102, 102,
+				config.MustParseCIDR("192.168.0.0/16")),
+		}, {
+			Type: syscall.RTM_NEWRULE,
+			Rule: newRule(netlink.FAMILY_V6, 101, 101, nil),
+		},
+	}
+	if diff := helpers.Diff(got, expected); diff != "" {
+		t.Fatalf("initial rules received (-got, +want):\n%s", diff)
+	}
+
+	// Update rules
+	cases := []struct {
+		setup    string
+		expected []RuleUpdate
+	}{
+		{
+			setup: "-4 rule add pref 103 table 103",
+			expected: []RuleUpdate{
+				{
+					Type: syscall.RTM_NEWRULE,
+					Rule: newRule(netlink.FAMILY_V4, 103, 103, nil),
+				},
+			},
+		}, {
+			setup: "-4 rule del pref 103",
+			expected: []RuleUpdate{
+				{
+					Type: syscall.RTM_DELRULE,
+					Rule: newRule(netlink.FAMILY_V4, 103, 103, nil),
+				},
+			},
+		}, {
+			setup: "-6 rule del pref 101",
+			expected: []RuleUpdate{
+				{
+					Type: syscall.RTM_DELRULE,
+					Rule: newRule(netlink.FAMILY_V6, 101, 101, nil),
+				},
+			},
+		},
+	}
+	unsubscribe()
+	for _, tc := range cases {
+		ready := make(chan struct{})
+		got := []*RuleUpdate{}
+		replayed := false
+		unsubscribe := c.Subscribe("test", func(notification Notification) {
+			if !replayed {
+				// Skip the current RIB
+				replayed = notification.EndOfRIB
+				return
+			}
+			u := notification.RuleUpdate
+			if u == nil {
+				t.Fatalf("Non-rule update received: %v", notification)
+			}
+			got = append(got, u)
+			close(ready)
+		})
+		var outbuf, errbuf bytes.Buffer
+		cmd := exec.Command("sh", "-exc", fmt.Sprintf("ip %s", tc.setup))
+		cmd.Stdout = &outbuf
+		cmd.Stderr = &errbuf
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("Unable to setup rule\n** Setup:\n%s\n** Stdout:\n%s\n** Stderr:\n%s\n** Error:\n%+v",
+				tc.setup, outbuf.String(), errbuf.String(), err)
+		}
+		timeout := time.After(1 * time.Second)
+		select {
+		case <-ready:
+		case <-timeout:
+		}
+		unsubscribe()
+		if diff := helpers.Diff(got, tc.expected); diff != "" {
+			t.Fatalf("rule %q (-got, +want):\n%s", tc.setup, diff)
+		}
+	}
+
+	if counter := r.Counter("rule.initial").Snapshot().Count(); counter < 3 {
+		t.Errorf("initial rule counter too low (%d, expected at least 3)", counter)
+	}
+}
+
+func TestObserveLinks(t *testing.T) {
+	resetNamespace(t)
+
+	r := reporter.NewMock()
+	c, err := New(r, DefaultConfiguration, Dependencies{Daemon: daemon.NewMock()})
+	if err != nil {
+		t.Fatalf("New() error:\n%+v", err)
+	}
+	done := make(chan struct{})
+	unsubscribe := c.Subscribe("initial", func(notification Notification) {
+		if notification.EndOfRIB {
+			close(done)
+		}
+	})
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start() error:\n%+v", err)
+	}
+	defer func() {
+		if err := c.Stop(); err != nil {
+			t.Fatalf("Stop() error:\n%+v", err)
+		}
+	}()
+	<-done
+
+	dummy0, err := netlink.LinkByName("dummy0")
+	if err != nil {
+		t.Fatalf("LinkByName(%q) error:\n%+v", "dummy0", err)
+	}
+	type linkState struct {
+		Index int
+		Up    bool
+	}
+	cases := []struct {
+		setup    string
+		expected linkState
+	}{
+		{"set down dev dummy0", linkState{dummy0.Attrs().Index, false}},
+		{"set up dev dummy0", linkState{dummy0.Attrs().Index, true}},
+	}
+	unsubscribe()
+	for _, tc := range cases {
+		ready := make(chan struct{})
+		var got *linkState
+		replayed := false
+		unsubscribe := c.Subscribe("test", func(notification Notification) {
+			if !replayed {
+				// Skip the current RIB
+				replayed = notification.EndOfRIB
+				return
+			}
+			// Link changes also trigger route updates
+			u := notification.LinkUpdate
+			if u != nil && got == nil {
+				attrs := u.Link.Attrs()
+				got = &linkState{attrs.Index, attrs.Flags&net.FlagUp != 0}
+				close(ready)
+			}
+		})
+		var outbuf, errbuf bytes.Buffer
+		cmd := exec.Command("sh", "-exc", fmt.Sprintf("ip link %s", tc.setup))
+		cmd.Stdout = &outbuf
+		cmd.Stderr = &errbuf
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("Unable to setup link\n** Setup:\n%s\n** Stdout:\n%s\n** Stderr:\n%s\n** Error:\n%+v",
+				tc.setup, outbuf.String(), errbuf.String(), err)
+		}
+		timeout := time.After(1 * time.Second)
+		select {
+		case <-ready:
+		case <-timeout:
+		}
+		unsubscribe()
+		if diff := helpers.Diff(got, &tc.expected); diff != "" {
+			t.Fatalf("link %q (-got, +want):\n%s", tc.setup, diff)
+		}
+	}
+
+	if counter := r.Counter("link.updates").Snapshot().Count(); counter < 2 {
+		t.Errorf("link counter too low (%d, expected at least 2)", counter)
+	}
+}
+
+func TestFamilies(t *testing.T) {
+	_, prefix4, _ := net.ParseCIDR("0.0.0.0/0")
+	_, prefix6, _ := net.ParseCIDR("::/0")
+	cases := []struct {
+		configured []Family
+		filters    routeFilters
+		expected   []Family
+	}{
+		{nil, nil, []Family{FamilyIPv4, FamilyIPv6}},
+		{[]Family{FamilyIPv6}, nil, []Family{FamilyIPv6}},
+		{nil, routeFilters{}, []Family{}},
+		{nil, routeFilters{{Table: 254, Prefix: *prefix6}}, []Family{FamilyIPv6}},
+		{nil, routeFilters{
+			{Table: 254, Prefix: *prefix6},
+			{Table: 254, Prefix: *prefix4},
+		}, []Family{FamilyIPv4, FamilyIPv6}},
+		{[]Family{FamilyIPv4}, routeFilters{{Table: 254, Prefix: *prefix6}}, []Family{FamilyIPv4}},
+	}
+	for _, tc := range cases {
+		c := &realComponent{
+			config: Configuration{Families: tc.configured},
+		}
+		c.filters = tc.filters
+		if diff := helpers.Diff(c.families(), tc.expected); diff != "" {
+			t.Errorf("families(%v, %v) (-got, +want):\n%s",
+				tc.configured, tc.filters, diff)
+		}
+	}
+}
+
+func TestObserveOneFamily(t *testing.T) {
+	resetNamespace(t)
+
+	r := reporter.NewMock()
+	configuration := DefaultConfiguration
+	configuration.Families = []Family{FamilyIPv6}
+	c, err := New(r, configuration, Dependencies{Daemon: daemon.NewMock()})
+	if err != nil {
+		t.Fatalf("New() error:\n%+v", err)
+	}
+
+	// Setup observer
+	got := []string{}
+	done := make(chan struct{})
+	updates := make(chan string)
+	c.Subscribe("test", func(notification Notification) {
+		if notification.EndOfRIB {
+			close(done)
+			return
+		}
+		u := notification.RouteUpdate
+		if u == nil || u.Table != syscall.RT_TABLE_MAIN || u.Dst.IP.IsLinkLocalUnicast() {
+			return
+		}
+		select {
+		case <-done:
+			updates <- u.Dst.String()
+		default:
+			got = append(got, u.Dst.String())
+		}
+	})
+
+	// Add some initial routes
+	setup := `
+ip route add 192.168.24.0/24 dev dummy0
+ip route add 2001:db8:24::/64 dev dummy0
+`
+	var outbuf, errbuf bytes.Buffer
+	cmd := exec.Command("sh", "-exc", setup)
+	cmd.Stdout = &outbuf
+	cmd.Stderr = &errbuf
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Unable to setup routes\n** Setup:\n%s\n** Stdout:\n%s\n** Stderr:\n%s\n** Error:\n%+v",
+			setup, outbuf.String(), errbuf.String(), err)
+	}
+
+	// Start component
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start() error:\n%+v", err)
+	}
+	defer func() {
+		if err := c.Stop(); err != nil {
+			t.Fatalf("Stop() error:\n%+v", err)
+		}
+	}()
+
+	<-done
+	if diff := helpers.Diff(got, []string{"2001:db8:24::/64"}); diff != "" {
+		t.Errorf("initial routes (-got, +want):\n%s", diff)
+	}
+	if counter := r.Counter("route.initial.ipv4").Snapshot().Count(); counter != 0 {
+		t.Errorf("route.initial.ipv4 == %d, expected 0", counter)
+	}
+
+	// IPv4 updates are not sent
+	setup = `
+ip route add 192.168.25.0/24 dev dummy0
+ip route add 2001:db8:25::/64 dev dummy0
+`
+	outbuf.Reset()
+	errbuf.Reset()
+	cmd = exec.Command("sh", "-exc", setup)
+	cmd.Stdout = &outbuf
+	cmd.Stderr = &errbuf
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Unable to setup routes\n** Setup:\n%s\n** Stdout:\n%s\n** Stderr:\n%s\n** Error:\n%+v",
+			setup, outbuf.String(), errbuf.String(), err)
+	}
+	if update := <-updates; update != "2001:db8:25::/64" {
+		t.Errorf("update == %q, expected %q", update, "2001:db8:25::/64")
+	}
+}
+
 func TestManyManyRoutes(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Skip many many routes test in short mode")
@@ -454,7 +1033,7 @@ func TestManyManyRoutes(t *testing.T) {
 	resetNamespace(t)
 	routes := 5000
 	r := reporter.NewMock()
-	c, err := New(r, DefaultConfiguration)
+	c, err := New(r, DefaultConfiguration, Dependencies{Daemon: daemon.NewMock()})
 	if err != nil {
 		t.Fatalf("New() error:\n%+v", err)
 	}
@@ -463,7 +1042,7 @@ func TestManyManyRoutes(t *testing.T) {
 	events := []string{}
 	var eventLock sync.Mutex // protect events and prefixes
 	eor := make(chan struct{})
-	c.Subscribe(func(notification Notification) {
+	c.Subscribe("test", func(notification Notification) {
 		eventLock.Lock()
 		defer eventLock.Unlock()
 		if notification.StartOfRIB {
@@ -481,7 +1060,7 @@ func TestManyManyRoutes(t *testing.T) {
 			return
 		}
 		u := notification.RouteUpdate
-		if u.Table != syscall.RT_TABLE_MAIN {
+		if u == nil || u.Table != syscall.RT_TABLE_MAIN {
 			return
 		}
 		if u.Dst.IP.To4() == nil {
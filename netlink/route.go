@@ -0,0 +1,603 @@
+package netlink
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+
+	"lrg/helpers"
+)
+
+// The netlink library doesn't know about several route attributes:
+// nexthop objects, expiration, router preference, source prefix,
+// gateways of another family and realms. Routes are therefore decoded
+// and encoded here. Only unicast routes for IPv4 and IPv6 are
+// supported.
+
+const (
+	rtaVia     = 18
+	rtaPref    = 20
+	rtaExpires = 23
+	rtaNHID    = 30
+)
+
+// Route is a route. Fields are the same as the ones of the netlink
+// library, with the addition of the nexthop object (NHID), the
+// expiration in seconds (Expires), the router preference (Pref), the
+// source prefix (SrcPrefix), the gateway of another family (Via) and
+// the realm (Realm).
+type Route struct {
+	LinkIndex int
+	Scope     netlink.Scope
+	Dst       *net.IPNet
+	Src       net.IP
+	Gw        net.IP
+	MultiPath []*NexthopInfo
+	Protocol  int
+	Priority  int
+	Table     int
+	Type      int
+	Tos       int
+	Flags     int
+	Encap     netlink.Encap
+	NHID      int
+	Expires   int
+	Pref      int
+	SrcPrefix *net.IPNet
+	Via       *Via
+	Realm     int
+}
+
+// NexthopInfo is a next hop of a multipath route.
+type NexthopInfo struct {
+	LinkIndex int
+	Hops      int
+	Gw        net.IP
+	Flags     int
+	Encap     netlink.Encap
+	Via       *Via
+}
+
+// Via is a gateway of another family than the route (RTA_VIA).
+type Via struct {
+	AddrFamily int
+	Addr       net.IP
+}
+
+// RouteUpdate is sent when a route changes. Type is either
+// syscall.RTM_NEWROUTE or syscall.RTM_DELROUTE.
+type RouteUpdate struct {
+	Type uint16
+	Route
+}
+
+func (r Route) String() string {
+	elems := []string{}
+	if len(r.MultiPath) == 0 {
+		elems = append(elems, fmt.Sprintf("Ifindex: %d", r.LinkIndex))
+	}
+	elems = append(elems, fmt.Sprintf("Dst: %s", r.Dst))
+	if r.SrcPrefix != nil {
+		elems = append(elems, fmt.Sprintf("From: %s", r.SrcPrefix))
+	}
+	if r.Encap != nil {
+		elems = append(elems, fmt.Sprintf("Encap: %s", r.Encap))
+	}
+	elems = append(elems, fmt.Sprintf("Src: %s", r.Src))
+	switch {
+	case r.NHID != 0:
+		elems = append(elems, fmt.Sprintf("NHID: %d", r.NHID))
+	case len(r.MultiPath) > 0:
+		elems = append(elems, fmt.Sprintf("Gw: %s", r.MultiPath))
+	case r.Via != nil:
+		elems = append(elems, fmt.Sprintf("Via: %s", r.Via))
+	default:
+		elems = append(elems, fmt.Sprintf("Gw: %s", r.Gw))
+	}
+	elems = append(elems, fmt.Sprintf("Flags: %s", listFlags(r.Flags)))
+	elems = append(elems, fmt.Sprintf("Table: %d", r.Table))
+	return fmt.Sprintf("{%s}", strings.Join(elems, " "))
+}
+
+// Equal tells if two routes are identical. The expiration is not
+// compared as it is the remaining lifetime of the route: the kernel
+// notifies the same route with different values.
+func (r Route) Equal(x Route) bool {
+	if len(r.MultiPath) != len(x.MultiPath) {
+		return false
+	}
+	for i := range r.MultiPath {
+		if !r.MultiPath[i].Equal(*x.MultiPath[i]) {
+			return false
+		}
+	}
+	return r.LinkIndex == x.LinkIndex &&
+		r.Scope == x.Scope &&
+		ipNetPtrEqual(r.Dst, x.Dst) &&
+		r.Src.Equal(x.Src) &&
+		r.Gw.Equal(x.Gw) &&
+		r.Protocol == x.Protocol &&
+		r.Priority == x.Priority &&
+		r.Table == x.Table &&
+		r.Type == x.Type &&
+		r.Tos == x.Tos &&
+		r.Flags == x.Flags &&
+		encapEqual(r.Encap, x.Encap) &&
+		r.NHID == x.NHID &&
+		r.Pref == x.Pref &&
+		ipNetPtrEqual(r.SrcPrefix, x.SrcPrefix) &&
+		r.Via.Equal(x.Via) &&
+		r.Realm == x.Realm
+}
+
+func (n *NexthopInfo) String() string {
+	elems := []string{}
+	elems = append(elems, fmt.Sprintf("Ifindex: %d", n.LinkIndex))
+	if n.Encap != nil {
+		elems = append(elems, fmt.Sprintf("Encap: %s", n.Encap))
+	}
+	elems = append(elems, fmt.Sprintf("Weight: %d", n.Hops+1))
+	if n.Via != nil {
+		elems = append(elems, fmt.Sprintf("Via: %s", n.Via))
+	} else {
+		elems = append(elems, fmt.Sprintf("Gw: %s", n.Gw))
+	}
+	elems = append(elems, fmt.Sprintf("Flags: %s", listFlags(n.Flags)))
+	return fmt.Sprintf("{%s}", strings.Join(elems, " "))
+}
+
+// Equal tells if two next hops are identical.
+func (n NexthopInfo) Equal(x NexthopInfo) bool {
+	return n.LinkIndex == x.LinkIndex &&
+		n.Hops == x.Hops &&
+		n.Gw.Equal(x.Gw) &&
+		n.Flags == x.Flags &&
+		encapEqual(n.Encap, x.Encap) &&
+		n.Via.Equal(x.Via)
+}
+
+func (v *Via) String() string {
+	return fmt.Sprintf("Family: %d, Address: %s", v.AddrFamily, v.Addr)
+}
+
+// Equal tells if two optional "via" gateways are equal.
+func (v *Via) Equal(x *Via) bool {
+	if v == nil || x == nil {
+		return v == x
+	}
+	return v.AddrFamily == x.AddrFamily && v.Addr.Equal(x.Addr)
+}
+
+// listFlags returns the names of the known next hop flags.
+func listFlags(flags int) []string {
+	names := []string{}
+	if flags&syscall.RTNH_F_ONLINK != 0 {
+		names = append(names, "onlink")
+	}
+	if flags&syscall.RTNH_F_PERVASIVE != 0 {
+		names = append(names, "pervasive")
+	}
+	return names
+}
+
+// ipNetPtrEqual tells if two optional prefixes are equal.
+func ipNetPtrEqual(n1, n2 *net.IPNet) bool {
+	if n1 == nil || n2 == nil {
+		return n1 == n2
+	}
+	return helpers.IPNetEqual(*n1, *n2)
+}
+
+// encapEqual tells if two optional encapsulations are equal.
+func encapEqual(e1, e2 netlink.Encap) bool {
+	if e1 == nil || e2 == nil {
+		return e1 == e2
+	}
+	return e1.Equal(e2)
+}
+
+// ipData returns the bytes of an IP address for the provided family.
+func ipData(ip net.IP, family int) []byte {
+	if family == netlink.FAMILY_V4 {
+		return ip.To4()
+	}
+	return ip.To16()
+}
+
+// ipFamily returns the family of an IP address.
+func ipFamily(ip net.IP) int {
+	if ip.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
+
+// encodeVia encodes a "via" gateway (struct rtvia).
+func encodeVia(v *Via) []byte {
+	addr := ipData(v.Addr, v.AddrFamily)
+	b := make([]byte, 2+len(addr))
+	nl.NativeEndian().PutUint16(b, uint16(v.AddrFamily))
+	copy(b[2:], addr)
+	return b
+}
+
+// decodeVia decodes a "via" gateway (struct rtvia).
+func decodeVia(b []byte) (*Via, error) {
+	if len(b) < 2 {
+		return nil, errors.New("via gateway too short")
+	}
+	return &Via{
+		AddrFamily: int(nl.NativeEndian().Uint16(b[0:2])),
+		Addr:       net.IP(b[2:]),
+	}, nil
+}
+
+// encodeEncap returns the attributes for an encapsulation.
+func encodeEncap(e netlink.Encap) ([]*nl.RtAttr, error) {
+	typ := make([]byte, 2)
+	nl.NativeEndian().PutUint16(typ, uint16(e.Type()))
+	buf, err := e.Encode()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot encode encapsulation")
+	}
+	return []*nl.RtAttr{
+		nl.NewRtAttr(nl.RTA_ENCAP_TYPE, typ),
+		nl.NewRtAttr(nl.RTA_ENCAP, buf),
+	}, nil
+}
+
+// decodeEncap decodes an encapsulation. Only MPLS encapsulation is
+// known, other encapsulations are ignored.
+func decodeEncap(encapType, encap []byte) (netlink.Encap, error) {
+	if len(encapType) < 2 || len(encap) == 0 {
+		return nil, nil
+	}
+	switch nl.NativeEndian().Uint16(encapType[0:2]) {
+	case nl.LWTUNNEL_ENCAP_MPLS:
+		e := &netlink.MPLSEncap{}
+		if err := e.Decode(encap); err != nil {
+			return nil, errors.Wrap(err, "cannot decode MPLS encapsulation")
+		}
+		return e, nil
+	}
+	return nil, nil
+}
+
+// uint32Attr returns an attribute with a 32-bit value.
+func uint32Attr(attrType int, value int) *nl.RtAttr {
+	b := make([]byte, 4)
+	nl.NativeEndian().PutUint32(b, uint32(value))
+	return nl.NewRtAttr(attrType, b)
+}
+
+// routeRequest returns a request to add (syscall.RTM_NEWROUTE) or
+// to remove (syscall.RTM_DELROUTE) the provided route.
+func routeRequest(proto, flags int, route Route) (*nl.NetlinkRequest, error) {
+	var family int
+	switch {
+	case route.Dst != nil && route.Dst.IP != nil:
+		family = ipFamily(route.Dst.IP)
+	case route.Src != nil:
+		family = ipFamily(route.Src)
+	case route.Gw != nil:
+		family = ipFamily(route.Gw)
+	default:
+		return nil, errors.New("one of destination, source or gateway must be set")
+	}
+
+	msg := nl.NewRtMsg()
+	if proto == syscall.RTM_DELROUTE {
+		msg = nl.NewRtDelMsg()
+	}
+	msg.Family = uint8(family)
+	msg.Flags = uint32(route.Flags)
+	msg.Scope = uint8(route.Scope)
+	if route.Tos > 0 {
+		msg.Tos = uint8(route.Tos)
+	}
+	if route.Protocol > 0 {
+		msg.Protocol = uint8(route.Protocol)
+	}
+	if route.Type > 0 {
+		msg.Type = uint8(route.Type)
+	}
+	attrs := []*nl.RtAttr{}
+	if route.Table > 0 {
+		if route.Table >= 256 {
+			msg.Table = syscall.RT_TABLE_UNSPEC
+			attrs = append(attrs, uint32Attr(syscall.RTA_TABLE, route.Table))
+		} else {
+			msg.Table = uint8(route.Table)
+		}
+	}
+	if route.Dst != nil && route.Dst.IP != nil {
+		dstLen, _ := route.Dst.Mask.Size()
+		msg.Dst_len = uint8(dstLen)
+		attrs = append(attrs, nl.NewRtAttr(syscall.RTA_DST, ipData(route.Dst.IP, family)))
+	}
+	if route.SrcPrefix != nil {
+		srcLen, _ := route.SrcPrefix.Mask.Size()
+		msg.Src_len = uint8(srcLen)
+		attrs = append(attrs, nl.NewRtAttr(syscall.RTA_SRC, ipData(route.SrcPrefix.IP, family)))
+	}
+	if route.Src != nil {
+		attrs = append(attrs, nl.NewRtAttr(syscall.RTA_PREFSRC, ipData(route.Src, family)))
+	}
+	if route.Gw != nil {
+		attrs = append(attrs, nl.NewRtAttr(syscall.RTA_GATEWAY, ipData(route.Gw, family)))
+	}
+	if route.Via != nil {
+		attrs = append(attrs, nl.NewRtAttr(rtaVia, encodeVia(route.Via)))
+	}
+	if route.Encap != nil {
+		encap, err := encodeEncap(route.Encap)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, encap...)
+	}
+	if len(route.MultiPath) > 0 {
+		buf := []byte{}
+		for _, nh := range route.MultiPath {
+			rtnh := &nl.RtNexthop{
+				RtNexthop: syscall.RtNexthop{
+					Hops:    uint8(nh.Hops),
+					Ifindex: int32(nh.LinkIndex),
+					Flags:   uint8(nh.Flags),
+				},
+			}
+			if nh.Gw != nil {
+				rtnh.Children = append(rtnh.Children,
+					nl.NewRtAttr(syscall.RTA_GATEWAY, ipData(nh.Gw, family)))
+			}
+			if nh.Via != nil {
+				rtnh.Children = append(rtnh.Children,
+					nl.NewRtAttr(rtaVia, encodeVia(nh.Via)))
+			}
+			if nh.Encap != nil {
+				encap, err := encodeEncap(nh.Encap)
+				if err != nil {
+					return nil, err
+				}
+				for _, attr := range encap {
+					rtnh.Children = append(rtnh.Children, attr)
+				}
+			}
+			buf = append(buf, rtnh.Serialize()...)
+		}
+		attrs = append(attrs, nl.NewRtAttr(syscall.RTA_MULTIPATH, buf))
+	}
+	if route.Priority > 0 {
+		attrs = append(attrs, uint32Attr(syscall.RTA_PRIORITY, route.Priority))
+	}
+	if route.Pref != 0 {
+		attrs = append(attrs, nl.NewRtAttr(rtaPref, []byte{uint8(route.Pref)}))
+	}
+	if route.Expires > 0 {
+		attrs = append(attrs, uint32Attr(rtaExpires, route.Expires))
+	}
+	if route.Realm > 0 {
+		attrs = append(attrs, uint32Attr(syscall.RTA_FLOW, route.Realm))
+	}
+	if route.NHID > 0 {
+		attrs = append(attrs, uint32Attr(rtaNHID, route.NHID))
+	}
+	attrs = append(attrs, uint32Attr(syscall.RTA_OIF, route.LinkIndex))
+
+	req := nl.NewNetlinkRequest(proto, flags|syscall.NLM_F_ACK)
+	req.AddData(msg)
+	for _, attr := range attrs {
+		req.AddData(attr)
+	}
+	return req, nil
+}
+
+// executeRouteRequest sends a route request and waits for the
+// acknowledgment of the kernel. The request is sent on the provided
+// socket or, when nil, on a new one.
+func executeRouteRequest(s *nl.NetlinkSocket, req *nl.NetlinkRequest) error {
+	if s == nil {
+		_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+		return err
+	}
+	if err := s.Send(req); err != nil {
+		return err
+	}
+	for {
+		msgs, err := s.Receive()
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != req.Seq || m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if errno := -int32(nl.NativeEndian().Uint32(m.Data[0:4])); errno != 0 {
+				return syscall.Errno(errno)
+			}
+			return nil
+		}
+	}
+}
+
+// deserializeRoute decodes a route message. Like iproute2, a route
+// without destination is a default route.
+func deserializeRoute(m []byte) (Route, error) {
+	if len(m) < syscall.SizeofRtMsg {
+		return Route{}, errors.New("route message too short")
+	}
+	msg := nl.DeserializeRtMsg(m)
+	attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+	if err != nil {
+		return Route{}, errors.Wrap(err, "cannot parse route attributes")
+	}
+	route := Route{
+		Scope:    netlink.Scope(msg.Scope),
+		Protocol: int(msg.Protocol),
+		Table:    int(msg.Table),
+		Type:     int(msg.Type),
+		Tos:      int(msg.Tos),
+		Flags:    int(msg.Flags),
+	}
+
+	native := nl.NativeEndian()
+	var encap, encapType []byte
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case syscall.RTA_GATEWAY:
+			route.Gw = net.IP(attr.Value)
+		case syscall.RTA_PREFSRC:
+			route.Src = net.IP(attr.Value)
+		case syscall.RTA_DST:
+			route.Dst = &net.IPNet{
+				IP:   attr.Value,
+				Mask: net.CIDRMask(int(msg.Dst_len), 8*len(attr.Value)),
+			}
+		case syscall.RTA_SRC:
+			route.SrcPrefix = &net.IPNet{
+				IP:   attr.Value,
+				Mask: net.CIDRMask(int(msg.Src_len), 8*len(attr.Value)),
+			}
+		case syscall.RTA_OIF:
+			route.LinkIndex = int(native.Uint32(attr.Value[0:4]))
+		case syscall.RTA_PRIORITY:
+			route.Priority = int(native.Uint32(attr.Value[0:4]))
+		case syscall.RTA_TABLE:
+			route.Table = int(native.Uint32(attr.Value[0:4]))
+		case syscall.RTA_FLOW:
+			route.Realm = int(native.Uint32(attr.Value[0:4]))
+		case rtaNHID:
+			route.NHID = int(native.Uint32(attr.Value[0:4]))
+		case rtaPref:
+			route.Pref = int(attr.Value[0])
+		case syscall.RTA_CACHEINFO:
+			// struct rta_cacheinfo, expiration is in hundredths of second
+			if len(attr.Value) >= 12 {
+				route.Expires = int(int32(native.Uint32(attr.Value[8:12]))) / 100
+			}
+		case rtaVia:
+			if route.Via, err = decodeVia(attr.Value); err != nil {
+				return Route{}, err
+			}
+		case nl.RTA_ENCAP_TYPE:
+			encapType = attr.Value
+		case nl.RTA_ENCAP:
+			encap = attr.Value
+		case syscall.RTA_MULTIPATH:
+			if route.MultiPath, err = deserializeNexthops(attr.Value); err != nil {
+				return Route{}, err
+			}
+		}
+	}
+	if route.Encap, err = decodeEncap(encapType, encap); err != nil {
+		return Route{}, err
+	}
+	if route.Dst == nil {
+		switch msg.Family {
+		case syscall.AF_INET:
+			route.Dst = &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(int(msg.Dst_len), 32)}
+		case syscall.AF_INET6:
+			route.Dst = &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(int(msg.Dst_len), 128)}
+		}
+	}
+	return route, nil
+}
+
+// deserializeNexthops decodes the next hops of a multipath route
+// (RTA_MULTIPATH).
+func deserializeNexthops(b []byte) ([]*NexthopInfo, error) {
+	nexthops := []*NexthopInfo{}
+	native := nl.NativeEndian()
+	for len(b) > 0 {
+		// struct rtnexthop, decoded by hand as the buffer may
+		// not be aligned
+		if len(b) < syscall.SizeofRtNexthop {
+			return nil, errors.New("next hop too short")
+		}
+		length := int(native.Uint16(b[0:2]))
+		if length < syscall.SizeofRtNexthop || len(b) < length {
+			return nil, errors.New("next hop too short")
+		}
+		nh := &NexthopInfo{
+			LinkIndex: int(int32(native.Uint32(b[4:8]))),
+			Hops:      int(b[3]),
+			Flags:     int(b[2]),
+		}
+		attrs, err := nl.ParseRouteAttr(b[syscall.SizeofRtNexthop:length])
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot parse next hop attributes")
+		}
+		var encap, encapType []byte
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.RTA_GATEWAY:
+				nh.Gw = net.IP(attr.Value)
+			case rtaVia:
+				if nh.Via, err = decodeVia(attr.Value); err != nil {
+					return nil, err
+				}
+			case nl.RTA_ENCAP_TYPE:
+				encapType = attr.Value
+			case nl.RTA_ENCAP:
+				encap = attr.Value
+			}
+		}
+		if nh.Encap, err = decodeEncap(encapType, encap); err != nil {
+			return nil, err
+		}
+		nexthops = append(nexthops, nh)
+		b = b[length:]
+	}
+	return nexthops, nil
+}
+
+// routeSubscribe will send route updates for IPv4 and IPv6 to the
+// provided channel. The channel is closed on error (after calling the
+// provided error callback) or when done is closed. The receive buffer
+// of the socket is set to the provided size.
+func routeSubscribe(ch chan<- RouteUpdate, done <-chan struct{}, buffer socketBuffer, cberr func(error)) error {
+	s, err := nl.Subscribe(syscall.NETLINK_ROUTE,
+		syscall.RTNLGRP_IPV4_ROUTE, syscall.RTNLGRP_IPV6_ROUTE)
+	if err != nil {
+		return err
+	}
+	if err := buffer.apply(s); err != nil {
+		s.Close()
+		return err
+	}
+	go func() {
+		<-done
+		s.Close()
+	}()
+	go func() {
+		defer close(ch)
+		for {
+			msgs, err := s.Receive()
+			if err != nil {
+				cberr(err)
+				return
+			}
+			for _, m := range msgs {
+				if m.Header.Type != syscall.RTM_NEWROUTE && m.Header.Type != syscall.RTM_DELROUTE {
+					continue
+				}
+				route, err := deserializeRoute(m.Data)
+				if err != nil {
+					cberr(err)
+					return
+				}
+				select {
+				case <-done:
+					return
+				case ch <- RouteUpdate{Type: m.Header.Type, Route: route}:
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,315 @@
+package netlink
+
+import (
+	"bytes"
+	"net"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+
+	"lrg/config"
+	"lrg/helpers"
+)
+
+func TestDeserializeRoute(t *testing.T) {
+	native := nl.NativeEndian()
+	u32 := func(v uint32) []byte {
+		b := make([]byte, 4)
+		native.PutUint32(b, v)
+		return b
+	}
+	via := func(ip string) []byte {
+		b := make([]byte, 2)
+		native.PutUint16(b, syscall.AF_INET6)
+		return append(b, net.ParseIP(ip).To16()...)
+	}
+	message := func(msg syscall.RtMsg, attrs ...*nl.RtAttr) []byte {
+		b := (&nl.RtMsg{RtMsg: msg}).Serialize()
+		for _, attr := range attrs {
+			b = append(b, attr.Serialize()...)
+		}
+		return b
+	}
+	ipv4 := syscall.RtMsg{
+		Family:   syscall.AF_INET,
+		Table:    syscall.RT_TABLE_MAIN,
+		Protocol: syscall.RTPROT_BOOT,
+		Type:     syscall.RTN_UNICAST,
+	}
+	ipv4Dst := ipv4
+	ipv4Dst.Dst_len = 24
+	ipv6 := syscall.RtMsg{
+		Family:   syscall.AF_INET6,
+		Dst_len:  64,
+		Src_len:  48,
+		Table:    syscall.RT_TABLE_MAIN,
+		Protocol: syscall.RTPROT_BOOT,
+		Type:     syscall.RTN_UNICAST,
+	}
+	cacheinfo := make([]byte, 32)
+	native.PutUint32(cacheinfo[8:12], 12000)
+	multipath := append((&nl.RtNexthop{
+		RtNexthop: syscall.RtNexthop{Hops: 1, Ifindex: 2},
+		Children:  []nl.NetlinkRequestData{nl.NewRtAttr(rtaVia, via("fe80::1"))},
+	}).Serialize(), (&nl.RtNexthop{
+		RtNexthop: syscall.RtNexthop{Ifindex: 3},
+		Children: []nl.NetlinkRequestData{
+			nl.NewRtAttr(syscall.RTA_GATEWAY, net.ParseIP("192.168.24.1").To4())},
+	}).Serialize()...)
+
+	cases := []struct {
+		description string
+		message     []byte
+		expected    Route
+		err         bool
+	}{
+		{
+			description: "default route",
+			message: message(ipv4,
+				nl.NewRtAttr(syscall.RTA_OIF, u32(2)),
+				nl.NewRtAttr(syscall.RTA_GATEWAY, net.ParseIP("192.168.24.1").To4())),
+			expected: Route{
+				LinkIndex: 2,
+				Dst:       config.MustParseCIDR("0.0.0.0/0"),
+				Gw:        net.ParseIP("192.168.24.1"),
+				Protocol:  syscall.RTPROT_BOOT,
+				Table:     syscall.RT_TABLE_MAIN,
+				Type:      syscall.RTN_UNICAST,
+			},
+		}, {
+			description: "nexthop object and realm",
+			message: message(ipv4Dst,
+				nl.NewRtAttr(syscall.RTA_DST, net.ParseIP("192.168.25.0").To4()),
+				nl.NewRtAttr(syscall.RTA_TABLE, u32(1000)),
+				nl.NewRtAttr(syscall.RTA_FLOW, u32(10)),
+				nl.NewRtAttr(rtaNHID, u32(20))),
+			expected: Route{
+				Dst:      config.MustParseCIDR("192.168.25.0/24"),
+				Protocol: syscall.RTPROT_BOOT,
+				Table:    1000,
+				Type:     syscall.RTN_UNICAST,
+				NHID:     20,
+				Realm:    10,
+			},
+		}, {
+			description: "IPv4 route via IPv6 gateways",
+			message: message(ipv4Dst,
+				nl.NewRtAttr(syscall.RTA_DST, net.ParseIP("192.168.25.0").To4()),
+				nl.NewRtAttr(syscall.RTA_MULTIPATH, multipath)),
+			expected: Route{
+				Dst:      config.MustParseCIDR("192.168.25.0/24"),
+				Protocol: syscall.RTPROT_BOOT,
+				Table:    syscall.RT_TABLE_MAIN,
+				Type:     syscall.RTN_UNICAST,
+				MultiPath: []*NexthopInfo{
+					{
+						LinkIndex: 2,
+						Hops:      1,
+						Via: &Via{
+							AddrFamily: netlink.FAMILY_V6,
+							Addr:       net.ParseIP("fe80::1"),
+						},
+					}, {
+						LinkIndex: 3,
+						Gw:        net.ParseIP("192.168.24.1"),
+					},
+				},
+			},
+		}, {
+			description: "source prefix, preference and expiration",
+			message: message(ipv6,
+				nl.NewRtAttr(syscall.RTA_DST, net.ParseIP("2001:db8:24::")),
+				nl.NewRtAttr(syscall.RTA_SRC, net.ParseIP("2001:db8:1::")),
+				nl.NewRtAttr(syscall.RTA_OIF, u32(2)),
+				nl.NewRtAttr(rtaPref, []byte{1}),
+				nl.NewRtAttr(syscall.RTA_CACHEINFO, cacheinfo),
+				nl.NewRtAttr(rtaVia, via("fe80::1"))),
+			expected: Route{
+				LinkIndex: 2,
+				Dst:       config.MustParseCIDR("2001:db8:24::/64"),
+				SrcPrefix: config.MustParseCIDR("2001:db8:1::/48"),
+				Protocol:  syscall.RTPROT_BOOT,
+				Table:     syscall.RT_TABLE_MAIN,
+				Type:      syscall.RTN_UNICAST,
+				Expires:   120,
+				Pref:      1,
+				Via: &Via{
+					AddrFamily: netlink.FAMILY_V6,
+					Addr:       net.ParseIP("fe80::1"),
+				},
+			},
+		}, {
+			description: "truncated via",
+			message: message(ipv4,
+				nl.NewRtAttr(rtaVia, []byte{10})),
+			err: true,
+		}, {
+			description: "truncated next hop",
+			message: message(ipv4,
+				nl.NewRtAttr(syscall.RTA_MULTIPATH, multipath[:10])),
+			err: true,
+		}, {
+			description: "truncated message",
+			message:     []byte{2, 24, 0},
+			err:         true,
+		},
+	}
+	for _, tc := range cases {
+		got, err := deserializeRoute(tc.message)
+		switch {
+		case err != nil && !tc.err:
+			t.Errorf("deserializeRoute(%q) error:\n%+v", tc.description, err)
+		case err == nil && tc.err:
+			t.Errorf("deserializeRoute(%q) == %v but expected error", tc.description, got)
+		case err == nil:
+			if !got.Equal(tc.expected) {
+				t.Errorf("deserializeRoute(%q) == %s, expected %s",
+					tc.description, got, tc.expected)
+			}
+			if got.Expires != tc.expected.Expires {
+				t.Errorf("deserializeRoute(%q) expiration == %d, expected %d",
+					tc.description, got.Expires, tc.expected.Expires)
+			}
+		}
+	}
+}
+
+func TestRouteAttributes(t *testing.T) {
+	cases := []struct {
+		description string
+		setup       string
+		route       Route
+	}{
+		{
+			description: "nexthop object",
+			setup:       "ip nexthop replace id 20 dev dummy0",
+			route: Route{
+				Dst:   config.MustParseCIDR("192.168.25.0/24"),
+				Table: syscall.RT_TABLE_MAIN,
+				NHID:  20,
+			},
+		}, {
+			description: "realm",
+			route: Route{
+				LinkIndex: 2,
+				Dst:       config.MustParseCIDR("192.168.25.0/24"),
+				Table:     syscall.RT_TABLE_MAIN,
+				Realm:     10,
+			},
+		}, {
+			description: "IPv6 gateway",
+			route: Route{
+				LinkIndex: 2,
+				Dst:       config.MustParseCIDR("192.168.25.0/24"),
+				Table:     syscall.RT_TABLE_MAIN,
+				Via: &Via{
+					AddrFamily: netlink.FAMILY_V6,
+					Addr:       net.ParseIP("fe80::1"),
+				},
+			},
+		}, {
+			description: "IPv6 gateways",
+			route: Route{
+				Dst:   config.MustParseCIDR("192.168.25.0/24"),
+				Table: syscall.RT_TABLE_MAIN,
+				MultiPath: []*NexthopInfo{
+					{
+						LinkIndex: 2,
+						Via: &Via{
+							AddrFamily: netlink.FAMILY_V6,
+							Addr:       net.ParseIP("fe80::1"),
+						},
+					}, {
+						LinkIndex: 2,
+						Via: &Via{
+							AddrFamily: netlink.FAMILY_V6,
+							Addr:       net.ParseIP("fe80::2"),
+						},
+					},
+				},
+			},
+		}, {
+			description: "preference and expiration",
+			route: Route{
+				LinkIndex: 2,
+				Dst:       config.MustParseCIDR("2001:db8:25::/64"),
+				Table:     syscall.RT_TABLE_MAIN,
+				Priority:  1024,
+				Pref:      1,
+				Expires:   100,
+			},
+		},
+	}
+	for _, tc := range cases {
+		resetNamespace(t)
+		var outbuf, errbuf bytes.Buffer
+		cmd := exec.Command("sh", "-exc", tc.setup)
+		cmd.Stdout = &outbuf
+		cmd.Stderr = &errbuf
+		if err := cmd.Run(); err != nil {
+			t.Errorf("Unable to setup %s\n** Setup:\n%s\n** Stdout:\n%s\n** Stderr:\n%s\n** Error:\n%+v",
+				tc.description, tc.setup, outbuf.String(), errbuf.String(), err)
+			continue
+		}
+		c := realComponent{}
+		if err := c.AddRoute(tc.route); err != nil {
+			t.Errorf("AddRoute(%q) error:\n%+v", tc.description, err)
+			continue
+		}
+		family := netlink.FAMILY_V4
+		if tc.route.Dst.IP.To4() == nil {
+			family = netlink.FAMILY_V6
+		}
+		routes, err := routeList(family, tc.route.Table)
+		if err != nil {
+			t.Errorf("routeList(%q) error:\n%+v", tc.description, err)
+			continue
+		}
+		var got *Route
+		for i := range routes {
+			if helpers.IPNetEqual(*routes[i].Dst, *tc.route.Dst) {
+				got = &routes[i]
+				break
+			}
+		}
+		switch {
+		case got == nil:
+			t.Errorf("routeList(%q) did not return %s", tc.description, tc.route)
+			continue
+		case !got.Via.Equal(tc.route.Via):
+			t.Errorf("routeList(%q) via == %s, expected %s",
+				tc.description, got.Via, tc.route.Via)
+		case len(got.MultiPath) != len(tc.route.MultiPath):
+			t.Errorf("routeList(%q) next hops == %s, expected %s",
+				tc.description, got.MultiPath, tc.route.MultiPath)
+		case got.NHID != tc.route.NHID:
+			t.Errorf("routeList(%q) nexthop object == %d, expected %d",
+				tc.description, got.NHID, tc.route.NHID)
+		case got.Realm != tc.route.Realm:
+			t.Errorf("routeList(%q) realm == %d, expected %d",
+				tc.description, got.Realm, tc.route.Realm)
+		case got.Pref != tc.route.Pref:
+			t.Errorf("routeList(%q) preference == %d, expected %d",
+				tc.description, got.Pref, tc.route.Pref)
+		case tc.route.Expires > 0 && (got.Expires <= 0 || got.Expires > tc.route.Expires):
+			t.Errorf("routeList(%q) expiration == %d, expected ~%d",
+				tc.description, got.Expires, tc.route.Expires)
+		}
+		for i := range got.MultiPath {
+			if i < len(tc.route.MultiPath) && !got.MultiPath[i].Via.Equal(tc.route.MultiPath[i].Via) {
+				t.Errorf("routeList(%q) next hop %d via == %s, expected %s",
+					tc.description, i, got.MultiPath[i].Via, tc.route.MultiPath[i].Via)
+			}
+		}
+		req, err := routeRequest(syscall.RTM_DELROUTE, 0, tc.route)
+		if err == nil {
+			_, err = req.Execute(syscall.NETLINK_ROUTE, 0)
+		}
+		if err != nil {
+			t.Errorf("cannot remove route %q:\n%+v", tc.description, err)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package netlink
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// The netlink library is able to add, remove and list rules but is
+// not able to listen to them and doesn't tell the family of listed
+// rules. Decoding is therefore done here.
+
+const (
+	rtnlgrpIPv4Rule = 8
+	rtnlgrpIPv6Rule = 19
+)
+
+// RuleUpdate is sent when a rule changes. Type is either
+// syscall.RTM_NEWRULE or syscall.RTM_DELRULE.
+type RuleUpdate struct {
+	Type uint16
+	netlink.Rule
+}
+
+// deserializeRule decodes a rule message. The header of a rule
+// message (struct fib_rule_hdr) has the same layout as the header of
+// a route message.
+func deserializeRule(m []byte) (netlink.Rule, error) {
+	if len(m) < syscall.SizeofRtMsg {
+		return netlink.Rule{}, errors.New("rule message too short")
+	}
+	msg := nl.DeserializeRtMsg(m)
+	attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+	if err != nil {
+		return netlink.Rule{}, errors.Wrap(err, "cannot parse rule attributes")
+	}
+
+	rule := netlink.NewRule()
+	rule.Family = int(msg.Family)
+	rule.Table = int(msg.Table)
+	native := nl.NativeEndian()
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case nl.FRA_TABLE:
+			rule.Table = int(native.Uint32(attr.Value[0:4]))
+		case nl.FRA_SRC:
+			rule.Src = &net.IPNet{
+				IP:   attr.Value,
+				Mask: net.CIDRMask(int(msg.Src_len), 8*len(attr.Value)),
+			}
+		case nl.FRA_DST:
+			rule.Dst = &net.IPNet{
+				IP:   attr.Value,
+				Mask: net.CIDRMask(int(msg.Dst_len), 8*len(attr.Value)),
+			}
+		case nl.FRA_FWMARK:
+			rule.Mark = int(native.Uint32(attr.Value[0:4]))
+		case nl.FRA_FWMASK:
+			rule.Mask = int(native.Uint32(attr.Value[0:4]))
+		case nl.FRA_IIFNAME:
+			rule.IifName = string(attr.Value[:len(attr.Value)-1])
+		case nl.FRA_OIFNAME:
+			rule.OifName = string(attr.Value[:len(attr.Value)-1])
+		case nl.FRA_SUPPRESS_PREFIXLEN:
+			if i := native.Uint32(attr.Value[0:4]); i != 0xffffffff {
+				rule.SuppressPrefixlen = int(i)
+			}
+		case nl.FRA_SUPPRESS_IFGROUP:
+			if i := native.Uint32(attr.Value[0:4]); i != 0xffffffff {
+				rule.SuppressIfgroup = int(i)
+			}
+		case nl.FRA_FLOW:
+			rule.Flow = int(native.Uint32(attr.Value[0:4]))
+		case nl.FRA_GOTO:
+			rule.Goto = int(native.Uint32(attr.Value[0:4]))
+		case nl.FRA_PRIORITY:
+			rule.Priority = int(native.Uint32(attr.Value[0:4]))
+		}
+	}
+	return *rule, nil
+}
+
+// ruleList returns the rules for all families.
+func ruleList() ([]netlink.Rule, error) {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETRULE, syscall.NLM_F_DUMP)
+	req.AddData(&nl.RtMsg{RtMsg: syscall.RtMsg{Family: syscall.AF_UNSPEC}})
+	msgs, err := req.Execute(syscall.NETLINK_ROUTE, syscall.RTM_NEWRULE)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]netlink.Rule, 0, len(msgs))
+	for _, m := range msgs {
+		rule, err := deserializeRule(m)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// ruleSubscribe will send rule updates to the provided channel. The
+// channel is closed on error (after calling the provided error
+// callback) or when done is closed. The receive buffer of the socket
+// is set to the provided size.
+func ruleSubscribe(ch chan<- RuleUpdate, done <-chan struct{}, buffer socketBuffer, cberr func(error)) error {
+	s, err := nl.Subscribe(syscall.NETLINK_ROUTE, rtnlgrpIPv4Rule, rtnlgrpIPv6Rule)
+	if err != nil {
+		return err
+	}
+	if err := buffer.apply(s); err != nil {
+		s.Close()
+		return err
+	}
+	go func() {
+		<-done
+		s.Close()
+	}()
+	go func() {
+		defer close(ch)
+		for {
+			msgs, err := s.Receive()
+			if err != nil {
+				cberr(err)
+				return
+			}
+			for _, m := range msgs {
+				if m.Header.Type != syscall.RTM_NEWRULE && m.Header.Type != syscall.RTM_DELRULE {
+					continue
+				}
+				rule, err := deserializeRule(m.Data)
+				if err != nil {
+					cberr(err)
+					return
+				}
+				select {
+				case <-done:
+					return
+				case ch <- RuleUpdate{Type: m.Header.Type, Rule: rule}:
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// AddRule will install the specified rule. An existing identical rule
+// is not an error. No retry logic is attempted, so error must be
+// handled in upper layers.
+func (c *realComponent) AddRule(rule netlink.Rule) error {
+	if err := netlink.RuleAdd(&rule); err != nil && err != syscall.EEXIST {
+		return errors.Wrapf(err, "cannot install rule %s", rule)
+	}
+	return nil
+}
+
+// DeleteRule will remove the specified rule. A missing rule is not an
+// error.
+func (c *realComponent) DeleteRule(rule netlink.Rule) error {
+	if err := ruleDel(rule); err != nil && err != syscall.ENOENT {
+		return errors.Wrapf(err, "cannot remove rule %s", rule)
+	}
+	return nil
+}
+
+// ruleDel removes a rule. The netlink library sets NLM_F_CREATE and
+// NLM_F_EXCL when deleting a rule and recent kernels reject such a
+// request. Only the family, the priority, the table and the
+// source/destination prefixes are used to select the rule to remove.
+func ruleDel(rule netlink.Rule) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_DELRULE, syscall.NLM_F_ACK)
+	msg := &nl.RtMsg{RtMsg: syscall.RtMsg{
+		Family: uint8(rule.Family),
+		Type:   nl.FR_ACT_TO_TBL,
+	}}
+	if rule.Table > 0 && rule.Table < 256 {
+		msg.Table = uint8(rule.Table)
+	}
+	var attrs []*nl.RtAttr
+	for _, prefix := range []struct {
+		attr   int
+		prefix *net.IPNet
+		len    *uint8
+	}{
+		{nl.FRA_SRC, rule.Src, &msg.Src_len},
+		{nl.FRA_DST, rule.Dst, &msg.Dst_len},
+	} {
+		if prefix.prefix == nil {
+			continue
+		}
+		ones, _ := prefix.prefix.Mask.Size()
+		*prefix.len = uint8(ones)
+		ip := prefix.prefix.IP.To4()
+		if rule.Family == netlink.FAMILY_V6 {
+			ip = prefix.prefix.IP.To16()
+		}
+		attrs = append(attrs, nl.NewRtAttr(prefix.attr, ip))
+	}
+	req.AddData(msg)
+	for _, attr := range attrs {
+		req.AddData(attr)
+	}
+	native := nl.NativeEndian()
+	if rule.Priority >= 0 {
+		b := make([]byte, 4)
+		native.PutUint32(b, uint32(rule.Priority))
+		req.AddData(nl.NewRtAttr(nl.FRA_PRIORITY, b))
+	}
+	if rule.Table >= 256 {
+		b := make([]byte, 4)
+		native.PutUint32(b, uint32(rule.Table))
+		req.AddData(nl.NewRtAttr(nl.FRA_TABLE, b))
+	}
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
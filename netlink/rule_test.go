@@ -0,0 +1,119 @@
+package netlink
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"lrg/daemon"
+	"lrg/helpers"
+	"lrg/reporter"
+)
+
+func TestAddDeleteRule(t *testing.T) {
+	r := reporter.NewMock()
+	c, err := New(r, DefaultConfiguration, Dependencies{Daemon: daemon.NewMock()})
+	if err != nil {
+		t.Fatalf("New() error:\n%+v", err)
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start() error:\n%+v", err)
+	}
+	defer func() {
+		if err := c.Stop(); err != nil {
+			t.Fatalf("Stop() error:\n%+v", err)
+		}
+	}()
+
+	newRule := func(family, priority, table int) netlink.Rule {
+		rule := netlink.NewRule()
+		rule.Family = family
+		rule.Priority = priority
+		rule.Table = table
+		return *rule
+	}
+	cases := []struct {
+		setup    string
+		add      bool
+		rule     netlink.Rule
+		expected string
+	}{
+		{
+			add:      true,
+			rule:     newRule(netlink.FAMILY_V4, 110, 100),
+			expected: "110: from all lookup 100",
+		}, {
+			add:      true,
+			rule:     newRule(netlink.FAMILY_V6, 110, 100),
+			expected: "110: from all lookup 100",
+		}, {
+			// Already present
+			setup:    "ip -4 rule add pref 110 table 100",
+			add:      true,
+			rule:     newRule(netlink.FAMILY_V4, 110, 100),
+			expected: "110: from all lookup 100",
+		}, {
+			setup:    "ip -4 rule add pref 110 table 100",
+			add:      false,
+			rule:     newRule(netlink.FAMILY_V4, 110, 100),
+			expected: "",
+		}, {
+			// Already missing
+			setup:    "",
+			add:      false,
+			rule:     newRule(netlink.FAMILY_V4, 110, 100),
+			expected: "",
+		},
+	}
+
+	for idx, tc := range cases {
+		var outbuf, errbuf bytes.Buffer
+		setup := `
+while ip -4 rule del pref 110 2> /dev/null; do :; done
+while ip -6 rule del pref 110 2> /dev/null; do :; done
+` + tc.setup
+		cmd := exec.Command("sh", "-exc", setup)
+		cmd.Stdout = &outbuf
+		cmd.Stderr = &errbuf
+		if err := cmd.Run(); err != nil {
+			t.Errorf("Unable to setup rules\n** Setup:\n%s\n** Stdout:\n%s\n** Stderr:\n%s\n** Error:\n%+v",
+				setup, outbuf.String(), errbuf.String(), err)
+			continue
+		}
+
+		if tc.add {
+			err = c.AddRule(tc.rule)
+		} else {
+			err = c.DeleteRule(tc.rule)
+		}
+		if err != nil {
+			t.Errorf("AddRule/DeleteRule(%d: %s) error:\n%+v", idx, tc.rule, err)
+			continue
+		}
+
+		outbuf.Reset()
+		errbuf.Reset()
+		family := "-4"
+		if tc.rule.Family == netlink.FAMILY_V6 {
+			family = "-6"
+		}
+		cmd = exec.Command("sh", "-c", "ip "+family+" rule show pref 110")
+		cmd.Stdout = &outbuf
+		cmd.Stderr = &errbuf
+		if err := cmd.Run(); err != nil {
+			t.Errorf("Unable to get rules\n** Stdout:\n%s\n** Stderr:\n%s\n** Error:\n%+v",
+				outbuf.String(), errbuf.String(), err)
+			continue
+		}
+		expected := helpers.TrimSpaces(tc.expected)
+		got := helpers.TrimSpaces(outbuf.String())
+		if diff := helpers.Diff(strings.Split(got, "\n"),
+			strings.Split(expected, "\n")); diff != "" {
+			t.Errorf("AddRule/DeleteRule(%d: %s) (-got +want):\n%s", idx, tc.rule, diff)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package netlink
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// socketBuffer is the receive buffer size to use for subscription
+// sockets. A size of 0 keeps the default size. When force is true,
+// the size can go over the maximum size allowed by the kernel
+// (net.core.rmem_max).
+type socketBuffer struct {
+	size  int
+	force bool
+}
+
+// apply sets the receive buffer size of the provided socket.
+func (b socketBuffer) apply(s *nl.NetlinkSocket) error {
+	if b.size == 0 {
+		return nil
+	}
+	opt := syscall.SO_RCVBUF
+	if b.force {
+		opt = syscall.SO_RCVBUFFORCE
+	}
+	if err := syscall.SetsockoptInt(s.GetFd(), syscall.SOL_SOCKET, opt, b.size); err != nil {
+		return errors.Wrap(err, "cannot set receive buffer size")
+	}
+	return nil
+}
+
+// probeSocketBuffer tells how to get a receive buffer of the provided
+// size. SO_RCVBUFFORCE is tried first and SO_RCVBUF is used when not
+// allowed. The effective size, as reported by the kernel, is also
+// returned.
+func probeSocketBuffer(size int) (socketBuffer, int, error) {
+	s, err := nl.Subscribe(syscall.NETLINK_ROUTE)
+	if err != nil {
+		return socketBuffer{}, 0, errors.Wrap(err, "cannot open netlink socket")
+	}
+	defer s.Close()
+	buffer := socketBuffer{size: size, force: true}
+	if err := buffer.apply(s); errors.Cause(err) == syscall.EPERM {
+		buffer.force = false
+		err = buffer.apply(s)
+	}
+	if err != nil {
+		return socketBuffer{}, 0, err
+	}
+	effective, err := syscall.GetsockoptInt(s.GetFd(), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	if err != nil {
+		return socketBuffer{}, 0, errors.Wrap(err, "cannot get receive buffer size")
+	}
+	return buffer, effectiveSocketSize(size, effective), nil
+}
+
+// effectiveSocketSize converts the receive buffer size reported by
+// the kernel to the size usable for data. When the size is set, the
+// kernel doubles it to account for bookkeeping overhead. The default
+// size (net.core.rmem_default) is reported as is.
+func effectiveSocketSize(size, reported int) int {
+	if size == 0 {
+		return reported
+	}
+	return reported / 2
+}
@@ -0,0 +1,90 @@
+package netlink
+
+import (
+	"testing"
+
+	"lrg/daemon"
+	"lrg/reporter"
+)
+
+func TestSocketSize(t *testing.T) {
+	r := reporter.NewMock()
+	configuration := DefaultConfiguration
+	configuration.SocketSize = 1000000
+	c, err := New(r, configuration, Dependencies{Daemon: daemon.NewMock()})
+	if err != nil {
+		t.Fatalf("New() error:\n%+v", err)
+	}
+	done := make(chan struct{})
+	c.Subscribe("test", func(notification Notification) {
+		if notification.EndOfRIB {
+			close(done)
+		}
+	})
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start() error:\n%+v", err)
+	}
+	defer func() {
+		if err := c.Stop(); err != nil {
+			t.Fatalf("Stop() error:\n%+v", err)
+		}
+	}()
+	<-done
+
+	// Tests are run as root, so the size can be forced
+	if gauge := r.Gauge("socket.size").Snapshot().Value(); gauge != 1000000 {
+		t.Errorf("socket.size == %d, expected 1000000", gauge)
+	}
+}
+
+func TestEffectiveSocketSize(t *testing.T) {
+	cases := []struct {
+		size     int
+		reported int
+		expected int
+	}{
+		{0, 212992, 212992},
+		{400000, 800000, 400000},
+		// Size not forced and limited by the kernel
+		{1000000, 425984, 212992},
+	}
+	for _, tc := range cases {
+		got := effectiveSocketSize(tc.size, tc.reported)
+		if got != tc.expected {
+			t.Errorf("effectiveSocketSize(%d, %d) == %d, expected %d",
+				tc.size, tc.reported, got, tc.expected)
+		}
+	}
+}
+
+func TestGrowSocketSize(t *testing.T) {
+	cases := []struct {
+		size      int
+		effective int
+		max       uint
+		expected  int
+	}{
+		{0, 200000, 0, 0},
+		{0, 200000, 1000000, 400000},
+		{400000, 400000, 1000000, 800000},
+		{800000, 800000, 1000000, 1000000},
+		{1000000, 1000000, 1000000, 1000000},
+		// Size not forced and limited by the kernel
+		{1000000, 200000, 1000000, 1000000},
+	}
+	for _, tc := range cases {
+		configuration := DefaultConfiguration
+		configuration.SocketMaxSize = tc.max
+		c := &realComponent{
+			r:                   reporter.NewMock(),
+			config:              configuration,
+			socketSize:          tc.size,
+			effectiveSocketSize: tc.effective,
+		}
+		c.growSocketSize()
+		if c.socketSize != tc.expected {
+			t.Errorf("growSocketSize(size=%d, effective=%d, max=%d) == %d, expected %d",
+				tc.size, tc.effective, tc.max, c.socketSize, tc.expected)
+		}
+	}
+}
@@ -4,21 +4,37 @@ package netlink
 
 import (
 	"github.com/vishvananda/netlink"
+
+	"lrg/reporter"
 )
 
 type mockComponent struct {
 	observerSubComponent
-	addRouteCallback func(netlink.Route) error
+	callbacks MockCallbacks
+}
+
+// MockCallbacks are the callbacks invoked by the mock component when
+// asked to modify the kernel state. A nil callback is a successful
+// operation. Without ApplyRoutes, each operation of a batch is
+// handled by AddRoute or DeleteRoute. Without HasRoute, all routes
+// are present.
+type MockCallbacks struct {
+	AddRoute    func(Route) error
+	DeleteRoute func(Route) error
+	ApplyRoutes func([]RouteOperation) []error
+	HasRoute    func(Route) (bool, error)
+	AddRule     func(netlink.Rule) error
+	DeleteRule  func(netlink.Rule) error
 }
 
 // NewMock creates a new mock component for netlink component. This
 // component does nothing on its own. It also provides a function to
 // inject notifications and will just broadcast them to all
 // subscribers.
-func NewMock(addRouteCallback func(netlink.Route) error) (Component, func(Notification)) {
+func NewMock(callbacks MockCallbacks) (Component, func(Notification)) {
 	c := &mockComponent{
-		observerSubComponent: newObserver(),
-		addRouteCallback:     addRouteCallback,
+		observerSubComponent: newObserver(reporter.NewMock(), DefaultConfiguration.ChannelSize),
+		callbacks:            callbacks,
 	}
 	return c, c.inject
 }
@@ -34,12 +50,66 @@ func (c *mockComponent) Stop() error {
 }
 
 // AddRoute calls the provided callback.
-func (c *mockComponent) AddRoute(r netlink.Route) error {
-	return c.addRouteCallback(r)
+func (c *mockComponent) AddRoute(r Route) error {
+	if c.callbacks.AddRoute == nil {
+		return nil
+	}
+	return c.callbacks.AddRoute(r)
+}
+
+// DeleteRoute calls the provided callback.
+func (c *mockComponent) DeleteRoute(r Route) error {
+	if c.callbacks.DeleteRoute == nil {
+		return nil
+	}
+	return c.callbacks.DeleteRoute(r)
+}
+
+// ApplyRoutes calls the provided callback.
+func (c *mockComponent) ApplyRoutes(operations []RouteOperation) []error {
+	if c.callbacks.ApplyRoutes != nil {
+		return c.callbacks.ApplyRoutes(operations)
+	}
+	results := make([]error, len(operations))
+	for i, operation := range operations {
+		if operation.Delete {
+			results[i] = c.DeleteRoute(operation.Route)
+		} else {
+			results[i] = c.AddRoute(operation.Route)
+		}
+	}
+	return results
+}
+
+// HasRoute calls the provided callback.
+func (c *mockComponent) HasRoute(r Route) (bool, error) {
+	if c.callbacks.HasRoute == nil {
+		return true, nil
+	}
+	return c.callbacks.HasRoute(r)
+}
+
+// AddRule calls the provided callback.
+func (c *mockComponent) AddRule(r netlink.Rule) error {
+	if c.callbacks.AddRule == nil {
+		return nil
+	}
+	return c.callbacks.AddRule(r)
+}
+
+// DeleteRule calls the provided callback.
+func (c *mockComponent) DeleteRule(r netlink.Rule) error {
+	if c.callbacks.DeleteRule == nil {
+		return nil
+	}
+	return c.callbacks.DeleteRule(r)
 }
 
 // inject will inject notifications into the component. It will just
-// be broadcasted to all subscribers.
+// be broadcasted to all subscribers. Like for the real component,
+// route updates are only sent to the subscribers interested in them.
+// It returns once all subscribers have handled the notification.
 func (c *mockComponent) inject(n Notification) {
 	c.notify(n)
+	c.flush()
 }
@@ -11,21 +11,28 @@ import (
 )
 
 func TestMockComponent(t *testing.T) {
-	routes := []netlink.Route{}
-	c, inject := NewMock(func(route netlink.Route) error {
-		routes = append(routes, route)
-		return nil
+	routes := []Route{}
+	rules := []netlink.Rule{}
+	c, inject := NewMock(MockCallbacks{
+		AddRoute: func(route Route) error {
+			routes = append(routes, route)
+			return nil
+		},
+		DeleteRule: func(rule netlink.Rule) error {
+			rules = append(rules, rule)
+			return nil
+		},
 	})
 	count := 0
 	var last Notification
-	c.Subscribe(func(n Notification) {
+	c.Subscribe("test", func(n Notification) {
 		count++
 		last = n
 	})
 
-	expected := Notification{RouteUpdate: &netlink.RouteUpdate{
+	expected := Notification{RouteUpdate: &RouteUpdate{
 		Type: syscall.RTM_NEWROUTE,
-		Route: netlink.Route{
+		Route: Route{
 			LinkIndex: 2,
 			Dst:       config.MustParseCIDR("192.168.0.0/16"),
 		},
@@ -40,9 +47,9 @@ func TestMockComponent(t *testing.T) {
 			diff)
 	}
 
-	expected = Notification{RouteUpdate: &netlink.RouteUpdate{
+	expected = Notification{RouteUpdate: &RouteUpdate{
 		Type: syscall.RTM_NEWROUTE,
-		Route: netlink.Route{
+		Route: Route{
 			LinkIndex: 2,
 			Dst:       config.MustParseCIDR("192.168.10.0/24"),
 		},
@@ -57,18 +64,63 @@ func TestMockComponent(t *testing.T) {
 			diff)
 	}
 
-	if err := c.AddRoute(netlink.Route{
+	if err := c.AddRoute(Route{
 		LinkIndex: 2,
 		Dst:       config.MustParseCIDR("192.168.0.0/16"),
 	}); err != nil {
 		t.Fatalf("AddRoute() error:\n%+v", err)
 	}
-	if diff := helpers.Diff(routes, []netlink.Route{
-		netlink.Route{
+	if diff := helpers.Diff(routes, []Route{
+		Route{
 			LinkIndex: 2,
 			Dst:       config.MustParseCIDR("192.168.0.0/16"),
 		}}); diff != "" {
 		t.Fatalf("AddRoute() (-got, +want):\n%s", diff)
 	}
 
+	// No callback for DeleteRoute
+	if err := c.DeleteRoute(Route{
+		LinkIndex: 2,
+		Dst:       config.MustParseCIDR("192.168.0.0/16"),
+	}); err != nil {
+		t.Fatalf("DeleteRoute() error:\n%+v", err)
+	}
+
+	// Batches use AddRoute and DeleteRoute callbacks
+	results := c.ApplyRoutes([]RouteOperation{
+		{Route: Route{
+			LinkIndex: 2,
+			Dst:       config.MustParseCIDR("192.168.1.0/24"),
+		}},
+		{Delete: true, Route: Route{
+			LinkIndex: 2,
+			Dst:       config.MustParseCIDR("192.168.0.0/16"),
+		}},
+	})
+	if diff := helpers.Diff(results, []error{nil, nil}); diff != "" {
+		t.Fatalf("ApplyRoutes() (-got, +want):\n%s", diff)
+	}
+	if diff := helpers.Diff(routes, []Route{
+		Route{
+			LinkIndex: 2,
+			Dst:       config.MustParseCIDR("192.168.0.0/16"),
+		},
+		Route{
+			LinkIndex: 2,
+			Dst:       config.MustParseCIDR("192.168.1.0/24"),
+		}}); diff != "" {
+		t.Fatalf("ApplyRoutes() (-got, +want):\n%s", diff)
+	}
+
+	// No callback for AddRule
+	if err := c.AddRule(netlink.Rule{Priority: 100, Table: 100}); err != nil {
+		t.Fatalf("AddRule() error:\n%+v", err)
+	}
+	if err := c.DeleteRule(netlink.Rule{Priority: 100, Table: 100}); err != nil {
+		t.Fatalf("DeleteRule() error:\n%+v", err)
+	}
+	if diff := helpers.Diff(rules, []netlink.Rule{
+		netlink.Rule{Priority: 100, Table: 100}}); diff != "" {
+		t.Fatalf("DeleteRule() (-got, +want):\n%s", diff)
+	}
 }